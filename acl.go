@@ -18,6 +18,12 @@ const (
 	WhisperPermission     = 0x100
 	TextMessagePermission = 0x200
 	TempChannelPermission = 0x400
+	ListenPermission      = 0x800
+
+	// Grumble extension: sending private messages to users in the
+	// channel. Granted by default unless the server's
+	// AllowPrivateMessages option is disabled.
+	PrivateMessagePermission = 0x1000
 
 	// Root channel only
 	KickPermission         = 0x10000
@@ -27,9 +33,14 @@ const (
 
 	// Extra flags
 	CachedPermission = 0x8000000
-	AllPermissions   = 0xf07ff
+	AllPermissions   = 0xf1fff
 )
 
+// The permissions granted to the creator of a temporary channel. They let
+// the creator edit the channel, adjust its ACLs and move intruders out.
+const TempChannelOwnerPermissions = WritePermission | TraversePermission | EnterPermission |
+	SpeakPermission | MuteDeafenPermission | MovePermission | TextMessagePermission
+
 type Permission uint32
 
 // Check whether the given flags are set on perm
@@ -150,6 +161,11 @@ func (server *Server) HasPermission(client *Client, channel *Channel, perm Permi
 		return true
 	}
 
+	// Invited clients may enter the channel they were invited to.
+	if perm == EnterPermission && client.invited[channel.Id] {
+		return true
+	}
+
 	// First, try to look in the server's ACLCache.
 	granted := Permission(NonePermission)
 	cached := server.aclcache.GetPermission(client, channel)
@@ -165,9 +181,34 @@ func (server *Server) HasPermission(client *Client, channel *Channel, perm Permi
 		}
 	}
 
+	granted = server.evaluateACL(client, channel, nil)
+
+	// Cache the result
+	server.aclcache.StorePermission(client, channel, granted)
+
+	// The +write permission implies all permissions except for +speak and +whisper.
+	// This means that if the user has WritePermission, we should return true for all
+	// permissions exccept SpeakPermission and WhisperPermission.
+	if perm != SpeakPermission && perm != WhisperPermission {
+		return (granted & (perm | WritePermission)) != NonePermission
+	} else {
+		return (granted & perm) != NonePermission
+	}
+
+	return false
+}
+
+// Evaluate the ACLs of channel and its parents for client, and return
+// the permissions they grant. If matched is non-nil, it is called for
+// every ACL entry that applies to client, with whether the entry's
+// permissions apply to channel itself. See aclcheck.go.
+func (server *Server) evaluateACL(client *Client, channel *Channel, matched func(acl *ChannelACL, applied bool)) Permission {
 	// Default permissions
-	def := Permission(TraversePermission | EnterPermission | SpeakPermission | WhisperPermission | TextMessagePermission)
-	granted = def
+	def := Permission(TraversePermission | EnterPermission | SpeakPermission | WhisperPermission | TextMessagePermission | ListenPermission)
+	if server.cfg.BoolValue("AllowPrivateMessages") {
+		def |= PrivateMessagePermission
+	}
+	granted := def
 
 	channels := []*Channel{}
 	iter := channel
@@ -196,6 +237,10 @@ func (server *Server) HasPermission(client *Client, channel *Channel, perm Permi
 			matchUser := acl.IsUserACL() && acl.UserId == client.UserId()
 			matchGroup := GroupMemberCheck(channel, iter, acl.Group, client)
 			if matchUser || matchGroup {
+				applied := (channel == iter && acl.ApplyHere) || (channel != iter && acl.ApplySubs)
+				if matched != nil {
+					matched(acl, applied)
+				}
 				if acl.Allow.IsSet(TraversePermission) {
 					traverse = true
 				}
@@ -208,7 +253,7 @@ func (server *Server) HasPermission(client *Client, channel *Channel, perm Permi
 				if acl.Deny.IsSet(WritePermission) {
 					write = false
 				}
-				if (channel == iter && acl.ApplyHere) || (channel != iter && acl.ApplySubs) {
+				if applied {
 					granted |= acl.Allow
 					granted &= ^acl.Deny
 				}
@@ -224,17 +269,5 @@ func (server *Server) HasPermission(client *Client, channel *Channel, perm Permi
 		}
 	}
 
-	// Cache the result
-	server.aclcache.StorePermission(client, channel, granted)
-
-	// The +write permission implies all permissions except for +speak and +whisper.
-	// This means that if the user has WritePermission, we should return true for all
-	// permissions exccept SpeakPermission and WhisperPermission.
-	if perm != SpeakPermission && perm != WhisperPermission {
-		return (granted & (perm | WritePermission)) != NonePermission
-	} else {
-		return (granted & perm) != NonePermission
-	}
-
-	return false
+	return granted
 }
@@ -0,0 +1,136 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements permission simulation: evaluating the ACL chain
+// of a channel for a connected session or a registered user, and
+// reporting the resulting permissions along with the ACL entries that
+// matched, so admins can see why someone can't enter a channel.
+//
+// Registered users that aren't connected are evaluated with the access
+// tokens stored with their registration, as if they were in their last
+// channel. Temporary group memberships and channel invites only exist
+// for connected sessions.
+
+import (
+	"strings"
+)
+
+// The names of the permission bits, as shown by the Mumble client.
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{WritePermission, "write"},
+	{TraversePermission, "traverse"},
+	{EnterPermission, "enter"},
+	{SpeakPermission, "speak"},
+	{MuteDeafenPermission, "mutedeafen"},
+	{MovePermission, "move"},
+	{MakeChannelPermission, "makechannel"},
+	{LinkChannelPermission, "linkchannel"},
+	{WhisperPermission, "whisper"},
+	{TextMessagePermission, "textmessage"},
+	{TempChannelPermission, "tempchannel"},
+	{ListenPermission, "listen"},
+	{PrivateMessagePermission, "privatemessage"},
+	{KickPermission, "kick"},
+	{BanPermission, "ban"},
+	{RegisterPermission, "register"},
+	{SelfRegisterPermission, "selfregister"},
+}
+
+// Get the names of the permission bits set in perm.
+func (perm Permission) Names() string {
+	names := []string{}
+	for _, pn := range permissionNames {
+		if perm&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// An ACL entry that matched during a permission check.
+type ACLMatch struct {
+	// The channel the entry is defined on.
+	ChannelId int
+
+	// The user id or group the entry is defined for.
+	UserId int
+	Group  string
+
+	ApplyHere bool
+	ApplySubs bool
+	Allow     uint32
+	Deny      uint32
+
+	// Whether the entry's Allow and Deny were applied to the checked
+	// channel. Entries on parent channels only change traverse and
+	// write unless ApplySubs is set.
+	Applied bool
+}
+
+// The result of a permission check.
+type PermissionCheck struct {
+	// The resulting permissions, as a bitmask and as names.
+	Permissions uint32
+	Names       string
+
+	// The ACL entries that matched, from the root channel down.
+	Matches []ACLMatch
+
+	// Set if permissions were decided by something other than the
+	// ACLs: "superuser" or "invited".
+	Override string
+}
+
+// Get a client to check permissions for a registered user that isn't
+// connected.
+func (server *Server) permissionCheckClient(user *User) *Client {
+	channel, ok := server.Channels[user.LastChannelId]
+	if !ok {
+		channel = server.root
+	}
+	return &Client{
+		server:   server,
+		user:     user,
+		Username: user.Name,
+		CertHash: user.CertHash,
+		Tokens:   user.Tokens,
+		Channel:  channel,
+	}
+}
+
+// Evaluate client's permissions on channel, bypassing the ACL cache.
+func (server *Server) checkPermissions(client *Client, channel *Channel) (check *PermissionCheck) {
+	check = &PermissionCheck{Matches: []ACLMatch{}}
+	granted := server.evaluateACL(client, channel, func(acl *ChannelACL, applied bool) {
+		check.Matches = append(check.Matches, ACLMatch{
+			ChannelId: acl.Channel.Id,
+			UserId:    acl.UserId,
+			Group:     acl.Group,
+			ApplyHere: acl.ApplyHere,
+			ApplySubs: acl.ApplySubs,
+			Allow:     uint32(acl.Allow),
+			Deny:      uint32(acl.Deny),
+			Applied:   applied,
+		})
+	})
+
+	if client.IsSuperUser() {
+		granted = AllPermissions &^ (SpeakPermission | WhisperPermission)
+		check.Override = "superuser"
+	} else if client.invited[channel.Id] && !granted.IsSet(EnterPermission) {
+		granted |= EnterPermission
+		check.Override = "invited"
+	}
+	check.Permissions = uint32(granted)
+	check.Names = granted.Names()
+	return check
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements applying ACL edits sent by clients. An edit
+// replaces the groups and ACL entries of a channel as a whole. The edit
+// is validated before anything is changed, so a malformed edit leaves
+// the channel untouched.
+//
+// Changing a channel's ACL can change the permissions of any client in
+// the channel's subtree. Clients whose permissions changed are sent a
+// PermissionQuery with the flush flag set, telling them to forget the
+// permissions they have cached, followed by their permissions in their
+// current channel.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"os"
+)
+
+// Get all channels in the subtree rooted at channel.
+func channelSubtree(channel *Channel, channels []*Channel) []*Channel {
+	channels = append(channels, channel)
+	for _, child := range channel.children {
+		channels = channelSubtree(child, channels)
+	}
+	return channels
+}
+
+// Get the permissions of all connected clients in channels.
+func (server *Server) permissionSnapshot(channels []*Channel) map[uint32]ChannelCache {
+	snapshot := make(map[uint32]ChannelCache)
+	for session, client := range server.clients {
+		if client.state != StateClientReady || client.IsSuperUser() {
+			continue
+		}
+		perms := make(ChannelCache)
+		for _, channel := range channels {
+			server.HasPermission(client, channel, EnterPermission)
+			perms[channel.Id] = server.aclcache.GetPermission(client, channel)
+		}
+		snapshot[session] = perms
+	}
+	return snapshot
+}
+
+// Clear the ACL cache, and tell clients whose permissions in channels
+// differ from those in before to flush their permission caches.
+func (server *Server) flushPermissions(channels []*Channel, before map[uint32]ChannelCache) {
+	server.ClearACLCache()
+
+	after := server.permissionSnapshot(channels)
+	for session, perms := range after {
+		client := server.clients[session]
+		changed := false
+		for cid, perm := range perms {
+			if old, ok := before[session][cid]; !ok || old != perm {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		err := client.sendProtoMessage(MessagePermissionQuery, &mumbleproto.PermissionQuery{
+			Flush: proto.Bool(true),
+		})
+		if err != nil {
+			client.Panic(err.String())
+			continue
+		}
+		server.sendClientPermissions(client, client.Channel)
+	}
+}
+
+// Replace the groups and ACL entries of channel with those in acl.
+// Temporary group members are kept.
+func (server *Server) applyACL(channel *Channel, acl *mumbleproto.ACL) (err os.Error) {
+	groups := map[string]*Group{}
+	for _, pbgrp := range acl.Groups {
+		if pbgrp.Name == nil || len(*pbgrp.Name) == 0 {
+			return os.NewError("group without a name")
+		}
+		changroup := NewGroup(channel, *pbgrp.Name)
+
+		changroup.Inherit = pbgrp.Inherit == nil || *pbgrp.Inherit
+		changroup.Inheritable = pbgrp.Inheritable == nil || *pbgrp.Inheritable
+		for _, uid := range pbgrp.Add {
+			changroup.Add[int(uid)] = true
+		}
+		for _, uid := range pbgrp.Remove {
+			changroup.Remove[int(uid)] = true
+		}
+		if old, ok := channel.Groups[changroup.Name]; ok {
+			changroup.Temporary = old.Temporary
+		}
+
+		groups[changroup.Name] = changroup
+	}
+
+	acls := []*ChannelACL{}
+	for _, pbacl := range acl.Acls {
+		chanacl := NewChannelACL(channel)
+
+		chanacl.ApplyHere = pbacl.ApplyHere == nil || *pbacl.ApplyHere
+		chanacl.ApplySubs = pbacl.ApplySubs == nil || *pbacl.ApplySubs
+		if pbacl.UserId != nil {
+			chanacl.UserId = int(*pbacl.UserId)
+		} else if pbacl.Group != nil && len(*pbacl.Group) > 0 {
+			chanacl.Group = *pbacl.Group
+		} else {
+			return os.NewError("ACL entry without a user or group")
+		}
+		if pbacl.Deny != nil {
+			chanacl.Deny = Permission(*pbacl.Deny & AllPermissions)
+		}
+		if pbacl.Grant != nil {
+			chanacl.Allow = Permission(*pbacl.Grant & AllPermissions)
+		}
+
+		acls = append(acls, chanacl)
+	}
+
+	channel.InheritACL = acl.InheritAcls == nil || *acl.InheritAcls
+	channel.Groups = groups
+	channel.ACL = acls
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// The number of shards in an addrIndex.
+const addrIndexShards = 16
+
+type addrIndexShard struct {
+	mutex sync.RWMutex
+	// Maps a host address to the clients connected from it.
+	hosts map[string][]*Client
+	// Maps a host-port combination to the client whose UDP
+	// packets originate from it.
+	hostports map[string]*Client
+}
+
+// An addrIndex maps the source addresses of incoming UDP packets to
+// clients. The index is split into shards by host address, each with its
+// own lock, so that packets from different hosts can be matched to their
+// senders concurrently.
+type addrIndex struct {
+	shards [addrIndexShards]addrIndexShard
+}
+
+func newAddrIndex() *addrIndex {
+	idx := new(addrIndex)
+	for i := range idx.shards {
+		idx.shards[i].hosts = make(map[string][]*Client)
+		idx.shards[i].hostports = make(map[string]*Client)
+	}
+	return idx
+}
+
+// Get the shard responsible for host.
+func (idx *addrIndex) shard(host string) *addrIndexShard {
+	return &idx.shards[crc32.ChecksumIEEE([]byte(host))%addrIndexShards]
+}
+
+// Add a client connected from host. Slices in the hosts map are never
+// modified in place, so readers may keep using them after unlocking.
+func (idx *addrIndex) AddHost(host string, client *Client) {
+	shard := idx.shard(host)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	old := shard.hosts[host]
+	clients := make([]*Client, len(old), len(old)+1)
+	copy(clients, old)
+	shard.hosts[host] = append(clients, client)
+}
+
+// Remove a client from the index.
+func (idx *addrIndex) Remove(client *Client) {
+	host := client.tcpaddr.IP.String()
+	shard := idx.shard(host)
+	shard.mutex.Lock()
+	clients := []*Client{}
+	for _, hostclient := range shard.hosts[host] {
+		if hostclient != client {
+			clients = append(clients, hostclient)
+		}
+	}
+	if len(clients) > 0 {
+		shard.hosts[host] = clients
+	} else {
+		shard.hosts[host] = nil, false
+	}
+	shard.mutex.Unlock()
+
+	if client.udpaddr != nil {
+		shard = idx.shard(client.udpaddr.IP.String())
+		shard.mutex.Lock()
+		shard.hostports[client.udpaddr.String()] = nil, false
+		shard.mutex.Unlock()
+	}
+}
+
+// Look up the sender of a UDP packet from addr. If the host-port
+// combination is already bound to a client, that client is returned.
+// Otherwise, the clients connected from the same host are returned as
+// candidates.
+func (idx *addrIndex) Lookup(addr *net.UDPAddr) (client *Client, candidates []*Client) {
+	host := addr.IP.String()
+	shard := idx.shard(host)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	client, ok := shard.hostports[addr.String()]
+	if ok {
+		return client, nil
+	}
+	return nil, shard.hosts[host]
+}
+
+// Bind the host-port combination addr to client.
+func (idx *addrIndex) Bind(addr *net.UDPAddr, client *Client) {
+	shard := idx.shard(addr.IP.String())
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.hostports[addr.String()] = client
+}
+
+// Remove the binding of the host-port combination addr.
+func (idx *addrIndex) Unbind(addr *net.UDPAddr) {
+	shard := idx.shard(addr.IP.String())
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.hostports[addr.String()] = nil, false
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the bind configuration of a virtual server. By
+// default, a server listens for TCP connections and UDP voice traffic on
+// the same port on all interfaces. The TCPAddresses and UDPAddresses
+// config keys override this, each holding a comma-separated list of
+// addresses to bind. Each address can be given as "host:port", "host"
+// (using the server's port) or ":port" (binding all interfaces).
+//
+// Replies to UDP traffic are always sent from the socket the client's
+// traffic arrived on, which keeps multi-homed and NAT setups working.
+//
+// To spread voice ingest over several cores, the UDPReaders config key
+// makes the server bind each UDP address with that many sockets, each
+// with its own reader goroutine, using SO_REUSEPORT where it is
+// supported (see udpreuse_linux.go). Zero means one per GOMAXPROCS.
+
+import (
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A bound UDP voice socket, and the bind address it was bound for.
+type udpSocket struct {
+	conn  *net.UDPConn
+	batch udpBatchConn
+	addr  string
+}
+
+// A bound TCP socket, and the bind address it was bound for.
+type tcpSocket struct {
+	l    *net.TCPListener
+	addr string
+}
+
+// Parse a comma-separated list of bind addresses into "host:port" form,
+// filling in defhost and defport where the host or port are omitted.
+// An empty list yields the default address.
+func parseBindAddrs(list string, defhost string, defport int) (addrs []string, err os.Error) {
+	for _, field := range strings.Split(list, ",", -1) {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		host, port := field, strconv.Itoa(defport)
+		if strings.HasPrefix(field, "[") || strings.Count(field, ":") == 1 {
+			host, port, err = net.SplitHostPort(field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(host) == 0 {
+			host = defhost
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+
+	if len(addrs) == 0 {
+		addrs = []string{net.JoinHostPort(defhost, strconv.Itoa(defport))}
+	}
+	return addrs, nil
+}
+
+// Get the addresses the server should bind for the given config key.
+func (server *Server) bindAddrs(key string) ([]string, os.Error) {
+	return parseBindAddrs(server.cfg.StringValue(key), server.address, server.port)
+}
+
+// Bind the server's UDP voice sockets.
+func (server *Server) SetupUDP() (err os.Error) {
+	addrs, err := server.bindAddrs("UDPAddresses")
+	if err != nil {
+		return err
+	}
+
+	readers := server.cfg.IntValue("UDPReaders")
+	if readers <= 0 {
+		readers = runtime.GOMAXPROCS(0)
+	}
+
+	for _, addr := range addrs {
+		udpaddr, err := net.ResolveUDPAddr(addr)
+		if err != nil {
+			return err
+		}
+		// Sockets handed over by an upgrade are used as they are. See
+		// upgrade.go.
+		conns := inheritedUDPConns(server.Id, addr)
+		if len(conns) == 0 {
+			conns, err = listenUDPPool(udpaddr, readers)
+			if err != nil {
+				return err
+			}
+		}
+		for _, conn := range conns {
+			if err := server.tuneUDPSocket(conn); err != nil {
+				log.Printf("Unable to set UDP socket buffer sizes for %v: %v", addr, err.String())
+			}
+			server.udpsocks = append(server.udpsocks, &udpSocket{conn, newUDPBatchConn(conn), addr})
+		}
+	}
+
+	return nil
+}
+
+// Bind n UDP sockets to addr. If SO_REUSEPORT can't be used, a single
+// socket is bound instead.
+func listenUDPPool(addr *net.UDPAddr, n int) (conns []*net.UDPConn, err os.Error) {
+	if n > 1 {
+		for i := 0; i < n; i++ {
+			conn, err := listenUDPReusePort(addr)
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				conns = nil
+				log.Printf("Unable to bind %v UDP sockets to %v, using one: %v", n, addr, err.String())
+				break
+			}
+			conns = append(conns, conn)
+		}
+		if len(conns) > 0 {
+			return conns, nil
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
+
+// Bind the server's TLS listeners.
+func (server *Server) SetupTLS() (err os.Error) {
+	addrs, err := server.bindAddrs("TCPAddresses")
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		tcpaddr, err := net.ResolveTCPAddr(addr)
+		if err != nil {
+			return err
+		}
+		tcpl := inheritedTCPListener(server.Id, addr)
+		if tcpl == nil {
+			tcpl, err = net.ListenTCP("tcp", tcpaddr)
+			if err != nil {
+				return err
+			}
+		}
+		l := NewTLSListener(tcpl, server.tcpTuning())
+		if l == nil {
+			tcpl.Close()
+			return os.NewError("Unable to create TLS listener on " + addr)
+		}
+		server.tcpsocks = append(server.tcpsocks, &tcpSocket{tcpl, addr})
+		server.tlsls = append(server.tlsls, l)
+	}
+
+	return nil
+}
+
+// Close the sockets bound by SetupUDP and SetupTLS. Used when a server
+// that has bound its sockets fails to start.
+func (server *Server) closeSockets() {
+	for _, sock := range server.udpsocks {
+		sock.batch.Close()
+		sock.conn.Close()
+	}
+	for _, sock := range server.tcpsocks {
+		sock.l.Close()
+	}
+	server.udpsocks = nil
+	server.tcpsocks = nil
+	server.tlsls = nil
+}
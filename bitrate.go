@@ -0,0 +1,122 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-channel bitrate caps. A channel's MaxBitrate
+// limits the audio bitrate of the clients in the channel. The effective
+// limit (the lower of the channel's and the server's) is advertised to
+// clients through ServerConfig when they enter the channel, and in the
+// channel's ChannelState. Unless EnforceMaxBandwidth is disabled, the
+// server's MaxBandwidth is enforced in channels without a cap of their
+// own.
+//
+// Clients that persistently exceed the limit have their voice packets
+// dropped until their bitrate falls below the limit again. Like Murmur,
+// a client is sent a text message asking it to reduce its bandwidth as
+// soon as it exceeds the limit, before any packets are dropped. Bitrates
+// are measured over windows of bitrateWindow nanoseconds, counting the
+// voice packet payload plus typical IP and UDP header overhead.
+
+import (
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"sync/atomic"
+)
+
+const (
+	// The length of a bitrate measurement window, in nanoseconds.
+	bitrateWindow = 1e9
+
+	// The number of consecutive windows a client must exceed its
+	// bitrate limit before its voice packets are dropped.
+	bitrateStrikes = 3
+
+	// The per-packet overhead of IP and UDP headers, in bytes.
+	packetOverhead = 28
+)
+
+// Measures the voice bitrate of a client. Only used from the client's
+// udpreceiver goroutine.
+type bitrateMeter struct {
+	windowStart int64
+	bytes       int64
+	strikes     int
+	dropping    bool
+}
+
+// Account for a voice packet of size bytes received at now, and check it
+// against limit (in bits per second). Returns false in allow if the
+// packet should be dropped, and true in warn if the client has just
+// started exceeding the limit.
+func (bm *bitrateMeter) allow(now int64, size int, limit int) (allow bool, warn bool) {
+	if limit <= 0 {
+		bm.strikes = 0
+		bm.dropping = false
+		return true, false
+	}
+
+	if now-bm.windowStart >= bitrateWindow {
+		rate := bm.bytes * 8 * 1e9 / (now - bm.windowStart)
+		if bm.windowStart > 0 && rate > int64(limit) {
+			bm.strikes++
+			warn = bm.strikes == 1
+		} else {
+			bm.strikes = 0
+		}
+		bm.dropping = bm.strikes >= bitrateStrikes
+		bm.windowStart = now
+		bm.bytes = 0
+	}
+
+	bm.bytes += int64(size + packetOverhead)
+	return !bm.dropping, warn
+}
+
+// Get the bitrate limit in effect for clients in channel, in bits per
+// second.
+func (server *Server) effectiveBitrate(channel *Channel) int {
+	limit := int(server.MaxBandwidth)
+	if channel != nil && channel.MaxBitrate > 0 && channel.MaxBitrate < limit {
+		limit = channel.MaxBitrate
+	}
+	return limit
+}
+
+// Update the client's bitrate limit after it has entered channel, and
+// advertise the new limit to the client.
+func (server *Server) updateClientBitrate(client *Client, channel *Channel) {
+	limit := 0
+	if channel != nil && (channel.MaxBitrate > 0 || server.cfg.BoolValue("EnforceMaxBandwidth")) {
+		limit = server.effectiveBitrate(channel)
+	}
+	// Only the handler goroutine writes bitrateLimit, so adding the
+	// difference is equivalent to an atomic store.
+	old := atomic.AddInt32(&client.bitrateLimit, 0)
+	atomic.AddInt32(&client.bitrateLimit, int32(limit)-old)
+
+	if client.state == StateClientReady {
+		client.sendProtoMessage(MessageServerConfig, &mumbleproto.ServerConfig{
+			MaxBandwidth: proto.Uint32(uint32(server.effectiveBitrate(channel))),
+		})
+	}
+}
+
+// Check whether a voice packet of size bytes from the client is within
+// the client's bitrate limit.
+//
+// This method is called from the client's udpreceiver goroutine.
+func (client *Client) allowVoice(now int64, size int) bool {
+	limit := int(atomic.AddInt32(&client.bitrateLimit, 0))
+	allow, warn := client.bitrate.allow(now, size, limit)
+	if warn {
+		client.Printf("Exceeding bandwidth limit of %v bit/s", limit)
+		client.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
+			Message: proto.String(fmt.Sprintf("Your client is using more bandwidth than this server allows "+
+				"(%v kbit/s). Please lower your audio quality settings, or your voice will be dropped.", limit/1000)),
+		})
+	}
+	return allow
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements banning addresses listed in external blocklists.
+// The URLs given by the -blocklists flag are fetched every
+// -blocklistinterval seconds. Each list holds one IP address or CIDR
+// range per line; anything after a '#' or ';' is a comment, so lists
+// such as Spamhaus DROP can be used as they are.
+//
+// Listed addresses are kept in an auto-ban list separate from the global
+// ban list, so they are neither stored nor shown with the manual bans.
+// Whenever the lists are fetched, the auto-ban list is replaced by their
+// contents, so addresses removed from a list are unbanned, and connected
+// clients on newly listed addresses are disconnected. A list that can't
+// be fetched keeps its previous entries. Like the global ban list, the
+// auto-ban list only applies to servers with UseGlobalBans set.
+
+import (
+	"bufio"
+	"expvar"
+	"flag"
+	"http"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var blocklists *string = flag.String("blocklists", "", "Comma-separated URLs of IP/CIDR blocklists to ban addresses from")
+var blocklistinterval *int = flag.Int("blocklistinterval", 3600, "Seconds between blocklist updates")
+
+const (
+	// The largest blocklist read, in bytes.
+	maxBlocklistSize = 16 << 20
+
+	// The maximum number of entries read from a single blocklist.
+	maxBlocklistEntries = 100000
+)
+
+// The bans from all blocklists.
+var blocklistBans = new(BanList)
+
+// The number of entries in the auto-ban list.
+var blocklistEntries = expvar.NewInt("grumble.blocklist.entries")
+
+// Parse a blocklist read from r into bans. Invalid lines are skipped.
+func parseBlocklist(r io.Reader, source string) (bans []Ban, err os.Error) {
+	br := bufio.NewReader(io.LimitReader(r, maxBlocklistSize))
+	now := time.Seconds()
+	for len(bans) < maxBlocklistEntries {
+		line, rerr := br.ReadString('\n')
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			ip, mask, err := parseBanAddr(line)
+			if err == nil {
+				bans = append(bans, Ban{
+					IP:     ip,
+					Mask:   mask,
+					Name:   source,
+					Reason: "Listed in blocklist",
+					Start:  now,
+				})
+			}
+		}
+		if rerr == os.EOF {
+			break
+		} else if rerr != nil {
+			return nil, rerr
+		}
+	}
+	return bans, nil
+}
+
+// Fetch and parse the blocklist at url.
+func fetchBlocklist(url string) (bans []Ban, err os.Error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, os.NewError(resp.Status)
+	}
+	return parseBlocklist(resp.Body, url)
+}
+
+// Replace the auto-ban list with the bans of lists, and disconnect the
+// clients that are now banned.
+func applyBlocklists(lists map[string][]Ban) {
+	bans := []Ban{}
+	for _, list := range lists {
+		bans = append(bans, list...)
+	}
+	blocklistBans.Set(bans)
+	blocklistEntries.Set(int64(len(bans)))
+
+	for _, server := range allServers() {
+		server.syncCall(func() {
+			if !server.cfg.BoolValue("UseGlobalBans") {
+				return
+			}
+			for _, client := range server.clients {
+				if ban, ok := blocklistBans.Match(client.tcpaddr.IP, client.CertHash); ok {
+					server.disconnectBanned(client, ban)
+				}
+			}
+		})
+	}
+}
+
+// Fetch the blocklists at urls every -blocklistinterval seconds, and
+// apply them. Never returns.
+func SyncBlocklists(urls []string) {
+	interval := int64(*blocklistinterval)
+	if interval < 60 {
+		interval = 60
+	}
+	lists := make(map[string][]Ban)
+	for {
+		for _, url := range urls {
+			bans, err := fetchBlocklist(url)
+			if err != nil {
+				log.Printf("Unable to fetch blocklist %v: %v", url, err.String())
+				continue
+			}
+			if len(bans) != len(lists[url]) {
+				log.Printf("Blocklist %v has %v entries", url, len(bans))
+			}
+			lists[url] = bans
+		}
+		applyBlocklists(lists)
+
+		time.Sleep(interval * 1e9)
+	}
+}
+
+// Parse the -blocklists flag into a list of URLs.
+func blocklistURLs() (urls []string) {
+	for _, url := range strings.Split(*blocklists, ",", -1) {
+		url = strings.TrimSpace(url)
+		if len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements bridging channel text messages to and from
+// external chat systems. Bridges are configured per server with the
+// TextBridges config key, a comma-separated list of channel=URL
+// mappings, for example
+//
+//	1=irc://irc.example.org:6667/grumble,2=https://example.org/hooks/xyz
+//
+// irc:// URLs join an IRC channel and relay messages both ways (see
+// bridgeirc.go). http:// and https:// URLs are webhooks that messages are
+// posted to as JSON, in a form accepted by Discord and Slack webhooks.
+//
+// Messages relayed from a bridge are prefixed with the bridge's kind and
+// the name of their sender. They are relayed to the other bridges of the
+// channel, but never back to the bridge they came from.
+
+import (
+	"bytes"
+	"goprotobuf.googlecode.com/hg/proto"
+	"html"
+	"http"
+	"json"
+	"log"
+	"mumbleproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The number of outgoing messages a bridge queues before dropping them.
+const bridgeQueueLength = 64
+
+var ErrBridgeBusy = os.NewError("bridge queue full")
+
+// A Bridge relays text messages between a channel and an external chat
+// system.
+type Bridge interface {
+	// The kind of the bridge, used to prefix relayed messages.
+	Kind() string
+
+	// Queue a message from from to be sent to the external system.
+	// Send must not block.
+	Send(from string, text string) os.Error
+
+	// Shut the bridge down.
+	Close()
+}
+
+// Called by bridges with messages from their external system. May be
+// called from any goroutine.
+type bridgeDeliverFunc func(from string, text string)
+
+// Create a bridge for url.
+func newBridge(url string, deliver bridgeDeliverFunc) (Bridge, os.Error) {
+	switch {
+	case strings.HasPrefix(url, "irc://"):
+		return newIRCBridge(url[len("irc://"):], deliver)
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return newWebhookBridge(url), nil
+	}
+	return nil, os.NewError("unsupported bridge URL " + url)
+}
+
+// Start the bridges configured for the server, stopping any running
+// ones first.
+func (server *Server) startBridges() {
+	server.stopBridges()
+
+	for _, entry := range strings.Split(server.cfg.StringValue("TextBridges"), ",", -1) {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		parts := strings.Split(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Invalid text bridge %v", entry)
+			continue
+		}
+		cid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			log.Printf("Invalid text bridge channel %v", parts[0])
+			continue
+		}
+
+		var bridge Bridge
+		bridge, err = newBridge(strings.TrimSpace(parts[1]), func(from string, text string) {
+			server.syncCall(func() {
+				server.relayFromBridge(cid, bridge, from, text)
+			})
+		})
+		if err != nil {
+			log.Printf("Unable to start text bridge: %v", err.String())
+			continue
+		}
+		server.bridges[cid] = append(server.bridges[cid], bridge)
+	}
+}
+
+// Stop all of the server's bridges.
+func (server *Server) stopBridges() {
+	for cid, bridges := range server.bridges {
+		for _, bridge := range bridges {
+			bridge.Close()
+		}
+		server.bridges[cid] = nil, false
+	}
+}
+
+var htmlTagRegexp = regexp.MustCompile("<[^>]*>")
+
+// Convert the HTML of a text message into plain text.
+func plainText(text string) string {
+	text = strings.Replace(text, "<br>", " ", -1)
+	text = strings.Replace(text, "<br />", " ", -1)
+	return strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, "")))
+}
+
+// Relay a text message sent to channel to its bridges. The bridge the
+// message came from, if any, is skipped.
+func (server *Server) relayToBridges(channel *Channel, origin Bridge, from string, text string) {
+	for _, bridge := range server.bridges[channel.Id] {
+		if bridge == origin {
+			continue
+		}
+		if err := bridge.Send(from, text); err != nil {
+			log.Printf("Unable to relay message to %v bridge of channel %v: %v", bridge.Kind(), channel.Id, err.String())
+		}
+	}
+}
+
+// Deliver a message from a bridge to the users of the bridged channel,
+// and relay it on to the channel's other bridges.
+func (server *Server) relayFromBridge(cid int, origin Bridge, from string, text string) {
+	channel, ok := server.Channels[cid]
+	if !ok || len(text) == 0 {
+		return
+	}
+	from = "[" + origin.Kind() + "] " + from
+
+	txtmsg := &mumbleproto.TextMessage{
+		ChannelId: []uint32{uint32(cid)},
+		Message:   proto.String("<b>" + html.EscapeString(from) + ":</b> " + html.EscapeString(text)),
+	}
+	for _, client := range channel.clients {
+		if err := client.sendProtoMessage(MessageTextMessage, txtmsg); err != nil {
+			client.Panic(err.String())
+		}
+	}
+
+	server.relayToBridges(channel, origin, from, text)
+}
+
+// A bridge posting messages to a webhook. Webhooks only relay messages
+// out of the server.
+type webhookBridge struct {
+	url string
+	out chan map[string]string
+}
+
+func newWebhookBridge(url string) *webhookBridge {
+	bridge := &webhookBridge{
+		url: url,
+		out: make(chan map[string]string, bridgeQueueLength),
+	}
+	go bridge.run()
+	return bridge
+}
+
+func (bridge *webhookBridge) Kind() string {
+	return "web"
+}
+
+func (bridge *webhookBridge) Send(from string, text string) os.Error {
+	// Discord webhooks use content, Slack webhooks use text.
+	msg := map[string]string{
+		"username": from,
+		"content":  text,
+		"text":     from + ": " + text,
+	}
+	select {
+	case bridge.out <- msg:
+		return nil
+	default:
+	}
+	return ErrBridgeBusy
+}
+
+func (bridge *webhookBridge) Close() {
+	close(bridge.out)
+}
+
+// Post queued messages to the webhook.
+func (bridge *webhookBridge) run() {
+	for msg := range bridge.out {
+		buf, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		resp, err := http.Post(bridge.url, "application/json", bytes.NewBuffer(buf))
+		if err != nil {
+			log.Printf("Unable to post to webhook: %v", err.String())
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("Webhook returned %v", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements text bridges to IRC channels. A bridge URL has
+// the form irc://host:port/channel, where the channel is given without
+// its leading '#'. The bridge connects with the nick given by the
+// -bridgenick flag, joins the channel, and reconnects if the connection
+// is lost. Messages from the bridge's own nick are ignored, so relayed
+// messages are never relayed back.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var bridgenick *string = flag.String("bridgenick", "grumble", "Nick used by IRC text bridges")
+
+// How long to wait before reconnecting to IRC, in nanoseconds.
+const ircReconnectDelay = 30e9
+
+type ircBridge struct {
+	addr    string
+	channel string
+	deliver bridgeDeliverFunc
+
+	out  chan string
+	done chan bool
+}
+
+// Create an IRC bridge for the host:port/channel part of an irc:// URL.
+func newIRCBridge(target string, deliver bridgeDeliverFunc) (*ircBridge, os.Error) {
+	parts := strings.Split(target, "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, os.NewError("invalid IRC bridge irc://" + target)
+	}
+
+	addr := parts[0]
+	if strings.Index(addr, ":") < 0 {
+		addr += ":6667"
+	}
+	bridge := &ircBridge{
+		addr:    addr,
+		channel: "#" + strings.TrimLeft(parts[1], "#"),
+		deliver: deliver,
+		out:     make(chan string, bridgeQueueLength),
+		done:    make(chan bool),
+	}
+	go bridge.run()
+	return bridge, nil
+}
+
+func (bridge *ircBridge) Kind() string {
+	return "irc"
+}
+
+func (bridge *ircBridge) Send(from string, text string) os.Error {
+	// IRC messages can't span lines.
+	text = strings.Replace(text, "\r", " ", -1)
+	text = strings.Replace(text, "\n", " ", -1)
+
+	select {
+	case bridge.out <- fmt.Sprintf("PRIVMSG %v :<%v> %v", bridge.channel, from, text):
+		return nil
+	default:
+	}
+	return ErrBridgeBusy
+}
+
+func (bridge *ircBridge) Close() {
+	close(bridge.done)
+}
+
+// Keep the bridge connected until it is closed.
+func (bridge *ircBridge) run() {
+	for {
+		err := bridge.session()
+		if err == nil {
+			return
+		}
+		log.Printf("IRC bridge to %v %v: %v", bridge.addr, bridge.channel, err.String())
+
+		select {
+		case <-bridge.done:
+			return
+		case <-time.After(ircReconnectDelay):
+		}
+	}
+}
+
+// Parse the sender nick, command and parameters of an IRC line.
+func parseIRCLine(line string) (nick string, cmd string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		prefix := line[1:]
+		if i := strings.Index(prefix, " "); i >= 0 {
+			prefix, line = prefix[:i], prefix[i+1:]
+		} else {
+			line = ""
+		}
+		nick = strings.Split(prefix, "!", 2)[0]
+	}
+
+	trailing := ""
+	if i := strings.Index(line, " :"); i >= 0 {
+		line, trailing = line[:i], line[i+2:]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	cmd, params = strings.ToUpper(fields[0]), fields[1:]
+	if len(trailing) > 0 {
+		params = append(params, trailing)
+	}
+	return
+}
+
+// Connect to the IRC server and relay messages until the connection is
+// lost or the bridge is closed.
+func (bridge *ircBridge) session() (err os.Error) {
+	conn, err := net.Dial("tcp", bridge.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	nick := *bridgenick
+	send := func(line string) {
+		if err == nil {
+			_, err = conn.Write([]byte(line + "\r\n"))
+		}
+	}
+	send("NICK " + nick)
+	send("USER " + nick + " 0 * :Grumble text bridge")
+
+	lines := make(chan string)
+	quit := make(chan bool)
+	defer close(quit)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			select {
+			case lines <- strings.TrimRight(line, "\r\n"):
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for err == nil {
+		select {
+		case <-bridge.done:
+			send("QUIT :Bridge stopped")
+			return nil
+
+		case msg := <-bridge.out:
+			send(msg)
+
+		case line, ok := <-lines:
+			if !ok {
+				return os.NewError("connection closed")
+			}
+			from, cmd, params := parseIRCLine(line)
+			switch cmd {
+			case "PING":
+				send("PONG :" + strings.Join(params, " "))
+			case "001":
+				send("JOIN " + bridge.channel)
+			case "433":
+				// Nick in use.
+				nick += "_"
+				send("NICK " + nick)
+			case "PRIVMSG":
+				if len(params) == 2 && strings.ToLower(params[0]) == strings.ToLower(bridge.channel) && from != nick {
+					bridge.deliver(from, params[1])
+				}
+			}
+		}
+	}
+	return err
+}
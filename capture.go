@@ -0,0 +1,205 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-session packet capture, for diagnosing
+// interoperability problems with clients on production servers. While a
+// capture of a session is running, the session's control messages are
+// decoded and written to a capture file, one line per message, along
+// with the headers of its voice packets. Voice payloads aren't captured.
+//
+// Captures are started through the control interface, and are written
+// to the captures directory of the data directory. They stop after the
+// requested duration, at most maxCaptureDuration, or once the file
+// reaches maxCaptureSize. Passwords and crypt keys are blanked out.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The longest capture, in seconds.
+	maxCaptureDuration = 600
+
+	// The largest capture file, in bytes.
+	maxCaptureSize = 64 << 20
+)
+
+// Create an empty protobuf message for each control message kind.
+var captureMessages = map[uint16]func() interface{}{
+	MessageVersion:                func() interface{} { return new(mumbleproto.Version) },
+	MessageAuthenticate:           func() interface{} { return new(mumbleproto.Authenticate) },
+	MessagePing:                   func() interface{} { return new(mumbleproto.Ping) },
+	MessageReject:                 func() interface{} { return new(mumbleproto.Reject) },
+	MessageServerSync:             func() interface{} { return new(mumbleproto.ServerSync) },
+	MessageChannelRemove:          func() interface{} { return new(mumbleproto.ChannelRemove) },
+	MessageChannelState:           func() interface{} { return new(mumbleproto.ChannelState) },
+	MessageUserRemove:             func() interface{} { return new(mumbleproto.UserRemove) },
+	MessageUserState:              func() interface{} { return new(mumbleproto.UserState) },
+	MessageBanList:                func() interface{} { return new(mumbleproto.BanList) },
+	MessageTextMessage:            func() interface{} { return new(mumbleproto.TextMessage) },
+	MessagePermissionDenied:       func() interface{} { return new(mumbleproto.PermissionDenied) },
+	MessageACL:                    func() interface{} { return new(mumbleproto.ACL) },
+	MessageQueryUsers:             func() interface{} { return new(mumbleproto.QueryUsers) },
+	MessageCryptSetup:             func() interface{} { return new(mumbleproto.CryptSetup) },
+	MessageContextActionAdd:       func() interface{} { return new(mumbleproto.ContextActionAdd) },
+	MessageContextAction:          func() interface{} { return new(mumbleproto.ContextAction) },
+	MessageUserList:               func() interface{} { return new(mumbleproto.UserList) },
+	MessageVoiceTarget:            func() interface{} { return new(mumbleproto.VoiceTarget) },
+	MessagePermissionQuery:        func() interface{} { return new(mumbleproto.PermissionQuery) },
+	MessageCodecVersion:           func() interface{} { return new(mumbleproto.CodecVersion) },
+	MessageUserStats:              func() interface{} { return new(mumbleproto.UserStats) },
+	MessageRequestBlob:            func() interface{} { return new(mumbleproto.RequestBlob) },
+	MessageServerConfig:           func() interface{} { return new(mumbleproto.ServerConfig) },
+	MessageSuggestConfig:          func() interface{} { return new(mumbleproto.SuggestConfig) },
+	MessagePluginDataTransmission: func() interface{} { return new(mumbleproto.PluginDataTransmission) },
+}
+
+// A running capture of a session.
+type packetCapture struct {
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int
+	until    int64
+	protobuf bool
+	closed   bool
+}
+
+// Start capturing client's traffic to a new file in the captures
+// directory, for duration seconds. Any running capture of the client is
+// stopped. Returns the name of the capture file.
+func (server *Server) startCapture(client *Client, duration int64) (filename string, err os.Error) {
+	if duration <= 0 || duration > maxCaptureDuration {
+		duration = maxCaptureDuration
+	}
+	server.stopCapture(client)
+
+	dir := filepath.Join(*datadir, "captures")
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	filename = filepath.Join(dir, fmt.Sprintf("%v-%v-%v.log", server.Id, client.TraceId, time.Seconds()))
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	pc := &packetCapture{
+		file:     f,
+		writer:   bufio.NewWriter(f),
+		until:    time.Nanoseconds() + duration*1e9,
+		protobuf: client.usesProtobufUDP(),
+	}
+	pc.printf("capture of session %v (%v), client %v %v, for %v seconds", client.Session, client.ShownName(), client.ClientName, client.OSName, duration)
+	client.capture = pc
+	go func() {
+		time.Sleep(duration * 1e9)
+		pc.Close()
+	}()
+	return filename, nil
+}
+
+// Stop the running capture of client, if any.
+func (server *Server) stopCapture(client *Client) {
+	if client.capture != nil {
+		client.capture.Close()
+		client.capture = nil
+	}
+}
+
+// Close the capture file. Further packets are ignored.
+func (pc *packetCapture) Close() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.writer.Flush()
+	pc.file.Close()
+}
+
+// Write a line to the capture file, stopping the capture if it has run
+// for too long or grown too large.
+func (pc *packetCapture) printf(format string, args ...interface{}) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.closed {
+		return
+	}
+
+	now := time.Nanoseconds()
+	line := fmt.Sprintf("%v.%06d %v\n", now/1e9, (now%1e9)/1e3, fmt.Sprintf(format, args...))
+	pc.size += len(line)
+	if now > pc.until || pc.size > maxCaptureSize {
+		pc.closed = true
+		pc.writer.WriteString("capture stopped\n")
+		pc.writer.Flush()
+		pc.file.Close()
+		return
+	}
+	pc.writer.WriteString(line)
+}
+
+// Capture a control message sent or received over TCP. dir is "in" or
+// "out".
+func (pc *packetCapture) control(dir string, kind uint16, buf []byte) {
+	if pc == nil {
+		return
+	}
+	if kind == MessageUDPTunnel {
+		pc.voice(dir, "tcp", buf)
+		return
+	}
+
+	newMessage, ok := captureMessages[kind]
+	if !ok {
+		pc.printf("%v tcp kind=%v len=%v", dir, kind, len(buf))
+		return
+	}
+	msg := newMessage()
+	if err := proto.Unmarshal(buf, msg); err != nil {
+		pc.printf("%v tcp kind=%v len=%v undecodable: %v", dir, kind, len(buf), err.String())
+		return
+	}
+
+	// Don't write secrets to disk.
+	switch m := msg.(type) {
+	case *mumbleproto.Authenticate:
+		if m.Password != nil {
+			m.Password = proto.String("-")
+		}
+	case *mumbleproto.CryptSetup:
+		m.Key, m.ClientNonce, m.ServerNonce = nil, nil, nil
+	}
+
+	text := new(bytes.Buffer)
+	proto.MarshalText(text, msg)
+	pc.printf("%v tcp kind=%v len=%v %v", dir, kind, len(buf), strings.Join(strings.Fields(text.String()), " "))
+}
+
+// Capture the header of a voice packet. dir is "in" or "out", and
+// transport "udp" or "tcp".
+func (pc *packetCapture) voice(dir string, transport string, data []byte) {
+	if pc == nil || len(data) == 0 {
+		return
+	}
+	if pc.protobuf {
+		pc.printf("%v %v voice type=%v len=%v", dir, transport, data[0], len(data))
+		return
+	}
+	pc.printf("%v %v voice type=%v target=%v len=%v", dir, transport, (data[0]>>5)&0x07, data[0]&0x1f, len(data))
+}
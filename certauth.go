@@ -0,0 +1,48 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements certificate-based access control for closed
+// servers. When the RequireStrongCertificate config key is set, only
+// clients whose certificate chains up to one of the server's certificate
+// authorities (see register.go) may connect. The SuperUser is exempt, so
+// the server can still be administered without such a certificate.
+//
+// When the CertificateIdentity config key is set to "cn", a strong
+// certificate also determines who the client is: the client's name is
+// taken from the certificate's common name, and it is authenticated as
+// the registered user of that name, regardless of the certificate hash
+// stored for the user. This lets an organisation reissue certificates
+// without re-registering its users.
+
+import (
+	"crypto/x509"
+)
+
+// Check whether client may connect to the server given its certificate.
+// Returns the reason for rejecting the client, or an empty string if it
+// may connect.
+func (server *Server) certificateDenied(client *Client) string {
+	if client.Username == "SuperUser" || !server.cfg.BoolValue("RequireStrongCertificate") {
+		return ""
+	}
+	if len(client.CertHash) == 0 {
+		return "This server requires a client certificate."
+	}
+	if !client.StrongCertificate {
+		return "Your certificate is not accepted by this server."
+	}
+	return ""
+}
+
+// Get the identity asserted by a client's strong certificate, or an
+// empty string if identities aren't taken from certificates.
+func (server *Server) certificateIdentity(cert *x509.Certificate) string {
+	switch server.cfg.StringValue("CertificateIdentity") {
+	case "cn":
+		return cert.Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements monitoring of the server certificate's expiry.
+// The number of days left until the certificate expires is exported as
+// grumble.cert.daysremaining and through the control interface, and a
+// warning is logged whenever it drops below one of the thresholds given
+// by -certwarn. Grumble refuses to start with an expired certificate
+// unless -allowexpiredcert is given.
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate expiry is checked, in nanoseconds.
+const certCheckInterval = 3600e9
+
+// The number of days until the server certificate expires. Negative
+// once it has expired.
+var certDaysRemaining = expvar.NewInt("grumble.cert.daysremaining")
+
+// The expiry time of the server certificate, in seconds since the
+// Unix epoch.
+var (
+	certExpiryMutex sync.RWMutex
+	certExpiry      int64
+)
+
+// Read the expiry time of the certificate in filename.
+func readCertExpiry(filename string) (expiry int64, err os.Error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return 0, os.NewError("no certificate found in " + filename)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return 0, err
+	}
+	return cert.NotAfter.Seconds(), nil
+}
+
+// Get the number of whole days from now until expiry.
+func daysUntil(expiry int64) int64 {
+	secs := expiry - time.Seconds()
+	if secs < 0 {
+		return (secs - 86399) / 86400
+	}
+	return secs / 86400
+}
+
+// Parse the -certwarn flag into a list of thresholds, largest first.
+func parseCertWarnings(str string) (days []int) {
+	for _, field := range strings.Split(str, ",", -1) {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring invalid certificate warning threshold: %v", field)
+			continue
+		}
+		days = append(days, n)
+	}
+	sort.SortInts(days)
+	for i, j := 0, len(days)-1; i < j; i, j = i+1, j-1 {
+		days[i], days[j] = days[j], days[i]
+	}
+	return days
+}
+
+// Get the number of days until the server certificate expires.
+func CertDaysRemaining() int64 {
+	certExpiryMutex.RLock()
+	defer certExpiryMutex.RUnlock()
+	return daysUntil(certExpiry)
+}
+
+// Check the server certificate's expiry, and start monitoring it.
+// Exits if the certificate has expired, unless -allowexpiredcert is
+// set.
+func MonitorCertExpiry(filename string) {
+	expiry, err := readCertExpiry(filename)
+	if err != nil {
+		log.Printf("Unable to check certificate expiry: %v", err.String())
+		return
+	}
+
+	certExpiryMutex.Lock()
+	certExpiry = expiry
+	certExpiryMutex.Unlock()
+
+	days := daysUntil(expiry)
+	certDaysRemaining.Set(days)
+	if days < 0 {
+		if !*allowexpiredcert {
+			log.Fatalf("The server certificate expired on %v. Use -allowexpiredcert to start anyway.", time.SecondsToLocalTime(expiry))
+		}
+		log.Printf("Warning: the server certificate expired on %v", time.SecondsToLocalTime(expiry))
+	} else {
+		log.Printf("The server certificate expires in %v days", days)
+	}
+
+	go certExpiryMonitor(expiry, parseCertWarnings(*certwarn))
+}
+
+// Periodically update the days remaining, and log a warning whenever a
+// threshold is crossed. Once the certificate has expired, a warning is
+// logged once a day.
+func certExpiryMonitor(expiry int64, thresholds []int) {
+	// Don't warn about thresholds already crossed at startup.
+	next := 0
+	for next < len(thresholds) && daysUntil(expiry) <= int64(thresholds[next]) {
+		next++
+	}
+	lastExpiredWarning := daysUntil(expiry)
+
+	ticker := time.NewTicker(certCheckInterval)
+	for _ = range ticker.C {
+		days := daysUntil(expiry)
+		certDaysRemaining.Set(days)
+
+		if days < 0 {
+			if days != lastExpiredWarning {
+				log.Printf("Warning: the server certificate expired on %v", time.SecondsToLocalTime(expiry))
+				lastExpiredWarning = days
+			}
+			continue
+		}
+
+		warn := false
+		for next < len(thresholds) && days <= int64(thresholds[next]) {
+			warn = true
+			next++
+		}
+		if warn {
+			log.Printf("Warning: the server certificate expires in %v days, on %v", days, time.SecondsToLocalTime(expiry))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-channel enter, join and leave messages.
+//
+// A channel's enter message is sent privately to a user entering the
+// channel. Its join and leave messages are sent to the channel's members
+// when another user joins or leaves the channel. In join and leave
+// messages, {username} is replaced by the name of the user.
+//
+// The messages are set through the Grumble extension fields of the
+// ChannelState message, and require WritePermission in the channel.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"html"
+	"mumbleproto"
+	"strings"
+)
+
+// The maximum length of a channel's enter, join or leave message.
+const MaxChannelMessageLength = 1000
+
+// Expand the variables of a join or leave message for client.
+func expandChannelMessage(text string, client *Client) string {
+	return strings.Replace(text, "{username}", html.EscapeString(client.ShownName()), -1)
+}
+
+// Send text to all members of channel, except client.
+func (server *Server) sendChannelNotice(channel *Channel, client *Client, text string) {
+	txtmsg := &mumbleproto.TextMessage{
+		ChannelId: []uint32{uint32(channel.Id)},
+		Message:   proto.String(expandChannelMessage(text, client)),
+	}
+	for _, member := range channel.clients {
+		if member == client || member.state != StateClientReady {
+			continue
+		}
+		if err := member.sendProtoMessage(MessageTextMessage, txtmsg); err != nil {
+			member.Printf("Unable to send channel message: %v", err.String())
+		}
+	}
+}
+
+// Send the channel messages caused by client moving from oldchan to
+// channel. Either of oldchan and channel may be nil, for clients that
+// are connecting or disconnecting.
+func (server *Server) sendChannelMessages(client *Client, oldchan *Channel, channel *Channel) {
+	if oldchan != nil && len(oldchan.LeaveMessage) > 0 {
+		server.sendChannelNotice(oldchan, client, oldchan.LeaveMessage)
+	}
+
+	if channel == nil {
+		return
+	}
+
+	if len(channel.JoinMessage) > 0 {
+		server.sendChannelNotice(channel, client, channel.JoinMessage)
+	}
+
+	if len(channel.EnterMessage) > 0 {
+		err := client.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
+			Session: []uint32{client.Session},
+			Message: proto.String(channel.EnterMessage),
+		})
+		if err != nil {
+			client.Printf("Unable to send channel enter message: %v", err.String())
+		}
+	}
+}
+
+// Update the channel's messages from the fields set in chanstate.
+func (channel *Channel) setMessages(chanstate *mumbleproto.ChannelState) {
+	if chanstate.EnterMessage != nil {
+		channel.EnterMessage = *chanstate.EnterMessage
+	}
+	if chanstate.JoinMessage != nil {
+		channel.JoinMessage = *chanstate.JoinMessage
+	}
+	if chanstate.LeaveMessage != nil {
+		channel.LeaveMessage = *chanstate.LeaveMessage
+	}
+}
@@ -17,6 +17,14 @@ type Channel struct {
 
 	clients map[uint32]*Client
 
+	// Clients listening to the channel without being in it
+	listeners map[uint32]*Client
+
+	// The clients that receive voice sent to the channel (its members
+	// and listeners), maintained incrementally for fast broadcasts.
+	recipients     []*Client
+	recipientIndex map[uint32]int
+
 	parent   *Channel
 	children map[int]*Channel
 
@@ -32,6 +40,16 @@ type Channel struct {
 
 	// Blobs
 	DescriptionBlob string
+
+	// Messages sent when users enter, join or leave the channel.
+	// See chanmsg.go.
+	EnterMessage string
+	JoinMessage  string
+	LeaveMessage string
+
+	// The maximum audio bitrate of clients in the channel, in bits
+	// per second. Zero means no limit. See bitrate.go.
+	MaxBitrate int
 }
 
 func NewChannel(id int, name string) (channel *Channel) {
@@ -39,6 +57,8 @@ func NewChannel(id int, name string) (channel *Channel) {
 	channel.Id = id
 	channel.Name = name
 	channel.clients = make(map[uint32]*Client)
+	channel.listeners = make(map[uint32]*Client)
+	channel.recipientIndex = make(map[uint32]int)
 	channel.children = make(map[int]*Channel)
 	channel.ACL = []*ChannelACL{}
 	channel.Groups = map[string]*Group{}
@@ -61,12 +81,50 @@ func (channel *Channel) RemoveChild(child *Channel) {
 func (channel *Channel) AddClient(client *Client) {
 	channel.clients[client.Session] = client
 	client.Channel = channel
+	channel.updateRecipient(client)
 }
 
 // Remove client
 func (channel *Channel) RemoveClient(client *Client) {
 	channel.clients[client.Session] = nil, false
 	client.Channel = nil
+	channel.updateRecipient(client)
+}
+
+// Add a listener to the channel
+func (channel *Channel) AddListener(client *Client) {
+	channel.listeners[client.Session] = client
+	client.listening[channel.Id] = channel
+	channel.updateRecipient(client)
+}
+
+// Remove a listener from the channel
+func (channel *Channel) RemoveListener(client *Client) {
+	channel.listeners[client.Session] = nil, false
+	client.listening[channel.Id] = nil, false
+	channel.updateRecipient(client)
+}
+
+// Add or remove client from the channel's voice recipients, depending on
+// whether it is a member or a listener of the channel.
+func (channel *Channel) updateRecipient(client *Client) {
+	_, member := channel.clients[client.Session]
+	_, listener := channel.listeners[client.Session]
+	idx, present := channel.recipientIndex[client.Session]
+
+	if (member || listener) && !present {
+		channel.recipientIndex[client.Session] = len(channel.recipients)
+		channel.recipients = append(channel.recipients, client)
+	} else if !(member || listener) && present {
+		// Move the last recipient into the removed client's slot.
+		last := len(channel.recipients) - 1
+		moved := channel.recipients[last]
+		channel.recipients[idx] = moved
+		channel.recipientIndex[moved.Session] = idx
+		channel.recipients[last] = nil
+		channel.recipients = channel.recipients[0:last]
+		channel.recipientIndex[client.Session] = 0, false
+	}
 }
 
 // Does the channel have a description?
@@ -15,6 +15,8 @@ import (
 	"cryptstate"
 	"io"
 	"packetdatastream"
+	"sync"
+	"time"
 )
 
 // A client connection
@@ -30,6 +32,7 @@ type Client struct {
 	server  *Server
 
 	msgchan     chan *Message
+	voicechan   chan *Message
 	udprecv     chan []byte
 	doneSending chan bool
 
@@ -37,6 +40,12 @@ type Client struct {
 
 	crypt  *cryptstate.CryptState
 	codecs []int32
+
+	// Guards the decryption state of crypt. With several UDP readers
+	// (see udpreuse_linux.go), any of them may try to decrypt a
+	// client's packets, and CryptSetup resyncs its nonce.
+	decryptMutex sync.Mutex
+
 	udp    bool
 
 	// If the client is a registered user on the server,
@@ -52,25 +61,78 @@ type Client struct {
 
 	// Version
 	Version    uint32
+	VersionV2  uint64
 	ClientName string
 	OSName     string
 	OSVersion  string
 
 	// Personal
-	Username        string
-	Session         uint32
-	CertHash        string
-	Tokens          []string
-	Channel         *Channel
-	SelfMute        bool
-	SelfDeaf        bool
-	Mute            bool
-	Deaf            bool
-	Suppress        bool
-	PrioritySpeaker bool
-	Recording       bool
-	PluginContext   []byte
-	PluginIdentity  string
+	Username          string
+	Session           uint32
+	TraceId           string
+	CertHash          string
+	StrongCertificate bool
+	Tokens            []string
+	Country           string
+	Channel           *Channel
+	SelfMute          bool
+	SelfDeaf          bool
+	Mute              bool
+	Deaf              bool
+	Suppress          bool
+	PrioritySpeaker   bool
+	Recording         bool
+	PluginContext     []byte
+	PluginIdentity    string
+
+	// Channels the client is listening to
+	listening map[int]*Channel
+
+	// The password given when authenticating, and the channels the
+	// client may enter through invites. See invite.go.
+	authPassword string
+	invited      map[int]bool
+
+	// Rate limiter for plugin data messages
+	pluginBucket *LeakyBucket
+
+	// Talk-time statistics for the session
+	talk talkStats
+
+	// Network quality statistics for the session. See netquality.go.
+	netq netQuality
+
+	// When the client last sent a message on its control channel, in
+	// nanoseconds. See keepalive.go.
+	lastMessage int64
+
+	// The UDP socket the client's voice traffic arrives on
+	udpsock *udpSocket
+
+	// The challenge state of the client's UDP address. See udpbind.go.
+	udpbind udpBinding
+
+	// When the client's timed mute and deafen expire, in seconds since
+	// the epoch. See timedmute.go.
+	muteExpiry int64
+	deafExpiry int64
+
+	// The running packet capture of the session, if any. See
+	// capture.go.
+	capture *packetCapture
+
+	// The bitrate limit of the client's channel, in bits per second,
+	// or 0 if there is none. See bitrate.go.
+	bitrateLimit int32
+	bitrate      bitrateMeter
+}
+
+// Decrypt a voice datagram of the client into dst. Safe to call from
+// any UDP reader.
+func (client *Client) decrypt(dst, src []byte) os.Error {
+	client.decryptMutex.Lock()
+	defer client.decryptMutex.Unlock()
+	return client.crypt.Decrypt(dst, src)
 }
 
 // Is the client a registered user?
@@ -113,7 +175,7 @@ func (client *Client) ShownName() string {
 
 // Something invalid happened on the wire.
 func (client *Client) Panic(reason string) {
-	log.Printf("Client panic: %s", reason)
+	client.Printf("Client panic: %s", reason)
 	client.Disconnect()
 }
 
@@ -204,6 +266,8 @@ func (client *Client) readProtoMessage() (msg *Message, err os.Error) {
 		kind:   kind,
 		client: client,
 	}
+	client.capture.control("in", kind, buf)
+	client.server.countBytesIn(6 + len(buf))
 
 	return
 }
@@ -251,6 +315,21 @@ func (c *Client) sendPermissionDeniedTypeUser(kind string, user *Client) {
 	}
 }
 
+// Send permission denied with a textual reason
+func (c *Client) sendPermissionDeniedText(reason string) {
+	d, err := proto.Marshal(&mumbleproto.PermissionDenied{
+		Reason: proto.String(reason),
+		Type:   mumbleproto.NewPermissionDenied_DenyType(mumbleproto.PermissionDenied_Text),
+	})
+	if err != nil {
+		c.Panic(err.String())
+	}
+	c.msgchan <- &Message{
+		buf:  d,
+		kind: MessagePermissionDenied,
+	}
+}
+
 // Send permission denied by who, what, where
 func (c *Client) sendPermissionDenied(who *Client, where *Channel, what Permission) {
 	d, err := proto.Marshal(&mumbleproto.PermissionDenied{
@@ -274,7 +353,8 @@ func (c *Client) sendPermissionDeniedFallback(kind string, version uint32, text
 	c.sendPermissionDeniedType(kind)
 }
 
-// UDP receiver.
+// UDP receiver. Packets on the udprecv channel are pooled packet
+// buffers, with the packet itself starting at PacketHeadroom.
 func (client *Client) udpreceiver() {
 	for buf := range client.udprecv {
 		// Received a zero-valued buffer. This means that the udprecv
@@ -282,22 +362,54 @@ func (client *Client) udpreceiver() {
 		if len(buf) == 0 {
 			return
 		}
+		if len(buf) <= PacketHeadroom {
+			packetPool.Put(buf)
+			continue
+		}
 
-		kind := (buf[0] >> 5) & 0x07
+		if client.usesProtobufUDP() {
+			client.handleProtobufUDP(buf)
+			continue
+		}
+
+		data := buf[PacketHeadroom:]
+		kind := (data[0] >> 5) & 0x07
 
 		switch kind {
+		case UDPMessageVoiceOpus:
+			pkt, err := parseLegacyOpusPacket(data)
+			if err != nil {
+				packetPool.Put(buf)
+				continue
+			}
+			pkt.session = client.Session
+
+			// Protobuf clients need a re-encoded copy. Legacy clients
+			// get the packet rewritten in place.
+			var pbuf *VoiceBuffer
+			if pb := pkt.protobufBytes(); pb != nil {
+				pbuf = NewVoiceBuffer(nil, pb)
+			}
+			if !client.allowVoice(time.Nanoseconds(), len(data)) {
+				packetPool.Put(buf)
+				continue
+			}
+			client.countVoicePacket()
+			target := byte(pkt.target)
+			out := prependSession(buf, data[0]&0xe0, client.Session)
+			client.routeVoice(target, NewVoiceBuffer(buf, out), pbuf)
+
 		case UDPMessageVoiceSpeex:
 			fallthrough
 		case UDPMessageVoiceCELTAlpha:
 			fallthrough
 		case UDPMessageVoiceCELTBeta:
-			kind := buf[0] & 0xe0
-			target := buf[0] & 0x1f
+			kind := data[0] & 0xe0
+			target := data[0] & 0x1f
 			var counter uint8
-			outbuf := make([]byte, 1024)
 
-			incoming := packetdatastream.New(buf[1 : 1+(len(buf)-1)])
-			outgoing := packetdatastream.New(outbuf[1 : 1+(len(outbuf)-1)])
+			// Validate the frame headers in place.
+			incoming := packetdatastream.New(data[1:])
 			_ = incoming.GetUint32()
 
 			for {
@@ -308,43 +420,124 @@ func (client *Client) udpreceiver() {
 				}
 			}
 
-			outgoing.PutUint32(client.Session)
-			outgoing.PutBytes(buf[1 : 1+(len(buf)-1)])
-			outbuf[0] = kind
-
-			// VoiceTarget
-			if target != 0x1f {
-				client.server.voicebroadcast <- &VoiceBroadcast{
-					client: client,
-					buf:    outbuf[0 : 1+outgoing.Size()],
-					target: target,
-				}
-				// Server loopback
-			} else {
-				client.sendUdp(&Message{
-					buf:    outbuf[0 : 1+outgoing.Size()],
-					client: client,
-				})
+			if !client.allowVoice(time.Nanoseconds(), len(data)) {
+				packetPool.Put(buf)
+				continue
 			}
+			client.countVoicePacket()
+			out := prependSession(buf, kind, client.Session)
+			client.routeVoice(target, NewVoiceBuffer(buf, out), nil)
 
 		case UDPMessagePing:
+			client.countUDPPing(data)
 			client.server.udpsend <- &Message{
-				buf:    buf,
+				buf:    data,
 				client: client,
+				vbuf:   NewVoiceBuffer(buf, data),
 			}
+
+		default:
+			packetPool.Put(buf)
 		}
 	}
 }
 
+// Handle a UDP datagram from a client that uses protobuf framing.
+func (client *Client) handleProtobufUDP(buf []byte) {
+	data := buf[PacketHeadroom:]
+	switch data[0] {
+	case UDPProtobufAudio:
+		size := len(data)
+		pkt, err := parseProtobufAudioPacket(data[1:])
+		packetPool.Put(buf)
+		if err != nil || !client.allowVoice(time.Nanoseconds(), size) {
+			return
+		}
+		pkt.session = client.Session
+		client.countVoicePacket()
+
+		lbuf := packetPool.Get()
+		legacy := pkt.encodeLegacy(lbuf)
+		if legacy == nil {
+			packetPool.Put(lbuf)
+			return
+		}
+		var pbuf *VoiceBuffer
+		if pb := pkt.protobufBytes(); pb != nil {
+			pbuf = NewVoiceBuffer(nil, pb)
+		}
+		client.routeVoice(byte(pkt.target), NewVoiceBuffer(lbuf, legacy), pbuf)
+
+	case UDPProtobufPing:
+		client.countUDPPing(data)
+		client.server.udpsend <- &Message{
+			buf:    data,
+			client: client,
+			vbuf:   NewVoiceBuffer(buf, data),
+		}
+
+	default:
+		packetPool.Put(buf)
+	}
+}
+
+// Send a voice packet to its target. The packet is given in both legacy
+// and protobuf framing; pbuf is nil if the packet can't be represented in
+// protobuf framing. The caller's references to buf and pbuf are passed on.
+func (client *Client) routeVoice(target byte, buf *VoiceBuffer, pbuf *VoiceBuffer) {
+	vb := &VoiceBroadcast{
+		client: client,
+		buf:    buf,
+		pbuf:   pbuf,
+		target: target,
+	}
+
+	// VoiceTarget
+	if target != 0x1f {
+		client.server.voicebroadcast <- vb
+		// Server loopback
+	} else {
+		vb.sendTo(client)
+		vb.release()
+	}
+}
+
+// Queue a voice packet for sending to the client. If the client's voice
+// queue is full, the oldest queued packet is dropped to make room, so a
+// congested client never blocks the caller.
 func (client *Client) sendUdp(msg *Message) {
+	for {
+		select {
+		case client.voicechan <- msg:
+			return
+		default:
+		}
+
+		select {
+		case old := <-client.voicechan:
+			old.vbuf.Unref()
+			if !client.disconnected {
+				client.server.countVoiceDrop(client)
+			}
+		default:
+		}
+	}
+}
+
+// Send a queued voice packet, either over UDP or tunneled through
+// the client's TCP connection.
+func (client *Client) sendVoice(msg *Message) (err os.Error) {
 	if client.udp {
-		log.Printf("Sent UDP!")
+		client.capture.voice("out", "udp", msg.buf)
+		client.server.countBytesOut(len(msg.buf))
 		client.server.udpsend <- msg
-	} else {
-		log.Printf("Sent TCP!")
-		msg.kind = MessageUDPTunnel
-		client.msgchan <- msg
+		return
 	}
+
+	msg.kind = MessageUDPTunnel
+	err = client.sendMessage(msg)
+	msg.vbuf.Unref()
+	return
 }
 
 // Send a Message to the client.  The Message in msg to the client's
@@ -354,6 +547,9 @@ func (client *Client) sendUdp(msg *Message) {
 // sender goroutine, since it serializes access to the underlying
 // buffered writer.
 func (client *Client) sendMessage(msg *Message) os.Error {
+	client.capture.control("out", msg.kind, msg.buf)
+	client.server.countBytesOut(6 + len(msg.buf))
+
 	// Write message kind
 	err := binary.Write(client.writer, binary.BigEndian, msg.kind)
 	if err != nil {
@@ -392,12 +588,30 @@ func (client *Client) sender() {
 		client.doneSending <- true
 	}()
 
-	for msg := range client.msgchan {
-		if msg == nil {
-			return
+	// Drop any voice packets left in the queue on shutdown.
+	defer func() {
+		for {
+			select {
+			case msg := <-client.voicechan:
+				msg.vbuf.Unref()
+			default:
+				return
+			}
+		}
+	}()
+
+	for {
+		var err os.Error
+		select {
+		case msg, ok := <-client.msgchan:
+			if !ok || msg == nil {
+				return
+			}
+			err = client.sendMessage(msg)
+		case msg := <-client.voicechan:
+			err = client.sendVoice(msg)
 		}
 
-		err := client.sendMessage(msg)
 		if err != nil {
 			// fixme(mkrautz): This is a deadlock waiting to happen.
 			client.Panic("Unable to send message to client")
@@ -416,10 +630,10 @@ func (client *Client) receiver() {
 			msg, err := client.readProtoMessage()
 			if err != nil {
 				if err == os.EOF {
-					log.Printf("Client disconnected.")
+					client.Printf("Client disconnected.")
 					client.Disconnect()
 				} else {
-					log.Printf("Client error.")
+					client.Printf("Client error.")
 				}
 				return
 			}
@@ -427,7 +641,9 @@ func (client *Client) receiver() {
 			// go through our synchronous path.
 			if msg.kind == MessageUDPTunnel {
 				client.udp = false
-				client.udprecv <- msg.buf
+				if buf := pooledPacket(msg.buf); buf != nil {
+					client.udprecv <- buf
+				}
 			} else {
 				client.server.incoming <- msg
 			}
@@ -461,10 +677,7 @@ func (client *Client) receiver() {
 		// information we must send it our version information so it knows
 		// what version of the protocol it should speak.
 		if client.state == StateClientConnected {
-			client.sendProtoMessage(MessageVersion, &mumbleproto.Version{
-				Version: proto.Uint32(0x10203),
-				Release: proto.String("Grumble"),
-			})
+			client.sendProtoMessage(MessageVersion, client.server.versionMessage())
 			// fixme(mkrautz): Re-add OS information... Does it break anything? It seems like
 			// the client discards the version message if there is no OS information in it.
 			client.state = StateServerSentVersion
@@ -473,10 +686,10 @@ func (client *Client) receiver() {
 			msg, err := client.readProtoMessage()
 			if err != nil {
 				if err == os.EOF {
-					log.Printf("Client disconnected.")
+					client.Printf("Client disconnected.")
 					client.Disconnect()
 				} else {
-					log.Printf("Client error.")
+					client.Printf("Client error.")
 				}
 				return
 			}
@@ -494,6 +707,12 @@ func (client *Client) receiver() {
 				client.Version = 0x10200
 			}
 
+			if version.VersionV2 != nil {
+				client.VersionV2 = *version.VersionV2
+			} else {
+				client.VersionV2 = versionV2FromV1(client.Version)
+			}
+
 			if version.Release != nil {
 				client.ClientName = *version.Release
 			}
@@ -506,9 +725,9 @@ func (client *Client) receiver() {
 				client.OSVersion = *version.OsVersion
 			}
 
-			log.Printf("version = 0x%x", client.Version)
-			log.Printf("os = %s %s", client.OSName, client.OSVersion)
-			log.Printf("client = %s", client.ClientName)
+			client.Printf("version = 0x%x", client.Version)
+			client.Printf("os = %s %s", client.OSName, client.OSVersion)
+			client.Printf("client = %s", client.ClientName)
 
 			client.state = StateClientSentVersion
 		}
@@ -552,6 +771,23 @@ func (client *Client) sendChannelTree(channel *Channel) {
 	}
 	chanstate.Links = links
 
+	if len(channel.listeners) > 0 {
+		chanstate.ListenerCount = proto.Uint32(uint32(len(channel.listeners)))
+	}
+
+	if len(channel.EnterMessage) > 0 {
+		chanstate.EnterMessage = proto.String(channel.EnterMessage)
+	}
+	if len(channel.JoinMessage) > 0 {
+		chanstate.JoinMessage = proto.String(channel.JoinMessage)
+	}
+	if len(channel.LeaveMessage) > 0 {
+		chanstate.LeaveMessage = proto.String(channel.LeaveMessage)
+	}
+	if channel.MaxBitrate > 0 {
+		chanstate.MaxBitrate = proto.Uint32(uint32(channel.MaxBitrate))
+	}
+
 	err := client.sendProtoMessage(MessageChannelState, chanstate)
 	if err != nil {
 		client.Panic(err.String())
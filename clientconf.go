@@ -0,0 +1,116 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the ServerConfig and SuggestConfig messages sent
+// to clients at the end of the sync process. ServerConfig tells clients
+// about the limits enforced by the server, while SuggestConfig lets the
+// server suggest client settings. Both are driven by the server's
+// configuration:
+//
+//	AllowHTML              whether text messages may contain HTML
+//	MaxTextMessageLength   the maximum length of a text message
+//	MaxImageMessageLength  the maximum length of a text message with images
+//	SuggestVersion         the suggested client version, such as "1.2.3"
+//	SuggestPositional      whether clients should enable positional audio
+//	SuggestPushToTalk      whether clients should use push-to-talk
+//
+// The Suggest keys are not sent to clients unless set. Changes made
+// through the control interface are sent to connected clients.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Parse a version string such as "1.2.3" into the format used by
+// the Mumble protocol. Returns 0 for malformed versions.
+func parseVersion(str string) uint32 {
+	parts := strings.Split(str, ".", -1)
+	if len(parts) != 3 {
+		return 0
+	}
+
+	var version uint32
+	for _, part := range parts {
+		num, err := strconv.Atoui(part)
+		if err != nil || num > 0xff {
+			return 0
+		}
+		version = version<<8 | uint32(num)
+	}
+	return version
+}
+
+// Send the server's ServerConfig to client. The welcome text is only
+// included if welcome is set, since clients show the welcome text of
+// every ServerConfig they receive, and the ServerSync sent to a newly
+// connected client already carries it.
+func (server *Server) sendServerConfig(client *Client, welcome bool) os.Error {
+	config := &mumbleproto.ServerConfig{
+		MaxBandwidth:       proto.Uint32(uint32(server.effectiveBitrate(client.Channel))),
+		AllowHtml:          proto.Bool(server.cfg.BoolValue("AllowHTML")),
+		MessageLength:      proto.Uint32(server.cfg.Uint32Value("MaxTextMessageLength")),
+		ImageMessageLength: proto.Uint32(server.cfg.Uint32Value("MaxImageMessageLength")),
+	}
+	if text := server.welcomeTextFor(client); welcome && len(text) > 0 {
+		config.WelcomeText = proto.String(text)
+	}
+	return client.sendProtoMessage(MessageServerConfig, config)
+}
+
+// Send the server's SuggestConfig to client. Nothing is sent if the
+// server has no suggestions.
+func (server *Server) sendSuggestConfig(client *Client) os.Error {
+	suggest := &mumbleproto.SuggestConfig{}
+	send := false
+
+	if version := parseVersion(server.cfg.StringValue("SuggestVersion")); version != 0 {
+		suggest.Version = proto.Uint32(version)
+		send = true
+	}
+	if len(server.cfg.StringValue("SuggestPositional")) > 0 {
+		suggest.Positional = proto.Bool(server.cfg.BoolValue("SuggestPositional"))
+		send = true
+	}
+	if len(server.cfg.StringValue("SuggestPushToTalk")) > 0 {
+		suggest.PushToTalk = proto.Bool(server.cfg.BoolValue("SuggestPushToTalk"))
+		send = true
+	}
+
+	if !send {
+		return nil
+	}
+	return client.sendProtoMessage(MessageSuggestConfig, suggest)
+}
+
+// Send updated ServerConfig and SuggestConfig messages to all connected
+// clients after a change to the configuration key key.
+func (server *Server) configChanged(key string) {
+	switch key {
+	case "AllowPrivateMessages":
+		// The default permissions depend on it.
+		server.ClearACLCache()
+	case "TextBridges":
+		server.startBridges()
+	}
+
+	welcome := key == "WelcomeText"
+	for _, client := range server.clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		if err := server.sendServerConfig(client, welcome); err != nil {
+			client.Panic(err.String())
+			continue
+		}
+		if err := server.sendSuggestConfig(client); err != nil {
+			client.Panic(err.String())
+		}
+	}
+}
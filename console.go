@@ -0,0 +1,370 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the admin console, a line-oriented interface for
+// operators, usable with tools such as nc or socat:
+//
+//	socat - UNIX-CONNECT:$HOME/.grumble/console
+//
+// The console listens on the Unix domain socket given by -consoleaddr,
+// and, if -consoletcp is set, on a TCP address as well. TCP connections
+// must send the password given by -consolepass as their first line; the
+// TCP console is disabled without one. Commands act on the selected
+// virtual server, which can be changed with the server command, and are
+// implemented by the control interface, so they are audited the same way.
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var consoleaddr *string = flag.String("consoleaddr", filepath.Join(os.Getenv("HOME"), ".grumble", "console"), "Unix socket for the admin console. Disabled if empty")
+var consoletcp *string = flag.String("consoletcp", "", "TCP address for the admin console. Disabled if empty")
+var consolepass *string = flag.String("consolepass", "", "Password for the TCP admin console")
+
+const consoleHelp = `commands:
+  server [serverid]               show or select the server
+  who                             list connected users
+  channels                        list channels
+  kick <session> [reason]
+  mute|unmute <session> [minutes]
+  deafen|undeafen <session> [minutes]
+  move <session> <channelid>
+  ban <session> <days> [reason]   ban a user's address and certificate
+  msg <channelid> <message>       send a message to a channel tree
+  reload
+  quit
+`
+
+// A console session.
+type console struct {
+	rw    *bufio.ReadWriter
+	actor string
+	sid   int64
+}
+
+// Start the admin console listeners given by the console flags.
+func ListenConsole() (err os.Error) {
+	if len(*consoleaddr) > 0 {
+		os.Remove(*consoleaddr)
+		l, err := net.Listen("unix", *consoleaddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Admin console listening on %v", *consoleaddr)
+		go acceptConsole(l, false)
+	}
+
+	if len(*consoletcp) > 0 {
+		if len(*consolepass) == 0 {
+			return os.NewError("the TCP admin console needs a -consolepass")
+		}
+		l, err := net.Listen("tcp", *consoletcp)
+		if err != nil {
+			return err
+		}
+		log.Printf("Admin console listening on tcp:%v", *consoletcp)
+		go acceptConsole(l, true)
+	}
+	return nil
+}
+
+func acceptConsole(l net.Listener, auth bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Unable to accept console connection: %v", err.String())
+			return
+		}
+		go serveConsole(conn, auth)
+	}
+}
+
+// Serve a console connection. If auth is set, the connection must send
+// the console password first.
+func serveConsole(conn net.Conn, auth bool) {
+	defer conn.Close()
+
+	con := &console{
+		rw:    bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		actor: "console:" + conn.RemoteAddr().String(),
+	}
+	// Start with the server with the lowest id.
+	for _, server := range allServers() {
+		if con.sid == 0 || server.Id < con.sid {
+			con.sid = server.Id
+		}
+	}
+
+	if auth {
+		con.printf("password: ")
+		line, err := con.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		pass := strings.TrimRight(line, "\r\n")
+		if subtle.ConstantTimeCompare([]byte(pass), []byte(*consolepass)) != 1 {
+			log.Printf("Admin console: wrong password from %v", conn.RemoteAddr())
+			// Slow down password guessing.
+			time.Sleep(1e9)
+			con.printf("wrong password\n")
+			return
+		}
+	}
+
+	for {
+		con.printf("grumble %v> ", con.sid)
+		line, err := con.rw.ReadString('\n')
+		if err != nil {
+			if err != os.EOF {
+				log.Printf("Admin console: %v", err.String())
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return
+		}
+		err = con.run(fields[0], fields[1:])
+		if err != nil {
+			con.printf("error: %v\n", err.String())
+		}
+	}
+}
+
+func (con *console) printf(format string, args ...interface{}) {
+	fmt.Fprintf(con.rw, format, args...)
+	con.rw.Flush()
+}
+
+var errConsoleUsage = os.NewError("invalid arguments, try help")
+
+// Parse the session argument of a console command.
+func consoleSession(arg string) (uint32, os.Error) {
+	session, err := strconv.Atoui(arg)
+	if err != nil {
+		return 0, errConsoleUsage
+	}
+	return uint32(session), nil
+}
+
+// Run a console command.
+func (con *console) run(cmd string, args []string) (err os.Error) {
+	ctl := new(ControlRPC)
+	var ok bool
+
+	switch cmd {
+	case "help":
+		con.printf("%v", consoleHelp)
+
+	case "server":
+		if len(args) > 0 {
+			sid, err := strconv.Atoi64(args[0])
+			if err != nil {
+				return errConsoleUsage
+			}
+			if _, err = lookupServer(sid); err != nil {
+				return err
+			}
+			con.sid = sid
+		}
+		con.printf("server %v\n", con.sid)
+
+	case "who":
+		return con.who()
+
+	case "channels":
+		return con.channels()
+
+	case "kick", "mute", "unmute", "deafen", "undeafen":
+		if len(args) < 1 {
+			return errConsoleUsage
+		}
+		ma := &ModerateArgs{ServerId: con.sid, Actor: con.actor}
+		if ma.Session, err = consoleSession(args[0]); err != nil {
+			return err
+		}
+		switch cmd {
+		case "kick":
+			ma.Reason = strings.Join(args[1:], " ")
+			err = ctl.KickUser(ma, &ok)
+		case "mute", "unmute", "deafen", "undeafen":
+			ma.Enable = cmd == "mute" || cmd == "deafen"
+			if ma.Enable && len(args) > 1 {
+				minutes, err := strconv.Atoi(args[1])
+				if err != nil || minutes < 0 {
+					return errConsoleUsage
+				}
+				ma.Duration = int64(minutes) * 60
+			}
+			if cmd == "mute" || cmd == "unmute" {
+				err = ctl.MuteUser(ma, &ok)
+			} else {
+				err = ctl.DeafenUser(ma, &ok)
+			}
+		}
+		return err
+
+	case "move":
+		if len(args) < 2 {
+			return errConsoleUsage
+		}
+		ma := &ModerateArgs{ServerId: con.sid, Actor: con.actor}
+		if ma.Session, err = consoleSession(args[0]); err != nil {
+			return err
+		}
+		if ma.ChannelId, err = strconv.Atoi(args[1]); err != nil {
+			return errConsoleUsage
+		}
+		return ctl.MoveUser(ma, &ok)
+
+	case "ban":
+		if len(args) < 2 {
+			return errConsoleUsage
+		}
+		return con.ban(args)
+
+	case "msg":
+		if len(args) < 2 {
+			return errConsoleUsage
+		}
+		ba := &BroadcastArgs{
+			ServerId: con.sid,
+			Actor:    con.actor,
+			Message:  strings.Join(args[1:], " "),
+		}
+		if ba.ChannelId, err = strconv.Atoi(args[0]); err != nil {
+			return errConsoleUsage
+		}
+		var n int
+		if err = ctl.Broadcast(ba, &n); err != nil {
+			return err
+		}
+		con.printf("sent to %v users\n", n)
+
+	case "reload":
+		return ctl.Reload(&ReloadArgs{ServerId: con.sid}, &ok)
+
+	default:
+		return os.NewError("unknown command " + cmd + ", try help")
+	}
+	return nil
+}
+
+// List the users connected to the selected server.
+func (con *console) who() os.Error {
+	server, err := lookupServer(con.sid)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	server.syncCall(func() {
+		for _, client := range server.clients {
+			if client.state != StateClientReady {
+				continue
+			}
+			flags := ""
+			if client.IsRegistered() {
+				flags += "R"
+			}
+			if client.Mute || client.SelfMute {
+				flags += "M"
+			}
+			if client.Deaf || client.SelfDeaf {
+				flags += "D"
+			}
+			lines = append(lines, fmt.Sprintf("%6v  %-32v  %4v  %-3v  %v", client.Session, client.ShownName(), client.Channel.Id, flags, client.tcpaddr))
+		}
+	})
+	sort.SortStrings(lines)
+	for _, line := range lines {
+		con.printf("%v\n", line)
+	}
+	con.printf("(%v users)\n", len(lines))
+	return nil
+}
+
+// List the channels of the selected server as a tree.
+func (con *console) channels() os.Error {
+	server, err := lookupServer(con.sid)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	var walk func(channel *Channel, depth int)
+	walk = func(channel *Channel, depth int) {
+		lines = append(lines, fmt.Sprintf("%6v  %v%v (%v users)", channel.Id, strings.Repeat("  ", depth), channel.Name, len(channel.clients)))
+		ids := []int{}
+		for id, _ := range channel.children {
+			ids = append(ids, id)
+		}
+		sort.SortInts(ids)
+		for _, id := range ids {
+			walk(channel.children[id], depth+1)
+		}
+	}
+	server.syncCall(func() {
+		walk(server.root, 0)
+	})
+	for _, line := range lines {
+		con.printf("%v\n", line)
+	}
+	return nil
+}
+
+// Ban the address and certificate of a connected user of the selected
+// server. The ban disconnects the user.
+func (con *console) ban(args []string) (err os.Error) {
+	server, err := lookupServer(con.sid)
+	if err != nil {
+		return err
+	}
+	session, err := consoleSession(args[0])
+	if err != nil {
+		return err
+	}
+	days, err := strconv.Atoi(args[1])
+	if err != nil || days < 0 {
+		return errConsoleUsage
+	}
+
+	ba := &GlobalBanArgs{
+		Duration: int64(days) * 86400,
+		Reason:   strings.Join(args[2:], " "),
+	}
+	server.syncCall(func() {
+		client, ok := server.clients[session]
+		if !ok {
+			err = ErrNoSuchSession
+			return
+		}
+		ba.Address = client.tcpaddr.IP.String()
+		ba.CertHash = client.CertHash
+		ba.Name = client.ShownName()
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Audit: %v: ban session %v (%v) on server %v", con.actor, session, ba.Name, server.Id)
+	var ban Ban
+	return new(ControlRPC).AddGlobalBan(ba, &ban)
+}
@@ -0,0 +1,628 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the 'grumble ctl' command, a small command line
+// client for Grumble's control interface.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func ctlUsage() {
+	fmt.Fprintf(os.Stderr, "usage: grumble [options] ctl <command> [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  users <serverid> [name [offset [limit]]]\n")
+	fmt.Fprintf(os.Stderr, "  config <serverid> <key> [value]\n")
+	fmt.Fprintf(os.Stderr, "  resetconfig <serverid> <key>\n")
+	fmt.Fprintf(os.Stderr, "  welcome <serverid> [file|-]\n")
+	fmt.Fprintf(os.Stderr, "  prune <serverid> <days>\n")
+	fmt.Fprintf(os.Stderr, "  export <serverid> [file]\n")
+	fmt.Fprintf(os.Stderr, "  import <serverid> <file> [skip|update]\n")
+	fmt.Fprintf(os.Stderr, "  kick <serverid> <session> [reason]\n")
+	fmt.Fprintf(os.Stderr, "  move <serverid> <session> <channelid>\n")
+	fmt.Fprintf(os.Stderr, "  mute|unmute <serverid> <session> [minutes]\n")
+	fmt.Fprintf(os.Stderr, "  deafen|undeafen <serverid> <session> [minutes]\n")
+	fmt.Fprintf(os.Stderr, "  priority|unpriority <serverid> <session>\n")
+	fmt.Fprintf(os.Stderr, "  bans\n")
+	fmt.Fprintf(os.Stderr, "  ban <address[/prefix]|certhash> <days> [reason]\n")
+	fmt.Fprintf(os.Stderr, "  unban <index>\n")
+	fmt.Fprintf(os.Stderr, "  cert\n")
+	fmt.Fprintf(os.Stderr, "  totp <serverid> [off]\n")
+	fmt.Fprintf(os.Stderr, "  reload <serverid>\n")
+	fmt.Fprintf(os.Stderr, "  invite <serverid> <channelid> [uses [hours [host]]]\n")
+	fmt.Fprintf(os.Stderr, "  uninvite <serverid> <token>\n")
+	fmt.Fprintf(os.Stderr, "  broadcast <serverid> <channelid> <message>\n")
+	fmt.Fprintf(os.Stderr, "  meta <serverid> <userid> <namespace> [key [value|-]]\n")
+	fmt.Fprintf(os.Stderr, "  capture <serverid> <session> <seconds|off>\n")
+	fmt.Fprintf(os.Stderr, "  usage <serverid> <day|week> [count]\n")
+	fmt.Fprintf(os.Stderr, "  checkperm <serverid> <channelid> <session|user:userid>\n")
+	fmt.Fprintf(os.Stderr, "  upgrade\n")
+	fmt.Fprintf(os.Stderr, "  templates\n")
+	fmt.Fprintf(os.Stderr, "  template <serverid> <name> [users]\n")
+	fmt.Fprintf(os.Stderr, "  create <template>\n")
+	fmt.Fprintf(os.Stderr, "  clone <serverid> [users]\n")
+}
+
+func ctlFatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "grumble ctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Parse the server id argument of a ctl command.
+func ctlServerId(arg string) int64 {
+	sid, err := strconv.Atoi64(arg)
+	if err != nil {
+		ctlFatal("invalid server id: %v", arg)
+	}
+	return sid
+}
+
+// Parse an optional integer argument at index i of args.
+func ctlIntArg(args []string, i int, def int) int {
+	if len(args) <= i {
+		return def
+	}
+	val, err := strconv.Atoi(args[i])
+	if err != nil {
+		ctlFatal("invalid number: %v", args[i])
+	}
+	return val
+}
+
+// Moderation commands and the ControlRPC methods implementing them,
+// along with the value of ModerateArgs.Enable for toggles.
+type ctlModeration struct {
+	method string
+	enable bool
+}
+
+var ctlModerationCommands = map[string]ctlModeration{
+	"kick":       ctlModeration{"ControlRPC.KickUser", false},
+	"move":       ctlModeration{"ControlRPC.MoveUser", false},
+	"mute":       ctlModeration{"ControlRPC.MuteUser", true},
+	"unmute":     ctlModeration{"ControlRPC.MuteUser", false},
+	"deafen":     ctlModeration{"ControlRPC.DeafenUser", true},
+	"undeafen":   ctlModeration{"ControlRPC.DeafenUser", false},
+	"priority":   ctlModeration{"ControlRPC.PrioritizeUser", true},
+	"unpriority": ctlModeration{"ControlRPC.PrioritizeUser", false},
+}
+
+// Format a timestamp for display.
+func ctlTime(secs uint64) string {
+	if secs == 0 {
+		return "never"
+	}
+	return time.SecondsToLocalTime(int64(secs)).String()
+}
+
+// Run a ctl command against a running Grumble instance.
+func GrumbleCtl(args []string) {
+	if len(args) == 0 {
+		ctlUsage()
+		os.Exit(1)
+	}
+
+	client, err := DialControlRPC()
+	if err != nil {
+		ctlFatal("unable to connect to %v:%v: %v", *ctlnet, *ctladdr, err.String())
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "users":
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ua := &UserListArgs{ServerId: ctlServerId(args[1])}
+		if len(args) > 2 {
+			ua.Name = args[2]
+		}
+		ua.Offset = ctlIntArg(args, 3, 0)
+		ua.Limit = ctlIntArg(args, 4, 0)
+
+		reply := &UserListReply{}
+		err = client.Call("ControlRPC.ListUsers", ua, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+		for _, user := range reply.Users {
+			fmt.Printf("%6v  %-32v  %6v  %v\n", user.Id, user.Name, user.LastChannelId, ctlTime(user.LastActive))
+			fmt.Printf("        connected %v, disconnected %v\n", ctlTime(user.LastConnect), ctlTime(user.LastDisconnect))
+		}
+		fmt.Printf("(%v of %v users)\n", len(reply.Users), reply.Total)
+
+	case "config":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ca := &ConfigArgs{ServerId: ctlServerId(args[1]), Key: args[2]}
+		method := "ControlRPC.GetConfig"
+		if len(args) > 3 {
+			ca.Value = args[3]
+			method = "ControlRPC.SetConfig"
+		}
+
+		reply := &ConfigArgs{}
+		err = client.Call(method, ca, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("%v = %v\n", reply.Key, reply.Value)
+
+	case "resetconfig":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ca := &ConfigArgs{ServerId: ctlServerId(args[1]), Key: args[2]}
+		reply := &ConfigArgs{}
+		err = client.Call("ControlRPC.ResetConfig", ca, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("%v = %v\n", reply.Key, reply.Value)
+
+	case "welcome":
+		// The welcome text is usually too long to conveniently pass
+		// as an argument to 'config', so it is read from a file, or
+		// from standard input if the file is '-'.
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ca := &ConfigArgs{ServerId: ctlServerId(args[1]), Key: "WelcomeText"}
+		method := "ControlRPC.GetConfig"
+		if len(args) > 2 {
+			var buf []byte
+			if args[2] == "-" {
+				buf, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				buf, err = ioutil.ReadFile(args[2])
+			}
+			if err != nil {
+				ctlFatal("%v", err.String())
+			}
+			ca.Value = strings.TrimSpace(string(buf))
+			method = "ControlRPC.SetConfig"
+		}
+
+		reply := &ConfigArgs{}
+		err = client.Call(method, ca, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("%v\n", reply.Value)
+
+	case "prune":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		pa := &PruneUsersArgs{ServerId: ctlServerId(args[1]), MaxIdleDays: ctlIntArg(args, 2, 0)}
+		reply := &PruneUsersReply{}
+		err = client.Call("ControlRPC.PruneUsers", pa, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for _, user := range reply.Pruned {
+			fmt.Printf("%6v  %-32v  %v\n", user.Id, user.Name, ctlTime(user.LastActive))
+		}
+		fmt.Printf("(%v users pruned)\n", len(reply.Pruned))
+
+	case "export":
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		reply := []ExportedUser{}
+		err = client.Call("ControlRPC.ExportUsers", &UserListArgs{ServerId: ctlServerId(args[1])}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+		out := os.Stdout
+		if len(args) > 2 {
+			out, err = os.Create(args[2])
+			if err != nil {
+				ctlFatal("%v", err.String())
+			}
+			defer out.Close()
+		}
+		err = WriteUserCSV(out, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "import":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		f, err := os.Open(args[2])
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		users, err := ReadUserCSV(f)
+		f.Close()
+		if err != nil {
+			ctlFatal("%v: %v", args[2], err.String())
+		}
+
+		ia := &ImportUsersArgs{ServerId: ctlServerId(args[1]), Users: users}
+		if len(args) > 3 {
+			ia.Conflict = args[3]
+		}
+		reply := &ImportUsersReply{}
+		err = client.Call("ControlRPC.ImportUsers", ia, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for _, skipped := range reply.Skipped {
+			fmt.Printf("skipped %v\n", skipped)
+		}
+		fmt.Printf("(%v added, %v updated, %v skipped)\n", reply.Added, reply.Updated, len(reply.Skipped))
+
+	case "bans":
+		reply := []Ban{}
+		err = client.Call("ControlRPC.ListGlobalBans", &GlobalBanArgs{}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for i, ban := range reply {
+			target := ban.CertHash
+			if ban.IP != nil {
+				target = fmt.Sprintf("%v/%v", ban.IP, ban.Mask)
+			}
+			expiry := "never"
+			if ban.Duration > 0 {
+				expiry = ctlTime(uint64(ban.Start + ban.Duration))
+			}
+			fmt.Printf("%4v  %-40v  expires %v  %v\n", i, target, expiry, ban.Reason)
+		}
+		fmt.Printf("(%v bans)\n", len(reply))
+
+	case "ban":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ba := &GlobalBanArgs{Duration: int64(ctlIntArg(args, 2, 0)) * 86400}
+		if strings.IndexAny(args[1], ".:") >= 0 {
+			ba.Address = args[1]
+		} else {
+			ba.CertHash = args[1]
+		}
+		if len(args) > 3 {
+			ba.Reason = strings.Join(args[3:], " ")
+		}
+		reply := &Ban{}
+		err = client.Call("ControlRPC.AddGlobalBan", ba, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "unban":
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		var reply bool
+		err = client.Call("ControlRPC.RemoveGlobalBan", &GlobalBanArgs{Index: ctlIntArg(args, 1, -1)}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "broadcast":
+		if len(args) < 4 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ba := &BroadcastArgs{
+			ServerId:  ctlServerId(args[1]),
+			ChannelId: ctlIntArg(args, 2, 0),
+			Actor:     "ctl:" + os.Getenv("USER"),
+			Message:   strings.Join(args[3:], " "),
+		}
+		var reply int
+		err = client.Call("ControlRPC.Broadcast", ba, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("(sent to %v users)\n", reply)
+
+	case "reload":
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		var reply bool
+		err = client.Call("ControlRPC.Reload", &ReloadArgs{ServerId: ctlServerId(args[1])}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "invite":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ia := &InviteArgs{
+			ServerId:  ctlServerId(args[1]),
+			ChannelId: ctlIntArg(args, 2, 0),
+			Uses:      ctlIntArg(args, 3, 1),
+			Duration:  int64(ctlIntArg(args, 4, 0)) * 3600,
+		}
+		if len(args) > 5 {
+			ia.Host = args[5]
+		}
+		reply := &InviteReply{}
+		err = client.Call("ControlRPC.CreateInvite", ia, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("%v\n", reply.URL)
+
+	case "uninvite":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		var reply bool
+		err = client.Call("ControlRPC.RevokeInvite", &InviteArgs{ServerId: ctlServerId(args[1]), Token: args[2]}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "totp":
+		if len(args) < 2 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ta := &TOTPArgs{ServerId: ctlServerId(args[1]), Disable: len(args) > 2 && args[2] == "off"}
+		reply := &TOTPReply{}
+		err = client.Call("ControlRPC.SetupTOTP", ta, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		if !ta.Disable {
+			fmt.Printf("secret %v\n%v\n", reply.Secret, reply.URI)
+		}
+
+	case "meta":
+		if len(args) < 4 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		uid := ctlIntArg(args, 2, 0)
+		if uid < 0 {
+			ctlFatal("invalid user id: %v", args[2])
+		}
+		ma := &UserMetadataArgs{
+			ServerId:  ctlServerId(args[1]),
+			UserId:    uint32(uid),
+			Namespace: args[3],
+			Actor:     "ctl:" + os.Getenv("USER"),
+		}
+		if len(args) > 5 {
+			ma.Key = args[4]
+			if args[5] != "-" {
+				ma.Value = strings.Join(args[5:], " ")
+			}
+			var reply bool
+			err = client.Call("ControlRPC.SetUserMetadata", ma, &reply)
+			if err != nil {
+				ctlFatal("%v", err.String())
+			}
+			break
+		}
+
+		reply := make(map[string]string)
+		err = client.Call("ControlRPC.GetUserMetadata", ma, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		keys := []string{}
+		for key, _ := range reply {
+			if len(args) < 5 || key == args[4] {
+				keys = append(keys, key)
+			}
+		}
+		sort.SortStrings(keys)
+		for _, key := range keys {
+			fmt.Printf("%v=%v\n", key, reply[key])
+		}
+
+	case "capture":
+		if len(args) < 4 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		session, err := strconv.Atoui(args[2])
+		if err != nil {
+			ctlFatal("invalid session: %v", args[2])
+		}
+		ca := &CaptureArgs{
+			ServerId: ctlServerId(args[1]),
+			Session:  uint32(session),
+			Actor:    "ctl:" + os.Getenv("USER"),
+		}
+		if args[3] != "off" {
+			ca.Duration = int64(ctlIntArg(args, 3, 0))
+			if ca.Duration <= 0 {
+				ctlFatal("invalid duration: %v", args[3])
+			}
+		}
+		var reply string
+		err = client.Call("ControlRPC.CaptureSession", ca, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		if len(reply) > 0 {
+			fmt.Printf("capturing to %v\n", reply)
+		}
+
+	case "usage":
+		if len(args) < 3 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ua := &UsageArgs{
+			ServerId: ctlServerId(args[1]),
+			Period:   args[2],
+			Count:    ctlIntArg(args, 3, 7),
+		}
+		reply := []UsagePeak{}
+		err = client.Call("ControlRPC.UsagePeaks", ua, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for _, peak := range reply {
+			fmt.Printf("%v  %5v users  %5v channels  %12v bytes in  %12v bytes out\n",
+				ctlTime(uint64(peak.Start)), peak.PeakUsers, peak.ActiveChannels, peak.BytesIn, peak.BytesOut)
+		}
+
+	case "checkperm":
+		if len(args) < 4 {
+			ctlUsage()
+			os.Exit(1)
+		}
+		pa := &PermissionCheckArgs{
+			ServerId:  ctlServerId(args[1]),
+			ChannelId: ctlIntArg(args, 2, 0),
+		}
+		if strings.HasPrefix(args[3], "user:") {
+			uid, err := strconv.Atoui(args[3][5:])
+			if err != nil {
+				ctlFatal("invalid user id: %v", args[3])
+			}
+			pa.UserId = uint32(uid)
+		} else {
+			session, err := strconv.Atoui(args[3])
+			if err != nil || session == 0 {
+				ctlFatal("invalid session: %v", args[3])
+			}
+			pa.Session = uint32(session)
+		}
+		reply := &PermissionCheck{}
+		err = client.Call("ControlRPC.CheckPermissions", pa, reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for _, match := range reply.Matches {
+			who := match.Group
+			if match.UserId >= 0 {
+				who = fmt.Sprintf("user %v", match.UserId)
+			}
+			applied := ""
+			if !match.Applied {
+				applied = " (not applied)"
+			}
+			fmt.Printf("channel %v: %v here=%v subs=%v allow=%v deny=%v%v\n", match.ChannelId, who,
+				match.ApplyHere, match.ApplySubs, Permission(match.Allow).Names(), Permission(match.Deny).Names(), applied)
+		}
+		if len(reply.Override) > 0 {
+			fmt.Printf("overridden: %v\n", reply.Override)
+		}
+		fmt.Printf("permissions 0x%x: %v\n", reply.Permissions, reply.Names)
+
+	case "upgrade":
+		var reply bool
+		err = client.Call("ControlRPC.Upgrade", new(int), &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "templates":
+		reply := []string{}
+		err = client.Call("ControlRPC.ListTemplates", &TemplateArgs{}, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		for _, name := range reply {
+			fmt.Printf("%v\n", name)
+		}
+
+	case "template", "create", "clone":
+		if len(args) < 2 || (args[0] == "template" && len(args) < 3) {
+			ctlUsage()
+			os.Exit(1)
+		}
+		ta := &TemplateArgs{}
+		switch args[0] {
+		case "template":
+			ta.ServerId = ctlServerId(args[1])
+			ta.Template = args[2]
+			ta.IncludeUsers = len(args) > 3 && args[3] == "users"
+			var reply bool
+			err = client.Call("ControlRPC.SaveTemplate", ta, &reply)
+		case "create", "clone":
+			if args[0] == "create" {
+				ta.Template = args[1]
+			} else {
+				ta.ServerId = ctlServerId(args[1])
+				ta.IncludeUsers = len(args) > 2 && args[2] == "users"
+			}
+			var reply int64
+			err = client.Call("ControlRPC.CreateServer", ta, &reply)
+			if err == nil {
+				fmt.Printf("created server %v\n", reply)
+			}
+		}
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+
+	case "cert":
+		reply := &CertificateReply{}
+		err = client.Call("ControlRPC.CertificateExpiry", new(int), reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+		fmt.Printf("expires %v (%v days)\n", ctlTime(uint64(reply.Expiry)), reply.DaysRemaining)
+
+	default:
+		cmd, ok := ctlModerationCommands[args[0]]
+		if !ok || len(args) < 3 || (args[0] == "move" && len(args) < 4) {
+			ctlUsage()
+			os.Exit(1)
+		}
+
+		session, err := strconv.Atoui(args[2])
+		if err != nil {
+			ctlFatal("invalid session: %v", args[2])
+		}
+		ma := &ModerateArgs{
+			ServerId: ctlServerId(args[1]),
+			Session:  uint32(session),
+			Actor:    "ctl:" + os.Getenv("USER"),
+			Enable:   cmd.enable,
+		}
+		if args[0] == "kick" && len(args) > 3 {
+			ma.Reason = strings.Join(args[3:], " ")
+		}
+		if args[0] == "move" {
+			ma.ChannelId = ctlIntArg(args, 3, 0)
+		}
+		if args[0] == "mute" || args[0] == "deafen" {
+			ma.Duration = int64(ctlIntArg(args, 3, 0)) * 60
+		}
+
+		var reply bool
+		err = client.Call(cmd.method, ma, &reply)
+		if err != nil {
+			ctlFatal("%v", err.String())
+		}
+	}
+}
@@ -0,0 +1,1072 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements Grumble's control interface. It is exposed over
+// a local socket (see the -ctlnet and -ctladdr flags) using the rpc
+// package, and is meant to be used by 'grumble ctl' and external
+// management tools. On networks other than unix, which have no file
+// permissions to restrict access with, connections must send the
+// password given by -ctlpass as their first line before making calls.
+
+import (
+	"crypto/subtle"
+	"goprotobuf.googlecode.com/hg/proto"
+	"log"
+	"mumbleproto"
+	"net"
+	"os"
+	"rpc"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The default and maximum number of users returned by a single
+// ListUsers call.
+const (
+	DefaultUserListLimit = 50
+	MaxUserListLimit     = 1000
+)
+
+var (
+	ErrNoSuchServer  = os.NewError("no such server")
+	ErrNoSuchSession = os.NewError("no such session")
+	ErrNoSuchChannel = os.NewError("no such channel")
+)
+
+type ControlRPC struct{}
+
+// The maximum length of the password line of a control connection.
+const maxControlPasswordLength = 256
+
+// Listen for control connections on the given network and address.
+// For Unix domain sockets, a stale socket file is removed before
+// attempting to listen. Other networks need a -ctlpass.
+func ListenControlRPC(network, addr string) (err os.Error) {
+	auth := network != "unix"
+	if auth && len(*ctlpass) == 0 {
+		return os.NewError("the control interface on " + network + " needs a -ctlpass")
+	}
+	if network == "unix" {
+		os.Remove(addr)
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	srv := rpc.NewServer()
+	err = srv.Register(new(ControlRPC))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Control interface listening on %v:%v", network, addr)
+	go acceptControl(srv, l, auth)
+
+	return nil
+}
+
+// Serve control connections accepted on l. If auth is set, connections
+// must send the control password first.
+func acceptControl(srv *rpc.Server, l net.Listener, auth bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Unable to accept control connection: %v", err.String())
+			return
+		}
+		if !auth {
+			go srv.ServeConn(conn)
+			continue
+		}
+		go func(conn net.Conn) {
+			if !checkControlPassword(conn) {
+				conn.Close()
+				return
+			}
+			srv.ServeConn(conn)
+		}(conn)
+	}
+}
+
+// Read the password line of a control connection and check it. The line
+// is read a byte at a time, so nothing meant for the rpc server is read
+// along with it.
+func checkControlPassword(conn net.Conn) bool {
+	line := make([]byte, 0, maxControlPasswordLength)
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return false
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return false
+		}
+		line = append(line, b[0])
+	}
+	pass := strings.TrimRight(string(line), "\r")
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(*ctlpass)) != 1 {
+		log.Printf("Control interface: wrong password from %v", conn.RemoteAddr())
+		// Slow down password guessing.
+		time.Sleep(1e9)
+		return false
+	}
+	return true
+}
+
+// Connect to the control interface given by the -ctlnet and -ctladdr
+// flags, sending the -ctlpass if the network needs one.
+func DialControlRPC() (client *rpc.Client, err os.Error) {
+	if *ctlnet == "unix" {
+		return rpc.Dial(*ctlnet, *ctladdr)
+	}
+	if len(*ctlpass) == 0 {
+		return nil, os.NewError("the control interface on " + *ctlnet + " needs a -ctlpass")
+	}
+	conn, err := net.Dial(*ctlnet, *ctladdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(*ctlpass + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Look up the Server with the given id.
+func lookupServer(id int64) (server *Server, err os.Error) {
+	serversMutex.RLock()
+	server, exists := servers[id]
+	serversMutex.RUnlock()
+	if !exists {
+		return nil, ErrNoSuchServer
+	}
+	return server, nil
+}
+
+type UserListArgs struct {
+	ServerId int64
+
+	// Only include users whose name contains this string
+	// (case-insensitive). An empty string matches all users.
+	Name string
+
+	// Only include users last seen before or after the given
+	// Unix timestamps. A value of 0 disables the filter.
+	SeenBefore int64
+	SeenAfter  int64
+
+	// Pagination
+	Offset int
+	Limit  int
+}
+
+type RegisteredUser struct {
+	Id             uint32
+	Name           string
+	LastChannelId  int
+	LastActive     uint64
+	LastConnect    uint64
+	LastDisconnect uint64
+	TalkTime       uint64
+	VoicePackets   uint64
+}
+
+// Convert a User into a RegisteredUser.
+func registeredUser(user *User) RegisteredUser {
+	return RegisteredUser{
+		Id:             user.Id,
+		Name:           user.Name,
+		LastChannelId:  user.LastChannelId,
+		LastActive:     user.LastActive,
+		LastConnect:    user.LastConnect,
+		LastDisconnect: user.LastDisconnect,
+		TalkTime:       user.TalkTime,
+		VoicePackets:   user.VoicePackets,
+	}
+}
+
+type UserListReply struct {
+	// The total number of users matching the filters, regardless
+	// of pagination.
+	Total int
+	Users []RegisteredUser
+}
+
+// Sort users by their user id, to keep pagination stable.
+type userIdSlice []*User
+
+func (s userIdSlice) Len() int           { return len(s) }
+func (s userIdSlice) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s userIdSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// List and search the registered users of a server.
+func (c *ControlRPC) ListUsers(args *UserListArgs, reply *UserListReply) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = DefaultUserListLimit
+	} else if limit > MaxUserListLimit {
+		limit = MaxUserListLimit
+	}
+
+	offset := args.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	name := strings.ToLower(args.Name)
+
+	server.syncCall(func() {
+		matches := userIdSlice{}
+		for _, user := range server.Users {
+			if len(name) > 0 && !strings.Contains(strings.ToLower(user.Name), name) {
+				continue
+			}
+			if args.SeenBefore > 0 && int64(user.LastActive) >= args.SeenBefore {
+				continue
+			}
+			if args.SeenAfter > 0 && int64(user.LastActive) <= args.SeenAfter {
+				continue
+			}
+			matches = append(matches, user)
+		}
+		sort.Sort(matches)
+
+		reply.Total = len(matches)
+		reply.Users = []RegisteredUser{}
+		for i := offset; i < len(matches) && i < offset+limit; i++ {
+			reply.Users = append(reply.Users, registeredUser(matches[i]))
+		}
+	})
+
+	return nil
+}
+
+type ConfigArgs struct {
+	ServerId int64
+	Key      string
+	Value    string
+}
+
+// Get the value of a configuration key on a server.
+func (c *ControlRPC) GetConfig(args *ConfigArgs, reply *ConfigArgs) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	reply.ServerId = args.ServerId
+	reply.Key = args.Key
+	reply.Value = server.cfg.StringValue(args.Key)
+	return nil
+}
+
+// Set a configuration key on a server.
+func (c *ControlRPC) SetConfig(args *ConfigArgs, reply *ConfigArgs) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.cfg.Set(args.Key, args.Value)
+	server.syncCall(func() {
+		server.configChanged(args.Key)
+	})
+	*reply = *args
+	return nil
+}
+
+// Reset a configuration key on a server to its default value.
+func (c *ControlRPC) ResetConfig(args *ConfigArgs, reply *ConfigArgs) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.cfg.Reset(args.Key)
+	server.syncCall(func() {
+		server.configChanged(args.Key)
+	})
+	reply.ServerId = args.ServerId
+	reply.Key = args.Key
+	reply.Value = server.cfg.StringValue(args.Key)
+	return nil
+}
+
+type PruneUsersArgs struct {
+	ServerId int64
+
+	// Remove registrations idle for more than this many days.
+	MaxIdleDays int
+}
+
+type PruneUsersReply struct {
+	Pruned []RegisteredUser
+}
+
+// Remove the registrations of users that have been idle for too long.
+func (c *ControlRPC) PruneUsers(args *PruneUsersArgs, reply *PruneUsersReply) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+	if args.MaxIdleDays <= 0 {
+		return os.NewError("invalid idle age")
+	}
+
+	server.syncCall(func() {
+		reply.Pruned = []RegisteredUser{}
+		for _, user := range server.PruneRegistrations(args.MaxIdleDays) {
+			reply.Pruned = append(reply.Pruned, registeredUser(user))
+		}
+	})
+
+	return nil
+}
+
+// Arguments of the user moderation calls. Every moderation action is
+// written to the log, along with the Actor that requested it.
+type ModerateArgs struct {
+	ServerId int64
+	Session  uint32
+
+	// The person or system requesting the action, such as the name
+	// of a web panel user or a chat bridge.
+	Actor string
+
+	// The reason shown to a kicked user.
+	Reason string
+
+	// The channel to move the user to.
+	ChannelId int
+
+	// Whether to set or clear the mute, deafen or priority speaker
+	// state.
+	Enable bool
+
+	// How long a mute or deafen lasts, in seconds. Zero makes it last
+	// until it is undone. See timedmute.go.
+	Duration int64
+}
+
+// Run fn on the client given by args in the server's handler goroutine,
+// and log the action if it succeeds.
+func moderate(args *ModerateArgs, action string, fn func(server *Server, target *Client) os.Error) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		target, ok := server.clients[args.Session]
+		if !ok {
+			err = ErrNoSuchSession
+			return
+		}
+		name := target.ShownName()
+		err = fn(server, target)
+		if err == nil {
+			target.Printf("Audit: %v: %v session %v (%v) on server %v", args.Actor, action, args.Session, name, server.Id)
+		}
+	})
+
+	return err
+}
+
+// Pick the name of a moderation action that can be undone.
+func toggleAction(enable bool, on, off string) string {
+	if enable {
+		return on
+	}
+	return off
+}
+
+// Kick a connected user.
+func (c *ControlRPC) KickUser(args *ModerateArgs, reply *bool) os.Error {
+	return moderate(args, "kick", func(server *Server, target *Client) os.Error {
+		userremove := &mumbleproto.UserRemove{Session: proto.Uint32(target.Session)}
+		if len(args.Reason) > 0 {
+			userremove.Reason = proto.String(args.Reason)
+		}
+		err := server.broadcastProtoMessage(MessageUserRemove, userremove)
+		if err != nil {
+			return err
+		}
+		target.ForceDisconnect()
+		*reply = true
+		return nil
+	})
+}
+
+// Move a connected user to another channel.
+func (c *ControlRPC) MoveUser(args *ModerateArgs, reply *bool) os.Error {
+	return moderate(args, "move", func(server *Server, target *Client) os.Error {
+		channel, ok := server.Channels[args.ChannelId]
+		if !ok {
+			return ErrNoSuchChannel
+		}
+		userstate := &mumbleproto.UserState{
+			Session:   proto.Uint32(target.Session),
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		}
+		server.userEnterChannel(target, channel, userstate)
+		*reply = true
+		return server.broadcastProtoMessage(MessageUserState, userstate)
+	})
+}
+
+// Mute or unmute a connected user, optionally for a limited time.
+// Unmuting a user also undeafens them.
+func (c *ControlRPC) MuteUser(args *ModerateArgs, reply *bool) os.Error {
+	return moderate(args, toggleAction(args.Enable, "mute", "unmute"), func(server *Server, target *Client) os.Error {
+		userstate := &mumbleproto.UserState{
+			Session: proto.Uint32(target.Session),
+			Mute:    proto.Bool(args.Enable),
+		}
+		if args.Enable {
+			server.setTimedMute(target, false, args.Duration, args.Actor)
+		} else {
+			target.setMuteExpiry(0, 0)
+		}
+		target.Mute = args.Enable
+		if !target.Mute {
+			target.Deaf = false
+			userstate.Deaf = proto.Bool(false)
+		}
+		*reply = true
+		return server.broadcastProtoMessage(MessageUserState, userstate)
+	})
+}
+
+// Deafen or undeafen a connected user, optionally for a limited time.
+// Deafening a user also mutes them.
+func (c *ControlRPC) DeafenUser(args *ModerateArgs, reply *bool) os.Error {
+	return moderate(args, toggleAction(args.Enable, "deafen", "undeafen"), func(server *Server, target *Client) os.Error {
+		userstate := &mumbleproto.UserState{
+			Session: proto.Uint32(target.Session),
+			Deaf:    proto.Bool(args.Enable),
+		}
+		if args.Enable {
+			server.setTimedMute(target, true, args.Duration, args.Actor)
+		} else {
+			target.setMuteExpiry(target.muteExpiry, 0)
+		}
+		target.Deaf = args.Enable
+		if target.Deaf {
+			target.Mute = true
+			userstate.Mute = proto.Bool(true)
+		}
+		*reply = true
+		return server.broadcastProtoMessage(MessageUserState, userstate)
+	})
+}
+
+// Set or clear the priority speaker state of a connected user.
+func (c *ControlRPC) PrioritizeUser(args *ModerateArgs, reply *bool) os.Error {
+	return moderate(args, toggleAction(args.Enable, "prioritize", "unprioritize"), func(server *Server, target *Client) os.Error {
+		target.PrioritySpeaker = args.Enable
+		*reply = true
+		return server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session:         proto.Uint32(target.Session),
+			PrioritySpeaker: proto.Bool(args.Enable),
+		})
+	})
+}
+
+type GlobalBanArgs struct {
+	// The address range to ban, such as "10.0.0.0/8", and the
+	// certificate hash to ban. Either may be empty.
+	Address  string
+	CertHash string
+
+	Name     string
+	Reason   string
+	Duration int64
+
+	// The index of the ban to remove, as returned by ListGlobalBans.
+	Index int
+}
+
+// List the global bans.
+func (c *ControlRPC) ListGlobalBans(args *GlobalBanArgs, reply *[]Ban) os.Error {
+	globalBans.RemoveExpired()
+	*reply = globalBans.Bans()
+	return nil
+}
+
+// Add a global ban, and disconnect all clients matching it.
+func (c *ControlRPC) AddGlobalBan(args *GlobalBanArgs, reply *Ban) (err os.Error) {
+	ban := Ban{
+		CertHash: args.CertHash,
+		Name:     args.Name,
+		Reason:   args.Reason,
+		Start:    time.Seconds(),
+		Duration: args.Duration,
+	}
+	if len(args.Address) > 0 {
+		ban.IP, ban.Mask, err = parseBanAddr(args.Address)
+		if err != nil {
+			return err
+		}
+	}
+	if ban.IP == nil && len(ban.CertHash) == 0 {
+		return os.NewError("ban needs an address or a certificate hash")
+	}
+
+	globalBans.Add(ban)
+	log.Printf("Audit: added global ban of %v %v (%v)", args.Address, args.CertHash, args.Reason)
+	for _, server := range allServers() {
+		server.syncCall(func() {
+			server.kickBanned(ban)
+		})
+	}
+
+	*reply = ban
+	return nil
+}
+
+// Remove a global ban.
+func (c *ControlRPC) RemoveGlobalBan(args *GlobalBanArgs, reply *bool) os.Error {
+	if !globalBans.Remove(args.Index) {
+		return os.NewError("no such ban")
+	}
+	log.Printf("Audit: removed global ban %v", args.Index)
+	*reply = true
+	return nil
+}
+
+type CertificateReply struct {
+	// When the server certificate expires, in seconds since the Unix
+	// epoch, and the number of days until then.
+	Expiry        int64
+	DaysRemaining int64
+}
+
+// Get the expiry of the server certificate.
+func (c *ControlRPC) CertificateExpiry(args *int, reply *CertificateReply) os.Error {
+	certExpiryMutex.RLock()
+	reply.Expiry = certExpiry
+	certExpiryMutex.RUnlock()
+	if reply.Expiry == 0 {
+		return os.NewError("certificate expiry unknown")
+	}
+	reply.DaysRemaining = daysUntil(reply.Expiry)
+	return nil
+}
+
+type BroadcastArgs struct {
+	ServerId int64
+
+	// The message is sent to all users in the subtree of this channel.
+	// The root channel (0) sends it to every user on the server.
+	ChannelId int
+
+	// The person or system sending the message. See ModerateArgs.
+	Actor   string
+	Message string
+}
+
+// Collect the clients in channel and all of its subchannels.
+func subtreeClients(channel *Channel, clients []*Client) []*Client {
+	for _, client := range channel.clients {
+		clients = append(clients, client)
+	}
+	for _, child := range channel.children {
+		clients = subtreeClients(child, clients)
+	}
+	return clients
+}
+
+// Send a text message to all users in a channel subtree. The reply is
+// the number of users the message was sent to.
+func (c *ControlRPC) Broadcast(args *BroadcastArgs, reply *int) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+	if len(args.Message) == 0 {
+		return os.NewError("empty message")
+	}
+
+	server.syncCall(func() {
+		channel, ok := server.Channels[args.ChannelId]
+		if !ok {
+			err = ErrNoSuchChannel
+			return
+		}
+
+		clients := subtreeClients(channel, []*Client{})
+		txtmsg := &mumbleproto.TextMessage{
+			TreeId:  []uint32{uint32(channel.Id)},
+			Message: proto.String(args.Message),
+		}
+		for _, client := range clients {
+			if client.state != StateClientReady {
+				continue
+			}
+			if client.sendProtoMessage(MessageTextMessage, txtmsg) == nil {
+				*reply++
+			}
+		}
+		log.Printf("Audit: %v: broadcast to channel %v on server %v (%v users)", args.Actor, channel.Id, server.Id, *reply)
+	})
+
+	return err
+}
+
+type ReloadArgs struct {
+	ServerId int64
+}
+
+// Reload a server's registered users and groups, and the global ban
+// list, from the data directory.
+func (c *ControlRPC) Reload(args *ReloadArgs, reply *bool) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	err = store.LoadBans(globalBans)
+	if err != nil {
+		return err
+	}
+	err = server.Reload()
+	if err != nil {
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+type InviteArgs struct {
+	ServerId  int64
+	ChannelId int
+
+	// The number of times the invite may be used (0 for unlimited),
+	// and how long it is valid, in seconds (0 for unlimited).
+	Uses     int
+	Duration int64
+
+	// The host name to use in the invite URL. Defaults to the
+	// server's address.
+	Host string
+
+	// The token of an invite to revoke.
+	Token string
+}
+
+type InviteReply struct {
+	Token  string
+	URL    string
+	Expiry int64
+}
+
+// Create an invite to a channel.
+func (c *ControlRPC) CreateInvite(args *InviteArgs, reply *InviteReply) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	host := args.Host
+	if len(host) == 0 {
+		host = server.address
+		if len(host) == 0 || host == "0.0.0.0" {
+			host = "localhost"
+		}
+	}
+
+	server.syncCall(func() {
+		channel, ok := server.Channels[args.ChannelId]
+		if !ok {
+			err = ErrNoSuchChannel
+			return
+		}
+		invite := server.NewInvite(channel, args.Uses, args.Duration)
+		reply.Token = invite.Token
+		reply.URL = server.inviteURL(invite, host)
+		reply.Expiry = invite.Expiry
+		log.Printf("Audit: created invite to channel %v on server %v (%v uses)", channel.Id, server.Id, args.Uses)
+	})
+
+	return err
+}
+
+// Revoke an invite. Clients that have already used the invite keep
+// their access for the rest of their session.
+func (c *ControlRPC) RevokeInvite(args *InviteArgs, reply *bool) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		if _, ok := server.invites[args.Token]; !ok {
+			err = os.NewError("no such invite")
+			return
+		}
+		server.invites[args.Token] = nil, false
+		log.Printf("Audit: revoked invite on server %v", server.Id)
+		*reply = true
+	})
+
+	return err
+}
+
+// Export the registered users of a server.
+func (c *ControlRPC) ExportUsers(args *UserListArgs, reply *[]ExportedUser) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		*reply = server.exportUsers()
+	})
+
+	return nil
+}
+
+type ImportUsersArgs struct {
+	ServerId int64
+	Users    []ExportedUser
+
+	// How to handle users that are already registered: ImportSkip
+	// or ImportUpdate.
+	Conflict string
+}
+
+// Import registered users into a server.
+func (c *ControlRPC) ImportUsers(args *ImportUsersArgs, reply *ImportUsersReply) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	switch args.Conflict {
+	case "":
+		args.Conflict = ImportSkip
+	case ImportSkip, ImportUpdate:
+	default:
+		return os.NewError("invalid conflict resolution: " + args.Conflict)
+	}
+
+	server.syncCall(func() {
+		server.importUsers(args.Users, args.Conflict, reply)
+		log.Printf("Audit: imported users into server %v (%v added, %v updated, %v skipped)",
+			server.Id, reply.Added, reply.Updated, len(reply.Skipped))
+	})
+
+	return nil
+}
+
+type TOTPArgs struct {
+	ServerId int64
+
+	// Remove the SuperUser's TOTP secret instead of creating one.
+	Disable bool
+}
+
+type TOTPReply struct {
+	Secret string
+	URI    string
+}
+
+// Create a new TOTP secret for the SuperUser of a server, replacing any
+// existing one. From then on, the SuperUser must append the current code
+// to its password.
+func (c *ControlRPC) SetupTOTP(args *TOTPArgs, reply *TOTPReply) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		superUser, exists := server.Users[0]
+		if !exists {
+			err = os.NewError("no SuperUser")
+			return
+		}
+		if args.Disable {
+			superUser.TOTPSecret = ""
+			log.Printf("Audit: disabled SuperUser TOTP on server %v", server.Id)
+			return
+		}
+		superUser.TOTPSecret = newTOTPSecret()
+		reply.Secret = superUser.TOTPSecret
+		reply.URI = server.totpURI(superUser.TOTPSecret)
+		log.Printf("Audit: enabled SuperUser TOTP on server %v", server.Id)
+	})
+
+	return err
+}
+
+type UserMetadataArgs struct {
+	ServerId  int64
+	UserId    uint32
+	Namespace string
+
+	// The key to set, and its new value. An empty value removes the
+	// key.
+	Key   string
+	Value string
+
+	// The person or system changing the metadata. See ModerateArgs.
+	Actor string
+}
+
+// Get the metadata of a registered user in a namespace.
+func (c *ControlRPC) GetUserMetadata(args *UserMetadataArgs, reply *map[string]string) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		user, exists := server.Users[args.UserId]
+		if !exists {
+			err = os.NewError("no such user")
+			return
+		}
+		*reply = make(map[string]string)
+		for key, value := range user.Metadata[args.Namespace] {
+			(*reply)[key] = value
+		}
+	})
+
+	return err
+}
+
+// Set or remove a metadata key of a registered user.
+func (c *ControlRPC) SetUserMetadata(args *UserMetadataArgs, reply *bool) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		user, exists := server.Users[args.UserId]
+		if !exists {
+			err = os.NewError("no such user")
+			return
+		}
+		err = user.SetMetadata(args.Namespace, args.Key, args.Value)
+		if err != nil {
+			return
+		}
+		log.Printf("Audit: %v: set metadata %v/%v of user %v on server %v", args.Actor, args.Namespace, args.Key, user.Id, server.Id)
+		*reply = true
+	})
+
+	return err
+}
+
+type TemplateArgs struct {
+	// The server to save as a template or to clone.
+	ServerId int64
+
+	// The name of the template to save, or to create a server from.
+	Template string
+
+	// Whether to copy the registered users.
+	IncludeUsers bool
+}
+
+// Save a server as a template.
+func (c *ControlRPC) SaveTemplate(args *TemplateArgs, reply *bool) os.Error {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+	err = server.SaveTemplate(args.Template, args.IncludeUsers)
+	if err != nil {
+		return err
+	}
+	log.Printf("Audit: saved server %v as template %v", server.Id, args.Template)
+	*reply = true
+	return nil
+}
+
+// List the saved templates.
+func (c *ControlRPC) ListTemplates(args *TemplateArgs, reply *[]string) (err os.Error) {
+	*reply, err = templateNames()
+	return err
+}
+
+// Create and start a new server from a template, or, if no template is
+// given, as a clone of an existing server. The reply is the id of the
+// new server.
+func (c *ControlRPC) CreateServer(args *TemplateArgs, reply *int64) (err os.Error) {
+	var fs *frozenServer
+	if len(args.Template) > 0 {
+		fs, err = readTemplate(args.Template)
+	} else {
+		var server *Server
+		server, err = lookupServer(args.ServerId)
+		if err == nil {
+			fs, err = server.freezeForClone(args.IncludeUsers)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	server, err := startServerFrom(fs)
+	if err != nil {
+		return err
+	}
+	if len(args.Template) > 0 {
+		log.Printf("Audit: created server %v from template %v", server.Id, args.Template)
+	} else {
+		log.Printf("Audit: created server %v as a clone of server %v", server.Id, args.ServerId)
+	}
+	*reply = server.Id
+	return nil
+}
+
+type CaptureArgs struct {
+	ServerId int64
+	Session  uint32
+
+	// How long to capture for, in seconds. Zero stops a running
+	// capture.
+	Duration int64
+
+	// The person or system requesting the capture. See ModerateArgs.
+	Actor string
+}
+
+// Start or stop capturing the traffic of a session. The reply is the
+// name of the capture file.
+func (c *ControlRPC) CaptureSession(args *CaptureArgs, reply *string) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		client, ok := server.clients[args.Session]
+		if !ok {
+			err = ErrNoSuchSession
+			return
+		}
+		if args.Duration == 0 {
+			server.stopCapture(client)
+			client.Printf("Audit: %v: stopped capture", args.Actor)
+			return
+		}
+		*reply, err = server.startCapture(client, args.Duration)
+		if err == nil {
+			client.Printf("Audit: %v: capturing session %v to %v", args.Actor, client.Session, *reply)
+		}
+	})
+
+	return err
+}
+
+type UsageArgs struct {
+	ServerId int64
+
+	// "day" or "week".
+	Period string
+
+	// The number of periods to report, up to and including the
+	// current one.
+	Count int
+}
+
+// Get the daily or weekly usage peaks of a server. See usagestats.go.
+func (c *ControlRPC) UsagePeaks(args *UsageArgs, reply *[]UsagePeak) (err os.Error) {
+	if _, err = lookupServer(args.ServerId); err != nil {
+		return err
+	}
+
+	var period int64
+	switch args.Period {
+	case "day":
+		period = 86400
+	case "week":
+		period = 7 * 86400
+	default:
+		return os.NewError("invalid period " + args.Period)
+	}
+	count := args.Count
+	if count <= 0 {
+		count = 7
+	}
+
+	*reply, err = usagePeaks(args.ServerId, period, count)
+	return err
+}
+
+type PermissionCheckArgs struct {
+	ServerId  int64
+	ChannelId int
+
+	// The session to check. If zero, the registered user UserId is
+	// checked instead.
+	Session uint32
+	UserId  uint32
+}
+
+// Evaluate the permissions of a session or registered user on a channel,
+// and report which ACL entries matched. See aclcheck.go.
+func (c *ControlRPC) CheckPermissions(args *PermissionCheckArgs, reply *PermissionCheck) (err os.Error) {
+	server, err := lookupServer(args.ServerId)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		channel, ok := server.Channels[args.ChannelId]
+		if !ok {
+			err = ErrNoSuchChannel
+			return
+		}
+		var client *Client
+		if args.Session != 0 {
+			if client, ok = server.clients[args.Session]; !ok {
+				err = ErrNoSuchSession
+				return
+			}
+		} else {
+			user, ok := server.Users[args.UserId]
+			if !ok {
+				err = os.NewError("no such user")
+				return
+			}
+			client = server.permissionCheckClient(user)
+		}
+		*reply = *server.checkPermissions(client, channel)
+	})
+
+	return err
+}
+
+// Upgrade Grumble in place, by starting the binary it was started from
+// and handing the servers' sockets over to it. See upgrade.go.
+func (c *ControlRPC) Upgrade(args *int, reply *bool) os.Error {
+	select {
+	case upgradeRequest <- true:
+	default:
+		return os.NewError("an upgrade is already pending")
+	}
+	log.Printf("Audit: upgrade requested")
+	*reply = true
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements Grumble's debug listener. When enabled with the
+// -debugaddr flag, it serves pprof profiles (/debug/pprof/), goroutine
+// dumps (/debug/goroutines) and Grumble's internal counters (/debug/vars)
+// over HTTP. All requests must be authenticated using HTTP basic auth
+// with the credentials given by -debuguser and -debugpass.
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"http"
+	_ "http/pprof"
+	"json"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Internal counters, exported via /debug/vars
+var (
+	// The number of connected sessions, across all servers.
+	sessionCount = expvar.NewInt("grumble.sessions")
+
+	// The number of voice buffers that have not yet been sent to
+	// all of their recipients.
+	voiceBuffersInFlight = expvar.NewInt("grumble.voicebuffers")
+
+	// The number of voice packets dropped due to congestion, in
+	// total and per session.
+	totalVoiceDrops = expvar.NewInt("grumble.voicedrops.total")
+	voiceDrops      = newSessionCounter("grumble.voicedrops")
+)
+
+// A sessionCounter is an expvar.Var holding a counter per session.
+// Unlike expvar.Map, it allows counters to be removed once their
+// session disconnects.
+type sessionCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+// Create and publish a new sessionCounter.
+func newSessionCounter(name string) *sessionCounter {
+	sc := &sessionCounter{counts: make(map[string]int64)}
+	expvar.Publish(name, sc)
+	return sc
+}
+
+// Add delta to the counter for key.
+func (sc *sessionCounter) Add(key string, delta int64) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.counts[key] += delta
+}
+
+// Remove the counter for key.
+func (sc *sessionCounter) Remove(key string) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.counts[key] = 0, false
+}
+
+// Get the counters as a JSON object.
+func (sc *sessionCounter) String() string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	buf, err := json.Marshal(sc.counts)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
+
+// Get the key used for a client's per-session counters.
+func (server *Server) sessionKey(client *Client) string {
+	return fmt.Sprintf("%v/%v", server.Id, client.Session)
+}
+
+// Count a dropped voice packet for client.
+func (server *Server) countVoiceDrop(client *Client) {
+	totalVoiceDrops.Add(1)
+	voiceDrops.Add(server.sessionKey(client), 1)
+}
+
+// The largest goroutine dump we're willing to produce.
+const maxGoroutineDumpSize = 16 * 1024 * 1024
+
+// Write a stack trace of every goroutine.
+func goroutineDump(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxGoroutineDumpSize {
+			buf = buf[0:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+// Wraps an http.Handler, requiring HTTP basic auth for all requests.
+type basicAuthHandler struct {
+	handler  http.Handler
+	user     string
+	password string
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"grumble\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// Check the basic auth credentials of r.
+func (h *basicAuthHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+
+	creds := strings.Split(string(buf), ":", 2)
+	if len(creds) != 2 {
+		return false
+	}
+
+	userok := subtle.ConstantTimeCompare([]byte(creds[0]), []byte(h.user)) == 1
+	passok := subtle.ConstantTimeCompare([]byte(creds[1]), []byte(h.password)) == 1
+	return userok && passok
+}
+
+// Start the debug listener on addr. The profiling and expvar handlers
+// register themselves on http.DefaultServeMux, which is only ever served
+// through the authenticating handler.
+func ListenDebug(addr string, user string, password string) (err os.Error) {
+	if len(password) == 0 {
+		return os.NewError("refusing to start debug listener without a password (see -debugpass)")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc("/debug/goroutines", goroutineDump)
+
+	handler := &basicAuthHandler{http.DefaultServeMux, user, password}
+	log.Printf("Debug listener listening on %v", addr)
+	go http.Serve(l, handler)
+
+	return nil
+}
@@ -14,22 +14,35 @@ import (
 )
 
 type frozenServer struct {
-	Id                int             "id"
-	MaxUsers          int             "max_user"
-	Channels          []frozenChannel "channels"
-	Users             []frozenUser    "users"
+	Id                int               "id"
+	MaxUsers          int               "max_user"
+	Config            map[string]string "config"
+	Channels          []frozenChannel   "channels"
+	Users             []frozenUser      "users"
+	Invites           []Invite          "invites"
 }
 
 type frozenUser struct {
-	Id            uint32 "id"
-	Name          string "name"
-	Password      string "password"
-	CertHash      string "cert_hash"
-	Email         string "email"
-	TextureBlob   string "texture_blob"
-	CommentBlob   string "comment_blob"
-	LastChannelId int    "last_channel_id"
-	LastActive    uint64 "last_active"
+	Id             uint32                       "id"
+	Name           string                       "name"
+	Password       string                       "password"
+	CertHash       string                       "cert_hash"
+	Email          string                       "email"
+	TextureBlob    string                       "texture_blob"
+	CommentBlob    string                       "comment_blob"
+	LastChannelId  int                          "last_channel_id"
+	LastActive     uint64                       "last_active"
+	LastConnect    uint64                       "last_connect"
+	LastDisconnect uint64                       "last_disconnect"
+	TalkTime       uint64                       "talk_time"
+	VoicePackets   uint64                       "voice_packets"
+	Listening      []int                        "listening"
+	Tokens         []string                     "tokens"
+	VerifyToken    string                       "verify_token"
+	TOTPSecret     string                       "totp_secret"
+	MuteExpiry     int64                        "mute_expiry"
+	DeafExpiry     int64                        "deaf_expiry"
+	Metadata       map[string]map[string]string "metadata"
 }
 
 type frozenChannel struct {
@@ -42,6 +55,10 @@ type frozenChannel struct {
 	ACL             []frozenACL   "acl"
 	Groups          []frozenGroup "groups"
 	DescriptionBlob string        "description_blob"
+	EnterMessage    string        "enter_message"
+	JoinMessage     string        "join_message"
+	LeaveMessage    string        "leave_message"
+	MaxBitrate      int           "max_bitrate"
 }
 
 type frozenACL struct {
@@ -99,6 +116,7 @@ func (server *Server) FreezeToFile(filename string) (err os.Error) {
 func (server *Server) Freeze() (fs frozenServer, err os.Error) {
 	fs.Id = int(server.Id)
 	fs.MaxUsers = server.MaxUsers
+	fs.Config = server.cfg.GetAll()
 
 	channels := []frozenChannel{}
 	for _, c := range server.Channels {
@@ -120,6 +138,13 @@ func (server *Server) Freeze() (fs frozenServer, err os.Error) {
 	}
 	fs.Users = users
 
+	fs.Invites = []Invite{}
+	for _, invite := range server.invites {
+		if !invite.Expired() {
+			fs.Invites = append(fs.Invites, *invite)
+		}
+	}
+
 	return
 }
 
@@ -134,6 +159,10 @@ func (channel *Channel) Freeze() (fc frozenChannel, err os.Error) {
 	}
 	fc.Position = int64(channel.Position)
 	fc.InheritACL = channel.InheritACL
+	fc.EnterMessage = channel.EnterMessage
+	fc.JoinMessage = channel.JoinMessage
+	fc.LeaveMessage = channel.LeaveMessage
+	fc.MaxBitrate = channel.MaxBitrate
 
 	acls := []frozenACL{}
 	for _, acl := range channel.ACL {
@@ -175,6 +204,17 @@ func (user *User) Freeze() (fu frozenUser, err os.Error) {
 	fu.CommentBlob = user.CommentBlob
 	fu.LastChannelId = user.LastChannelId
 	fu.LastActive = user.LastActive
+	fu.LastConnect = user.LastConnect
+	fu.LastDisconnect = user.LastDisconnect
+	fu.TalkTime = user.TalkTime
+	fu.VoicePackets = user.VoicePackets
+	fu.Listening = user.ListeningChannels
+	fu.Tokens = user.Tokens
+	fu.VerifyToken = user.VerifyToken
+	fu.TOTPSecret = user.TOTPSecret
+	fu.MuteExpiry = user.MuteExpiry
+	fu.DeafExpiry = user.DeafExpiry
+	fu.Metadata = user.Metadata
 
 	return
 }
@@ -202,8 +242,8 @@ func (group *Group) Freeze() (fgrp frozenGroup, err os.Error) {
 	return
 }
 
-// Create a new Server from a frozen server
-func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
+// Read a frozen server from a file
+func readFrozenServer(filename string) (fs *frozenServer, err os.Error) {
 	descFile, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -215,15 +255,83 @@ func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
 		return nil, err
 	}
 
-	fs := new(frozenServer)
+	fs = new(frozenServer)
 	decoder := gob.NewDecoder(zr)
-	decoder.Decode(&fs)
+	err = decoder.Decode(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// Create the groups of a channel from a frozen channel
+func unfreezeGroups(c *Channel, fc *frozenChannel) map[string]*Group {
+	groups := map[string]*Group{}
+	for _, fgrp := range fc.Groups {
+		g := NewGroup(c, fgrp.Name)
+		g.Inherit = fgrp.Inherit
+		g.Inheritable = fgrp.Inheritable
+		for _, uid := range fgrp.Add {
+			g.Add[uid] = true
+		}
+		for _, uid := range fgrp.Remove {
+			g.Remove[uid] = true
+		}
+		groups[g.Name] = g
+	}
+	return groups
+}
+
+// Create a User from a frozen user
+func unfreezeUser(fu *frozenUser) (u *User, err os.Error) {
+	u, err = NewUser(fu.Id, fu.Name)
+	if err != nil {
+		return nil, err
+	}
 
+	u.Password = fu.Password
+	u.CertHash = fu.CertHash
+	u.Email = fu.Email
+	u.TextureBlob = fu.TextureBlob
+	u.CommentBlob = fu.CommentBlob
+	u.LastChannelId = fu.LastChannelId
+	u.LastActive = fu.LastActive
+	u.LastConnect = fu.LastConnect
+	u.LastDisconnect = fu.LastDisconnect
+	u.TalkTime = fu.TalkTime
+	u.VoicePackets = fu.VoicePackets
+	u.ListeningChannels = fu.Listening
+	u.Tokens = fu.Tokens
+	u.VerifyToken = fu.VerifyToken
+	u.TOTPSecret = fu.TOTPSecret
+	u.MuteExpiry = fu.MuteExpiry
+	u.DeafExpiry = fu.DeafExpiry
+	u.Metadata = fu.Metadata
+
+	return u, nil
+}
+
+// Create a new Server from a frozen server file
+func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
+	fs, err := readFrozenServer(filename)
+	if err != nil {
+		return nil, err
+	}
+	return unfreezeServer(fs)
+}
+
+// Create a new Server from a frozen server
+func unfreezeServer(fs *frozenServer) (s *Server, err os.Error) {
 	s, err = NewServer(int64(fs.Id), "0.0.0.0", int(DefaultPort+fs.Id-1))
 	if err != nil {
 		return nil, err
 	}
 
+	if fs.Config != nil {
+		s.cfg = NewConfig(fs.Config)
+	}
+
 	// Add all channels, but don't hook up parent/child relationships
 	// until all of them are loaded.
 	for _, fc := range fs.Channels {
@@ -231,6 +339,10 @@ func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
 		c.Position = int(fc.Position)
 		c.InheritACL = fc.InheritACL
 		c.DescriptionBlob = fc.DescriptionBlob
+		c.EnterMessage = fc.EnterMessage
+		c.JoinMessage = fc.JoinMessage
+		c.LeaveMessage = fc.LeaveMessage
+		c.MaxBitrate = fc.MaxBitrate
 
 		for _, facl := range fc.ACL {
 			acl := NewChannelACL(c)
@@ -242,18 +354,7 @@ func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
 			acl.Allow = Permission(facl.Allow)
 			c.ACL = append(c.ACL, acl)
 		}
-		for _, fgrp := range fc.Groups {
-			g := NewGroup(c, fgrp.Name)
-			g.Inherit = fgrp.Inherit
-			g.Inheritable = fgrp.Inheritable
-			for _, uid := range fgrp.Add {
-				g.Add[uid] = true
-			}
-			for _, uid := range fgrp.Remove {
-				g.Remove[uid] = true
-			}
-			c.Groups[g.Name] = g
-		}
+		c.Groups = unfreezeGroups(c, &fc)
 
 		s.Channels[c.Id] = c
 	}
@@ -278,19 +379,11 @@ func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
 
 	// Add all users
 	for _, fu := range fs.Users {
-		u, err := NewUser(fu.Id, fu.Name)
+		u, err := unfreezeUser(&fu)
 		if err != nil {
 			return nil, err
 		}
 
-		u.Password = fu.Password
-		u.CertHash = fu.CertHash
-		u.Email = fu.Email
-		u.TextureBlob = fu.TextureBlob
-		u.CommentBlob = fu.CommentBlob
-		u.LastChannelId = fu.LastChannelId
-		u.LastActive = fu.LastActive
-
 		s.Users[u.Id] = u
 		s.UserNameMap[u.Name] = u
 		if len(u.CertHash) > 0 {
@@ -298,5 +391,10 @@ func NewServerFromFrozen(filename string) (s *Server, err os.Error) {
 		}
 	}
 
+	for i := range fs.Invites {
+		invite := fs.Invites[i]
+		s.invites[invite.Token] = &invite
+	}
+
 	return s, nil
 }
@@ -0,0 +1,140 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements GeoIP-based connection policies. When Grumble is
+// started with the -geoipdb flag, the country of each connecting client
+// is looked up in a GeoIP country database, in MaxMind's CSV format:
+//
+//	"1.0.0.0","1.0.0.255","16777216","16777471","AU","Australia"
+//
+// The country is shown in the logs and in UserStats, and can be used to
+// allow or deny connections through the GeoIPAllow and GeoIPDeny config
+// keys, which hold comma-separated lists of country codes. Clients whose
+// country is unknown have the country code "--".
+
+import (
+	"bufio"
+	"expvar"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The country code of clients not found in the GeoIP database.
+const UnknownCountry = "--"
+
+// Internal counters, exported via /debug/vars
+var (
+	// The number of connected clients per country, and the number
+	// of connections denied per country.
+	countryConnections = expvar.NewMap("grumble.geoip.connections")
+	countryDenied      = expvar.NewMap("grumble.geoip.denied")
+)
+
+// The GeoIP database in use, or nil if GeoIP lookups are disabled.
+var geoip *GeoIPDB
+
+type geoIPRange struct {
+	start   uint32
+	end     uint32
+	country string
+}
+
+// A GeoIPDB maps IPv4 addresses to country codes.
+type GeoIPDB struct {
+	ranges []geoIPRange
+}
+
+func (db *GeoIPDB) Len() int           { return len(db.ranges) }
+func (db *GeoIPDB) Less(i, j int) bool { return db.ranges[i].start < db.ranges[j].start }
+func (db *GeoIPDB) Swap(i, j int)      { db.ranges[i], db.ranges[j] = db.ranges[j], db.ranges[i] }
+
+// Remove the quotes around a CSV field.
+func unquoteField(field string) string {
+	return strings.Trim(strings.TrimSpace(field), "\"")
+}
+
+// Load a GeoIP country database in CSV format from filename.
+func LoadGeoIPDB(filename string) (db *GeoIPDB, err os.Error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db = new(GeoIPDB)
+	reader := bufio.NewReader(f)
+	for lineno := 1; ; lineno++ {
+		line, err := reader.ReadString('\n')
+		if err == os.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != os.EOF {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// Country names may contain commas, so don't split
+		// past the country code.
+		fields := strings.Split(line, ",", 6)
+		if len(fields) < 5 {
+			return nil, os.NewError("malformed GeoIP database line " + strconv.Itoa(lineno))
+		}
+		start, err := strconv.Atoui64(unquoteField(fields[2]))
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.Atoui64(unquoteField(fields[3]))
+		if err != nil {
+			return nil, err
+		}
+		db.ranges = append(db.ranges, geoIPRange{uint32(start), uint32(end), strings.ToUpper(unquoteField(fields[4]))})
+	}
+
+	sort.Sort(db)
+	return db, nil
+}
+
+// Look up the country code of ip.
+func (db *GeoIPDB) Lookup(ip net.IP) string {
+	ip4 := ip.To4()
+	if db == nil || ip4 == nil {
+		return UnknownCountry
+	}
+
+	num := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return db.ranges[i].end >= num
+	})
+	if i < len(db.ranges) && db.ranges[i].start <= num {
+		return db.ranges[i].country
+	}
+	return UnknownCountry
+}
+
+// Check whether country appears in the comma-separated list of country
+// codes held by the config key.
+func (server *Server) countryListed(key string, country string) bool {
+	for _, code := range strings.Split(server.cfg.StringValue(key), ",", -1) {
+		if strings.ToUpper(strings.TrimSpace(code)) == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether clients from country may connect to the server.
+func (server *Server) countryAllowed(country string) bool {
+	if len(server.cfg.StringValue("GeoIPAllow")) > 0 && !server.countryListed("GeoIPAllow", country) {
+		return false
+	}
+	return !server.countryListed("GeoIPDeny", country)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements ghost session takeover. When a connection drops
+// without the server noticing, the stale session lingers until it times
+// out, and keeps its user from logging in again. The DuplicateSessions
+// config key decides what happens when a client connects as a user, or
+// with a certificate, that already has a live session:
+//
+//	reject  the new connection is refused (the default)
+//	kick    the old sessions are disconnected and the new one takes over
+//
+// In reject mode, unregistered clients may share a certificate, as
+// before; only registered users are refused.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+)
+
+// Get the connected sessions of the same user as client, or with the
+// same certificate.
+func (server *Server) ghostSessions(client *Client) (ghosts []*Client) {
+	for _, connected := range server.clients {
+		if connected == client {
+			continue
+		}
+		if client.user != nil && connected.UserId() == client.UserId() {
+			ghosts = append(ghosts, connected)
+		} else if len(client.CertHash) > 0 && connected.CertHash == client.CertHash {
+			ghosts = append(ghosts, connected)
+		}
+	}
+	return
+}
+
+// Get the sessions client takes over when it is let in: its ghost
+// sessions in kick mode, and none otherwise.
+func (server *Server) takenOverSessions(client *Client) []*Client {
+	if server.cfg.StringValue("DuplicateSessions") != "kick" {
+		return nil
+	}
+	return server.ghostSessions(client)
+}
+
+// Handle the existing sessions of a client that has just authenticated,
+// according to the DuplicateSessions policy. Returns false if the client
+// was refused.
+func (server *Server) takeOverGhosts(client *Client) bool {
+	ghosts := server.ghostSessions(client)
+	if len(ghosts) == 0 {
+		return true
+	}
+
+	if server.cfg.StringValue("DuplicateSessions") != "kick" {
+		if client.user == nil {
+			return true
+		}
+		for _, ghost := range ghosts {
+			if ghost.UserId() == client.UserId() {
+				client.RejectAuth("UsernameInUse", "A client is already connected using those credentials.")
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, ghost := range ghosts {
+		err := server.broadcastProtoMessage(MessageUserRemove, &mumbleproto.UserRemove{
+			Session: proto.Uint32(ghost.Session),
+			Reason:  proto.String("Reconnected from another client."),
+		})
+		if err != nil {
+			ghost.Printf("Unable to broadcast UserRemove: %v", err.String())
+		}
+		ghost.Printf("Disconnected, taken over by a new connection from %v", server.logAddr(client.tcpaddr.IP))
+		ghost.ForceDisconnect()
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the global ban list, which is shared by all
+// virtual servers hosted by a Grumble instance. A client matching a
+// global ban is refused when it authenticates with any server that has
+// the UseGlobalBans config key set (the default).
+//
+// The global ban list is managed through the control interface, and is
+// stored in the data directory alongside the frozen servers. Bans from
+// external blocklists are kept in a separate list (see blocklist.go).
+
+import (
+	"compress/gzip"
+	"fmt"
+	"gob"
+	"goprotobuf.googlecode.com/hg/proto"
+	"io/ioutil"
+	"mumbleproto"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The name of the global ban list file in the data directory.
+const globalBanFile = "globalbans"
+
+// A Ban refuses clients connecting from a range of addresses, or with
+// a given certificate hash.
+type Ban struct {
+	// The banned address range, given as an IP address in its 16-byte
+	// form, and the number of leading bits of it to match. IPv4
+	// addresses are matched in their IPv4-mapped IPv6 form, so an
+	// IPv4 /24 has a Mask of 120. A nil IP matches no address.
+	IP   net.IP
+	Mask int
+
+	// The banned certificate hash. Empty matches no certificates.
+	CertHash string
+
+	// The name of the banned user, for reference.
+	Name   string
+	Reason string
+
+	// When the ban was created, and its duration in seconds. A zero
+	// Duration makes the ban permanent.
+	Start    int64
+	Duration int64
+}
+
+// Has the ban expired?
+func (ban Ban) Expired() bool {
+	return ban.Duration > 0 && time.Seconds() >= ban.Start+ban.Duration
+}
+
+// The message shown to a client refused because of ban.
+func (ban Ban) String() string {
+	if len(ban.Reason) > 0 {
+		return fmt.Sprintf("You are banned: %v", ban.Reason)
+	}
+	return "You are banned"
+}
+
+// Does the ban match a client connecting from ip with the given
+// certificate hash?
+func (ban Ban) Match(ip net.IP, certhash string) bool {
+	if ban.Expired() {
+		return false
+	}
+	if len(ban.CertHash) > 0 && strings.ToLower(ban.CertHash) == strings.ToLower(certhash) {
+		return true
+	}
+	if ban.IP == nil || ip == nil {
+		return false
+	}
+
+	a, b := ban.IP.To16(), ip.To16()
+	for i := 0; i < ban.Mask && i < 128; i += 8 {
+		bits := ban.Mask - i
+		if bits > 8 {
+			bits = 8
+		}
+		mask := byte(0xff << uint(8-bits))
+		if a[i/8]&mask != b[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse an address range such as "10.0.0.0/8" or "2001:db8::/32" into
+// an IP and a Mask for a Ban. An address without a prefix length bans
+// only that address.
+func parseBanAddr(str string) (ip net.IP, mask int, err os.Error) {
+	parts := strings.Split(str, "/", 2)
+	ip = net.ParseIP(parts[0])
+	if ip == nil {
+		return nil, 0, os.NewError("invalid address: " + parts[0])
+	}
+
+	mask = 128
+	if len(parts) > 1 {
+		mask, err = strconv.Atoi(parts[1])
+		if err != nil || mask < 0 || mask > 128 {
+			return nil, 0, os.NewError("invalid prefix length: " + parts[1])
+		}
+		if ip.To4() != nil {
+			if mask > 32 {
+				return nil, 0, os.NewError("invalid prefix length: " + parts[1])
+			}
+			mask += 96
+		}
+	}
+	return ip.To16(), mask, nil
+}
+
+// A BanList is a list of bans that is safe for concurrent use.
+type BanList struct {
+	mutex sync.RWMutex
+	bans  []Ban
+}
+
+// The global ban list.
+var globalBans = new(BanList)
+
+// Get a copy of all bans in the list.
+func (bl *BanList) Bans() []Ban {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	bans := make([]Ban, len(bl.bans))
+	copy(bans, bl.bans)
+	return bans
+}
+
+// Add a ban to the list.
+func (bl *BanList) Add(ban Ban) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.bans = append(bl.bans, ban)
+}
+
+// Replace the contents of the list with bans.
+func (bl *BanList) Set(bans []Ban) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.bans = bans
+}
+
+// Remove the ban at index i. Returns false if there is no such ban.
+func (bl *BanList) Remove(i int) bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if i < 0 || i >= len(bl.bans) {
+		return false
+	}
+	bl.bans = append(bl.bans[:i], bl.bans[i+1:]...)
+	return true
+}
+
+// Remove expired bans from the list.
+func (bl *BanList) RemoveExpired() {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bans := []Ban{}
+	for _, ban := range bl.bans {
+		if !ban.Expired() {
+			bans = append(bans, ban)
+		}
+	}
+	bl.bans = bans
+}
+
+// Find the first ban matching a client connecting from ip with the
+// given certificate hash.
+func (bl *BanList) Match(ip net.IP, certhash string) (ban Ban, ok bool) {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	for _, ban := range bl.bans {
+		if ban.Match(ip, certhash) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Write the list to filename.
+func (bl *BanList) WriteFile(filename string) (err os.Error) {
+	bl.RemoveExpired()
+	bans := bl.Bans()
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+"_")
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = gob.NewEncoder(zw).Encode(bans)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Read the list from filename, replacing its current contents. A
+// missing file yields an empty list.
+func (bl *BanList) ReadFile(filename string) (err os.Error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	bans := []Ban{}
+	err = gob.NewDecoder(zr).Decode(&bans)
+	if err != nil {
+		return err
+	}
+
+	bl.mutex.Lock()
+	bl.bans = bans
+	bl.mutex.Unlock()
+	return nil
+}
+
+// Get the ban applying to client, if any.
+func (server *Server) globalBanFor(client *Client) (ban Ban, ok bool) {
+	if !server.cfg.BoolValue("UseGlobalBans") {
+		return Ban{}, false
+	}
+	if ban, ok = globalBans.Match(client.tcpaddr.IP, client.CertHash); ok {
+		return ban, ok
+	}
+	return blocklistBans.Match(client.tcpaddr.IP, client.CertHash)
+}
+
+// Disconnect all connected clients of the server that are matched by
+// ban.
+func (server *Server) kickBanned(ban Ban) {
+	if !server.cfg.BoolValue("UseGlobalBans") {
+		return
+	}
+	for _, client := range server.clients {
+		if ban.Match(client.tcpaddr.IP, client.CertHash) {
+			server.disconnectBanned(client, ban)
+		}
+	}
+}
+
+// Disconnect a client matched by a global ban.
+func (server *Server) disconnectBanned(client *Client, ban Ban) {
+	err := server.broadcastProtoMessage(MessageUserRemove, &mumbleproto.UserRemove{
+		Session: proto.Uint32(client.Session),
+		Reason:  proto.String(ban.String()),
+		Ban:     proto.Bool(true),
+	})
+	if err != nil {
+		client.Printf("Unable to broadcast UserRemove: %v", err.String())
+	}
+	client.Printf("Disconnected by global ban")
+	client.ForceDisconnect()
+}
@@ -182,13 +182,17 @@ func GroupMemberCheck(current *Channel, aclchan *Channel, name string, client *C
 	// The user is part of this group if the remaining name is part of
 	// his access token list.
 	if token {
-		log.Printf("GroupMemberCheck: Implement token matching")
-		member = false // fixme(mkrautz)
+		member = false
+		for _, tok := range client.Tokens {
+			if strings.ToLower(tok) == strings.ToLower(name) {
+				member = true
+				break
+			}
+		}
 		// The user is part of this group if the remaining name matches his
 		// cert hash.
 	} else if hash {
-		log.Printf("GroupMemberCheck: Implement hash matching")
-		member = false // fixme(mkrautz)
+		member = len(client.CertHash) > 0 && strings.ToLower(client.CertHash) == strings.ToLower(name)
 		// None
 	} else if name == "none" {
 		member = false
@@ -202,8 +206,7 @@ func GroupMemberCheck(current *Channel, aclchan *Channel, name string, client *C
 		// The user is part of the strong group if he is authenticated to the server
 		// via a strong certificate (i.e. non-self-signed).
 	} else if name == "strong" {
-		log.Printf("GroupMemberCheck: Implement strong certificate matching")
-		member = false // fixme(mkrautz)
+		member = client.StrongCertificate
 		// Is the user in the currently evaluated channel?
 	} else if name == "in" {
 		member = client.Channel == channel
@@ -13,7 +13,7 @@ import (
 	"log"
 	"sqlite"
 	"path/filepath"
-	"regexp"
+	"sync"
 	"time"
 )
 
@@ -24,16 +24,45 @@ var datadir *string = flag.String("datadir", "", "Directory to use for server st
 var blobdir *string = flag.String("blobdir", "", "Directory to use for blob storage")
 var sqlitedb *string = flag.String("murmurdb", "", "Path to murmur.sqlite to import server structure from")
 var cleanup *bool = flag.Bool("clean", false, "Clean up existing data dir content before importing Murmur data")
+var ctlnet *string = flag.String("ctlnet", "unix", "Network to use for the control interface")
+var ctladdr *string = flag.String("ctladdr", filepath.Join(os.Getenv("HOME"), ".grumble", "ctl"), "Address to use for the control interface")
+var ctlpass *string = flag.String("ctlpass", "", "Password for the control interface, required unless -ctlnet is unix")
+var runuser *string = flag.String("user", "", "User to run as after binding sockets (requires root)")
+var rungroup *string = flag.String("group", "", "Group to run as after binding sockets (requires root)")
+var chroot *bool = flag.Bool("chroot", false, "Chroot into the data directory after binding sockets (requires root)")
+var debugaddr *string = flag.String("debugaddr", "", "Address for the debug listener (pprof, counters). Disabled if empty")
+var debuguser *string = flag.String("debuguser", "grumble", "Username for the debug listener")
+var debugpass *string = flag.String("debugpass", "", "Password for the debug listener")
+var certwarn *string = flag.String("certwarn", "30,7,1", "Comma-separated list of days before certificate expiry at which to log warnings")
+var allowexpiredcert *bool = flag.Bool("allowexpiredcert", false, "Start even if the server certificate has expired")
+var smtpaddr *string = flag.String("smtpaddr", "", "Address of the SMTP server used to send registration verification mails")
+var smtpfrom *string = flag.String("smtpfrom", "grumble@localhost", "Sender address of registration verification mails")
+var verifyaddr *string = flag.String("verifyaddr", "", "Address for the registration verification listener. Disabled if empty")
+var verifyurl *string = flag.String("verifyurl", "", "Public URL of the registration verification listener, used in verification mails")
+var geoipdb *string = flag.String("geoipdb", "", "Path to a GeoIP country database (CSV) for GeoIP connection policies")
 
 var globalBlobstore *blobstore.BlobStore
 
+// The virtual servers hosted by this Grumble instance. Servers are added
+// by the control interface while others run, so once startup is done the
+// map must only be accessed with serversMutex held.
+var servers map[int64]*Server = make(map[int64]*Server)
+var serversMutex sync.RWMutex
+
+// Signals RunGrumble to freeze all servers and return. Used when
+// running as a Windows service.
+var shutdown chan bool = make(chan bool)
+
 func Usage() {
 	fmt.Fprintf(os.Stderr, "usage: grumble [options]\n")
+	fmt.Fprintf(os.Stderr, "       grumble [options] ctl <command> [args]\n")
+	fmt.Fprintf(os.Stderr, "       grumble [options] service <install|remove|start|stop|run>\n")
 	flag.PrintDefaults()
 }
 
 func MurmurImport(filename string) (err os.Error) {
-	db, err := sqlite.Open(filename)
+	// Murmur may still be running, so don't touch its database.
+	db, err := sqlite.OpenWithFlags(filename, sqlite.OpenReadOnly)
 	if err != nil {
 		panic(err.String())
 	}
@@ -69,16 +98,74 @@ func MurmurImport(filename string) (err os.Error) {
 	return
 }
 
-func main() {
+// Open the global blobstore in blobdir.
+func openBlobstore() {
 	var err os.Error
+	log.Printf("Using blob directory: %s", *blobdir)
+	globalBlobstore, err = blobstore.NewBlobStore(*blobdir, true)
+	if err != nil {
+		log.Fatalf("Unable to initialize blobstore: %v", err.String())
+	}
+}
+
+func main() {
 	flag.Parse()
 	if *help == true {
 		Usage()
 		return
 	}
 
+	if flag.NArg() > 0 && flag.Arg(0) == "ctl" {
+		GrumbleCtl(flag.Args()[1:])
+		return
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) == "service" {
+		ServiceCommand(flag.Args()[1:])
+		return
+	}
+
+	RunGrumble()
+}
+
+// Get the virtual servers hosted by this Grumble instance.
+func allServers() []*Server {
+	serversMutex.RLock()
+	defer serversMutex.RUnlock()
+	list := make([]*Server, 0, len(servers))
+	for _, s := range servers {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Freeze all servers to the data directory.
+func freezeAll() {
+	for _, s := range allServers() {
+		err := store.SaveServer(s)
+		if err != nil {
+			log.Printf("Unable to freeze server %v: %s", s.Id, err.String())
+			continue
+		}
+	}
+
+	err := store.SaveBans(globalBans)
+	if err != nil {
+		log.Printf("Unable to write global ban list: %s", err.String())
+	}
+}
+
+// Load and run all virtual servers. RunGrumble returns once Grumble has
+// been asked to shut down, either by a signal or via the shutdown channel.
+func RunGrumble() {
+	var err os.Error
+
 	log.Printf("Grumble - Mumble server written in Go")
 
+	// Pick up the sockets of the process we're upgrading, if any. See
+	// upgrade.go.
+	loadInheritedSockets()
+
 	if len(*datadir) == 0 {
 		*datadir = filepath.Join(os.Getenv("HOME"), ".grumble", "data")
 	}
@@ -88,14 +175,10 @@ func main() {
 		*blobdir = filepath.Join(os.Getenv("HOME"), ".grumble", "blob")
 	}
 
-	log.Printf("Using blob directory: %s", *blobdir)
-	globalBlobstore, err = blobstore.NewBlobStore(*blobdir, true)
-	if err != nil {
-		log.Fatalf("Unable to initialize blobstore: %v", err.String())
-	}
-
 	// Should we import data from a Murmur SQLite file?
 	if len(*sqlitedb) > 0 {
+		openBlobstore()
+
 		f, err := os.Open(*datadir)
 		if err != nil {
 			log.Fatalf("Murmur import failed: %s", err.String())
@@ -130,28 +213,32 @@ func main() {
 		return
 	}
 
-	f, err := os.Open(*datadir)
+	store, err = openStore()
 	if err != nil {
-		log.Fatalf("Murmur import failed: %s", err.String())
+		log.Fatalf("Unable to open storage backend: %s", err.String())
 	}
-	defer f.Close()
 
-	names, err := f.Readdirnames(-1)
+	ids, err := store.ServerIds()
 	if err != nil {
-		log.Fatalf("Murmur import failed: %s", err.String())
+		log.Fatalf("Unable to list servers: %s", err.String())
 	}
 
-	servers := make(map[int64]*Server)
-	for _, name := range names {
-		if matched, _ := regexp.MatchString("^[0-9]+$", name); matched {
-			log.Printf("Loading server %v", name)
-			s, err := NewServerFromFrozen(filepath.Join(*datadir, name))
-			if err != nil {
-				log.Fatalf("Unable to load server: %s", err.String())
-			}
-			servers[s.Id] = s
-			go s.ListenAndMurmur()
+	for _, id := range ids {
+		log.Printf("Loading server %v", id)
+		fs, err := store.LoadServer(id)
+		if err != nil {
+			log.Fatalf("Unable to load server: %s", err.String())
 		}
+		s, err := unfreezeServer(fs)
+		if err != nil {
+			log.Fatalf("Unable to load server: %s", err.String())
+		}
+		servers[s.Id] = s
+	}
+
+	err = store.LoadBans(globalBans)
+	if err != nil {
+		log.Fatalf("Unable to load global ban list: %s", err.String())
 	}
 
 	if len(servers) == 0 {
@@ -161,37 +248,115 @@ func main() {
 		}
 
 		servers[s.Id] = s
-		go s.ListenAndMurmur()
 	}
 
-	if len(servers) > 0 {
+	loadUpgradeSessions()
+
+	if len(*geoipdb) > 0 {
+		geoip, err = LoadGeoIPDB(*geoipdb)
+		if err != nil {
+			log.Fatalf("Unable to load GeoIP database: %s", err.String())
+		}
+		log.Printf("Loaded GeoIP database from %v", *geoipdb)
+	}
+
+	MonitorCertExpiry("grumble.crt")
+
+	// Bind all sockets while we're still privileged.
+	for sid, s := range servers {
+		err = s.Listen()
+		if err != nil {
+			log.Fatalf("Unable to listen for server %v: %s", sid, err.String())
+		}
+	}
+	closeUnusedInheritedSockets()
+	waitForUpgradeParent()
+
+	// The other listeners are set up without privileges, by the process
+	// DropPrivileges starts if it drops them.
+	restarted, err := DropPrivileges()
+	if err != nil {
+		log.Fatalf("Unable to drop privileges: %s", err.String())
+	}
+	if restarted {
+		return
+	}
+
+	err = ListenControlRPC(*ctlnet, *ctladdr)
+	if err != nil {
+		log.Printf("Unable to start control interface: %s", err.String())
+	}
+
+	err = ListenConsole()
+	if err != nil {
+		log.Printf("Unable to start admin console: %s", err.String())
+	}
+
+	if len(*verifyaddr) > 0 {
+		err = ListenVerify(*verifyaddr)
+		if err != nil {
+			log.Printf("Unable to start verification listener: %s", err.String())
+		}
+	}
+
+	if len(*debugaddr) > 0 {
+		err = ListenDebug(*debugaddr, *debuguser, *debugpass)
+		if err != nil {
+			log.Printf("Unable to start debug listener: %s", err.String())
+		}
+	}
+
+	openBlobstore()
+
+	for _, s := range allServers() {
+		go s.Serve()
+	}
+
+	if urls := blocklistURLs(); len(urls) > 0 {
+		go SyncBlocklists(urls)
+	}
+
+	if len(*usagedb) > 0 {
+		go RecordUsage(*usagedb, *usageinterval)
+	}
+
+	if len(allServers()) > 0 {
 		ticker := time.NewTicker(10e9) // 10 secs
 		for {
 			select {
 			case <-ticker.C:
-				for sid, server := range servers {
-					err := server.FreezeToFile(filepath.Join(*datadir, fmt.Sprintf("%v", sid)))
-					if err != nil {
-						log.Printf("Unable to freeze server %v: %s", sid, err.String())
+				freezeAll()
+
+			case sig := <-signal.Incoming:
+				if sig == signal.SIGHUP {
+					reloadAll()
+					continue
+				}
+				if isUpgradeSignal(sig) {
+					if err := upgrade(); err != nil {
+						log.Printf("Unable to upgrade: %s", err.String())
 						continue
 					}
+					return
 				}
-
-			case sig := <-signal.Incoming:
 				if sig != signal.SIGINT && sig != signal.SIGTERM {
 					continue
 				}
 
-				for sid, s := range servers {
-					err := s.FreezeToFile(filepath.Join(*datadir, fmt.Sprintf("%v", sid)))
-					if err != nil {
-						log.Printf("Unable to freeze server %v: %s", sid, err.String())
-						continue
-					}
+				freezeAll()
+				log.Printf("Servers frozen")
+				return
 
-					log.Printf("Server %v frozen", sid)
+			case <-upgradeRequest:
+				if err := upgrade(); err != nil {
+					log.Printf("Unable to upgrade: %s", err.String())
+					continue
 				}
+				return
 
+			case <-shutdown:
+				freezeAll()
+				log.Printf("Servers frozen")
 				return
 			}
 		}
@@ -0,0 +1,112 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements channel invites. An invite is a random token
+// bound to a channel, which may be limited to a number of uses and to a
+// period of time. A client presenting the token, either as an access
+// token or as its server password, may enter the invite's channel for
+// the rest of its session, regardless of the channel's ACL.
+//
+// Invites are created through the control interface, which returns a
+// mumble:// URL that carries the token as the password, along with the
+// path of the channel.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"strings"
+	"time"
+)
+
+type Invite struct {
+	Token     string
+	ChannelId int
+
+	// The number of remaining uses, or -1 if unlimited.
+	Uses int
+
+	// When the invite expires, in seconds since the Unix epoch, or 0
+	// if it doesn't.
+	Expiry int64
+}
+
+// Has the invite expired?
+func (invite *Invite) Expired() bool {
+	return invite.Uses == 0 || (invite.Expiry > 0 && time.Seconds() >= invite.Expiry)
+}
+
+// Create a new invite to channel.
+func (server *Server) NewInvite(channel *Channel, uses int, duration int64) *Invite {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Unable to generate invite token")
+	}
+
+	invite := &Invite{
+		Token:     hex.EncodeToString(buf),
+		ChannelId: channel.Id,
+		Uses:      uses,
+	}
+	if uses <= 0 {
+		invite.Uses = -1
+	}
+	if duration > 0 {
+		invite.Expiry = time.Seconds() + duration
+	}
+	server.invites[invite.Token] = invite
+	return invite
+}
+
+// Redeem any invites among tokens for client.
+func (server *Server) redeemInvites(client *Client, tokens []string) {
+	for _, token := range tokens {
+		invite, ok := server.invites[token]
+		if !ok {
+			continue
+		}
+		if invite.Expired() {
+			server.invites[token] = nil, false
+			continue
+		}
+		if client.invited[invite.ChannelId] {
+			continue
+		}
+
+		client.invited[invite.ChannelId] = true
+		if invite.Uses > 0 {
+			invite.Uses--
+		}
+		if invite.Expired() {
+			server.invites[token] = nil, false
+		}
+		client.Printf("Redeemed invite to channel %v", invite.ChannelId)
+	}
+}
+
+// Remove expired invites.
+func (server *Server) removeExpiredInvites() {
+	for token, invite := range server.invites {
+		if invite.Expired() {
+			server.invites[token] = nil, false
+		}
+	}
+}
+
+// Get a mumble:// URL for an invite. The server is reached at host.
+func (server *Server) inviteURL(invite *Invite, host string) string {
+	path := ""
+	if channel, ok := server.Channels[invite.ChannelId]; ok {
+		for ; channel != nil && channel != server.root; channel = channel.parent {
+			// URLEscape escapes for query strings; spaces in
+			// paths must be escaped as %20.
+			name := strings.Replace(http.URLEscape(channel.Name), "+", "%20", -1)
+			path = "/" + name + path
+		}
+	}
+	return fmt.Sprintf("mumble://:%v@%v:%v%v?version=1.2.0", invite.Token, host, server.port, path)
+}
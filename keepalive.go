@@ -0,0 +1,50 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements detection of dead connections. The server pings
+// every connected client over TCP every KeepaliveInterval, and
+// disconnects clients that haven't sent any message on their control
+// channel for ConnectionTimeout seconds. Mumble clients ping the server
+// every few seconds on their own, so a client that stays silent for
+// that long is almost certainly gone, for example because its TCP
+// connection was dropped without being closed.
+//
+// The server's pings also make writes to dead connections fail sooner,
+// and keep NAT mappings alive.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"time"
+)
+
+// The interval at which clients are pinged and checked for timeouts,
+// in nanoseconds.
+const KeepaliveInterval = 10e9
+
+// Record that client sent a message on its control channel.
+func (client *Client) markActive() {
+	client.lastMessage = time.Nanoseconds()
+}
+
+// Ping all ready clients, and disconnect those that have timed out.
+func (server *Server) checkKeepalive() {
+	timeout := int64(server.cfg.IntValue("ConnectionTimeout")) * 1e9
+	now := time.Nanoseconds()
+
+	ping := &mumbleproto.Ping{Timestamp: proto.Uint64(uint64(now))}
+	for _, client := range server.clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		if timeout > 0 && client.lastMessage > 0 && now-client.lastMessage > timeout {
+			client.Printf("Connection timed out after %v seconds of inactivity", (now-client.lastMessage)/1e9)
+			client.Disconnect()
+			continue
+		}
+		client.sendProtoMessage(MessagePing, ping)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"time"
+)
+
+// A LeakyBucket is a simple rate limiter. Each action adds tokens to the
+// bucket, and the bucket drains at a fixed rate. Actions that would cause
+// the bucket to overflow are rate limited.
+type LeakyBucket struct {
+	tokensPerSec  float64
+	maxTokens     float64
+	currentTokens float64
+	lastUpdate    int64
+}
+
+// Create a new LeakyBucket that drains tokensPerSec tokens per second
+// and holds at most maxTokens tokens.
+func NewLeakyBucket(tokensPerSec int, maxTokens int) *LeakyBucket {
+	return &LeakyBucket{
+		tokensPerSec: float64(tokensPerSec),
+		maxTokens:    float64(maxTokens),
+		lastUpdate:   time.Nanoseconds(),
+	}
+}
+
+// Attempt to add tokens to the bucket. Returns true if the action should
+// be rate limited, in which case the bucket is left unchanged.
+func (lb *LeakyBucket) Ratelimit(tokens int) bool {
+	now := time.Nanoseconds()
+	drained := float64(now-lb.lastUpdate) * lb.tokensPerSec / 1e9
+	lb.lastUpdate = now
+
+	lb.currentTokens -= drained
+	if lb.currentTokens < 0 {
+		lb.currentTokens = 0
+	}
+
+	if lb.currentTokens+float64(tokens) > lb.maxTokens {
+		return true
+	}
+
+	lb.currentTokens += float64(tokens)
+	return false
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-identity limits, which stop a single person
+// from holding many identities on a server: the number of registrations
+// per certificate hash, and the number of concurrent connections per
+// address and per certificate hash. A limit of zero disables it.
+//
+// A certificate can end up with more than one registration through
+// pending registrations (see verify.go), and identities carried in strong
+// certificates (see certauth.go). Registrations imported through the
+// control interface aren't limited.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Count the registrations of the certificate with the given hash.
+func (server *Server) registrationsForCert(certhash string) (n int) {
+	certhash = strings.ToLower(certhash)
+	for _, user := range server.Users {
+		if len(user.CertHash) > 0 && strings.ToLower(user.CertHash) == certhash {
+			n++
+		}
+	}
+	return
+}
+
+// Check whether a new registration of client's certificate would exceed
+// the MaxRegistrationsPerCertificate limit. Returns the reason it may not
+// register, or an empty string if it may.
+func (server *Server) registrationLimitDenied(client *Client) string {
+	limit := server.cfg.IntValue("MaxRegistrationsPerCertificate")
+	if limit > 0 && server.registrationsForCert(client.CertHash) >= limit {
+		if limit == 1 {
+			return "This certificate is already registered on this server."
+		}
+		return fmt.Sprintf("This certificate already has %v registrations on this server, the most allowed.", limit)
+	}
+	return ""
+}
+
+// Check whether letting client in would exceed the MaxConnectionsPerIP
+// or MaxConnectionsPerCertificate limits. The replaced sessions, which
+// the client takes over, aren't counted. Returns the reason it is
+// refused, or an empty string if it may connect.
+func (server *Server) connectionLimitDenied(client *Client, replaced []*Client) string {
+	iplimit := server.cfg.IntValue("MaxConnectionsPerIP")
+	certlimit := server.cfg.IntValue("MaxConnectionsPerCertificate")
+	if iplimit <= 0 && (certlimit <= 0 || len(client.CertHash) == 0) {
+		return ""
+	}
+
+	ipcount, certcount := 0, 0
+clients:
+	for _, connected := range server.clients {
+		for _, r := range replaced {
+			if connected == r {
+				continue clients
+			}
+		}
+		if connected.tcpaddr.IP.Equal(client.tcpaddr.IP) {
+			ipcount++
+		}
+		if len(client.CertHash) > 0 && connected.CertHash == client.CertHash {
+			certcount++
+		}
+	}
+
+	if iplimit > 0 && ipcount >= iplimit {
+		return fmt.Sprintf("Too many connections from your address. At most %v are allowed.", iplimit)
+	}
+	if certlimit > 0 && len(client.CertHash) > 0 && certcount >= certlimit {
+		return fmt.Sprintf("Too many connections with your certificate. At most %v are allowed.", certlimit)
+	}
+	return ""
+}
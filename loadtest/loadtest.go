@@ -0,0 +1,247 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// grumble-loadtest simulates a number of concurrent Mumble clients against
+// a server, and reports the latency and loss of the voice packets routed
+// between them. It is meant for validating changes to the voice routing
+// path before they are deployed.
+//
+// Clients are spread evenly across the channels given by -channels, and
+// every client both sends and receives voice. Voice is sent through the
+// TCP voice tunnel, so the numbers include the server's TCP handling.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var help *bool = flag.Bool("help", false, "Show this help")
+var addr *string = flag.String("server", "localhost:64738", "Address of the server to test")
+var password *string = flag.String("password", "", "Server password")
+var numClients *int = flag.Int("clients", 10, "Number of clients to simulate")
+var channels *string = flag.String("channels", "0", "Comma-separated list of channel ids to spread clients across")
+var prefix *string = flag.String("name", "loadtest", "Username prefix of the simulated clients")
+var bitrate *int = flag.Int("bitrate", 40000, "Voice bitrate of each client, in bits per second")
+var frameMs *int = flag.Int("frame", 20, "Duration of each voice packet, in milliseconds")
+var whisper *int = flag.Int("whisper", 0, "Send every n'th voice packet as a whisper to the client's own channel (0 disables)")
+var duration *int = flag.Int("duration", 30, "Duration of the test, in seconds")
+var rampup *int = flag.Int("rampup", 10, "Delay between connecting clients, in milliseconds")
+
+// Stats collects the measurements of all SimClients.
+type Stats struct {
+	mutex sync.Mutex
+
+	connected int
+	failed    int
+	errors    int
+	invalid   int
+
+	sent             int64
+	received         int64
+	lost             int64
+	whispersSent     int64
+	whispersReceived int64
+
+	// Voice latencies and TCP ping round-trip times, in nanoseconds.
+	latencies []int64
+	pings     []int64
+}
+
+func (s *Stats) AddConnected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connected++
+}
+
+func (s *Stats) AddFailed(name string, err os.Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed++
+	log.Printf("%v: unable to connect: %v", name, err.String())
+}
+
+func (s *Stats) AddError(name string, err os.Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errors++
+	log.Printf("%v: %v", name, err.String())
+}
+
+func (s *Stats) AddInvalid() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.invalid++
+}
+
+func (s *Stats) AddSent(whisper bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if whisper {
+		s.whispersSent++
+	} else {
+		s.sent++
+	}
+}
+
+func (s *Stats) AddReceived(whisper bool, latency int64, lost int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if whisper {
+		s.whispersReceived++
+	} else {
+		s.received++
+	}
+	s.lost += lost
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *Stats) AddPing(rtt int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pings = append(s.pings, rtt)
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Print the minimum, average, maximum and a few percentiles of the
+// durations in vals, in milliseconds.
+func printDistribution(name string, vals []int64) {
+	if len(vals) == 0 {
+		fmt.Printf("%-10v n/a\n", name)
+		return
+	}
+
+	sorted := make(int64Slice, len(vals))
+	copy(sorted, vals)
+	sort.Sort(sorted)
+
+	var sum int64
+	for _, v := range sorted {
+		sum += v
+	}
+	pct := func(p int) float64 {
+		return float64(sorted[(len(sorted)-1)*p/100]) / 1e6
+	}
+
+	fmt.Printf("%-10v min %.2fms  avg %.2fms  p50 %.2fms  p95 %.2fms  p99 %.2fms  max %.2fms\n", name,
+		float64(sorted[0])/1e6, float64(sum)/float64(len(sorted))/1e6,
+		pct(50), pct(95), pct(99), float64(sorted[len(sorted)-1])/1e6)
+}
+
+func (s *Stats) Report() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fmt.Printf("clients    %v connected, %v failed, %v errors\n", s.connected, s.failed, s.errors)
+	fmt.Printf("voice      %v sent, %v received, %v lost", s.sent, s.received, s.lost)
+	if s.received+s.lost > 0 {
+		fmt.Printf(" (%.2f%% loss)", float64(s.lost)*100/float64(s.received+s.lost))
+	}
+	fmt.Printf("\n")
+	if s.whispersSent > 0 {
+		fmt.Printf("whispers   %v sent, %v received\n", s.whispersSent, s.whispersReceived)
+	}
+	if s.invalid > 0 {
+		fmt.Printf("invalid    %v packets\n", s.invalid)
+	}
+	printDistribution("latency", s.latencies)
+	printDistribution("ping", s.pings)
+}
+
+// Parse the -channels flag.
+func parseChannels(str string) (ids []uint32, err os.Error) {
+	for _, field := range strings.Split(str, ",", -1) {
+		id, err := strconv.Atoui(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+func Usage() {
+	fmt.Fprintf(os.Stderr, "usage: grumble-loadtest [options]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	if *help || *numClients <= 0 || *frameMs <= 0 || *bitrate < 0 {
+		Usage()
+		return
+	}
+
+	ids, err := parseChannels(*channels)
+	if err != nil {
+		log.Fatalf("Invalid channel list: %v", err.String())
+	}
+
+	payloadSize := *bitrate / 8 * *frameMs / 1000
+	if payloadSize < payloadHeaderSize {
+		payloadSize = payloadHeaderSize
+	}
+	cfg := &SimConfig{
+		Addr:          *addr,
+		Password:      *password,
+		PayloadSize:   payloadSize,
+		FrameInterval: int64(*frameMs) * 1e6,
+		WhisperEvery:  *whisper,
+	}
+
+	stats := new(Stats)
+	mutex := new(sync.Mutex)
+	clients := []*SimClient{}
+
+	// Connect all clients before any of them start talking, so every
+	// client hears the whole test.
+	log.Printf("Connecting %v clients to %v", *numClients, *addr)
+	pending := make(chan bool)
+	for i := 0; i < *numClients; i++ {
+		sc := NewSimClient(cfg, stats, fmt.Sprintf("%v-%v", *prefix, i), ids[i%len(ids)])
+		go func() {
+			err := sc.Connect()
+			if err != nil {
+				stats.AddFailed(sc.name, err)
+			} else {
+				stats.AddConnected()
+				mutex.Lock()
+				clients = append(clients, sc)
+				mutex.Unlock()
+			}
+			pending <- true
+		}()
+		time.Sleep(int64(*rampup) * 1e6)
+	}
+	for i := 0; i < *numClients; i++ {
+		<-pending
+	}
+
+	log.Printf("Running for %v seconds with %v clients", *duration, len(clients))
+	finished := make(chan bool)
+	for _, sc := range clients {
+		go func(sc *SimClient) {
+			sc.Run(int64(*duration) * 1e9)
+			finished <- true
+		}(sc)
+	}
+	for _ = range clients {
+		<-finished
+	}
+
+	stats.Report()
+}
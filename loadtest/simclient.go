@@ -0,0 +1,351 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements a simulated Mumble client. A SimClient connects to
+// a server, authenticates, joins a channel and sends synthetic Opus voice
+// packets through the TCP voice tunnel. Every voice packet carries the time
+// it was sent and a sequence number, which lets the receiving SimClients
+// compute end-to-end latency and packet loss.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"io"
+	"mumbleproto"
+	"os"
+	"packetdatastream"
+	"sync"
+	"time"
+)
+
+// The subset of Mumble's TCP message kinds used by the simulator.
+const (
+	MessageVersion      = 0
+	MessageUDPTunnel    = 1
+	MessageAuthenticate = 2
+	MessagePing         = 3
+	MessageReject       = 4
+	MessageServerSync   = 5
+	MessageUserState    = 9
+	MessageVoiceTarget  = 19
+)
+
+const (
+	// The protocol version announced by the simulator
+	ClientVersion = 0x10203
+
+	// Legacy UDP message kind for Opus voice
+	UDPMessageVoiceOpus = 4
+
+	// Voice targets. Whispers go to the VoiceTarget registered by
+	// the simulator, which covers the client's own channel.
+	TargetNormal  = 0
+	TargetWhisper = 1
+
+	// The size of the header at the start of each voice payload:
+	// an 8-byte timestamp, a 4-byte sequence number and the target.
+	payloadHeaderSize = 13
+
+	// The largest message we're willing to read from the server.
+	maxMessageSize = 8 * 1024 * 1024
+)
+
+var ErrRejected = os.NewError("rejected by server")
+
+// Parameters shared by all SimClients of a run.
+type SimConfig struct {
+	Addr     string
+	Password string
+
+	// The size of each voice payload, and the interval at which
+	// voice packets are sent, in nanoseconds.
+	PayloadSize   int
+	FrameInterval int64
+
+	// Send every WhisperEvery'th packet as a whisper. Zero disables
+	// whispering.
+	WhisperEvery int
+}
+
+type SimClient struct {
+	cfg     *SimConfig
+	stats   *Stats
+	name    string
+	channel uint32
+
+	conn    *tls.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	wmutex  sync.Mutex
+	session uint32
+
+	// The Opus frame number and the per-target sequence numbers
+	// of sent voice packets.
+	frame uint64
+	seq   [2]uint32
+
+	// The last seen sequence number, keyed by sender session
+	// and target.
+	lastSeq map[uint64]uint32
+
+	done bool
+}
+
+func NewSimClient(cfg *SimConfig, stats *Stats, name string, channel uint32) *SimClient {
+	return &SimClient{
+		cfg:     cfg,
+		stats:   stats,
+		name:    name,
+		channel: channel,
+		lastSeq: make(map[uint64]uint32),
+	}
+}
+
+// Write a message to the server.
+func (sc *SimClient) sendMessage(kind uint16, buf []byte) (err os.Error) {
+	sc.wmutex.Lock()
+	defer sc.wmutex.Unlock()
+
+	err = binary.Write(sc.writer, binary.BigEndian, kind)
+	if err != nil {
+		return
+	}
+	err = binary.Write(sc.writer, binary.BigEndian, uint32(len(buf)))
+	if err != nil {
+		return
+	}
+	_, err = sc.writer.Write(buf)
+	if err != nil {
+		return
+	}
+	return sc.writer.Flush()
+}
+
+// Write a protobuf-encoded message to the server.
+func (sc *SimClient) sendProtoMessage(kind uint16, msg interface{}) (err os.Error) {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	return sc.sendMessage(kind, buf)
+}
+
+// Read the next message from the server.
+func (sc *SimClient) readMessage() (kind uint16, buf []byte, err os.Error) {
+	var length uint32
+
+	err = binary.Read(sc.reader, binary.BigEndian, &kind)
+	if err != nil {
+		return
+	}
+	err = binary.Read(sc.reader, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	if length > maxMessageSize {
+		return 0, nil, os.NewError("message too large")
+	}
+
+	buf = make([]byte, length)
+	_, err = io.ReadFull(sc.reader, buf)
+	return
+}
+
+// Connect to the server, authenticate and join the client's channel.
+func (sc *SimClient) Connect() (err os.Error) {
+	sc.conn, err = tls.Dial("tcp", sc.cfg.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	sc.reader = bufio.NewReader(sc.conn)
+	sc.writer = bufio.NewWriter(sc.conn)
+
+	err = sc.sendProtoMessage(MessageVersion, &mumbleproto.Version{
+		Version: proto.Uint32(ClientVersion),
+		Release: proto.String("grumble-loadtest"),
+	})
+	if err != nil {
+		return
+	}
+
+	auth := &mumbleproto.Authenticate{Username: proto.String(sc.name)}
+	if len(sc.cfg.Password) > 0 {
+		auth.Password = proto.String(sc.cfg.Password)
+	}
+	err = sc.sendProtoMessage(MessageAuthenticate, auth)
+	if err != nil {
+		return
+	}
+
+	// Wait for the server to tell us our session.
+	for {
+		kind, buf, err := sc.readMessage()
+		if err != nil {
+			return err
+		}
+		if kind == MessageReject {
+			reject := &mumbleproto.Reject{}
+			proto.Unmarshal(buf, reject)
+			if reject.Reason != nil {
+				return os.NewError(fmt.Sprintf("%v: %v", ErrRejected.String(), *reject.Reason))
+			}
+			return ErrRejected
+		}
+		if kind == MessageServerSync {
+			sync := &mumbleproto.ServerSync{}
+			err = proto.Unmarshal(buf, sync)
+			if err != nil {
+				return err
+			}
+			if sync.Session != nil {
+				sc.session = *sync.Session
+			}
+			break
+		}
+	}
+
+	if sc.channel != 0 {
+		err = sc.sendProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session:   proto.Uint32(sc.session),
+			ChannelId: proto.Uint32(sc.channel),
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if sc.cfg.WhisperEvery > 0 {
+		err = sc.sendProtoMessage(MessageVoiceTarget, &mumbleproto.VoiceTarget{
+			Id: proto.Uint32(TargetWhisper),
+			Targets: []*mumbleproto.VoiceTarget_Target{
+				&mumbleproto.VoiceTarget_Target{ChannelId: proto.Uint32(sc.channel)},
+			},
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// Send a synthetic voice packet to target.
+func (sc *SimClient) sendVoice(target byte) os.Error {
+	payload := make([]byte, sc.cfg.PayloadSize)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(time.Nanoseconds()))
+	binary.BigEndian.PutUint32(payload[8:12], sc.seq[target])
+	payload[12] = target
+	sc.seq[target]++
+
+	buf := make([]byte, 1+2*10+len(payload))
+	buf[0] = UDPMessageVoiceOpus<<5 | target
+	pds := packetdatastream.New(buf[1:])
+	pds.PutUint64(sc.frame)
+	pds.PutUint64(uint64(len(payload)))
+	pds.PutBytes(payload)
+	sc.frame++
+
+	return sc.sendMessage(MessageUDPTunnel, buf[0:1+pds.Size()])
+}
+
+// Handle a voice packet tunneled to us by the server.
+func (sc *SimClient) handleVoice(buf []byte) {
+	if len(buf) < 1 || (buf[0]>>5) != UDPMessageVoiceOpus {
+		return
+	}
+
+	pds := packetdatastream.New(buf[1:])
+	session := pds.GetUint32()
+	_ = pds.GetUint64()
+	size := int(pds.GetUint64() &^ 0x2000)
+	if !pds.IsValid() || size < payloadHeaderSize || size > pds.Left() {
+		sc.stats.AddInvalid()
+		return
+	}
+
+	payload := buf[1+pds.Size():]
+	sent := int64(binary.BigEndian.Uint64(payload[0:8]))
+	seq := binary.BigEndian.Uint32(payload[8:12])
+	target := payload[12]
+
+	var lost uint32
+	key := uint64(session)<<8 | uint64(target)
+	last, seen := sc.lastSeq[key]
+	if seen && seq > last+1 {
+		lost = seq - last - 1
+	}
+	if !seen || seq > last {
+		sc.lastSeq[key] = seq
+	}
+
+	sc.stats.AddReceived(target == TargetWhisper, time.Nanoseconds()-sent, int64(lost))
+}
+
+// Read messages from the server until the connection is closed.
+func (sc *SimClient) receiver() {
+	for {
+		kind, buf, err := sc.readMessage()
+		if err != nil {
+			if !sc.done {
+				sc.stats.AddError(sc.name, err)
+			}
+			return
+		}
+
+		switch kind {
+		case MessageUDPTunnel:
+			sc.handleVoice(buf)
+		case MessagePing:
+			ping := &mumbleproto.Ping{}
+			err = proto.Unmarshal(buf, ping)
+			if err == nil && ping.Timestamp != nil {
+				sc.stats.AddPing(time.Nanoseconds() - int64(*ping.Timestamp))
+			}
+		}
+	}
+}
+
+// Send voice until duration nanoseconds have passed, then disconnect.
+func (sc *SimClient) Run(duration int64) {
+	go sc.receiver()
+
+	voice := time.NewTicker(sc.cfg.FrameInterval)
+	defer voice.Stop()
+	ping := time.NewTicker(5e9)
+	defer ping.Stop()
+	end := time.After(duration)
+
+	var err os.Error
+	for n := 1; err == nil; {
+		select {
+		case <-voice.C:
+			target := byte(TargetNormal)
+			if sc.cfg.WhisperEvery > 0 && n%sc.cfg.WhisperEvery == 0 {
+				target = TargetWhisper
+			}
+			err = sc.sendVoice(target)
+			if err == nil {
+				sc.stats.AddSent(target == TargetWhisper)
+			}
+			n++
+		case <-ping.C:
+			err = sc.sendProtoMessage(MessagePing, &mumbleproto.Ping{
+				Timestamp: proto.Uint64(uint64(time.Nanoseconds())),
+			})
+		case <-end:
+			sc.done = true
+			sc.conn.Close()
+			return
+		}
+	}
+
+	sc.stats.AddError(sc.name, err)
+	sc.done = true
+	sc.conn.Close()
+}
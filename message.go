@@ -11,6 +11,8 @@ import (
 	"net"
 	"cryptstate"
 	"fmt"
+	"sort"
+	"time"
 )
 
 // These are the different kinds of messages
@@ -41,6 +43,14 @@ const (
 	MessageUserStats
 	MessageRequestBlob
 	MessageServerConfig
+	MessageSuggestConfig
+	MessagePluginDataTransmission
+)
+
+// Limits for PluginDataTransmission messages
+const (
+	MaxPluginDataLength   = 1000
+	MaxPluginDataIdLength = 100
 )
 
 const (
@@ -48,6 +58,13 @@ const (
 	UDPMessagePing
 	UDPMessageVoiceSpeex
 	UDPMessageVoiceCELTBeta
+	UDPMessageVoiceOpus
+)
+
+// The protocol versions announced by the server
+const (
+	ServerVersion   = 0x10203
+	ServerVersionV2 = 1<<48 | 5<<32
 )
 
 type Message struct {
@@ -63,6 +80,14 @@ type Message struct {
 	// client field should point to that client.
 	client  *Client
 	address net.Addr
+
+	// For connectionless datagrams, the socket to reply from.
+	sock *udpSocket
+
+	// For voice packets, the VoiceBuffer holding buf. The
+	// sender of the message drops its reference once the
+	// message has been sent.
+	vbuf *VoiceBuffer
 }
 
 type VoiceBroadcast struct {
@@ -70,8 +95,40 @@ type VoiceBroadcast struct {
 	client *Client
 	// The VoiceTarget identifier.
 	target byte
-	// The voice packet itself.
-	buf []byte
+	// The voice packet itself, in legacy framing.
+	buf *VoiceBuffer
+	// The voice packet in protobuf framing, for clients that
+	// support it. Only set for Opus packets.
+	pbuf *VoiceBuffer
+}
+
+// Get the voice packet in the framing understood by client, or
+// nil if the packet can't be sent to the client.
+func (vb *VoiceBroadcast) bufFor(client *Client) *VoiceBuffer {
+	if client.usesProtobufUDP() {
+		return vb.pbuf
+	}
+	return vb.buf
+}
+
+// Send the voice packet to client, in the framing it understands.
+func (vb *VoiceBroadcast) sendTo(client *Client) {
+	buf := vb.bufFor(client)
+	if buf == nil {
+		return
+	}
+	buf.Ref()
+	client.sendUdp(&Message{
+		buf:    buf.data,
+		client: client,
+		vbuf:   buf,
+	})
+}
+
+// Drop the broadcast's references to its voice buffers.
+func (vb *VoiceBroadcast) release() {
+	vb.buf.Unref()
+	vb.pbuf.Unref()
 }
 
 func (server *Server) handleCryptSetup(client *Client, msg *Message) {
@@ -85,23 +142,48 @@ func (server *Server) handleCryptSetup(client *Client, msg *Message) {
 	// No client nonce. This means the client
 	// is requesting that we re-sync our nonces.
 	if len(cs.ClientNonce) == 0 {
-		log.Printf("Requested crypt-nonce resync")
+		client.Printf("Requested crypt-nonce resync")
 		cs.ClientNonce = make([]byte, cryptstate.AESBlockSize)
 		if copy(cs.ClientNonce, client.crypt.EncryptIV[0:]) != cryptstate.AESBlockSize {
 			return
 		}
 		client.sendProtoMessage(MessageCryptSetup, cs)
 	} else {
-		log.Printf("Received client nonce")
+		client.Printf("Received client nonce")
 		if len(cs.ClientNonce) != cryptstate.AESBlockSize {
 			return
 		}
 
+		client.decryptMutex.Lock()
 		client.crypt.Resync += 1
-		if copy(client.crypt.DecryptIV[0:], cs.ClientNonce) != cryptstate.AESBlockSize {
-			return
-		}
-		log.Printf("Crypt re-sync successful")
+		copy(client.crypt.DecryptIV[0:], cs.ClientNonce)
+		client.decryptMutex.Unlock()
+		client.Printf("Crypt re-sync successful")
+	}
+}
+
+// Handle an Authenticate message sent by an already authenticated client.
+// Clients send these to update their access token list. For registered
+// users, the new list replaces the stored one, which lets users remove
+// tokens they no longer want.
+func (server *Server) handleAuthenticateTokens(client *Client, msg *Message) {
+	auth := &mumbleproto.Authenticate{}
+	err := proto.Unmarshal(msg.buf, auth)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	client.Tokens = mergeTokens(nil, auth.Tokens)
+	if client.user != nil {
+		client.user.Tokens = client.Tokens
+	}
+	server.redeemInvites(client, client.Tokens)
+
+	// Tokens affect group membership, so permissions must be re-evaluated.
+	server.ClearACLCache()
+	if client.Channel != nil {
+		server.sendClientPermissions(client, client.Channel)
 	}
 }
 
@@ -113,8 +195,8 @@ func (server *Server) handlePingMessage(client *Client, msg *Message) {
 		return
 	}
 
-	// Phony response for ping messages. We don't keep stats
-	// for this yet.
+	server.updateNetQuality(client, ping)
+
 	client.sendProtoMessage(MessagePing, &mumbleproto.Ping{
 		Timestamp: ping.Timestamp,
 		Good:      proto.Uint32(uint32(client.crypt.Good)),
@@ -176,6 +258,15 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 		// fixme(mkrautz): Check length
 	}
 
+	// Check the length of the channel's enter, join and leave messages.
+	for _, text := range []*string{chanstate.EnterMessage, chanstate.JoinMessage, chanstate.LeaveMessage} {
+		if text != nil && len(*text) > MaxChannelMessageLength {
+			client.sendPermissionDeniedType("TextTooLong")
+			return
+		}
+	}
+	setsMessages := chanstate.EnterMessage != nil || chanstate.JoinMessage != nil || chanstate.LeaveMessage != nil
+
 	// Extract the the name of channel and check whether it's valid.
 	// A valid channel name is a name that:
 	//  a) Isn't already used by a channel at the same level as the channel itself (that is, channels
@@ -226,6 +317,10 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			client.sendPermissionDeniedTypeUser("MissingCertificate", client)
 			return
 		}
+		if reason := server.channelCreationDenied(client); len(reason) > 0 {
+			client.sendPermissionDeniedText(reason)
+			return
+		}
 
 		// We can't add channels to a temporary channel
 		if parent.Temporary {
@@ -246,6 +341,10 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 		channel.DescriptionBlob = key
 		channel.Temporary = *chanstate.Temporary
 		channel.Position = int(*chanstate.Position)
+		channel.setMessages(chanstate)
+		if chanstate.MaxBitrate != nil {
+			channel.MaxBitrate = int(*chanstate.MaxBitrate)
+		}
 		parent.AddChild(channel)
 
 		// Add the creator to the channel's admin group
@@ -256,8 +355,10 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 		}
 
 		// If the client wouldn't have WritePermission in the just-created channel,
-		// add a +write ACL for the user's hash.
-		if !server.HasPermission(client, channel, WritePermission) {
+		// add a +write ACL for the user's hash. The creator of a temporary channel
+		// is always granted ownership of it, since unregistered users can't be
+		// members of the admin group.
+		if channel.Temporary || !server.HasPermission(client, channel, WritePermission) {
 			acl := NewChannelACL(channel)
 			acl.ApplyHere = true
 			acl.ApplySubs = true
@@ -268,6 +369,9 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			}
 			acl.Deny = Permission(NonePermission)
 			acl.Allow = Permission(WritePermission | TraversePermission)
+			if channel.Temporary {
+				acl.Allow = Permission(TempChannelOwnerPermissions)
+			}
 
 			channel.ACL = append(channel.ACL, acl)
 
@@ -328,6 +432,22 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			}
 		}
 
+		// Enter, join or leave message change
+		if setsMessages {
+			if !server.HasPermission(client, channel, WritePermission) {
+				client.sendPermissionDenied(client, channel, WritePermission)
+				return
+			}
+		}
+
+		// Bitrate limit change
+		if chanstate.MaxBitrate != nil {
+			if !server.HasPermission(client, channel, WritePermission) {
+				client.sendPermissionDenied(client, channel, WritePermission)
+				return
+			}
+		}
+
 		// Parent change (channel move)
 		if parent != nil {
 			// No-op?
@@ -426,6 +546,17 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			channel.Position = int(*chanstate.Position)
 		}
 
+		// Enter, join or leave message change
+		channel.setMessages(chanstate)
+
+		// Bitrate limit change
+		if chanstate.MaxBitrate != nil {
+			channel.MaxBitrate = int(*chanstate.MaxBitrate)
+			for _, member := range channel.clients {
+				server.updateClientBitrate(member, channel)
+			}
+		}
+
 		// Add links
 		for _, iter := range linkadd {
 			server.LinkChannels(channel, iter)
@@ -594,31 +725,40 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 
 	// Texture change
 	if userstate.Texture != nil {
-		// Check the length of the texture
+		texture, err := server.processTexture(userstate.Texture)
+		if err != nil {
+			client.Printf("Rejected texture from client %v: %v", client.Session, err.String())
+			client.sendPermissionDeniedType("TextTooLong")
+			return
+		}
+		userstate.Texture = texture
 	}
 
-	// Registration
-	if userstate.UserId != nil {
-		// If user == actor, check for SelfRegisterPermission on root channel.
-		// If user != actor, check for RegisterPermission permission on root channel.
-		permCheck := Permission(NonePermission)
-		uid := *userstate.UserId
-		if target == actor {
-			permCheck = SelfRegisterPermission
-		} else {
-			permCheck = RegisterPermission
-		}
-		if uid >= 0 || !server.HasPermission(actor, server.root, SelfRegisterPermission) {
-			client.sendPermissionDenied(actor, server.root, permCheck)
+	// Channel listeners
+	if len(userstate.ListeningChannelAdd) > 0 || len(userstate.ListeningChannelRemove) > 0 {
+		// Clients may only change their own listeners.
+		if actor != target {
+			client.Panic("Cannot change another user's channel listeners")
 			return
 		}
 
-		// We can't register a user with an empty hash.
-		if len(target.CertHash) == 0 {
-			client.sendPermissionDeniedTypeUser("MissingCertificate", target)
+		for _, cid := range userstate.ListeningChannelAdd {
+			channel, ok := server.Channels[int(cid)]
+			if !ok {
+				return
+			}
+			if !server.HasPermission(target, channel, ListenPermission) {
+				client.sendPermissionDenied(target, channel, ListenPermission)
+				return
+			}
 		}
 	}
 
+	// Registration. See register.go.
+	if userstate.UserId != nil && !server.checkRegistration(actor, target) {
+		return
+	}
+
 	// Prevent self-targetting state changes to be applied to other users
 	// That is, if actor != user, then:
 	//   Discard message if it has any of the following things set:
@@ -693,6 +833,10 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 	}
 
 	if userstate.Mute != nil || userstate.Deaf != nil || userstate.Suppress != nil || userstate.PrioritySpeaker != nil {
+		if userstate.Mute != nil || userstate.Deaf != nil {
+			// Timed mutes become permanent when changed by a user.
+			target.setMuteExpiry(0, 0)
+		}
 		if userstate.Deaf != nil {
 			target.Deaf = *userstate.Deaf
 			if target.Deaf {
@@ -733,10 +877,31 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		broadcast = true
 	}
 
-	if userstate.UserId != nil {
-		// fixme(mkrautz): Registration is currently unhandled.
-		log.Printf("handleUserState: (Self)Register not implemented yet!")
+	if userstate.UserId != nil && actor == target && userstate.Email != nil && emailVerification() {
+		// Self-registrations with an email address are only
+		// activated once the address is verified. See verify.go.
+		if err := server.registerPending(target, *userstate.Email); err != nil {
+			target.Printf("Unable to register: %v", err.String())
+		}
 		userstate.UserId = nil
+		userstate.Email = nil
+	} else if userstate.UserId != nil {
+		user, err := server.RegisterClient(target)
+		if err != nil {
+			target.Printf("Unable to register: %v", err.String())
+			userstate.UserId = nil
+		} else {
+			if actor != target {
+				actor.Printf("Registered session %v as user %v (%v)", target.Session, user.Id, user.Name)
+			}
+			userstate.UserId = proto.Uint32(user.Id)
+			if userstate.Email != nil {
+				user.Email = *userstate.Email
+				userstate.Email = nil
+			}
+			server.sendClientPermissions(target, target.Channel)
+			broadcast = true
+		}
 	}
 
 	if userstate.ChannelId != nil {
@@ -747,6 +912,25 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		}
 	}
 
+	if len(userstate.ListeningChannelAdd) > 0 || len(userstate.ListeningChannelRemove) > 0 {
+		for _, cid := range userstate.ListeningChannelAdd {
+			channel := server.Channels[int(cid)]
+			if _, listening := target.listening[channel.Id]; !listening {
+				channel.AddListener(target)
+				server.broadcastListenerCount(channel)
+			}
+		}
+		for _, cid := range userstate.ListeningChannelRemove {
+			channel, ok := target.listening[int(cid)]
+			if ok {
+				channel.RemoveListener(target)
+				server.broadcastListenerCount(channel)
+			}
+		}
+		server.storeListeners(target)
+		broadcast = true
+	}
+
 	if broadcast {
 		// This variable denotes the length of a zlib-encoded "old-style" texture.
 		// Mumble and Murmur used qCompress and qUncompress from Qt to compress
@@ -825,15 +1009,34 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 
 	clients := make(map[uint32]*Client)
 
-	// Tree
+	// Tree. The client must have TextMessage permission in the root of
+	// each tree. Sub-channels it may not message are skipped, along
+	// with their own sub-channels.
+	visited := make(map[int]bool)
 	for _, chanid := range txtmsg.TreeId {
-		if channel, ok := server.Channels[int(chanid)]; ok {
-			if !server.HasPermission(client, channel, TextMessagePermission) {
-				client.sendPermissionDenied(client, channel, TextMessagePermission)
+		channel, ok := server.Channels[int(chanid)]
+		if !ok {
+			continue
+		}
+		if !server.HasPermission(client, channel, TextMessagePermission) {
+			client.sendPermissionDenied(client, channel, TextMessagePermission)
+			return
+		}
+
+		queue := []*Channel{channel}
+		for len(queue) > 0 {
+			channel = queue[0]
+			queue = queue[1:]
+			if visited[channel.Id] || !server.HasPermission(client, channel, TextMessagePermission) {
+				continue
 			}
+			visited[channel.Id] = true
 			for _, target := range channel.clients {
 				clients[target.Session] = target
 			}
+			for _, child := range channel.children {
+				queue = append(queue, child)
+			}
 		}
 	}
 
@@ -853,8 +1056,8 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 	// Direct-to-clients
 	for _, session := range txtmsg.Session {
 		if target, ok := server.clients[session]; ok {
-			if !server.HasPermission(client, target.Channel, TextMessagePermission) {
-				client.sendPermissionDenied(client, target.Channel, TextMessagePermission)
+			if !server.HasPermission(client, target.Channel, PrivateMessagePermission) {
+				client.sendPermissionDeniedText("You may not send private messages to " + target.ShownName() + ".")
 				return
 			}
 			clients[session] = target
@@ -864,12 +1067,38 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 	// Remove ourselves
 	clients[client.Session] = nil, false
 
+	// Run the message through the word filter. See wordfilter.go.
+	if txtmsg.Message != nil {
+		text, ok := server.filterTextMessage(client, *txtmsg.Message)
+		if !ok {
+			return
+		}
+		txtmsg.Message = proto.String(text)
+	}
+
+	// Recipients are told how the message was addressed, so clients
+	// can tell tree, channel and private messages apart.
 	for _, target := range clients {
 		target.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
-			Actor:   proto.Uint32(client.Session),
-			Message: txtmsg.Message,
+			Actor:     proto.Uint32(client.Session),
+			Session:   txtmsg.Session,
+			ChannelId: txtmsg.ChannelId,
+			TreeId:    txtmsg.TreeId,
+			Message:   txtmsg.Message,
 		})
 	}
+
+	// Relay channel messages to the channels' text bridges. See
+	// bridge.go.
+	if len(server.bridges) > 0 {
+		text := plainText(*txtmsg.Message)
+		bridged := append(append([]uint32{}, txtmsg.ChannelId...), txtmsg.TreeId...)
+		for _, chanid := range bridged {
+			if channel, ok := server.Channels[int(chanid)]; ok {
+				server.relayToBridges(channel, nil, client.ShownName(), text)
+			}
+		}
+	}
 }
 
 // ACL set/query
@@ -878,6 +1107,7 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 	err := proto.Unmarshal(msg.buf, acl)
 	if err != nil {
 		client.Panic(err.String())
+		return
 	}
 
 	// Look up the channel this ACL message operates on.
@@ -994,75 +1224,43 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 			reply.Groups = append(reply.Groups, mpgroup)
 		}
 
-		if err := client.sendProtoMessage(MessageACL, reply); err != nil {
-			client.Panic(err.String())
-		}
-
-		// Map the user ids in the user map to usernames of users.
-		// fixme(mkrautz): This requires a persistent datastore, because it retrieves registered users.
+		// Map the user ids in the user map to usernames of users, so
+		// the client's ACL editor can show them.
 		queryusers := &mumbleproto.QueryUsers{}
 		for uid, _ := range users {
+			user, ok := server.Users[uint32(uid)]
+			if !ok {
+				continue
+			}
 			queryusers.Ids = append(queryusers.Ids, uint32(uid))
-			queryusers.Names = append(queryusers.Names, "Unknown")
+			queryusers.Names = append(queryusers.Names, user.Name)
 		}
 		if len(queryusers.Ids) > 0 {
-			client.sendProtoMessage(MessageQueryUsers, reply)
-		}
-
-		// Set new groups and ACLs
-	} else {
-
-		// Get old temporary members
-		oldtmp := map[string]map[int]bool{}
-		for name, grp := range channel.Groups {
-			oldtmp[name] = grp.Temporary
-		}
-
-		// Clear current ACLs and groups
-		channel.ACL = []*ChannelACL{}
-		channel.Groups = map[string]*Group{}
-
-		// Add the received groups to the channel.
-		channel.InheritACL = *acl.InheritAcls
-		for _, pbgrp := range acl.Groups {
-			changroup := NewGroup(channel, *pbgrp.Name)
-
-			changroup.Inherit = *pbgrp.Inherit
-			changroup.Inheritable = *pbgrp.Inheritable
-			for _, uid := range pbgrp.Add {
-				changroup.Add[int(uid)] = true
-			}
-			for _, uid := range pbgrp.Remove {
-				changroup.Remove[int(uid)] = true
-			}
-			if temp, ok := oldtmp[*pbgrp.Name]; ok {
-				changroup.Temporary = temp
+			if err := client.sendProtoMessage(MessageQueryUsers, queryusers); err != nil {
+				client.Panic(err.String())
+				return
 			}
+		}
 
-			channel.Groups[changroup.Name] = changroup
+		if err := client.sendProtoMessage(MessageACL, reply); err != nil {
+			client.Panic(err.String())
 		}
-		// Add the received ACLs to the channel.
-		for _, pbacl := range acl.Acls {
-			chanacl := NewChannelACL(channel)
 
-			chanacl.ApplyHere = *pbacl.ApplyHere
-			chanacl.ApplySubs = *pbacl.ApplySubs
-			if pbacl.UserId != nil {
-				chanacl.UserId = int(*pbacl.UserId)
-			} else {
-				chanacl.Group = *pbacl.Group
-			}
-			chanacl.Deny = Permission(*pbacl.Deny & AllPermissions)
-			chanacl.Allow = Permission(*pbacl.Grant & AllPermissions)
+		// Set new groups and ACLs
+	} else {
+		subtree := channelSubtree(channel, nil)
+		before := server.permissionSnapshot(subtree)
 
-			channel.ACL = append(channel.ACL, chanacl)
+		if err := server.applyACL(channel, acl); err != nil {
+			client.Printf("Invalid ACL for channel %v: %v", channel.Id, err.String())
+			client.sendPermissionDeniedText("Invalid ACL: " + err.String())
+			return
 		}
-
-		// Clear the server's ACL cache
 		server.ClearACLCache()
 
-		// Regular user?
-		if !server.HasPermission(client, channel, WritePermission) && client.IsRegistered() || client.HasCertificate() {
+		// If the client removed its own Write permission, give it back
+		// through an ACL entry of its own, so it isn't locked out.
+		if !server.HasPermission(client, channel, WritePermission) && (client.IsRegistered() || client.HasCertificate()) {
 			chanacl := NewChannelACL(channel)
 
 			chanacl.ApplyHere = true
@@ -1076,11 +1274,10 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 			chanacl.Allow = Permission(WritePermission | TraversePermission)
 
 			channel.ACL = append(channel.ACL, chanacl)
-
-			server.ClearACLCache()
 		}
 
-		// fixme(mkrautz): Sync channel to datastore
+		client.Printf("Updated ACL of channel %v (%v groups, %v entries)", channel.Id, len(channel.Groups), len(channel.ACL))
+		server.flushPermissions(subtree, before)
 	}
 }
 
@@ -1088,6 +1285,95 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 func (server *Server) handleQueryUsers(client *Client, msg *Message) {
 }
 
+// Registered user list. An empty UserList message is a request for the list
+// of registered users. Otherwise, each entry renames a registered user, or
+// removes the registration if the entry has an empty name.
+func (server *Server) handleUserListMessage(client *Client, msg *Message) {
+	userlist := &mumbleproto.UserList{}
+	err := proto.Unmarshal(msg.buf, userlist)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if !server.HasPermission(client, server.root, RegisterPermission) {
+		client.sendPermissionDenied(client, server.root, RegisterPermission)
+		return
+	}
+
+	if len(userlist.Users) == 0 {
+		users := userIdSlice{}
+		for _, user := range server.Users {
+			if user.Id != 0 {
+				users = append(users, user)
+			}
+		}
+		sort.Sort(users)
+
+		for _, user := range users {
+			entry := &mumbleproto.UserList_User{
+				UserId:      proto.Uint32(user.Id),
+				Name:        proto.String(user.Name),
+				LastChannel: proto.Uint32(uint32(user.LastChannelId)),
+			}
+			if user.LastActive > 0 {
+				entry.LastSeen = proto.String(time.SecondsToUTC(int64(user.LastActive)).Format("2006-01-02T15:04:05"))
+			}
+			if user.LastConnect > 0 {
+				entry.LastConnect = proto.Uint64(user.LastConnect)
+			}
+			if user.LastDisconnect > 0 {
+				entry.LastDisconnect = proto.Uint64(user.LastDisconnect)
+			}
+			userlist.Users = append(userlist.Users, entry)
+		}
+
+		if err := client.sendProtoMessage(MessageUserList, userlist); err != nil {
+			client.Panic(err.String())
+		}
+		return
+	}
+
+	for _, entry := range userlist.Users {
+		if entry.UserId == nil {
+			continue
+		}
+		user, exists := server.Users[*entry.UserId]
+		if !exists || user.Id == 0 {
+			continue
+		}
+
+		if entry.Name == nil || len(*entry.Name) == 0 {
+			client.Printf("Removed registration of user %v (%v)", user.Id, user.Name)
+			server.RemoveRegistration(user)
+			continue
+		}
+
+		name := *entry.Name
+		if name == user.Name {
+			continue
+		}
+		if _, taken := server.UserNameMap[name]; taken || !server.validUserName(name) {
+			client.sendPermissionDeniedType("UserName")
+			continue
+		}
+		client.Printf("Renamed user %v from %v to %v", user.Id, user.Name, name)
+
+		server.UserNameMap[user.Name] = nil, false
+		user.Name = name
+		server.UserNameMap[name] = user
+
+		for _, target := range server.clients {
+			if target.user == user {
+				server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+					Session: proto.Uint32(target.Session),
+					Name:    proto.String(name),
+				})
+			}
+		}
+	}
+}
+
 // User stats message. Shown in the Mumble client when a
 // user right clicks a user and selects 'User Information'.
 func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
@@ -1095,9 +1381,42 @@ func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
 	err := proto.Unmarshal(msg.buf, stats)
 	if err != nil {
 		client.Panic(err.String())
+		return
+	}
+
+	target := client
+	if stats.Session != nil {
+		var exists bool
+		target, exists = server.clients[*stats.Session]
+		if !exists {
+			return
+		}
+	}
+
+	// fixme(mkrautz): Fill in the remaining statistics.
+	packets, talkTime, userPackets, userTalkTime := target.talkStatistics()
+	reply := &mumbleproto.UserStats{
+		Session:      proto.Uint32(target.Session),
+		StatsOnly:    proto.Bool(true),
+		TalkTime:     proto.Uint64(talkTime),
+		VoicePackets: proto.Uint64(packets),
 	}
+	if target.IsRegistered() {
+		reply.TotalTalkTime = proto.Uint64(userTalkTime)
+		reply.TotalVoicePackets = proto.Uint64(userPackets)
+	}
+	if len(target.Country) > 0 {
+		reply.Country = proto.String(target.Country)
+	}
+	if addr := server.visibleAddr(client, target.tcpaddr.IP); addr != nil {
+		reply.Address = addr.To16()
+	}
+	target.fillNetStats(reply)
+	reply.StrongCertificate = proto.Bool(target.StrongCertificate)
 
-	log.Printf("UserStats")
+	if err := client.sendProtoMessage(MessageUserStats, reply); err != nil {
+		client.Panic(err.String())
+	}
 }
 
 // Permission query
@@ -1198,3 +1517,45 @@ func (server *Server) handleRequestBlob(client *Client, msg *Message) {
 		}
 	}
 }
+
+// Route plugin data between clients
+func (server *Server) handlePluginDataTransmission(client *Client, msg *Message) {
+	pdt := &mumbleproto.PluginDataTransmission{}
+	err := proto.Unmarshal(msg.buf, pdt)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if client.pluginBucket.Ratelimit(1) {
+		return
+	}
+
+	if len(pdt.Data) > MaxPluginDataLength {
+		client.Printf("Dropping plugin data from client %v: data too long", client.Session)
+		return
+	}
+	if pdt.DataID != nil && len(*pdt.DataID) > MaxPluginDataIdLength {
+		client.Printf("Dropping plugin data from client %v: data id too long", client.Session)
+		return
+	}
+
+	receivers := pdt.ReceiverSessions
+
+	// Receivers only need to know who sent the data.
+	pdt.SenderSession = proto.Uint32(client.Session)
+	pdt.ReceiverSessions = nil
+
+	sent := make(map[uint32]bool)
+	for _, session := range receivers {
+		if sent[session] || session == client.Session {
+			continue
+		}
+		target, ok := server.clients[session]
+		if !ok || target.state != StateClientReady || target.Version < 0x10400 {
+			continue
+		}
+		target.sendProtoMessage(MessagePluginDataTransmission, pdt)
+		sent[session] = true
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-session network quality statistics. Packet
+// loss and reordering are taken from the crypt state: the server's own
+// counters for packets received from the client, and the counters the
+// client reports in its TCP pings for packets received from the server.
+// The client's ping round-trip times are taken from its TCP pings too.
+//
+// Jitter is estimated from the client's UDP pings, using the
+// interarrival jitter estimator of RFC 3550: the difference between
+// the spacing of the pings' arrival times and the spacing of their
+// timestamps, smoothed over time. Clients timestamp UDP pings in
+// microseconds.
+//
+// The rolling values are sent in UserStats, exported as per-session
+// counters, and logged when a session ends.
+//
+// The crypt state counters are also summed over all sessions, per
+// direction, so that loss on the network (lost and late packets) can be
+// told apart from crypt problems (resyncs). The size of the replay
+// window that decides whether a packet is late, lost or undecryptable is
+// set by the CryptLateWindow and CryptLostWindow config keys.
+
+import (
+	"cryptstate"
+	"expvar"
+	"goprotobuf.googlecode.com/hg/proto"
+	"math"
+	"mumbleproto"
+	"packetdatastream"
+	"sync"
+	"time"
+)
+
+// Internal counters, exported via /debug/vars
+var (
+	// The packet loss from and to each session (in tenths of a
+	// percent), and the jitter of each session's UDP pings (in
+	// microseconds).
+	sessionLossFromClient = newSessionCounter("grumble.netquality.lossfromclient")
+	sessionLossToClient   = newSessionCounter("grumble.netquality.losstoclient")
+	sessionJitter         = newSessionCounter("grumble.netquality.jitter")
+
+	// The crypt state counters of all sessions, for packets from and
+	// to clients: good, late, lost and resync.
+	cryptFromClient = expvar.NewMap("grumble.crypt.fromclient")
+	cryptToClient   = expvar.NewMap("grumble.crypt.toclient")
+)
+
+type netQuality struct {
+	mutex sync.Mutex
+
+	// Ping statistics reported by the client, in milliseconds.
+	udpPingAvg float32
+	udpPingVar float32
+	tcpPingAvg float32
+	tcpPingVar float32
+	udpPackets uint32
+	tcpPackets uint32
+
+	// The timestamp and arrival time of the last UDP ping, and the
+	// jitter estimate, in nanoseconds.
+	lastStamp   int64
+	lastArrival int64
+	jitter      float64
+
+	// The values last exported to the per-session counters, and the
+	// crypt state counters last added to the totals.
+	exported      [3]int64
+	cryptExported [8]int
+}
+
+// Add the change in the crypt state counters since they were last
+// exported to the totals.
+func (nq *netQuality) exportCrypt(crypt *cryptstate.CryptState) {
+	nq.mutex.Lock()
+	defer nq.mutex.Unlock()
+
+	values := [8]int{
+		crypt.Good, crypt.Late, crypt.Lost, crypt.Resync,
+		crypt.RemoteGood, crypt.RemoteLate, crypt.RemoteLost, crypt.RemoteResync,
+	}
+	names := []string{"good", "late", "lost", "resync"}
+	for i, name := range names {
+		cryptFromClient.Add(name, int64(values[i]-nq.cryptExported[i]))
+		cryptToClient.Add(name, int64(values[i+4]-nq.cryptExported[i+4]))
+	}
+	nq.cryptExported = values
+}
+
+// Count a UDP ping with the given client timestamp (in microseconds)
+// arriving at now.
+func (nq *netQuality) countUDPPing(stamp uint64, now int64) {
+	nq.mutex.Lock()
+	defer nq.mutex.Unlock()
+
+	ts := int64(stamp) * 1e3
+	if nq.lastArrival > 0 && ts > nq.lastStamp {
+		d := float64((now - nq.lastArrival) - (ts - nq.lastStamp))
+		nq.jitter += (math.Fabs(d) - nq.jitter) / 16
+	}
+	if ts > nq.lastStamp {
+		nq.lastStamp = ts
+		nq.lastArrival = now
+	}
+}
+
+// Record the statistics reported in a client's TCP ping.
+func (nq *netQuality) updateFromPing(ping *mumbleproto.Ping) {
+	nq.mutex.Lock()
+	defer nq.mutex.Unlock()
+
+	if ping.UdpPingAvg != nil {
+		nq.udpPingAvg = *ping.UdpPingAvg
+	}
+	if ping.UdpPingVar != nil {
+		nq.udpPingVar = *ping.UdpPingVar
+	}
+	if ping.TcpPingAvg != nil {
+		nq.tcpPingAvg = *ping.TcpPingAvg
+	}
+	if ping.TcpPingVar != nil {
+		nq.tcpPingVar = *ping.TcpPingVar
+	}
+	if ping.UdpPackets != nil {
+		nq.udpPackets = *ping.UdpPackets
+	}
+	if ping.TcpPackets != nil {
+		nq.tcpPackets = *ping.TcpPackets
+	}
+}
+
+// Get the jitter estimate, in nanoseconds.
+func (nq *netQuality) getJitter() float64 {
+	nq.mutex.Lock()
+	defer nq.mutex.Unlock()
+	return nq.jitter
+}
+
+// Get the percentage of packets lost, given the crypt state counters.
+func lossPercent(good, late, lost int) float64 {
+	total := good + late + lost
+	if total == 0 {
+		return 0
+	}
+	return float64(lost) * 100 / float64(total)
+}
+
+// Handle the UDP ping in data, sent by client over UDP.
+//
+// This method is called from the client's udpreceiver goroutine.
+func (client *Client) countUDPPing(data []byte) {
+	var stamp uint64
+	if client.usesProtobufUDP() {
+		ping := &mumbleproto.UDPPing{}
+		if proto.Unmarshal(data[1:], ping) != nil || ping.Timestamp == nil {
+			return
+		}
+		stamp = *ping.Timestamp
+	} else {
+		pds := packetdatastream.New(data[1:])
+		stamp = pds.GetUint64()
+		if !pds.IsValid() {
+			return
+		}
+	}
+	client.netq.countUDPPing(stamp, time.Nanoseconds())
+}
+
+// Handle the statistics in a TCP ping sent by client.
+func (server *Server) updateNetQuality(client *Client, ping *mumbleproto.Ping) {
+	if ping.Good != nil {
+		client.crypt.RemoteGood = int(*ping.Good)
+	}
+	if ping.Late != nil {
+		client.crypt.RemoteLate = int(*ping.Late)
+	}
+	if ping.Lost != nil {
+		client.crypt.RemoteLost = int(*ping.Lost)
+	}
+	if ping.Resync != nil {
+		client.crypt.RemoteResync = int(*ping.Resync)
+	}
+	client.netq.updateFromPing(ping)
+
+	// Export the new values. The per-session counters only support
+	// adding, so add the difference to the last exported values.
+	crypt := client.crypt
+	values := [3]int64{
+		int64(lossPercent(crypt.Good, crypt.Late, crypt.Lost) * 10),
+		int64(lossPercent(crypt.RemoteGood, crypt.RemoteLate, crypt.RemoteLost) * 10),
+		int64(client.netq.getJitter() / 1e3),
+	}
+	key := server.sessionKey(client)
+	client.netq.mutex.Lock()
+	sessionLossFromClient.Add(key, values[0]-client.netq.exported[0])
+	sessionLossToClient.Add(key, values[1]-client.netq.exported[1])
+	sessionJitter.Add(key, values[2]-client.netq.exported[2])
+	client.netq.exported = values
+	client.netq.mutex.Unlock()
+
+	client.netq.exportCrypt(crypt)
+}
+
+// Fill in the network statistics of client in a UserStats message.
+func (client *Client) fillNetStats(stats *mumbleproto.UserStats) {
+	crypt := client.crypt
+	if crypt == nil {
+		return
+	}
+	stats.FromClient = &mumbleproto.UserStats_Stats{
+		Good:   proto.Uint32(uint32(crypt.Good)),
+		Late:   proto.Uint32(uint32(crypt.Late)),
+		Lost:   proto.Uint32(uint32(crypt.Lost)),
+		Resync: proto.Uint32(uint32(crypt.Resync)),
+	}
+	stats.FromServer = &mumbleproto.UserStats_Stats{
+		Good:   proto.Uint32(uint32(crypt.RemoteGood)),
+		Late:   proto.Uint32(uint32(crypt.RemoteLate)),
+		Lost:   proto.Uint32(uint32(crypt.RemoteLost)),
+		Resync: proto.Uint32(uint32(crypt.RemoteResync)),
+	}
+
+	nq := &client.netq
+	nq.mutex.Lock()
+	defer nq.mutex.Unlock()
+	stats.UdpPackets = proto.Uint32(nq.udpPackets)
+	stats.TcpPackets = proto.Uint32(nq.tcpPackets)
+	stats.UdpPingAvg = proto.Float32(nq.udpPingAvg)
+	stats.UdpPingVar = proto.Float32(nq.udpPingVar)
+	stats.TcpPingAvg = proto.Float32(nq.tcpPingAvg)
+	stats.TcpPingVar = proto.Float32(nq.tcpPingVar)
+	stats.Jitter = proto.Float32(float32(nq.jitter / 1e6))
+}
+
+// Log the network quality of a session that has ended, and remove its
+// per-session counters.
+func (server *Server) finishNetQuality(client *Client) {
+	key := server.sessionKey(client)
+	sessionLossFromClient.Remove(key)
+	sessionLossToClient.Remove(key)
+	sessionJitter.Remove(key)
+
+	crypt := client.crypt
+	if crypt == nil {
+		return
+	}
+	client.netq.exportCrypt(crypt)
+	client.Printf("Network quality: from client %v good, %v late, %v lost, %v resync (%.1f%% loss); to client %v good, %v late, %v lost, %v resync (%.1f%% loss); UDP ping %.1fms, jitter %.1fms",
+		crypt.Good, crypt.Late, crypt.Lost, crypt.Resync, lossPercent(crypt.Good, crypt.Late, crypt.Lost),
+		crypt.RemoteGood, crypt.RemoteLate, crypt.RemoteLost, crypt.RemoteResync, lossPercent(crypt.RemoteGood, crypt.RemoteLate, crypt.RemoteLost),
+		client.netq.udpPingAvg, client.netq.getJitter()/1e6)
+}
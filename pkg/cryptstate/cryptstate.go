@@ -14,6 +14,12 @@ import (
 const AESBlockSize        = 16
 const DecryptHistorySize  = 0x100
 
+// The default replay window. See CryptState.SetWindow.
+const (
+	DefaultLateWindow = 30
+	DefaultLostWindow = 128
+)
+
 type CryptState struct {
 	RawKey [AESBlockSize]byte
 	EncryptIV [AESBlockSize]byte
@@ -30,15 +36,51 @@ type CryptState struct {
 	RemoteLost int
 	RemoteResync int
 
+	// The replay window. See SetWindow.
+	LateWindow int
+	LostWindow int
+
 	cipher *aes.Cipher
+
+	// Scratch space for encryption and decryption, so that neither
+	// allocates per packet. Encryption and decryption get separate
+	// buffers, since they're called from different goroutines.
+	encScratch ocbScratch
+	decScratch ocbScratch
+}
+
+type ocbScratch struct {
+	delta    [AESBlockSize]byte
+	checksum [AESBlockSize]byte
+	tmp      [AESBlockSize]byte
+	pad      [AESBlockSize]byte
+	tag      [AESBlockSize]byte
+	saveiv   [AESBlockSize]byte
 }
 
 func New() (cs *CryptState, err os.Error) {
 	cs = new(CryptState)
+	cs.LateWindow = DefaultLateWindow
+	cs.LostWindow = DefaultLostWindow
 
 	return
 }
 
+// Set the replay window. Packets arriving fewer than late packets after
+// later ones are accepted (once), and up to lost packets may be skipped
+// between two packets arriving in order. Packets outside the window fail
+// to decrypt until the client resyncs. Both are limited to half of the
+// decrypt history.
+func (cs *CryptState) SetWindow(late int, lost int) (err os.Error) {
+	if late < 1 || late > DecryptHistorySize/2 || lost < 1 || lost > DecryptHistorySize/2 {
+		err = os.NewError("Invalid replay window")
+		return
+	}
+	cs.LateWindow = late
+	cs.LostWindow = lost
+	return
+}
+
 func (cs *CryptState) GenerateKey() (err os.Error) {
 	rand.Read(cs.RawKey[0:])
 	rand.Read(cs.EncryptIV[0:])
@@ -88,8 +130,8 @@ func (cs *CryptState) Decrypt(dst, src []byte) (err os.Error) {
 		return
 	}
 
-	var saveiv [AESBlockSize]byte
-	var tag [AESBlockSize]byte
+	saveiv := cs.decScratch.saveiv[0:]
+	tag := cs.decScratch.tag[0:]
 	var ivbyte byte
 	var restore bool
 	lost := 0
@@ -128,13 +170,13 @@ func (cs *CryptState) Decrypt(dst, src []byte) (err os.Error) {
 			diff = diff + 256
 		}
 
-		if ivbyte < cs.DecryptIV[0] && diff > -30 && diff < 0 {
+		if ivbyte < cs.DecryptIV[0] && diff > -cs.LateWindow && diff < 0 {
 			// Late packet, but no wraparound
 			late = 1
 			lost = -1
 			cs.DecryptIV[0] = ivbyte
 			restore = true
-		} else if ivbyte > cs.DecryptIV[0] && diff > -30 && diff < 0 {
+		} else if ivbyte > cs.DecryptIV[0] && diff > -cs.LateWindow && diff < 0 {
 			// Last was 0x02, here comes 0xff from last round
 			late = 1
 			lost = -1
@@ -146,11 +188,11 @@ func (cs *CryptState) Decrypt(dst, src []byte) (err os.Error) {
 				}
 			}
 			restore = true
-		} else if ivbyte > cs.DecryptIV[0] && diff > 0 {
+		} else if ivbyte > cs.DecryptIV[0] && diff > 0 && diff <= cs.LostWindow {
 			// Lost a few packets, but beyond that we're good.
 			lost = int(ivbyte - cs.DecryptIV[0] - 1)
 			cs.DecryptIV[0] = ivbyte
-		} else if ivbyte < cs.DecryptIV[0] && diff > 0 {
+		} else if ivbyte < cs.DecryptIV[0] && diff > 0 && diff <= cs.LostWindow {
 			// Lost a few packets, and wrapped around
 			lost = int(256 - int(cs.DecryptIV[0]) + int(ivbyte) - 1)
 			cs.DecryptIV[0] = ivbyte
@@ -205,7 +247,7 @@ func (cs *CryptState) Decrypt(dst, src []byte) (err os.Error) {
 }
 
 func (cs *CryptState) Encrypt(dst, src []byte) {
-	var tag [AESBlockSize]byte
+	tag := cs.encScratch.tag[0:]
 
 	// First, increase our IV
 	for i := range cs.EncryptIV {
@@ -254,13 +296,13 @@ func times3(block []byte) {
 }
 
 func (cs *CryptState) OCBEncrypt(dst []byte, src []byte, nonce []byte, tag []byte) (err os.Error) {
-	var delta [AESBlockSize]byte
-	var checksum [AESBlockSize]byte
-	var tmp [AESBlockSize]byte
-	var pad [AESBlockSize]byte
+	delta := cs.encScratch.delta[0:]
+	checksum := cs.encScratch.checksum[0:]
+	tmp := cs.encScratch.tmp[0:]
+	pad := cs.encScratch.pad[0:]
 	off := 0
 
-	cs.cipher.Encrypt(delta[0:], cs.EncryptIV[0:])
+	cs.cipher.Encrypt(delta[0:], nonce[0:])
 	zeros(checksum[0:])
 
 	remain := len(src)
@@ -305,10 +347,10 @@ func (cs *CryptState) OCBEncrypt(dst []byte, src []byte, nonce []byte, tag []byt
 }
 
 func (cs *CryptState) OCBDecrypt(plain []byte, encrypted []byte, nonce []byte, tag []byte) (err os.Error) {
-	var checksum [AESBlockSize]byte
-	var delta [AESBlockSize]byte
-	var tmp [AESBlockSize]byte
-	var pad [AESBlockSize]byte
+	checksum := cs.decScratch.checksum[0:]
+	delta := cs.decScratch.delta[0:]
+	tmp := cs.decScratch.tmp[0:]
+	pad := cs.decScratch.pad[0:]
 	off := 0
 
 	cs.cipher.Encrypt(delta[0:], nonce[0:])
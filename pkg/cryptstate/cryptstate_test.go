@@ -145,3 +145,108 @@ func TestDecrypt(t *testing.T) {
 		t.Errorf("Mismatch in DIV")
 	}
 }
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := [AESBlockSize]byte {
+		0x96, 0x8b, 0x1b, 0x0c, 0x53, 0x1e, 0x1f, 0x80, 0xa6, 0x1d, 0xcb, 0x27, 0x94, 0x09, 0x6f, 0x32,
+	}
+	eiv := [AESBlockSize]byte {
+		0x1e, 0x2a, 0x9b, 0xd0, 0x2d, 0xa6, 0x8e, 0x46, 0x26, 0x85, 0x83, 0xe9, 0x14, 0x2a, 0xff, 0x2a,
+	}
+	div := [AESBlockSize]byte {
+		0x73, 0x99, 0x9d, 0xa2, 0x03, 0x70, 0x00, 0x96, 0xef, 0x55, 0x06, 0x7a, 0x8b, 0xbe, 0x00, 0x07,
+	}
+
+	enc, err := New()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	dec, err := New()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	enc.SetKey(key[0:], eiv[0:], div[0:])
+	dec.SetKey(key[0:], div[0:], eiv[0:])
+
+	// Encrypt and decrypt packets of varying lengths, to make sure the
+	// scratch buffers are reused correctly across packets.
+	for n := 1; n < 100; n++ {
+		msg := make([]byte, n)
+		for i := range msg {
+			msg[i] = byte(n + i)
+		}
+
+		crypted := make([]byte, n+4)
+		enc.Encrypt(crypted[0:], msg[0:])
+
+		out := make([]byte, n)
+		err = dec.Decrypt(out[0:], crypted[0:])
+		if err != nil {
+			t.Fatalf("Decrypt failed for length %v: %v", n, err)
+		}
+
+		if BlockCompare(out[0:], msg[0:]) == false {
+			t.Errorf("Mismatch in output for length %v", n)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	key := [AESBlockSize]byte {
+		0x96, 0x8b, 0x1b, 0x0c, 0x53, 0x1e, 0x1f, 0x80, 0xa6, 0x1d, 0xcb, 0x27, 0x94, 0x09, 0x6f, 0x32,
+	}
+	eiv := [AESBlockSize]byte {
+		0x1e, 0x2a, 0x9b, 0xd0, 0x2d, 0xa6, 0x8e, 0x46, 0x26, 0x85, 0x83, 0xe9, 0x14, 0x2a, 0xff, 0x2a,
+	}
+	div := [AESBlockSize]byte {
+		0x73, 0x99, 0x9d, 0xa2, 0x03, 0x70, 0x00, 0x96, 0xef, 0x55, 0x06, 0x7a, 0x8b, 0xbe, 0x00, 0x07,
+	}
+
+	enc, err := New()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	dec, err := New()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	enc.SetKey(key[0:], eiv[0:], div[0:])
+	dec.SetKey(key[0:], div[0:], eiv[0:])
+	err = dec.SetWindow(5, 10)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	packets := make([][]byte, 20)
+	for i := range packets {
+		packets[i] = make([]byte, 5)
+		enc.Encrypt(packets[i][0:], []byte{byte(i)})
+	}
+
+	steps := []struct {
+		packet int
+		ok     bool
+	}{
+		{0, true},
+		{12, false}, // Too many lost
+		{5, true},
+		{1, true},   // Late
+		{1, false},  // Replay
+		{0, false},  // Too late
+	}
+	out := make([]byte, 1)
+	for _, step := range steps {
+		err = dec.Decrypt(out[0:], packets[step.packet][0:])
+		if (err == nil) != step.ok {
+			t.Errorf("Decrypt of packet %v: got %v, expected ok=%v", step.packet, err, step.ok)
+		}
+	}
+
+	if dec.Good != 3 || dec.Late != 1 || dec.Lost != 3 {
+		t.Errorf("Counters mismatch: good %v, late %v, lost %v", dec.Good, dec.Late, dec.Lost)
+	}
+
+	if dec.SetWindow(0, 10) == nil || dec.SetWindow(5, DecryptHistorySize) == nil {
+		t.Errorf("Invalid window accepted")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Drops the privileges of the process as it's loaded, while it has
+// only one thread. See privdrop.go.
+
+#include <errno.h>
+#include <grp.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+static int dropped;
+
+int privdrop_dropped(void) {
+	return dropped;
+}
+
+static void fail(const char *what) {
+	fprintf(stderr, "grumble: unable to drop privileges: %s: %s\n", what, strerror(errno));
+	_exit(1);
+}
+
+__attribute__((constructor))
+static void privdrop_init(void) {
+	const char *spec = getenv("GRUMBLE_PRIVDROP");
+	const char *root;
+	char *end;
+	long uid, gid;
+
+	if (spec == NULL || *spec == '\0')
+		return;
+
+	// "uid:gid:root", as written by Spec.
+	errno = EINVAL;
+	uid = strtol(spec, &end, 10);
+	if (end == spec || *end != ':')
+		fail("GRUMBLE_PRIVDROP");
+	spec = end + 1;
+	gid = strtol(spec, &end, 10);
+	if (end == spec || *end != ':')
+		fail("GRUMBLE_PRIVDROP");
+	root = end + 1;
+
+	if (*root != '\0') {
+		if (chroot(root) != 0)
+			fail("chroot");
+		if (chdir("/") != 0)
+			fail("chdir");
+	}
+	if (gid != -1) {
+		gid_t groups[1];
+		groups[0] = (gid_t) gid;
+		if (setgroups(1, groups) != 0)
+			fail("setgroups");
+		if (setgid((gid_t) gid) != 0)
+			fail("setgid");
+	}
+	if (uid != -1) {
+		if (setuid((uid_t) uid) != 0)
+			fail("setuid");
+		// Make sure root can't be regained.
+		if (uid != 0 && setuid(0) == 0) {
+			errno = EPERM;
+			fail("setuid(0) succeeded after dropping root");
+		}
+	}
+	dropped = 1;
+}
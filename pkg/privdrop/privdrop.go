@@ -0,0 +1,37 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Package privdrop drops the privileges of a process for all of its
+// threads. Go code can't do that once the runtime has started: setuid
+// and setgid only change the credentials of the calling thread, and the
+// runtime's other threads keep running as root. So instead, a process
+// starts a copy of itself with Env set, and the copy drops privileges in
+// a C constructor, which runs before its runtime starts any threads.
+//
+// A process that fails to drop privileges exits before running any Go
+// code.
+package privdrop
+
+// int privdrop_dropped(void);
+import "C"
+
+import (
+	"fmt"
+)
+
+// The environment variable asking a new process to drop privileges.
+// Its value is formatted by Spec.
+const Env = "GRUMBLE_PRIVDROP"
+
+// Format the value of Env for a process that should switch to uid and
+// gid, after chrooting into root. Ids of -1 are kept, as is the root
+// directory if root is empty.
+func Spec(uid int, gid int, root string) string {
+	return fmt.Sprintf("%d:%d:%s", uid, gid, root)
+}
+
+// Whether this process dropped privileges as it started.
+func Dropped() bool {
+	return C.privdrop_dropped() != 0
+}
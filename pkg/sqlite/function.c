@@ -0,0 +1,43 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Trampolines between SQLite and the Go functions registered with
+// Conn.CreateFunction and Conn.CreateCollation. They live in a separate file, because the
+// preamble of a Go file with exported functions may only hold
+// declarations.
+
+#include "sqlite3.h"
+#include "_cgo_export.h"
+
+static void call_function(sqlite3_context *ctx, int argc, sqlite3_value **argv) {
+	goCallFunction(ctx, argc, argv);
+}
+
+static void destroy_function(void *id) {
+	goDestroyFunction(id);
+}
+
+int my_create_function(sqlite3 *db, const char *name, int nArg, void *id) {
+	return sqlite3_create_function_v2(db, name, nArg, SQLITE_UTF8, id, call_function, 0, 0, destroy_function);
+}
+
+void my_result_text(sqlite3_context *ctx, char *p, int np) {
+	sqlite3_result_text(ctx, p, np, SQLITE_TRANSIENT);
+}
+
+void my_result_blob(sqlite3_context *ctx, void *p, int np) {
+	sqlite3_result_blob(ctx, p, np, SQLITE_TRANSIENT);
+}
+
+static int compare_collation(void *id, int na, const void *a, int nb, const void *b) {
+	return goCompareCollation(id, na, (void *) a, nb, (void *) b);
+}
+
+static void destroy_collation(void *id) {
+	goDestroyCollation(id);
+}
+
+int my_create_collation(sqlite3 *db, const char *name, void *id) {
+	return sqlite3_create_collation_v2(db, name, SQLITE_UTF8, id, compare_collation, destroy_collation);
+}
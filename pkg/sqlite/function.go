@@ -0,0 +1,234 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+/*
+#include "sqlite3.h"
+#include <stdlib.h>
+
+// See function.c.
+int my_create_function(sqlite3 *db, const char *name, int nArg, void *id);
+void my_result_text(sqlite3_context *ctx, char *p, int np);
+void my_result_blob(sqlite3_context *ctx, void *p, int np);
+int my_create_collation(sqlite3 *db, const char *name, void *id);
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// A scalar SQL function implemented in Go.
+type Function func(args ...interface{}) interface{}
+
+// The functions registered with CreateFunction, by the id SQLite hands
+// back to the trampolines in function.c. Go values can't be stored in
+// C memory, so they're kept here until SQLite destroys them.
+var functions = struct {
+	mutex  sync.Mutex
+	byId   map[uintptr]Function
+	nextId uintptr
+}{byId: make(map[uintptr]Function)}
+
+// Register fn as the scalar SQL function name, taking nArg arguments,
+// or any number of arguments if nArg is -1. Registering a function
+// with the name and argument count of an existing one replaces it.
+//
+// The arguments fn is called with are int64, float64, string or []byte,
+// depending on their datatype, or nil for NULL, like the values of
+// ScanMap. Its result may be any of those, a bool or an int, or an
+// os.Error to make the SQL statement fail. Other results are converted
+// with fmt.Sprint. If fn panics, the SQL statement fails.
+func (c *Conn) CreateFunction(name string, nArg int, fn func(...interface{}) interface{}) os.Error {
+	if c == nil || c.db == nil {
+		return os.NewError("nil sqlite database")
+	}
+
+	functions.mutex.Lock()
+	functions.nextId++
+	id := functions.nextId
+	functions.byId[id] = fn
+	functions.mutex.Unlock()
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	rv := C.my_create_function(c.db, cname, C.int(nArg), unsafe.Pointer(id))
+	if rv != 0 {
+		// SQLite has already called the destructor.
+		return c.error(rv)
+	}
+	return nil
+}
+
+// Get the Go value of an SQL function argument.
+func functionArg(v *C.sqlite3_value) interface{} {
+	switch Datatype(C.sqlite3_value_type(v)) {
+	case Integer:
+		return int64(C.sqlite3_value_int64(v))
+	case Float:
+		return float64(C.sqlite3_value_double(v))
+	case Text, Blob:
+		n := C.sqlite3_value_bytes(v)
+		p := C.sqlite3_value_blob(v)
+		data := make([]byte, int(n))
+		if n > 0 && p != nil {
+			copy(data, (*[1 << 30]byte)(unsafe.Pointer(p))[0:n])
+		}
+		if Datatype(C.sqlite3_value_type(v)) == Text {
+			return string(data)
+		}
+		return data
+	}
+	return nil
+}
+
+// Set the result of an SQL function call.
+func setFunctionResult(ctx *C.sqlite3_context, result interface{}) {
+	switch v := result.(type) {
+	case nil:
+		C.sqlite3_result_null(ctx)
+	case bool:
+		var b C.sqlite3_int64
+		if v {
+			b = 1
+		}
+		C.sqlite3_result_int64(ctx, b)
+	case int:
+		C.sqlite3_result_int64(ctx, C.sqlite3_int64(v))
+	case int64:
+		C.sqlite3_result_int64(ctx, C.sqlite3_int64(v))
+	case float64:
+		C.sqlite3_result_double(ctx, C.double(v))
+	case []byte:
+		var p *byte
+		if len(v) > 0 {
+			p = &v[0]
+		}
+		C.my_result_blob(ctx, unsafe.Pointer(p), C.int(len(v)))
+	case os.Error:
+		setFunctionError(ctx, v.String())
+	default:
+		str := fmt.Sprint(v)
+		cstr := C.CString(str)
+		C.my_result_text(ctx, cstr, C.int(len(str)))
+		C.free(unsafe.Pointer(cstr))
+	}
+}
+
+// Make an SQL function call fail with msg.
+func setFunctionError(ctx *C.sqlite3_context, msg string) {
+	cmsg := C.CString(msg)
+	C.sqlite3_result_error(ctx, cmsg, C.int(len(msg)))
+	C.free(unsafe.Pointer(cmsg))
+}
+
+//export goCallFunction
+func goCallFunction(ctx *C.sqlite3_context, argc C.int, argv **C.sqlite3_value) {
+	id := uintptr(C.sqlite3_user_data(ctx))
+	functions.mutex.Lock()
+	fn, ok := functions.byId[id]
+	functions.mutex.Unlock()
+	if !ok {
+		setFunctionError(ctx, "sqlite: function is gone")
+		return
+	}
+
+	args := make([]interface{}, int(argc))
+	if argc > 0 {
+		values := (*[1 << 20]*C.sqlite3_value)(unsafe.Pointer(argv))[0:argc]
+		for i, v := range values {
+			args[i] = functionArg(v)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			setFunctionError(ctx, fmt.Sprintf("sqlite: function panicked: %v", r))
+		}
+	}()
+	setFunctionResult(ctx, fn(args...))
+}
+
+//export goDestroyFunction
+func goDestroyFunction(id unsafe.Pointer) {
+	functions.mutex.Lock()
+	functions.byId[uintptr(id)] = nil, false
+	functions.mutex.Unlock()
+}
+
+// The collations registered with CreateCollation, by id, like functions.
+var collations = struct {
+	mutex  sync.Mutex
+	byId   map[uintptr]func(a, b string) int
+	nextId uintptr
+}{byId: make(map[uintptr]func(a, b string) int)}
+
+// Register cmp as the collating sequence name, for use in COLLATE
+// clauses and column definitions. cmp must return a negative number if
+// a sorts before b, 0 if they're equal, and a positive number if a sorts
+// after b, and must be consistent. Registering a collation with the name
+// of an existing one replaces it.
+func (c *Conn) CreateCollation(name string, cmp func(a, b string) int) os.Error {
+	if c == nil || c.db == nil {
+		return os.NewError("nil sqlite database")
+	}
+
+	collations.mutex.Lock()
+	collations.nextId++
+	id := collations.nextId
+	collations.byId[id] = cmp
+	collations.mutex.Unlock()
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	rv := C.my_create_collation(c.db, cname, unsafe.Pointer(id))
+	if rv != 0 {
+		// Unlike sqlite3_create_function_v2, SQLite doesn't call the
+		// destructor when registration fails.
+		collations.mutex.Lock()
+		collations.byId[id] = nil, false
+		collations.mutex.Unlock()
+		return c.error(rv)
+	}
+	return nil
+}
+
+//export goCompareCollation
+func goCompareCollation(id unsafe.Pointer, na C.int, a unsafe.Pointer, nb C.int, b unsafe.Pointer) C.int {
+	collations.mutex.Lock()
+	cmp, ok := collations.byId[uintptr(id)]
+	collations.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+
+	var sa, sb string
+	if na > 0 {
+		sa = string((*[1 << 30]byte)(a)[0:na])
+	}
+	if nb > 0 {
+		sb = string((*[1 << 30]byte)(b)[0:nb])
+	}
+	// A panic can't be reported from a collation, so treat the strings
+	// as equal rather than unwinding through SQLite.
+	result := 0
+	func() {
+		defer func() {
+			recover()
+		}()
+		result = cmp(sa, sb)
+	}()
+	return C.int(result)
+}
+
+//export goDestroyCollation
+func goDestroyCollation(id unsafe.Pointer) {
+	collations.mutex.Lock()
+	collations.byId[uintptr(id)] = nil, false
+	collations.mutex.Unlock()
+}
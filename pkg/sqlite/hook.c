@@ -0,0 +1,66 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Trampolines between SQLite and the hooks registered on a Conn. The
+// database handle is passed as the hooks' argument, so the Go side can
+// find the Conn's hooks. See hook.go.
+
+#include "sqlite3.h"
+#include "_cgo_export.h"
+
+static int commit_hook(void *db) {
+	return goCommitHook(db);
+}
+
+static void rollback_hook(void *db) {
+	goRollbackHook(db);
+}
+
+static void update_hook(void *db, int op, char const *dbname, char const *table, sqlite3_int64 rowid) {
+	goUpdateHook(db, op, (char *) dbname, (char *) table, rowid);
+}
+
+static int authorizer(void *db, int action, char const *arg1, char const *arg2, char const *dbname, char const *trigger) {
+	return goAuthorizer(db, action, (char *) arg1, (char *) arg2, (char *) dbname, (char *) trigger);
+}
+
+static void trace(void *db, char const *sql) {
+	goTrace(db, (char *) sql);
+}
+
+static void profile(void *db, char const *sql, sqlite3_uint64 ns) {
+	goProfile(db, (char *) sql, ns);
+}
+
+static int busy_handler(void *db, int count) {
+	return goBusyHandler(db, count);
+}
+
+void my_commit_hook(sqlite3 *db, int on) {
+	sqlite3_commit_hook(db, on ? commit_hook : 0, db);
+}
+
+void my_rollback_hook(sqlite3 *db, int on) {
+	sqlite3_rollback_hook(db, on ? rollback_hook : 0, db);
+}
+
+void my_update_hook(sqlite3 *db, int on) {
+	sqlite3_update_hook(db, on ? update_hook : 0, db);
+}
+
+int my_set_authorizer(sqlite3 *db, int on) {
+	return sqlite3_set_authorizer(db, on ? authorizer : 0, db);
+}
+
+void my_trace(sqlite3 *db, int on) {
+	sqlite3_trace(db, on ? trace : 0, db);
+}
+
+void my_profile(sqlite3 *db, int on) {
+	sqlite3_profile(db, on ? profile : 0, db);
+}
+
+int my_busy_handler(sqlite3 *db, int on) {
+	return sqlite3_busy_handler(db, on ? busy_handler : 0, db);
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+/*
+#include "sqlite3.h"
+
+// See hook.c.
+void my_commit_hook(sqlite3 *db, int on);
+void my_rollback_hook(sqlite3 *db, int on);
+void my_update_hook(sqlite3 *db, int on);
+int my_set_authorizer(sqlite3 *db, int on);
+void my_trace(sqlite3 *db, int on);
+void my_profile(sqlite3 *db, int on);
+int my_busy_handler(sqlite3 *db, int on);
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// The operations reported to update hooks.
+const (
+	OpDelete = 9
+	OpInsert = 18
+	OpUpdate = 23
+)
+
+// The results of an authorizer.
+const (
+	// Allow the action.
+	AuthOk = 0
+	// Fail the statement with an authorization error.
+	AuthDeny = 1
+	// Allow the statement, but treat reads of the column as NULL, or
+	// skip the deletion. Denies other actions.
+	AuthIgnore = 2
+)
+
+// The names of the actions passed to authorizers.
+var authActions = []string{
+	"COPY",
+	"CREATE_INDEX",
+	"CREATE_TABLE",
+	"CREATE_TEMP_INDEX",
+	"CREATE_TEMP_TABLE",
+	"CREATE_TEMP_TRIGGER",
+	"CREATE_TEMP_VIEW",
+	"CREATE_TRIGGER",
+	"CREATE_VIEW",
+	"DELETE",
+	"DROP_INDEX",
+	"DROP_TABLE",
+	"DROP_TEMP_INDEX",
+	"DROP_TEMP_TABLE",
+	"DROP_TEMP_TRIGGER",
+	"DROP_TEMP_VIEW",
+	"DROP_TRIGGER",
+	"DROP_VIEW",
+	"INSERT",
+	"PRAGMA",
+	"READ",
+	"SELECT",
+	"TRANSACTION",
+	"UPDATE",
+	"ATTACH",
+	"DETACH",
+	"ALTER_TABLE",
+	"REINDEX",
+	"ANALYZE",
+	"CREATE_VTABLE",
+	"DROP_VTABLE",
+	"FUNCTION",
+	"SAVEPOINT",
+}
+
+// The hooks registered on a connection.
+type connHooks struct {
+	commit   func() bool
+	rollback func()
+	update   func(op int, db, table string, rowid int64)
+	auth     func(action, arg1, arg2, db, trigger string) int
+	trace    func(sql string)
+	profile  func(sql string, ns int64)
+	busy     func(count int) bool
+}
+
+// The hooks of all connections, by database handle.
+var hooks = struct {
+	mutex sync.Mutex
+	byDb  map[uintptr]*connHooks
+}{byDb: make(map[uintptr]*connHooks)}
+
+// Get the key of c in hooks.
+func (c *Conn) hookKey() uintptr {
+	return uintptr(unsafe.Pointer(c.db))
+}
+
+// Change the hooks of c with f.
+func (c *Conn) setHooks(f func(h *connHooks)) {
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	h, ok := hooks.byDb[c.hookKey()]
+	if !ok {
+		h = &connHooks{}
+		hooks.byDb[c.hookKey()] = h
+	}
+	f(h)
+}
+
+// Get the hooks of the connection with the given database handle.
+func lookupHooks(db unsafe.Pointer) connHooks {
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	if h, ok := hooks.byDb[uintptr(db)]; ok {
+		return *h
+	}
+	return connHooks{}
+}
+
+// Forget the hooks of c. Called when c is closed.
+func (c *Conn) removeHooks() {
+	hooks.mutex.Lock()
+	hooks.byDb[c.hookKey()] = nil, false
+	hooks.mutex.Unlock()
+}
+
+// Call f whenever a transaction is about to be committed. If f returns
+// false, or panics, the commit is turned into a rollback. A nil f removes
+// the hook.
+//
+// Like the other hooks, f must not use the connection it's registered
+// on. Hooks only see changes made through their own connection, not
+// those made by other connections or processes.
+func (c *Conn) CommitHook(f func() bool) {
+	c.setHooks(func(h *connHooks) {
+		h.commit = f
+	})
+	C.my_commit_hook(c.db, boolToInt(f != nil))
+}
+
+// Call f whenever a transaction is rolled back, except when the
+// connection is closed. Panics in f are ignored. A nil f removes the
+// hook.
+func (c *Conn) RollbackHook(f func()) {
+	c.setHooks(func(h *connHooks) {
+		h.rollback = f
+	})
+	C.my_rollback_hook(c.db, boolToInt(f != nil))
+}
+
+// Call f whenever a row is inserted, updated or deleted, with the
+// operation (OpInsert, OpUpdate or OpDelete), the database and table the
+// row is in, and the row's rowid. Truncations by "DELETE FROM table"
+// without a WHERE clause aren't reported. Panics in f are ignored. A nil
+// f removes the hook.
+func (c *Conn) UpdateHook(f func(op int, db, table string, rowid int64)) {
+	c.setHooks(func(h *connHooks) {
+		h.update = f
+	})
+	C.my_update_hook(c.db, boolToInt(f != nil))
+}
+
+// Call f while statements are prepared, to check each action they take.
+// action is the name of the SQLite action code without its SQLITE_
+// prefix ("SELECT", "READ", "INSERT", ...), and arg1 and arg2 are its
+// arguments, for instance the table and column for "READ". db is the
+// database ("main", "temp", ...) and trigger the innermost trigger or
+// view responsible for the action, if any. f returns AuthOk, AuthDeny
+// or AuthIgnore. A nil f removes the authorizer.
+//
+// For example, to allow only reading the users table:
+//
+//	c.SetAuthorizer(func(action, arg1, arg2, db, trigger string) int {
+//		if action == "SELECT" || (action == "READ" && arg1 == "users") {
+//			return sqlite.AuthOk
+//		}
+//		return sqlite.AuthDeny
+//	})
+//
+// The authorizer is only consulted when statements are prepared, so it
+// doesn't apply to statements prepared before it was set.
+func (c *Conn) SetAuthorizer(f func(action, arg1, arg2, db, trigger string) int) os.Error {
+	c.setHooks(func(h *connHooks) {
+		h.auth = f
+	})
+	if rv := C.my_set_authorizer(c.db, boolToInt(f != nil)); rv != 0 {
+		return c.error(rv)
+	}
+	return nil
+}
+
+// Call f with the text of each statement as it starts running,
+// including the statements run by Conn.Exec and by triggers (as
+// comments naming the trigger). Panics in f are ignored. A nil f
+// removes the trace function.
+func (c *Conn) Trace(f func(sql string)) {
+	c.setHooks(func(h *connHooks) {
+		h.trace = f
+	})
+	C.my_trace(c.db, boolToInt(f != nil))
+}
+
+// Call f with the text of each statement when it finishes, and how long
+// it ran, in nanoseconds. SQLite currently only measures milliseconds.
+// Panics in f are ignored. A nil f removes the profile function.
+func (c *Conn) Profile(f func(sql string, ns int64)) {
+	c.setHooks(func(h *connHooks) {
+		h.profile = f
+	})
+	C.my_profile(c.db, boolToInt(f != nil))
+}
+
+// Call f when a table is locked by another connection, with the number
+// of times it has been called for the same lock before. If f returns
+// true, SQLite tries again; if it returns false, the statement fails
+// with ErrBusy. f may sleep to back off. Setting a busy handler replaces
+// the timeout set with BusyTimeout, and vice versa. A nil f removes the
+// busy handler.
+func (c *Conn) BusyHandler(f func(count int) bool) os.Error {
+	c.setHooks(func(h *connHooks) {
+		h.busy = f
+	})
+	if rv := C.my_busy_handler(c.db, boolToInt(f != nil)); rv != 0 {
+		return c.error(rv)
+	}
+	return nil
+}
+
+func boolToInt(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//export goCommitHook
+func goCommitHook(db unsafe.Pointer) (rollback C.int) {
+	f := lookupHooks(db).commit
+	if f == nil {
+		return 0
+	}
+	// A commit hook that panics rolls back.
+	defer func() {
+		if recover() != nil {
+			rollback = 1
+		}
+	}()
+	if !f() {
+		return 1
+	}
+	return 0
+}
+
+//export goRollbackHook
+func goRollbackHook(db unsafe.Pointer) {
+	if f := lookupHooks(db).rollback; f != nil {
+		// A panic can't be reported from a rollback hook, so it's
+		// dropped rather than unwinding through SQLite.
+		defer func() {
+			recover()
+		}()
+		f()
+	}
+}
+
+//export goUpdateHook
+func goUpdateHook(db unsafe.Pointer, op C.int, dbname *C.char, table *C.char, rowid C.sqlite3_int64) {
+	if f := lookupHooks(db).update; f != nil {
+		// Nor from an update hook.
+		defer func() {
+			recover()
+		}()
+		f(int(op), C.GoString(dbname), C.GoString(table), int64(rowid))
+	}
+}
+
+//export goAuthorizer
+func goAuthorizer(db unsafe.Pointer, action C.int, arg1, arg2, dbname, trigger *C.char) (result C.int) {
+	f := lookupHooks(db).auth
+	if f == nil {
+		return AuthOk
+	}
+	// An authorizer that panics denies.
+	defer func() {
+		if recover() != nil {
+			result = AuthDeny
+		}
+	}()
+	name := fmt.Sprintf("UNKNOWN_%d", int(action))
+	if int(action) >= 0 && int(action) < len(authActions) {
+		name = authActions[action]
+	}
+	return C.int(f(name, C.GoString(arg1), C.GoString(arg2), C.GoString(dbname), C.GoString(trigger)))
+}
+
+//export goTrace
+func goTrace(db unsafe.Pointer, sql *C.char) {
+	if f := lookupHooks(db).trace; f != nil {
+		defer func() {
+			recover()
+		}()
+		f(C.GoString(sql))
+	}
+}
+
+//export goProfile
+func goProfile(db unsafe.Pointer, sql *C.char, ns C.sqlite3_uint64) {
+	if f := lookupHooks(db).profile; f != nil {
+		defer func() {
+			recover()
+		}()
+		f(C.GoString(sql), int64(ns))
+	}
+}
+
+//export goBusyHandler
+func goBusyHandler(db unsafe.Pointer, count C.int) (retry C.int) {
+	f := lookupHooks(db).busy
+	if f == nil {
+		return 0
+	}
+	// A busy handler that panics gives up.
+	defer func() {
+		if recover() != nil {
+			retry = 0
+		}
+	}()
+	return boolToInt(f(int(count)))
+}
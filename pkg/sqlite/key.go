@@ -0,0 +1,46 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+// This file is only built with SQLCIPHER=1, which links against
+// SQLCipher (or another build of SQLite with SQLITE_HAS_CODEC) instead
+// of the bundled SQLite. See key_none.go for other builds.
+
+/*
+#include "sqlite3.h"
+
+// Not declared by the bundled sqlite3.h.
+int sqlite3_key(sqlite3 *db, const void *pKey, int nKey);
+int sqlite3_rekey(sqlite3 *db, const void *pKey, int nKey);
+*/
+import "C"
+
+import (
+	"os"
+	"unsafe"
+)
+
+// Whether the package was built with encryption support.
+const HasEncryption = true
+
+// Set the key of an encrypted database. It must be called right after
+// the database is opened, before anything else is done with it. A wrong
+// key is only noticed when the database is first read.
+func (c *Conn) Key(key []byte) os.Error {
+	var p unsafe.Pointer
+	if len(key) > 0 {
+		p = unsafe.Pointer(&key[0])
+	}
+	return c.error(C.sqlite3_key(c.db, p, C.int(len(key))))
+}
+
+// Re-encrypt the database with a new key. An empty key decrypts it.
+func (c *Conn) Rekey(key []byte) os.Error {
+	var p unsafe.Pointer
+	if len(key) > 0 {
+		p = unsafe.Pointer(&key[0])
+	}
+	return c.error(C.sqlite3_rekey(c.db, p, C.int(len(key))))
+}
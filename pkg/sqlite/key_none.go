@@ -0,0 +1,28 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+// This file is built unless SQLCIPHER=1. See key.go.
+
+import (
+	"os"
+)
+
+// Whether the package was built with encryption support.
+const HasEncryption = false
+
+var errNoEncryption = os.NewError("sqlite: built without encryption support")
+
+// Set the key of an encrypted database. Always fails, since the package
+// was built without encryption support.
+func (c *Conn) Key(key []byte) os.Error {
+	return errNoEncryption
+}
+
+// Re-encrypt the database with a new key. Always fails, since the
+// package was built without encryption support.
+func (c *Conn) Rekey(key []byte) os.Error {
+	return errNoEncryption
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+import (
+	"os"
+	"sync"
+)
+
+// A pool of connections to a database, for goroutines that would
+// otherwise have to take turns using a single connection.
+type Pool struct {
+	filename string
+	flags    []OpenFlag
+	init     func(*Conn) os.Error
+
+	// Holds a value for each connection handed out by Get.
+	sem chan bool
+
+	mutex  sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// Create a pool of at most max connections to the database in filename,
+// opened with flags. If init isn't nil, it's called on each connection
+// when it's opened, to set pragmas or create functions; connections it
+// fails on are closed.
+func NewPool(filename string, max int, init func(*Conn) os.Error, flags ...OpenFlag) *Pool {
+	if max < 1 {
+		max = 1
+	}
+	return &Pool{
+		filename: filename,
+		flags:    flags,
+		init:     init,
+		sem:      make(chan bool, max),
+	}
+}
+
+// Get a connection from the pool, opening one if none is idle. If the
+// pool's connections are all in use, Get waits until one is put back.
+// The connection must be returned with Put.
+func (p *Pool) Get() (*Conn, os.Error) {
+	p.sem <- true
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		<-p.sem
+		return nil, os.NewError("sqlite: pool is closed")
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[0 : n-1]
+		p.mutex.Unlock()
+		return c, nil
+	}
+	p.mutex.Unlock()
+
+	c, err := OpenWithFlags(p.filename, p.flags...)
+	if err == nil && p.init != nil {
+		if err = p.init(c); err != nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+// Return a connection obtained with Get to the pool. A transaction left
+// open on it is rolled back.
+func (p *Pool) Put(c *Conn) {
+	if c.InTransaction() {
+		c.Rollback()
+	}
+
+	p.mutex.Lock()
+	if p.closed {
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	p.mutex.Unlock()
+	<-p.sem
+}
+
+// Close the idle connections of the pool. Connections in use are closed
+// when they're put back, and Get fails from now on.
+func (p *Pool) Close() (err os.Error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.idle = nil
+	return err
+}
@@ -29,9 +29,12 @@ import "C"
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"unsafe"
 	"time"
 )
@@ -40,12 +43,42 @@ type Errno int
 
 func (e Errno) String() string {
 	s := errText[e]
+	if s == "" && e > 0xff {
+		// An extended code without a description of its own.
+		s = errText[e&0xff]
+	}
 	if s == "" {
 		return fmt.Sprintf("errno %d", int(e))
 	}
 	return s
 }
 
+// Get the primary code of an extended result code.
+func (e Errno) Primary() Errno {
+	return e & 0xff
+}
+
+// An error reported by SQLite. The bundled SQLite has no extended
+// codes for constraint failures, so they can only be told apart by Msg
+// ("column name is not unique", ...).
+type Error struct {
+	// The primary result code, such as ErrBusy or ErrConstraint, and
+	// the extended result code, such as ErrBusyRecovery, which equals
+	// Code when SQLite doesn't report anything more specific.
+	Code         Errno
+	ExtendedCode Errno
+
+	// SQLite's description of the error.
+	Msg string
+
+	// The SQL of the statement that failed, if any.
+	SQL string
+}
+
+func (e *Error) String() string {
+	return e.ExtendedCode.String() + ": " + e.Msg
+}
+
 var (
 	ErrError os.Error = Errno(1)  //    /* SQL error or missing database */
 	ErrInternal os.Error = Errno(2)  //    /* Internal logic error in SQLite */
@@ -71,6 +104,15 @@ var (
 	ErrFormat os.Error = Errno(24)  //    /* Auxiliary database format error */
 	ErrRange os.Error = Errno(25)  //    /* 2nd parameter to sqlite3_bind out of range */
 	ErrNotDB os.Error = Errno(26)  //    /* File opened that is not a database file */
+	ErrIOErrRead os.Error = Errno(10 | 1<<8)
+	ErrIOErrShortRead os.Error = Errno(10 | 2<<8)
+	ErrIOErrWrite os.Error = Errno(10 | 3<<8)
+	ErrIOErrFsync os.Error = Errno(10 | 4<<8)
+	ErrIOErrFstat os.Error = Errno(10 | 7<<8)
+	ErrIOErrLock os.Error = Errno(10 | 15<<8)
+	ErrLockedSharedCache os.Error = Errno(6 | 1<<8)
+	ErrBusyRecovery os.Error = Errno(5 | 1<<8)
+	ErrCantOpenNoTempDir os.Error = Errno(14 | 1<<8)
 	Row = Errno(100)  //   /* sqlite3_step() has another row ready */
 	Done = Errno(101)  //   /* sqlite3_step() has finished executing */
 )
@@ -104,23 +146,69 @@ var errText = map[Errno]string {
 	26: "File opened that is not a database file",
 	100: "sqlite3_step() has another row ready",
 	101: "sqlite3_step() has finished executing",
+	10 | 1<<8: "I/O error while reading",
+	10 | 2<<8: "Short read",
+	10 | 3<<8: "I/O error while writing",
+	10 | 4<<8: "I/O error while syncing",
+	10 | 7<<8: "I/O error while getting file status",
+	10 | 15<<8: "I/O error while locking",
+	6 | 1<<8: "A table in the shared cache is locked",
+	5 | 1<<8: "The database is being recovered by another connection",
+	14 | 1<<8: "Unable to find a temporary directory",
 }
 
 func (c *Conn) error(rv C.int) os.Error {
+	return c.errorSQL(rv, "")
+}
+
+// Get the error for result code rv of running sql, as an *Error.
+func (c *Conn) errorSQL(rv C.int, sql string) os.Error {
 	if c == nil || c.db == nil {
 		return os.NewError("nil sqlite database")
 	}
 	if rv == 0 {
 		return nil
 	}
-	if rv == 21 {	// misuse
-		return Errno(rv)
+	code := Errno(rv)
+	if code == 21 {	// misuse
+		// Misuse isn't recorded as the connection's error, so the
+		// connection's message would be from something else.
+		return &Error{Code: code, ExtendedCode: code, Msg: code.String(), SQL: sql}
+	}
+	extended := Errno(C.sqlite3_extended_errcode(c.db))
+	if extended.Primary() != code.Primary() {
+		// The connection's last error is from something else.
+		extended = code
+	}
+	return &Error{
+		Code:         code.Primary(),
+		ExtendedCode: extended,
+		Msg:          C.GoString(C.sqlite3_errmsg(c.db)),
+		SQL:          sql,
 	}
-	return os.NewError(Errno(rv).String() + ": " + C.GoString(C.sqlite3_errmsg(c.db)))
+}
+
+func (s *Stmt) error(rv C.int) os.Error {
+	return s.c.errorSQL(rv, s.sql)
+}
+
+// Check whether err is an *Error with the primary code code, and a
+// message containing msg. Conditions such as unknown savepoints are
+// only reported as ErrError, so the message is needed to tell them
+// apart.
+func isError(err os.Error, code os.Error, msg string) bool {
+	e, ok := err.(*Error)
+	return ok && os.Error(e.Code) == code && strings.Index(e.Msg, msg) >= 0
 }
 
 type Conn struct {
 	db *C.sqlite3
+
+	// How times are stored. See SetTimeFormat.
+	timeFormat TimeFormat
+
+	// The name of the in-memory database opened by OpenMemory, if any.
+	memName string
 }
 
 func Version() string {
@@ -128,26 +216,182 @@ func Version() string {
 	return C.GoString(p);
 }
 
+// Options for OpenWithFlags.
+type OpenFlag int
+
+const (
+	// Open the database read-only. Implies OpenNoCreate.
+	OpenReadOnly OpenFlag = iota
+	// Fail if the database doesn't exist, rather than creating it.
+	OpenNoCreate
+	// Don't serialize access to the connection. It must then only be
+	// used by one goroutine at a time.
+	OpenNoMutex
+	// Share the page cache with other connections to the same
+	// database in this process.
+	OpenSharedCache
+	// Use a private page cache, even if shared cache mode is enabled.
+	OpenPrivateCache
+)
+
+// How times bound to statements are stored in the database.
+type TimeFormat int
+
+const (
+	// As UTC text, in the format of SQLite's datetime() function:
+	// "YYYY-MM-DD HH:MM:SS". The default.
+	TimeText TimeFormat = iota
+	// As a Julian day number, like SQLite's julianday() function.
+	TimeJulianDay
+	// As seconds since the Unix epoch, like strftime('%s').
+	TimeUnix
+)
+
+// The layout of times stored as TimeText.
+const timeTextLayout = "2006-01-02 15:04:05"
+
+// The Julian day number of the Unix epoch.
+const unixEpochJulianDay = 2440587.5
+
+// Set how the times (time.Time or *time.Time) bound to statements of
+// the connection are stored. Scan reads times in any of the formats,
+// regardless of this setting.
+func (c *Conn) SetTimeFormat(format TimeFormat) {
+	c.timeFormat = format
+}
+
+// Get the value t is bound as, according to the connection's time
+// format.
+func (c *Conn) timeValue(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	switch c.timeFormat {
+	case TimeJulianDay:
+		return float64(t.Seconds())/86400 + unixEpochJulianDay
+	case TimeUnix:
+		return t.Seconds()
+	}
+	return time.SecondsToUTC(t.Seconds()).Format(timeTextLayout)
+}
+
+// Parse a time stored in a column of the given datatype.
+func parseTime(ctype Datatype, value string) (*time.Time, os.Error) {
+	switch ctype {
+	case Integer:
+		secs, err := strconv.Atoi64(value)
+		if err != nil {
+			return nil, err
+		}
+		return time.SecondsToUTC(secs), nil
+	case Float:
+		days, err := strconv.Atof64(value)
+		if err != nil {
+			return nil, err
+		}
+		return time.SecondsToUTC(int64((days-unixEpochJulianDay)*86400 + 0.5)), nil
+	}
+	// Text
+	for _, layout := range []string{timeTextLayout, time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return nil, os.NewError("unrecognized time " + value)
+}
+
+// Open the database in filename for reading and writing, creating it if
+// it doesn't exist.
 func Open(filename string) (*Conn, os.Error) {
+	return OpenWithFlags(filename)
+}
+
+// Open the database in filename. Without flags, this does the same as
+// Open. The bundled SQLite doesn't support URI filenames, so these are
+// taken as plain file names.
+func OpenWithFlags(filename string, flags ...OpenFlag) (*Conn, os.Error) {
 	if C.sqlite3_threadsafe() == 0 {
 		return nil, os.NewError("sqlite library was not compiled for thread-safe operation")
 	}
 
+	mode := C.int(C.SQLITE_OPEN_READWRITE | C.SQLITE_OPEN_CREATE)
+	mutex := C.int(C.SQLITE_OPEN_FULLMUTEX)
+	cache := C.int(0)
+	for _, flag := range flags {
+		switch flag {
+		case OpenReadOnly:
+			mode = C.SQLITE_OPEN_READONLY
+		case OpenNoCreate:
+			mode &^= C.SQLITE_OPEN_CREATE
+		case OpenNoMutex:
+			mutex = C.SQLITE_OPEN_NOMUTEX
+		case OpenSharedCache:
+			cache = C.SQLITE_OPEN_SHAREDCACHE
+		case OpenPrivateCache:
+			cache = C.SQLITE_OPEN_PRIVATECACHE
+		default:
+			return nil, os.NewError(fmt.Sprintf("sqlite: unknown open flag %d", int(flag)))
+		}
+	}
+
 	var db *C.sqlite3
 	name := C.CString(filename)
 	defer C.free(unsafe.Pointer(name))
-	rv := C.sqlite3_open_v2(name, &db,
-		C.SQLITE_OPEN_FULLMUTEX |
-		C.SQLITE_OPEN_READWRITE |
-		C.SQLITE_OPEN_CREATE,
-		nil)
+	rv := C.sqlite3_open_v2(name, &db, mode|mutex|cache, nil)
 	if rv != 0 {
-		return nil, Errno(rv)
+		if db == nil {
+			// Without a handle there's no message but the code's own.
+			code := Errno(rv)
+			return nil, &Error{Code: code.Primary(), ExtendedCode: code, Msg: code.String()}
+		}
+		// The error must be read before the handle is closed.
+		err := (&Conn{db: db}).error(rv)
+		C.sqlite3_close(db)
+		return nil, err
 	}
 	if db == nil {
 		return nil, os.NewError("sqlite succeeded without returning a database")
 	}
-	return &Conn{db}, nil
+	return &Conn{db: db}, nil
+}
+
+// The named in-memory databases opened by OpenMemory.
+var memoryDBs = struct {
+	mutex  sync.Mutex
+	byName map[string]*memoryDB
+}{byName: make(map[string]*memoryDB)}
+
+type memoryDB struct {
+	db   *C.sqlite3
+	refs int
+}
+
+// Open an in-memory database, which never touches the filesystem, and
+// is gone when it's closed. If name is empty, the database is private
+// to the connection, as with Open(":memory:").
+//
+// The bundled SQLite can't share in-memory databases between
+// connections, so all connections opened with the same name share the
+// same SQLite connection instead, including its transactions and hooks.
+// The database is kept until the last of them is closed.
+func OpenMemory(name string) (*Conn, os.Error) {
+	if len(name) == 0 {
+		return Open(":memory:")
+	}
+
+	memoryDBs.mutex.Lock()
+	defer memoryDBs.mutex.Unlock()
+	if mdb, ok := memoryDBs.byName[name]; ok {
+		mdb.refs++
+		return &Conn{db: mdb.db, memName: name}, nil
+	}
+	c, err := Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	memoryDBs.byName[name] = &memoryDB{db: c.db, refs: 1}
+	c.memName = name
+	return c, nil
 }
 
 func NewBackup(dst *Conn, dstTable string, src *Conn, srcTable string) (*Backup, os.Error) {
@@ -173,7 +417,7 @@ func (b *Backup) Step(npage int) os.Error {
 	if rv == 0 || Errno(rv) == ErrBusy || Errno(rv) == ErrLocked {
 		return nil
 	}
-	return Errno(rv)
+	return b.dst.error(rv)
 }
 	
 type BackupStatus struct {
@@ -200,21 +444,147 @@ func (b *Backup) Run(npage int, sleepNs int64, c chan<- BackupStatus) os.Error {
 	return b.dst.error(C.sqlite3_errcode(b.dst.db))		
 }
 
+// Finish the backup, releasing its resources. Returns the error that
+// stopped the backup, if any.
 func (b *Backup) Close() os.Error {
 	if b.sb == nil {
 		return os.EINVAL
 	}
-	C.sqlite3_backup_finish(b.sb)
+	rv := C.sqlite3_backup_finish(b.sb)
 	b.sb = nil
-	return nil
+	return b.dst.error(rv)
+}
+
+// How long BackupToFile waits before retrying a step when the database
+// is locked, in nanoseconds.
+const backupRetryNs = 100e6
+
+// Copy the whole database to the database file at path, replacing its
+// contents, pagesPerStep pages at a time (or all at once, if it's not
+// positive). Steps that find the database locked are retried. If
+// progress isn't nil, it's called after each step. Other connections
+// may use the database between steps.
+func (c *Conn) BackupToFile(path string, pagesPerStep int, progress func(BackupStatus)) (err os.Error) {
+	if pagesPerStep <= 0 {
+		pagesPerStep = -1
+	}
+	dst, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	b, err := NewBackup(dst, "main", c, "main")
+	if err != nil {
+		return err
+	}
+	for {
+		rv := C.sqlite3_backup_step(b.sb, C.int(pagesPerStep))
+		if progress != nil {
+			progress(b.Status())
+		}
+		switch {
+		case Errno(rv) == Done:
+			return b.Close()
+		case rv == 0:
+		case Errno(rv) == ErrBusy || Errno(rv) == ErrLocked:
+			time.Sleep(backupRetryNs)
+		default:
+			err = b.dst.error(rv)
+			b.Close()
+			return err
+		}
+	}
+	panic("unreachable")
 }
 
 func (c *Conn) BusyTimeout(ms int) os.Error {
-	rv := C.sqlite3_busy_timeout(c.db, C.int(ms))
-	if rv == 0 {
-		return nil
+	return c.error(C.sqlite3_busy_timeout(c.db, C.int(ms)))
+}
+
+// The run-time limits of a connection, for SetLimit and Limit.
+type LimitID int
+
+const (
+	// The length of a string or BLOB, or of a row, in bytes.
+	LimitLength LimitID = 0
+	// The length of an SQL statement, in bytes.
+	LimitSQLLength LimitID = 1
+	// The number of columns of a table, index or result set.
+	LimitColumn LimitID = 2
+	// The depth of the parse tree of an expression.
+	LimitExprDepth LimitID = 3
+	// The number of terms of a compound SELECT.
+	LimitCompoundSelect LimitID = 4
+	// The number of virtual machine instructions of a statement.
+	LimitVdbeOp LimitID = 5
+	// The number of arguments of a function.
+	LimitFunctionArg LimitID = 6
+	// The number of attached databases.
+	LimitAttached LimitID = 7
+	// The length of the pattern of a LIKE or GLOB, in bytes.
+	LimitLikePatternLength LimitID = 8
+	// The highest number of a bound parameter.
+	LimitVariableNumber LimitID = 9
+	// The depth of recursion of triggers.
+	LimitTriggerDepth LimitID = 10
+)
+
+// Set the limit id of the connection to value, and get its previous
+// value. SQLite silently lowers values above the limit it was compiled
+// with, so use Limit to see the value in effect. Negative values leave
+// the limit unchanged.
+func (c *Conn) SetLimit(id LimitID, value int) int {
+	if value < 0 {
+		return c.Limit(id)
 	}
-	return Errno(rv)
+	return int(C.sqlite3_limit(c.db, C.int(id), C.int(value)))
+}
+
+// Get the limit id of the connection.
+func (c *Conn) Limit(id LimitID) int {
+	return int(C.sqlite3_limit(c.db, C.int(id), -1))
+}
+
+// Allow or disallow loading extensions into the connection, with
+// LoadExtension or the load_extension() SQL function. Loading is
+// disallowed by default. Since an extension can do anything the process
+// can, only allow it on connections that don't run SQL from untrusted
+// sources.
+func (c *Conn) EnableLoadExtension(enable bool) os.Error {
+	var on C.int
+	if enable {
+		on = 1
+	}
+	return c.error(C.sqlite3_enable_load_extension(c.db, on))
+}
+
+// Load the extension in the shared library at path, calling its entry
+// point entry, or sqlite3_extension_init if entry is empty. Fails
+// unless loading was allowed with EnableLoadExtension.
+func (c *Conn) LoadExtension(path, entry string) os.Error {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var centry *C.char
+	if len(entry) > 0 {
+		centry = C.CString(entry)
+		defer C.free(unsafe.Pointer(centry))
+	}
+	var cerr *C.char
+	rv := C.sqlite3_load_extension(c.db, cpath, centry, &cerr)
+	if rv != 0 {
+		msg := "unable to load extension " + path
+		if cerr != nil {
+			msg = C.GoString(cerr)
+			C.sqlite3_free(unsafe.Pointer(cerr))
+		}
+		return &Error{Code: Errno(rv).Primary(), ExtendedCode: Errno(rv), Msg: msg}
+	}
+	return nil
 }
 
 func (c *Conn) Exec(cmd string, args ...interface{}) os.Error {
@@ -229,7 +599,61 @@ func (c *Conn) Exec(cmd string, args ...interface{}) os.Error {
 	}
 	rv := C.sqlite3_step(s.stmt)
 	if Errno(rv) != Done {
-		return c.error(rv)
+		return s.error(rv)
+	}
+	return nil
+}
+
+// An error running one of the statements of a script with ExecScript.
+type ScriptError struct {
+	// The byte offset of the failing statement in the script.
+	Offset int
+	Err    os.Error
+}
+
+func (e *ScriptError) String() string {
+	return fmt.Sprintf("statement at offset %d: %v", e.Offset, e.Err.String())
+}
+
+// Run the statements of script, which are separated by semicolons, in
+// order. Rows returned by the statements are ignored. Stops at the first
+// statement that fails, and returns a *ScriptError. Statements run
+// before it aren't undone, unless the script runs in a transaction.
+func (c *Conn) ExecScript(script string) os.Error {
+	if c == nil || c.db == nil {
+		return os.NewError("nil sqlite database")
+	}
+	cscript := C.CString(script)
+	defer C.free(unsafe.Pointer(cscript))
+
+	offset := 0
+	for offset < len(script) {
+		// Report the offset of the statement itself, rather than of
+		// the whitespace before it.
+		for offset < len(script) && strings.IndexRune(" \t\r\n", int(script[offset])) >= 0 {
+			offset++
+		}
+		p := (*C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(cscript)) + uintptr(offset)))
+		var stmt *C.sqlite3_stmt
+		var tail *C.char
+		rv := C.sqlite3_prepare_v2(c.db, p, C.int(len(script)-offset), &stmt, &tail)
+		if rv != 0 {
+			return &ScriptError{offset, c.errorSQL(rv, script[offset:])}
+		}
+		if stmt == nil {
+			// Only comments or whitespace were left.
+			break
+		}
+		end := int(uintptr(unsafe.Pointer(tail)) - uintptr(unsafe.Pointer(cscript)))
+		s := &Stmt{c: c, stmt: stmt, sql: script[offset:end], t0: time.Nanoseconds()}
+		for s.Next() {
+		}
+		err := s.Error()
+		s.Finalize()
+		if err != nil {
+			return &ScriptError{offset, err}
+		}
+		offset = end
 	}
 	return nil
 }
@@ -243,6 +667,25 @@ type Stmt struct {
 	args string
 }
 
+// Nullable values, for columns that may be NULL. When a NULL column is
+// scanned into one, Valid is false. When one is bound with Valid false,
+// it is bound as NULL. (Binding nil also binds NULL, and scanning a NULL
+// column into any other type leaves the destination untouched.)
+type NullString struct {
+	String string
+	Valid  bool
+}
+
+type NullInt64 struct {
+	Int64 int64
+	Valid bool
+}
+
+type NullFloat64 struct {
+	Float64 float64
+	Valid   bool
+}
+
 func (c *Conn) Prepare(cmd string) (*Stmt, os.Error) {
 	if c == nil || c.db == nil {
 		return nil, os.NewError("nil sqlite database")
@@ -253,17 +696,18 @@ func (c *Conn) Prepare(cmd string) (*Stmt, os.Error) {
 	var tail *C.char
 	rv := C.sqlite3_prepare_v2(c.db, cmdstr, C.int(len(cmd)+1), &stmt, &tail)
 	if rv != 0 {
-		return nil, c.error(rv)
+		return nil, c.errorSQL(rv, cmd)
 	}
 	return &Stmt{c: c, stmt: stmt, sql: cmd, t0: time.Nanoseconds()}, nil
 }
 
 func (s *Stmt) Exec(args ...interface{}) os.Error {
 	s.args = fmt.Sprintf(" %v", []interface{}(args))
-	rv := C.sqlite3_reset(s.stmt)
-	if rv != 0 {
-		return s.c.error(rv)
-	}
+	// sqlite3_reset returns the error of the previous run, which has
+	// already been reported by Next, so it must not keep the statement
+	// from being run again.
+	C.sqlite3_reset(s.stmt)
+	s.err = nil
 
 	n := int(C.sqlite3_bind_parameter_count(s.stmt))
 	if n != len(args) {
@@ -272,23 +716,74 @@ func (s *Stmt) Exec(args ...interface{}) os.Error {
 
 	for i, v := range args {
 		var str string
+		switch x := v.(type) {
+		case NullString:
+			if x.Valid {
+				v = x.String
+			} else {
+				v = nil
+			}
+		case NullInt64:
+			if x.Valid {
+				v = x.Int64
+			} else {
+				v = nil
+			}
+		case NullFloat64:
+			if x.Valid {
+				v = x.Float64
+			} else {
+				v = nil
+			}
+		case time.Time:
+			v = s.c.timeValue(&x)
+		case *time.Time:
+			v = s.c.timeValue(x)
+		}
 		switch v := v.(type) {
+		case nil:
+			if rv := C.sqlite3_bind_null(s.stmt, C.int(i+1)); rv != 0 {
+				return s.error(rv)
+			}
+			continue
+
 		case []byte:
 			var p *byte
 			if len(v) > 0 {
 				p = &v[0]
 			}
 			if rv := C.my_bind_blob(s.stmt, C.int(i+1), unsafe.Pointer(p), C.int(len(v))); rv != 0 {
-				return s.c.error(rv)
+				return s.error(rv)
 			}
 			continue
 		
 		case bool:
+			var b C.sqlite3_int64
 			if v {
-				str = "1"
-			} else {
-				str = "0"
+				b = 1
+			}
+			if rv := C.sqlite3_bind_int64(s.stmt, C.int(i+1), b); rv != 0 {
+				return s.error(rv)
+			}
+			continue
+
+		case int:
+			if rv := C.sqlite3_bind_int64(s.stmt, C.int(i+1), C.sqlite3_int64(v)); rv != 0 {
+				return s.error(rv)
+			}
+			continue
+
+		case int64:
+			if rv := C.sqlite3_bind_int64(s.stmt, C.int(i+1), C.sqlite3_int64(v)); rv != 0 {
+				return s.error(rv)
+			}
+			continue
+
+		case float64:
+			if rv := C.sqlite3_bind_double(s.stmt, C.int(i+1), C.double(v)); rv != 0 {
+				return s.error(rv)
 			}
+			continue
 
 		default:
 			str = fmt.Sprint(v)
@@ -298,12 +793,54 @@ func (s *Stmt) Exec(args ...interface{}) os.Error {
 		rv := C.my_bind_text(s.stmt, C.int(i+1), cstr, C.int(len(str)))
 		C.free(unsafe.Pointer(cstr))
 		if rv != 0 {
-			return s.c.error(rv)
+			return s.error(rv)
 		}
 	}
 	return nil
 }
 
+// An error running a row of a batch with ExecMany.
+type BatchError struct {
+	// The index of the failing row in the batch.
+	Row int
+	Err os.Error
+}
+
+func (e *BatchError) String() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err.String())
+}
+
+// Run the statement once for each row of arguments, all in one
+// transaction (or savepoint, in a transaction). If a row fails, the
+// whole batch is rolled back, and a *BatchError is returned. Rows the
+// statement returns are ignored.
+func (s *Stmt) ExecMany(rows [][]interface{}) os.Error {
+	return s.c.Transaction(func(c *Conn) os.Error {
+		for i, row := range rows {
+			if err := s.Exec(row...); err != nil {
+				return &BatchError{i, err}
+			}
+			for s.Next() {
+			}
+			if err := s.Error(); err != nil {
+				return &BatchError{i, err}
+			}
+		}
+		return nil
+	})
+}
+
+// Prepare sql, and run it once for each row of arguments, as
+// Stmt.ExecMany does.
+func (c *Conn) ExecMany(sql string, rows [][]interface{}) os.Error {
+	s, err := c.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer s.Finalize()
+	return s.ExecMany(rows)
+}
+
 func (s *Stmt) Error() os.Error {
 	return s.err
 }
@@ -315,13 +852,14 @@ func (s *Stmt) Next() bool {
 		return true
 	}
 	if err != Done {
-		s.err = s.c.error(rv)
+		s.err = s.error(rv)
 	}
 	return false		
 }
 
 func (s *Stmt) Reset() os.Error {
 	C.sqlite3_reset(s.stmt)
+	s.err = nil
 	return nil
 }
 
@@ -332,6 +870,21 @@ func (s *Stmt) Scan(args ...interface{}) os.Error {
 	}
 	
 	for i, v := range args {
+		// The column's type must be read before its value is converted.
+		ctype := Datatype(C.sqlite3_column_type(s.stmt, C.int(i)))
+		if ctype == Null {
+			switch v := v.(type) {
+			case *NullString:
+				*v = NullString{}
+			case *NullInt64:
+				*v = NullInt64{}
+			case *NullFloat64:
+				*v = NullFloat64{}
+			}
+			// Other destinations are left untouched.
+			continue
+		}
+
 		n := C.sqlite3_column_bytes(s.stmt, C.int(i))
 		p := C.sqlite3_column_blob(s.stmt, C.int(i))
 		if p == nil && n > 0 {
@@ -366,6 +919,26 @@ func (s *Stmt) Scan(args ...interface{}) os.Error {
 				return os.NewError("arg " + strconv.Itoa(i) + " as float64: " + err.String())
 			}
 			*v = x
+		case *NullString:
+			*v = NullString{string(data), true}
+		case *NullInt64:
+			x, err := strconv.Atoi64(string(data))
+			if err != nil {
+				return os.NewError("arg " + strconv.Itoa(i) + " as int64: " + err.String())
+			}
+			*v = NullInt64{x, true}
+		case *NullFloat64:
+			x, err := strconv.Atof64(string(data))
+			if err != nil {
+				return os.NewError("arg " + strconv.Itoa(i) + " as float64: " + err.String())
+			}
+			*v = NullFloat64{x, true}
+		case *time.Time:
+			t, err := parseTime(ctype, string(data))
+			if err != nil {
+				return os.NewError("arg " + strconv.Itoa(i) + " as time: " + err.String())
+			}
+			*v = *t
 		default:
 			return os.NewError("unsupported type in Scan: " + reflect.Typeof(v).String())
 		}
@@ -373,6 +946,234 @@ func (s *Stmt) Scan(args ...interface{}) os.Error {
 	return nil
 }
 
+// Get the value of key in a struct field tag of the form
+// `key:"value" otherkey:"value"`, or "" if key isn't in the tag.
+func tagValue(tag string, key string) string {
+	i := strings.Index(tag, key+":\"")
+	if i < 0 {
+		return ""
+	}
+	value := tag[i+len(key)+2:]
+	if j := strings.Index(value, "\""); j >= 0 {
+		return value[:j]
+	}
+	return ""
+}
+
+// Scan the current row into the struct dst points to. Each column is
+// stored in the exported field with the same name, ignoring case, or in
+// the field tagged `sqlite:"column"`. Fields tagged `sqlite:"-"` are
+// skipped, and so are columns without a matching field. Fields must be
+// of a type Scan supports.
+func (s *Stmt) ScanStruct(dst interface{}) os.Error {
+	v := reflect.NewValue(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return os.NewError("ScanStruct needs a pointer to a struct, got " + reflect.Typeof(dst).String())
+	}
+	v = v.Elem()
+	t := v.Type()
+
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		name := tagValue(f.Tag, "sqlite")
+		if name == "-" {
+			continue
+		} else if len(name) == 0 {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = i
+	}
+
+	args := make([]interface{}, s.ColumnCount())
+	for i := range args {
+		if fi, ok := fields[strings.ToLower(s.ColumnName(i))]; ok {
+			args[i] = v.Field(fi).Addr().Interface()
+		} else {
+			args[i] = new([]byte)
+		}
+	}
+	return s.Scan(args...)
+}
+
+// Get the values of the current row, in column order. Values are int64,
+// float64, string or []byte, depending on their datatype, or nil for
+// NULL.
+func (s *Stmt) ScanValues() ([]interface{}, os.Error) {
+	values := make([]interface{}, s.ColumnCount())
+	for i := range values {
+		switch s.ColumnType(i) {
+		case Integer:
+			values[i] = int64(C.sqlite3_column_int64(s.stmt, C.int(i)))
+		case Float:
+			values[i] = float64(C.sqlite3_column_double(s.stmt, C.int(i)))
+		case Text, Blob:
+			n := C.sqlite3_column_bytes(s.stmt, C.int(i))
+			p := C.sqlite3_column_blob(s.stmt, C.int(i))
+			if p == nil && n > 0 {
+				return nil, os.NewError("got nil blob")
+			}
+			// The column's memory is only valid until the next step.
+			data := make([]byte, int(n))
+			if n > 0 {
+				copy(data, (*[1<<30]byte)(unsafe.Pointer(p))[0:n])
+			}
+			if s.ColumnType(i) == Text {
+				values[i] = string(data)
+			} else {
+				values[i] = data
+			}
+		}
+	}
+	return values, nil
+}
+
+// Get the current row as a map from column names to values, typed as
+// by ScanValues. If several columns have the same name, the last one
+// wins.
+func (s *Stmt) ScanMap() (map[string]interface{}, os.Error) {
+	values, err := s.ScanValues()
+	if err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{})
+	for i, value := range values {
+		row[s.ColumnName(i)] = value
+	}
+	return row, nil
+}
+
+// The rows of a query, as returned by Conn.Query.
+type Rows struct {
+	stmt *Stmt
+	row  map[string]interface{}
+	err  os.Error
+}
+
+// Run a query, and iterate over the rows of its result:
+//
+//	rows, err := c.Query("SELECT * FROM users")
+//	if err != nil { ... }
+//	defer rows.Close()
+//	for rows.Next() {
+//		row := rows.Row()
+//		...
+//	}
+//	if err := rows.Error(); err != nil { ... }
+func (c *Conn) Query(cmd string, args ...interface{}) (*Rows, os.Error) {
+	s, err := c.Prepare(cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Exec(args...)
+	if err != nil {
+		s.Finalize()
+		return nil, err
+	}
+	return &Rows{stmt: s}, nil
+}
+
+// Advance to the next row. Returns false when there are no more rows,
+// or on error.
+func (r *Rows) Next() bool {
+	r.row = nil
+	if r.err != nil || !r.stmt.Next() {
+		return false
+	}
+	r.row, r.err = r.stmt.ScanMap()
+	return r.err == nil
+}
+
+// Get the current row, as returned by Stmt.ScanMap.
+func (r *Rows) Row() map[string]interface{} {
+	return r.row
+}
+
+// Get the columns of the result, in order.
+func (r *Rows) Columns() []string {
+	columns := make([]string, r.stmt.ColumnCount())
+	for i := range columns {
+		columns[i] = r.stmt.ColumnName(i)
+	}
+	return columns
+}
+
+// Get the error that stopped the iteration, if any.
+func (r *Rows) Error() os.Error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.stmt.Error()
+}
+
+// Release the query's statement.
+func (r *Rows) Close() os.Error {
+	return r.stmt.Finalize()
+}
+
+// The fundamental datatypes of SQLite values.
+type Datatype int
+
+const (
+	Integer Datatype = 1
+	Float   Datatype = 2
+	Text    Datatype = 3
+	Blob    Datatype = 4
+	Null    Datatype = 5
+)
+
+func (t Datatype) String() string {
+	switch t {
+	case Integer:
+		return "INTEGER"
+	case Float:
+		return "FLOAT"
+	case Text:
+		return "TEXT"
+	case Blob:
+		return "BLOB"
+	case Null:
+		return "NULL"
+	}
+	return fmt.Sprintf("datatype %d", int(t))
+}
+
+// Get the number of parameters of the statement, which is the number of
+// arguments Exec expects.
+func (s *Stmt) ParameterCount() int {
+	return int(C.sqlite3_bind_parameter_count(s.stmt))
+}
+
+// Get the number of columns in the statement's result set.
+func (s *Stmt) ColumnCount() int {
+	return int(C.sqlite3_column_count(s.stmt))
+}
+
+// Get the name of the i'th result column, counting from 0, or "" if
+// there is no such column.
+func (s *Stmt) ColumnName(i int) string {
+	return C.GoString(C.sqlite3_column_name(s.stmt, C.int(i)))
+}
+
+// Get the datatype of the i'th column of the current row. Since SQLite
+// is dynamically typed, it may differ from row to row. Only valid after
+// Next has returned true.
+func (s *Stmt) ColumnType(i int) Datatype {
+	if i < 0 || i >= s.ColumnCount() {
+		return Null
+	}
+	return Datatype(C.sqlite3_column_type(s.stmt, C.int(i)))
+}
+
+// Get the type the i'th result column is declared with in its table,
+// or "" if it isn't a table column (for instance, an expression).
+func (s *Stmt) ColumnDeclType(i int) string {
+	return C.GoString(C.sqlite3_column_decltype(s.stmt, C.int(i)))
+}
+
 func (s *Stmt) SQL() string {
 	return s.sql + s.args
 }
@@ -384,7 +1185,7 @@ func (s *Stmt) Nanoseconds() int64 {
 func (s *Stmt) Finalize() os.Error {
 	rv := C.sqlite3_finalize(s.stmt)
 	if rv != 0 {
-		return s.c.error(rv)
+		return s.error(rv)
 	}
 	return nil
 }
@@ -393,10 +1194,419 @@ func (c *Conn) Close() os.Error {
 	if c == nil || c.db == nil {
 		return os.NewError("nil sqlite database")
 	}
+	if len(c.memName) > 0 {
+		memoryDBs.mutex.Lock()
+		defer memoryDBs.mutex.Unlock()
+		if mdb := memoryDBs.byName[c.memName]; mdb.refs > 1 {
+			mdb.refs--
+			c.db = nil
+			return nil
+		}
+	}
 	rv := C.sqlite3_close(c.db)
 	if rv != 0 {
 		return c.error(rv)
 	}
+	c.removeHooks()
+	if len(c.memName) > 0 {
+		memoryDBs.byName[c.memName] = nil, false
+	}
 	c.db = nil
 	return nil
 }
+
+// Get the rowid of the row most recently inserted through the
+// connection.
+func (c *Conn) LastInsertRowId() int64 {
+	return int64(C.sqlite3_last_insert_rowid(c.db))
+}
+
+// Get the number of rows changed by the most recent INSERT, UPDATE or
+// DELETE statement run through the connection.
+func (c *Conn) Changes() int {
+	return int(C.sqlite3_changes(c.db))
+}
+
+// Begin a transaction. Statements executed until Commit or Rollback
+// is called are applied atomically.
+func (c *Conn) Begin() os.Error {
+	return c.Exec("BEGIN")
+}
+
+// Commit the current transaction.
+func (c *Conn) Commit() os.Error {
+	return c.Exec("COMMIT")
+}
+
+// Roll back the current transaction.
+func (c *Conn) Rollback() os.Error {
+	return c.Exec("ROLLBACK")
+}
+
+// Report whether a transaction is active, that is, whether the
+// connection is out of autocommit mode.
+func (c *Conn) InTransaction() bool {
+	if c == nil || c.db == nil {
+		return false
+	}
+	return C.sqlite3_get_autocommit(c.db) == 0
+}
+
+// The savepoint nested transactions run in. It mustn't be an SQL
+// keyword, such as "transaction". Savepoints with the same name can be
+// nested, since RELEASE and ROLLBACK TO use the most recent one.
+const transactionSavepoint = "grumble_tx"
+
+// Run f in a transaction. If f returns an error or panics, the
+// transaction is rolled back; otherwise it is committed. Returns the
+// error returned by f, or the error committing the transaction.
+//
+// If a transaction is already active, f is run in a savepoint of it
+// instead (see WithSavepoint), so transactions can be nested.
+func (c *Conn) Transaction(f func(*Conn) os.Error) (err os.Error) {
+	if c.InTransaction() {
+		return c.WithSavepoint(transactionSavepoint, f)
+	}
+
+	err = c.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			c.Rollback()
+		}
+	}()
+
+	err = f(c)
+	if err != nil {
+		return err
+	}
+	err = c.Commit()
+	if err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+var (
+	ErrSavepointName = os.NewError("sqlite: invalid savepoint name")
+	ErrNoSavepoint   = os.NewError("sqlite: no such savepoint")
+	ErrPragmaName    = os.NewError("sqlite: invalid pragma name")
+	ErrDatabaseName  = os.NewError("sqlite: invalid database name")
+	ErrAttached      = os.NewError("sqlite: database name is already in use")
+	ErrNotAttached   = os.NewError("sqlite: no such database")
+)
+
+// Check that name can be used as a savepoint or pragma name without
+// quoting.
+func validIdentifier(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run a savepoint statement on name, mapping the error SQLite reports
+// for unknown savepoints to ErrNoSavepoint.
+func (c *Conn) savepointExec(stmt string, name string) os.Error {
+	if !validIdentifier(name) {
+		return ErrSavepointName
+	}
+	err := c.Exec(stmt + " " + name)
+	if isError(err, ErrError, "no such savepoint") {
+		return ErrNoSavepoint
+	}
+	return err
+}
+
+// Start a savepoint with the given name. Outside of a transaction,
+// this starts a transaction as well, which is committed when the
+// savepoint is released.
+func (c *Conn) Savepoint(name string) os.Error {
+	return c.savepointExec("SAVEPOINT", name)
+}
+
+// Release the most recent savepoint with the given name, and all
+// savepoints started after it.
+func (c *Conn) ReleaseSavepoint(name string) os.Error {
+	return c.savepointExec("RELEASE SAVEPOINT", name)
+}
+
+// Roll back to the most recent savepoint with the given name. The
+// savepoint stays active.
+func (c *Conn) RollbackToSavepoint(name string) os.Error {
+	return c.savepointExec("ROLLBACK TO SAVEPOINT", name)
+}
+
+// Run f within a savepoint with the given name, whether or not a
+// transaction is active. If f returns an error or panics, the changes
+// it made are rolled back; otherwise the savepoint is released.
+func (c *Conn) WithSavepoint(name string, f func(*Conn) os.Error) (err os.Error) {
+	err = c.Savepoint(name)
+	if err != nil {
+		return err
+	}
+
+	released := false
+	defer func() {
+		if !released {
+			c.RollbackToSavepoint(name)
+			c.ReleaseSavepoint(name)
+		}
+	}()
+
+	err = f(c)
+	if err != nil {
+		return err
+	}
+	err = c.ReleaseSavepoint(name)
+	if err != nil {
+		return err
+	}
+	released = true
+	return nil
+}
+
+// Attach the database in the file at path to the connection as name,
+// so its tables can be used as name.table, for instance in queries that
+// join them with tables of the main database.
+func (c *Conn) Attach(path, name string) os.Error {
+	if !validIdentifier(name) || name == "main" || name == "temp" {
+		return ErrDatabaseName
+	}
+	err := c.Exec("ATTACH DATABASE ? AS "+name, path)
+	if isError(err, ErrError, "is already in use") {
+		return ErrAttached
+	}
+	return err
+}
+
+// Detach the database attached as name.
+func (c *Conn) Detach(name string) os.Error {
+	if !validIdentifier(name) {
+		return ErrDatabaseName
+	}
+	err := c.Exec("DETACH DATABASE " + name)
+	if isError(err, ErrError, "no such database") {
+		return ErrNotAttached
+	}
+	return err
+}
+
+// Get the value of the pragma name, typed like the values of ScanMap,
+// or nil if the pragma returns no value.
+func (c *Conn) Pragma(name string) (interface{}, os.Error) {
+	if !validIdentifier(name) {
+		return nil, ErrPragmaName
+	}
+	return c.pragmaExec("PRAGMA " + name)
+}
+
+// Set the pragma name to value, which may be a string, a bool or a
+// number. Returns the value the pragma reports afterwards, if any, as
+// Pragma does; journal_mode reports the mode actually in use, for
+// instance.
+func (c *Conn) SetPragma(name string, value interface{}) (interface{}, os.Error) {
+	if !validIdentifier(name) {
+		return nil, ErrPragmaName
+	}
+	var literal string
+	switch v := value.(type) {
+	case string:
+		literal = "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case bool:
+		literal = "0"
+		if v {
+			literal = "1"
+		}
+	case int, int64, float64:
+		literal = fmt.Sprint(v)
+	default:
+		return nil, os.NewError("unsupported type in SetPragma: " + reflect.Typeof(value).String())
+	}
+	return c.pragmaExec("PRAGMA " + name + " = " + literal)
+}
+
+// Run a pragma statement, and get the first column of its first row.
+func (c *Conn) pragmaExec(cmd string) (value interface{}, err os.Error) {
+	rows, err := c.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		value = rows.Row()[rows.Columns()[0]]
+	}
+	return value, rows.Error()
+}
+
+// Run a check pragma, and get the problems it reports.
+func (c *Conn) checkPragma(cmd string) (problems []string, err os.Error) {
+	rows, err := c.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	problems = []string{}
+	for rows.Next() {
+		if msg, ok := rows.Row()[rows.Columns()[0]].(string); ok && msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err = rows.Error(); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// Check the whole database for corruption, including its indices, and
+// get at most maxErrors of the problems found (100 if maxErrors isn't
+// positive). The database is intact if there are none.
+func (c *Conn) IntegrityCheck(maxErrors int) ([]string, os.Error) {
+	if maxErrors <= 0 {
+		maxErrors = 100
+	}
+	return c.checkPragma(fmt.Sprintf("PRAGMA integrity_check(%d)", maxErrors))
+}
+
+// Like IntegrityCheck, but much faster, since it doesn't check that
+// indices match their tables.
+func (c *Conn) QuickCheck() ([]string, os.Error) {
+	return c.checkPragma("PRAGMA quick_check")
+}
+
+// Set the journal mode of the database: "DELETE", "TRUNCATE", "PERSIST",
+// "MEMORY", "WAL" or "OFF". Fails if SQLite doesn't switch to the mode,
+// as happens with WAL for in-memory databases.
+func (c *Conn) SetJournalMode(mode string) os.Error {
+	value, err := c.SetPragma("journal_mode", mode)
+	if err != nil {
+		return err
+	}
+	if current, ok := value.(string); !ok || strings.ToUpper(current) != strings.ToUpper(mode) {
+		return os.NewError(fmt.Sprintf("sqlite: unable to set journal mode %v, using %v", mode, value))
+	}
+	return nil
+}
+
+// Set how often SQLite waits for writes to reach the disk: "OFF",
+// "NORMAL" or "FULL". In WAL mode, NORMAL is safe against corruption,
+// and only syncs at checkpoints.
+func (c *Conn) SetSynchronous(level string) os.Error {
+	_, err := c.SetPragma("synchronous", level)
+	return err
+}
+
+// A BLOB opened for incremental I/O by Conn.OpenBlob. It implements
+// io.ReadWriteSeeker over the BLOB's contents. Writes can't change the
+// size of the BLOB; to grow it, update the row with a zeroblob() first.
+type BlobIO struct {
+	c      *Conn
+	blob   *C.sqlite3_blob
+	size   int64
+	offset int64
+}
+
+// Open the BLOB in column of the row with the given rowid in table of
+// database db ("main" for the database opened by Open). The BLOB is
+// only writable if writable is set. It must be closed with Close.
+func (c *Conn) OpenBlob(db, table, column string, rowid int64, writable bool) (*BlobIO, os.Error) {
+	if c == nil || c.db == nil {
+		return nil, os.NewError("nil sqlite database")
+	}
+	cdb := C.CString(db)
+	defer C.free(unsafe.Pointer(cdb))
+	ctable := C.CString(table)
+	defer C.free(unsafe.Pointer(ctable))
+	ccolumn := C.CString(column)
+	defer C.free(unsafe.Pointer(ccolumn))
+
+	var flags C.int
+	if writable {
+		flags = 1
+	}
+	var blob *C.sqlite3_blob
+	rv := C.sqlite3_blob_open(c.db, cdb, ctable, ccolumn, C.sqlite3_int64(rowid), flags, &blob)
+	if rv != 0 {
+		if blob != nil {
+			C.sqlite3_blob_close(blob)
+		}
+		return nil, c.error(rv)
+	}
+	return &BlobIO{c: c, blob: blob, size: int64(C.sqlite3_blob_bytes(blob))}, nil
+}
+
+// Get the size of the BLOB, in bytes.
+func (b *BlobIO) Size() int64 {
+	return b.size
+}
+
+func (b *BlobIO) Read(p []byte) (n int, err os.Error) {
+	if b.offset >= b.size {
+		return 0, os.EOF
+	}
+	if int64(len(p)) > b.size-b.offset {
+		p = p[0 : b.size-b.offset]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	rv := C.sqlite3_blob_read(b.blob, unsafe.Pointer(&p[0]), C.int(len(p)), C.int(b.offset))
+	if rv != 0 {
+		return 0, b.c.error(rv)
+	}
+	b.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (b *BlobIO) Write(p []byte) (n int, err os.Error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.offset+int64(len(p)) > b.size {
+		return 0, os.NewError("sqlite: write past the end of the BLOB")
+	}
+	rv := C.sqlite3_blob_write(b.blob, unsafe.Pointer(&p[0]), C.int(len(p)), C.int(b.offset))
+	if rv != 0 {
+		return 0, b.c.error(rv)
+	}
+	b.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (b *BlobIO) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += b.offset
+	case 2:
+		offset += b.size
+	default:
+		return 0, os.EINVAL
+	}
+	if offset < 0 || offset > b.size {
+		return 0, os.EINVAL
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *BlobIO) Close() os.Error {
+	rv := C.sqlite3_blob_close(b.blob)
+	b.blob = nil
+	if rv != 0 {
+		return b.c.error(rv)
+	}
+	return nil
+}
+
+var _ io.ReadWriteSeeker = (*BlobIO)(nil)
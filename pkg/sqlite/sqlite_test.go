@@ -0,0 +1,1195 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *Conn {
+	c, err := OpenMemory("")
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err.String())
+	}
+	return c
+}
+
+func TestStmtReuseAfterError(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT NOT NULL)")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+
+	s, err := c.Prepare("INSERT INTO t (id, name) VALUES (?, ?)")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer s.Finalize()
+
+	if err = s.Exec(1, "a"); err != nil {
+		t.Fatalf(err.String())
+	}
+	for s.Next() {
+	}
+	if err = s.Error(); err != nil {
+		t.Fatalf(err.String())
+	}
+
+	// A duplicate id makes the insert fail...
+	if err = s.Exec(1, "b"); err != nil {
+		t.Fatalf(err.String())
+	}
+	for s.Next() {
+	}
+	if s.Error() == nil {
+		t.Fatalf("duplicate insert didn't fail")
+	}
+
+	// ... which mustn't keep the statement from being run again.
+	if err = s.Exec(2, "b"); err != nil {
+		t.Fatalf("unable to rerun statement: %v", err.String())
+	}
+	for s.Next() {
+	}
+	if err = s.Error(); err != nil {
+		t.Fatalf("stale error after rerun: %v", err.String())
+	}
+
+	err = c.ExecMany("INSERT INTO t (id, name) VALUES (?, ?)", [][]interface{}{[]interface{}{3, "c"}, []interface{}{3, "d"}})
+	if err == nil {
+		t.Fatalf("batch with duplicate ids didn't fail")
+	}
+	err = c.ExecMany("INSERT INTO t (id, name) VALUES (?, ?)", [][]interface{}{[]interface{}{3, "c"}, []interface{}{4, "d"}})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+
+	var n int64
+	q, err := c.Prepare("SELECT COUNT(*) FROM t")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer q.Finalize()
+	if err = q.Exec(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if !q.Next() {
+		t.Fatalf("no count: %v", q.Error())
+	}
+	if err = q.Scan(&n); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n != 4 {
+		t.Errorf("have %v rows, want 4", n)
+	}
+}
+
+func mustExec(t *testing.T, c *Conn, sql string, args ...interface{}) {
+	if err := c.Exec(sql, args...); err != nil {
+		t.Fatalf("%v: %v", sql, err.String())
+	}
+}
+
+// Get the single integer result of a query.
+func queryInt(t *testing.T, c *Conn, sql string, args ...interface{}) int64 {
+	s, err := c.Prepare(sql)
+	if err != nil {
+		t.Fatalf("%v: %v", sql, err.String())
+	}
+	defer s.Finalize()
+	if err = s.Exec(args...); err != nil {
+		t.Fatalf("%v: %v", sql, err.String())
+	}
+	if !s.Next() {
+		t.Fatalf("%v: no row: %v", sql, s.Error())
+	}
+	var n int64
+	if err = s.Scan(&n); err != nil {
+		t.Fatalf("%v: %v", sql, err.String())
+	}
+	return n
+}
+
+func TestTransaction(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+
+	failed := os.NewError("failed")
+	err := c.Transaction(func(c *Conn) os.Error {
+		mustExec(t, c, "INSERT INTO t VALUES (1)")
+		if !c.InTransaction() {
+			t.Errorf("no transaction active in Transaction")
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Transaction returned %v, want %v", err, failed)
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 0 {
+		t.Errorf("failed transaction left %v rows", n)
+	}
+
+	err = c.Transaction(func(c *Conn) os.Error {
+		mustExec(t, c, "INSERT INTO t VALUES (1)")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if c.InTransaction() {
+		t.Errorf("transaction still active")
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 1 {
+		t.Errorf("committed transaction left %v rows, want 1", n)
+	}
+
+	if err = c.Begin(); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "INSERT INTO t VALUES (2)")
+	if err = c.Rollback(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 1 {
+		t.Errorf("rolled back transaction left %v rows, want 1", n)
+	}
+}
+
+func TestNestedTransaction(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+
+	failed := os.NewError("failed")
+	var inner os.Error
+	err := c.Transaction(func(c *Conn) os.Error {
+		mustExec(t, c, "INSERT INTO t VALUES (1)")
+		// A nested transaction runs in a savepoint, whose failure
+		// doesn't affect the outer transaction.
+		inner = c.Transaction(func(c *Conn) os.Error {
+			mustExec(t, c, "INSERT INTO t VALUES (2)")
+			return failed
+		})
+		if err := c.Transaction(func(c *Conn) os.Error {
+			mustExec(t, c, "INSERT INTO t VALUES (3)")
+			return nil
+		}); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if inner != failed {
+		t.Errorf("nested Transaction returned %v, want %v", inner, failed)
+	}
+	if c.InTransaction() {
+		t.Errorf("transaction still active")
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t WHERE n = 2"); n != 0 {
+		t.Errorf("failed nested transaction left its row")
+	}
+	if n := queryInt(t, c, "SELECT SUM(n) FROM t"); n != 4 {
+		t.Errorf("sum %v, want 4", n)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+	if err := c.Savepoint("a"); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "INSERT INTO t VALUES (1)")
+	if err := c.Savepoint("b"); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "INSERT INTO t VALUES (2)")
+	if err := c.RollbackToSavepoint("b"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err := c.ReleaseSavepoint("a"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := queryInt(t, c, "SELECT SUM(n) FROM t"); n != 1 {
+		t.Errorf("sum %v, want 1", n)
+	}
+
+	if err := c.ReleaseSavepoint("nope"); err != ErrNoSavepoint {
+		t.Errorf("releasing an unknown savepoint returned %v", err)
+	}
+	if err := c.Savepoint("bad name"); err != ErrSavepointName {
+		t.Errorf("invalid savepoint name returned %v", err)
+	}
+}
+
+func TestExecScan(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (i INTEGER, f REAL, s TEXT, b BLOB, ok INTEGER)")
+	mustExec(t, c, "INSERT INTO t VALUES (?, ?, ?, ?, ?)", 42, 2.5, "hello", []byte{1, 2, 3}, true)
+	if id := c.LastInsertRowId(); id != 1 {
+		t.Errorf("last insert rowid %v, want 1", id)
+	}
+	if n := c.Changes(); n != 1 {
+		t.Errorf("%v changes, want 1", n)
+	}
+
+	s, err := c.Prepare("SELECT i, f, s, b, ok FROM t")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer s.Finalize()
+	if err = s.Exec(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if !s.Next() {
+		t.Fatalf("no row: %v", s.Error())
+	}
+	var i int
+	var f float64
+	var str string
+	var b []byte
+	var ok bool
+	if err = s.Scan(&i, &f, &str, &b, &ok); err != nil {
+		t.Fatalf(err.String())
+	}
+	if i != 42 || f != 2.5 || str != "hello" || !bytes.Equal(b, []byte{1, 2, 3}) || !ok {
+		t.Errorf("scanned %v %v %v %v %v", i, f, str, b, ok)
+	}
+	if s.Next() {
+		t.Errorf("more than one row")
+	}
+
+	if err = s.Scan(&i); err == nil {
+		t.Errorf("Scan with the wrong argument count didn't fail")
+	}
+	if err = s.Exec(1); err == nil {
+		t.Errorf("Exec with the wrong argument count didn't fail")
+	}
+}
+
+func TestNullTypes(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (s TEXT, i INTEGER, f REAL)")
+	mustExec(t, c, "INSERT INTO t VALUES (?, ?, ?)", nil, NullInt64{}, NullFloat64{})
+	mustExec(t, c, "INSERT INTO t VALUES (?, ?, ?)", NullString{"x", true}, NullInt64{7, true}, NullFloat64{1.5, true})
+
+	s, err := c.Prepare("SELECT s, i, f FROM t ORDER BY rowid")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer s.Finalize()
+	if err = s.Exec(); err != nil {
+		t.Fatalf(err.String())
+	}
+
+	var ns NullString
+	var ni NullInt64
+	var nf NullFloat64
+	if !s.Next() {
+		t.Fatalf("no row: %v", s.Error())
+	}
+	if err = s.Scan(&ns, &ni, &nf); err != nil {
+		t.Fatalf(err.String())
+	}
+	if ns.Valid || ni.Valid || nf.Valid {
+		t.Errorf("NULLs scanned as valid: %v %v %v", ns, ni, nf)
+	}
+
+	if !s.Next() {
+		t.Fatalf("no second row: %v", s.Error())
+	}
+	if err = s.Scan(&ns, &ni, &nf); err != nil {
+		t.Fatalf(err.String())
+	}
+	if !ns.Valid || ns.String != "x" || !ni.Valid || ni.Int64 != 7 || !nf.Valid || nf.Float64 != 1.5 {
+		t.Errorf("scanned %v %v %v", ns, ni, nf)
+	}
+}
+
+func TestColumnInfo(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (id INTEGER, name VARCHAR(20))")
+	mustExec(t, c, "INSERT INTO t VALUES (1, NULL)")
+	s, err := c.Prepare("SELECT id, name AS n FROM t")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer s.Finalize()
+	if s.ColumnCount() != 2 {
+		t.Fatalf("%v columns, want 2", s.ColumnCount())
+	}
+	if s.ColumnName(0) != "id" || s.ColumnName(1) != "n" {
+		t.Errorf("column names %v, %v", s.ColumnName(0), s.ColumnName(1))
+	}
+	if s.ColumnDeclType(0) != "INTEGER" || s.ColumnDeclType(1) != "VARCHAR(20)" {
+		t.Errorf("declared types %v, %v", s.ColumnDeclType(0), s.ColumnDeclType(1))
+	}
+	if err = s.Exec(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if !s.Next() {
+		t.Fatalf("no row: %v", s.Error())
+	}
+	if s.ColumnType(0) != Integer || s.ColumnType(1) != Null {
+		t.Errorf("column types %v, %v", s.ColumnType(0), s.ColumnType(1))
+	}
+}
+
+func TestScanStruct(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, pw TEXT)")
+	mustExec(t, c, "INSERT INTO users (name, pw) VALUES ('alice', 'secret')")
+
+	var u struct {
+		Id       int64
+		Username string `sqlite:"name"`
+		Password string `sqlite:"-"`
+	}
+	s, err := c.Prepare("SELECT id, name, pw FROM users")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer s.Finalize()
+	if err = s.Exec(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if !s.Next() {
+		t.Fatalf("no row: %v", s.Error())
+	}
+	if err = s.ScanStruct(&u); err != nil {
+		t.Fatalf(err.String())
+	}
+	if u.Id != 1 || u.Username != "alice" || len(u.Password) != 0 {
+		t.Errorf("scanned %v", u)
+	}
+	if err = s.ScanStruct(u); err == nil {
+		t.Errorf("ScanStruct into a non-pointer didn't fail")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	mustExec(t, c, "INSERT INTO users (name) VALUES ('alice')")
+	mustExec(t, c, "INSERT INTO users (name) VALUES ('bob')")
+
+	rows, err := c.Query("SELECT id, name FROM users WHERE id = ?", 1)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer rows.Close()
+	if columns := rows.Columns(); len(columns) != 2 || columns[0] != "id" || columns[1] != "name" {
+		t.Errorf("columns %v", columns)
+	}
+	n := 0
+	for rows.Next() {
+		row := rows.Row()
+		if row["id"] != int64(1) || row["name"] != "alice" {
+			t.Errorf("row %v", row)
+		}
+		n++
+	}
+	if err = rows.Error(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n != 1 {
+		t.Errorf("%v rows, want 1", n)
+	}
+}
+
+func TestPragmas(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	if _, err := c.SetPragma("user_version", 7); err != nil {
+		t.Fatalf(err.String())
+	}
+	v, err := c.Pragma("user_version")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if v != int64(7) {
+		t.Errorf("user_version %v, want 7", v)
+	}
+	if _, err = c.Pragma("user_version; DROP TABLE t"); err != ErrPragmaName {
+		t.Errorf("invalid pragma name returned %v", err)
+	}
+	if err = c.SetJournalMode("WAL"); err == nil {
+		t.Errorf("WAL mode for an in-memory database didn't fail")
+	}
+	if err = c.SetJournalMode("MEMORY"); err != nil {
+		t.Errorf(err.String())
+	}
+}
+
+func TestBlobIO(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (data BLOB)")
+	mustExec(t, c, "INSERT INTO t VALUES (zeroblob(5))")
+
+	b, err := c.OpenBlob("main", "t", "data", c.LastInsertRowId(), true)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if b.Size() != 5 {
+		t.Errorf("size %v, want 5", b.Size())
+	}
+	if _, err = b.Write([]byte("hello")); err != nil {
+		t.Fatalf(err.String())
+	}
+	if _, err = b.Write([]byte("!")); err == nil {
+		t.Errorf("write past the end didn't fail")
+	}
+	if _, err = b.Seek(1, 0); err != nil {
+		t.Fatalf(err.String())
+	}
+	data, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if string(data) != "ello" {
+		t.Errorf("read %q, want \"ello\"", data)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatalf(err.String())
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.CreateFunction("twice", 1, func(args ...interface{}) interface{} {
+		return args[0].(int64) * 2
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := queryInt(t, c, "SELECT twice(21)"); n != 42 {
+		t.Errorf("twice(21) = %v", n)
+	}
+
+	err = c.CreateFunction("fail", 0, func(args ...interface{}) interface{} {
+		return os.NewError("failed")
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if err = c.Exec("SELECT fail()"); err == nil {
+		t.Errorf("function returning an error didn't fail the statement")
+	}
+
+	err = c.CreateFunction("oops", 0, func(args ...interface{}) interface{} {
+		panic("oops")
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if err = c.Exec("SELECT oops()"); err == nil {
+		t.Errorf("panicking function didn't fail the statement")
+	}
+}
+
+func TestCollations(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.CreateCollation("reverse", func(a, b string) int {
+		switch {
+		case a < b:
+			return 1
+		case a > b:
+			return -1
+		}
+		return 0
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "CREATE TABLE t (s TEXT)")
+	mustExec(t, c, "INSERT INTO t VALUES ('a')")
+	mustExec(t, c, "INSERT INTO t VALUES ('b')")
+	rows, err := c.Query("SELECT s FROM t ORDER BY s COLLATE reverse")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer rows.Close()
+	if !rows.Next() || rows.Row()["s"] != "b" {
+		t.Errorf("collation didn't reverse the order: %v %v", rows.Row(), rows.Error())
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+
+	var ops []int
+	c.UpdateHook(func(op int, db, table string, rowid int64) {
+		if db != "main" || table != "t" {
+			t.Errorf("update of %v.%v", db, table)
+		}
+		ops = append(ops, op)
+	})
+	mustExec(t, c, "INSERT INTO t VALUES (1)")
+	mustExec(t, c, "UPDATE t SET n = 2")
+	mustExec(t, c, "DELETE FROM t WHERE n = 2")
+	if len(ops) != 3 || ops[0] != OpInsert || ops[1] != OpUpdate || ops[2] != OpDelete {
+		t.Errorf("update hook saw %v", ops)
+	}
+	c.UpdateHook(func(op int, db, table string, rowid int64) {
+		panic("oops")
+	})
+	mustExec(t, c, "INSERT INTO t VALUES (1)")
+	mustExec(t, c, "DELETE FROM t WHERE n = 1")
+	c.UpdateHook(nil)
+
+	rollbacks := 0
+	c.RollbackHook(func() {
+		rollbacks++
+	})
+	c.CommitHook(func() bool {
+		return false
+	})
+	if err := c.Exec("INSERT INTO t VALUES (3)"); err == nil {
+		t.Errorf("commit hook didn't turn the commit into a rollback")
+	}
+	if rollbacks != 1 {
+		t.Errorf("rollback hook called %v times, want 1", rollbacks)
+	}
+	c.CommitHook(func() bool {
+		panic("oops")
+	})
+	if err := c.Exec("INSERT INTO t VALUES (4)"); err == nil {
+		t.Errorf("panicking commit hook didn't roll back")
+	}
+	c.CommitHook(nil)
+	c.RollbackHook(nil)
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 0 {
+		t.Errorf("rolled back commits left %v rows", n)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE secret (n INTEGER)")
+	err := c.SetAuthorizer(func(action, arg1, arg2, db, trigger string) int {
+		if action == "READ" && arg1 == "secret" {
+			return AuthDeny
+		}
+		return AuthOk
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	_, err = c.Prepare("SELECT n FROM secret")
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrAuth {
+		t.Errorf("denied read returned %v", err)
+	}
+	if err = c.SetAuthorizer(nil); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "SELECT n FROM secret")
+}
+
+func TestTraceProfile(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	var traced []string
+	c.Trace(func(sql string) {
+		traced = append(traced, sql)
+	})
+	mustExec(t, c, "SELECT 1")
+	c.Trace(nil)
+	mustExec(t, c, "SELECT 2")
+	if len(traced) != 1 || traced[0] != "SELECT 1" {
+		t.Errorf("traced %v", traced)
+	}
+
+	var profiled []string
+	c.Profile(func(sql string, ns int64) {
+		if ns < 0 {
+			t.Errorf("%v ran for %v ns", sql, ns)
+		}
+		profiled = append(profiled, sql)
+	})
+	mustExec(t, c, "SELECT 1")
+	if len(profiled) != 1 || profiled[0] != "SELECT 1" {
+		t.Errorf("profiled %v", profiled)
+	}
+
+	c.Trace(func(sql string) {
+		panic("oops")
+	})
+	c.Profile(func(sql string, ns int64) {
+		panic("oops")
+	})
+	mustExec(t, c, "SELECT 1")
+	c.Trace(nil)
+	c.Profile(nil)
+}
+
+func TestBusyHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "busy.db")
+
+	c1, err := Open(path)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer c1.Close()
+	c2, err := Open(path)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer c2.Close()
+
+	mustExec(t, c1, "CREATE TABLE t (n INTEGER)")
+	mustExec(t, c1, "BEGIN EXCLUSIVE")
+	defer c1.Rollback()
+
+	calls := 0
+	err = c2.BusyHandler(func(count int) bool {
+		if count != calls {
+			t.Errorf("busy handler called with count %v, want %v", count, calls)
+		}
+		calls++
+		return calls < 3
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	err = c2.Exec("INSERT INTO t VALUES (1)")
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrBusy {
+		t.Errorf("insert into a locked database returned %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("busy handler called %v times, want 3", calls)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER UNIQUE)")
+	mustExec(t, c, "INSERT INTO t VALUES (1)")
+	err := c.Exec("INSERT INTO t VALUES (1)")
+	e, ok := err.(*Error)
+	if !ok || os.Error(e.Code) != ErrConstraint || os.Error(e.ExtendedCode) != ErrConstraint {
+		t.Fatalf("duplicate insert returned %v", err)
+	}
+	if e.SQL != "INSERT INTO t VALUES (1)" || len(e.Msg) == 0 {
+		t.Errorf("error has SQL %q, message %q", e.SQL, e.Msg)
+	}
+
+	_, err = c.Prepare("SELECT * FROM nonexistent")
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrError || e.SQL != "SELECT * FROM nonexistent" {
+		t.Errorf("preparing a bad query returned %v", err)
+	}
+}
+
+func TestMisuseError(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	// SQLITE_MISUSE isn't recorded as the connection's error, but it's
+	// reported as an *Error all the same.
+	err := c.errorSQL(21, "SELECT 1")
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrMisuse || e.SQL != "SELECT 1" {
+		t.Errorf("misuse returned %v", err)
+	}
+}
+
+func TestOpenWithFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flags.db")
+
+	_, err = OpenWithFlags(path, OpenNoCreate)
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrCantOpen {
+		t.Errorf("opening a missing database returned %v", err)
+	}
+
+	c, err := Open(path)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+	c.Close()
+
+	c, err = OpenWithFlags(path, OpenReadOnly)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer c.Close()
+	err = c.Exec("INSERT INTO t VALUES (1)")
+	if e, ok := err.(*Error); !ok || os.Error(e.Code) != ErrReadOnly {
+		t.Errorf("write to a read-only database returned %v", err)
+	}
+}
+
+func TestOpenMemory(t *testing.T) {
+	a, err := OpenMemory("shared")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer a.Close()
+	b, err := OpenMemory("shared")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, a, "CREATE TABLE t (n INTEGER)")
+	mustExec(t, a, "INSERT INTO t VALUES (1)")
+	if n := queryInt(t, b, "SELECT COUNT(*) FROM t"); n != 1 {
+		t.Errorf("connection with the same name sees %v rows, want 1", n)
+	}
+	// Closing one connection keeps the database for the other.
+	b.Close()
+	if n := queryInt(t, a, "SELECT COUNT(*) FROM t"); n != 1 {
+		t.Errorf("%v rows after closing the other connection, want 1", n)
+	}
+
+	private := openTestDB(t)
+	defer private.Close()
+	if err = private.Exec("SELECT * FROM t"); err == nil {
+		t.Errorf("private in-memory database shares tables")
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.ExecScript(`
+		CREATE TABLE t (n INTEGER UNIQUE);
+		INSERT INTO t VALUES (1);
+		-- A comment.
+		INSERT INTO t VALUES (2);
+	`)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 2 {
+		t.Errorf("%v rows, want 2", n)
+	}
+
+	script := "INSERT INTO t VALUES (3); INSERT INTO t VALUES (1)"
+	err = c.ExecScript(script)
+	serr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("failing script returned %v", err)
+	}
+	if serr.Offset != strings.Index(script, "INSERT INTO t VALUES (1)") {
+		t.Errorf("error at offset %v", serr.Offset)
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 3 {
+		t.Errorf("%v rows, want 3", n)
+	}
+}
+
+func TestBackupToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+
+	c := openTestDB(t)
+	defer c.Close()
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+	for i := 0; i < 100; i++ {
+		mustExec(t, c, "INSERT INTO t VALUES (?)", i)
+	}
+
+	steps := 0
+	err = c.BackupToFile(path, 1, func(status BackupStatus) {
+		steps++
+	})
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if steps == 0 {
+		t.Errorf("progress function not called")
+	}
+
+	b, err := Open(path)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer b.Close()
+	if n := queryInt(t, b, "SELECT COUNT(*) FROM t"); n != 100 {
+		t.Errorf("backup has %v rows, want 100", n)
+	}
+}
+
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer os.RemoveAll(dir)
+
+	opened := 0
+	p := NewPool(filepath.Join(dir, "pool.db"), 2, func(c *Conn) os.Error {
+		opened++
+		return c.Exec("CREATE TABLE IF NOT EXISTS t (n INTEGER)")
+	})
+	a, err := p.Get()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	b, err := p.Get()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if a == b || opened != 2 {
+		t.Errorf("pool opened %v connections, want 2", opened)
+	}
+
+	// A transaction left open is rolled back when the connection is
+	// put back.
+	mustExec(t, a, "BEGIN")
+	mustExec(t, a, "INSERT INTO t VALUES (1)")
+	p.Put(a)
+	if n := queryInt(t, b, "SELECT COUNT(*) FROM t"); n != 0 {
+		t.Errorf("rolled back insert left %v rows", n)
+	}
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if c != a || opened != 2 {
+		t.Errorf("idle connection not reused")
+	}
+	p.Put(b)
+	p.Put(c)
+
+	if err = p.Close(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if _, err = p.Get(); err == nil {
+		t.Errorf("Get from a closed pool didn't fail")
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+	mustExec(t, c, "CREATE INDEX t_n ON t (n)")
+	mustExec(t, c, "INSERT INTO t VALUES (1)")
+
+	problems, err := c.QuickCheck()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if len(problems) != 0 {
+		t.Errorf("quick check of a new database found %v", problems)
+	}
+	problems, err = c.IntegrityCheck(0)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if len(problems) != 0 {
+		t.Errorf("integrity check of a new database found %v", problems)
+	}
+}
+
+func TestExecMany(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)")
+	rows := [][]interface{}{
+		[]interface{}{1, "a"},
+		[]interface{}{2, "b"},
+		[]interface{}{2, "c"},
+	}
+	err := c.ExecMany("INSERT INTO t VALUES (?, ?)", rows)
+	berr, ok := err.(*BatchError)
+	if !ok || berr.Row != 2 {
+		t.Fatalf("batch with a duplicate id returned %v", err)
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 0 {
+		t.Errorf("failed batch left %v rows", n)
+	}
+
+	if err = c.ExecMany("INSERT INTO t VALUES (?, ?)", rows[0:2]); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := queryInt(t, c, "SELECT COUNT(*) FROM t"); n != 2 {
+		t.Errorf("%v rows, want 2", n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	old := c.Limit(LimitAttached)
+	if prev := c.SetLimit(LimitAttached, 0); prev != old {
+		t.Errorf("SetLimit returned %v, want %v", prev, old)
+	}
+	if n := c.Limit(LimitAttached); n != 0 {
+		t.Errorf("attached limit %v, want 0", n)
+	}
+	if n := c.SetLimit(LimitAttached, -1); n != 0 {
+		t.Errorf("SetLimit with a negative value changed the limit to %v", n)
+	}
+	if err := c.Exec("ATTACH DATABASE ':memory:' AS aux"); err == nil {
+		t.Errorf("attach beyond the limit didn't fail")
+	}
+}
+
+func TestLoadExtensionDisabled(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.LoadExtension("nonexistent", "")
+	if _, ok := err.(*Error); !ok {
+		t.Errorf("loading an extension while disabled returned %v", err)
+	}
+	if err = c.EnableLoadExtension(true); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err = c.LoadExtension("nonexistent", ""); err == nil {
+		t.Errorf("loading a missing extension didn't fail")
+	}
+}
+
+func TestKey(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	err := c.Key([]byte("secret"))
+	if !HasEncryption {
+		if err == nil {
+			t.Errorf("Key succeeded without encryption support")
+		}
+		if err = c.Rekey([]byte("secret")); err == nil {
+			t.Errorf("Rekey succeeded without encryption support")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "CREATE TABLE t (n INTEGER)")
+	if err = c.Rekey([]byte("other")); err != nil {
+		t.Errorf(err.String())
+	}
+}
+
+func TestAttach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer os.RemoveAll(dir)
+
+	c := openTestDB(t)
+	defer c.Close()
+
+	if err = c.Attach(filepath.Join(dir, "aux.db"), "aux"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err = c.Attach(filepath.Join(dir, "other.db"), "aux"); err != ErrAttached {
+		t.Errorf("attaching twice returned %v", err)
+	}
+	mustExec(t, c, "CREATE TABLE aux.t (n INTEGER)")
+	mustExec(t, c, "INSERT INTO aux.t VALUES (5)")
+	if n := queryInt(t, c, "SELECT n FROM aux.t"); n != 5 {
+		t.Errorf("read %v from attached database, want 5", n)
+	}
+	if err = c.Detach("aux"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err = c.Detach("aux"); err != ErrNotAttached {
+		t.Errorf("detaching twice returned %v", err)
+	}
+	if err = c.Attach(filepath.Join(dir, "main.db"), "main"); err != ErrDatabaseName {
+		t.Errorf("attaching as main returned %v", err)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	mustExec(t, c, "CREATE TABLE t (at)")
+	when := time.SecondsToUTC(1300000000)
+	for _, format := range []TimeFormat{TimeText, TimeJulianDay, TimeUnix} {
+		c.SetTimeFormat(format)
+		mustExec(t, c, "DELETE FROM t")
+		mustExec(t, c, "INSERT INTO t VALUES (?)", when)
+
+		s, err := c.Prepare("SELECT at FROM t")
+		if err != nil {
+			t.Fatalf(err.String())
+		}
+		if err = s.Exec(); err != nil {
+			t.Fatalf(err.String())
+		}
+		var at time.Time
+		if !s.Next() {
+			t.Fatalf("no row: %v", s.Error())
+		}
+		if err = s.Scan(&at); err != nil {
+			t.Fatalf(err.String())
+		}
+		s.Finalize()
+		if at.Seconds() != when.Seconds() {
+			t.Errorf("format %v: read %v, want %v", format, at.Seconds(), when.Seconds())
+		}
+	}
+}
+
+// A virtual table module whose tables hold the numbers 1 to 3.
+type countModule struct{}
+
+func (countModule) Connect(args []string) (VTab, os.Error) {
+	return countTable{}, nil
+}
+
+type countTable struct{}
+
+func (countTable) Schema() string {
+	return "CREATE TABLE x (n INTEGER)"
+}
+
+func (countTable) Open() (VTabCursor, os.Error) {
+	return &countCursor{}, nil
+}
+
+func (countTable) Disconnect() {
+}
+
+type countCursor struct {
+	i int
+}
+
+func (cur *countCursor) Filter() os.Error {
+	cur.i = 0
+	return nil
+}
+
+func (cur *countCursor) Next() os.Error {
+	cur.i++
+	return nil
+}
+
+func (cur *countCursor) EOF() bool {
+	return cur.i >= 3
+}
+
+func (cur *countCursor) Column(i int) (interface{}, os.Error) {
+	return int64(cur.i + 1), nil
+}
+
+func (cur *countCursor) Rowid() (int64, os.Error) {
+	return int64(cur.i + 1), nil
+}
+
+func (cur *countCursor) Close() os.Error {
+	return nil
+}
+
+func TestVirtualTable(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	if err := c.CreateModule("count", countModule{}); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "CREATE VIRTUAL TABLE temp.numbers USING count()")
+	if n := queryInt(t, c, "SELECT SUM(n) FROM numbers"); n != 6 {
+		t.Errorf("sum %v, want 6", n)
+	}
+	if n := queryInt(t, c, "SELECT MAX(rowid) FROM numbers"); n != 3 {
+		t.Errorf("max rowid %v, want 3", n)
+	}
+}
+
+// A count module whose cursors panic reading a column.
+type panicModule struct{}
+
+func (panicModule) Connect(args []string) (VTab, os.Error) {
+	return panicTable{}, nil
+}
+
+type panicTable struct {
+	countTable
+}
+
+func (panicTable) Open() (VTabCursor, os.Error) {
+	return &panicCursor{}, nil
+}
+
+type panicCursor struct {
+	countCursor
+}
+
+func (cur *panicCursor) Column(i int) (interface{}, os.Error) {
+	panic("column")
+}
+
+func TestVirtualTablePanic(t *testing.T) {
+	c := openTestDB(t)
+	defer c.Close()
+
+	if err := c.CreateModule("panic", panicModule{}); err != nil {
+		t.Fatalf(err.String())
+	}
+	mustExec(t, c, "CREATE VIRTUAL TABLE temp.numbers USING panic()")
+	err := c.Exec("SELECT SUM(n) FROM numbers")
+	if err == nil {
+		t.Fatalf("panicking column didn't fail the query")
+	}
+	if !strings.Contains(err.String(), "panicked") {
+		t.Errorf("error %q doesn't report the panic", err.String())
+	}
+}
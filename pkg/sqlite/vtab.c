@@ -0,0 +1,135 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// The sqlite3_module shared by all modules registered with
+// Conn.CreateModule. Virtual tables and cursors carry the id of their Go
+// counterpart, and each callback hands it to the Go side. See vtab.go.
+
+#include <stdlib.h>
+#include <string.h>
+#include "sqlite3.h"
+#include "_cgo_export.h"
+
+typedef struct {
+	sqlite3_vtab base;
+	void *id;
+} go_vtab;
+
+typedef struct {
+	sqlite3_vtab_cursor base;
+	void *id;
+} go_cursor;
+
+// Set the error message of a virtual table to msg, which is freed.
+void my_vtab_error(sqlite3_vtab *vtab, char *msg) {
+	sqlite3_free(vtab->zErrMsg);
+	vtab->zErrMsg = sqlite3_mprintf("%s", msg);
+	free(msg);
+}
+
+void my_cursor_error(sqlite3_vtab_cursor *cur, char *msg) {
+	my_vtab_error(cur->pVtab, msg);
+}
+
+static int vtab_connect(sqlite3 *db, void *module, int argc, const char *const *argv, sqlite3_vtab **ppVTab, char **pzErr) {
+	void *id = 0;
+	char *err = 0;
+	int rv = goVTabConnect(db, module, argc, (char **) argv, &id, &err);
+	if (rv != SQLITE_OK) {
+		if (err) {
+			*pzErr = sqlite3_mprintf("%s", err);
+			free(err);
+		}
+		return rv;
+	}
+	go_vtab *vtab = sqlite3_malloc(sizeof(go_vtab));
+	if (vtab == 0) {
+		goVTabDisconnect(id);
+		return SQLITE_NOMEM;
+	}
+	memset(vtab, 0, sizeof(go_vtab));
+	vtab->id = id;
+	*ppVTab = &vtab->base;
+	return SQLITE_OK;
+}
+
+static int vtab_best_index(sqlite3_vtab *vtab, sqlite3_index_info *info) {
+	// Every query is a full scan.
+	info->estimatedCost = 1e6;
+	return SQLITE_OK;
+}
+
+static int vtab_disconnect(sqlite3_vtab *vtab) {
+	goVTabDisconnect(((go_vtab *) vtab)->id);
+	sqlite3_free(vtab->zErrMsg);
+	sqlite3_free(vtab);
+	return SQLITE_OK;
+}
+
+static int vtab_open(sqlite3_vtab *vtab, sqlite3_vtab_cursor **ppCursor) {
+	void *id = 0;
+	int rv = goVTabOpen(vtab, ((go_vtab *) vtab)->id, &id);
+	if (rv != SQLITE_OK) {
+		return rv;
+	}
+	go_cursor *cur = sqlite3_malloc(sizeof(go_cursor));
+	if (cur == 0) {
+		goCursorClose(0, id);
+		return SQLITE_NOMEM;
+	}
+	memset(cur, 0, sizeof(go_cursor));
+	cur->id = id;
+	*ppCursor = &cur->base;
+	return SQLITE_OK;
+}
+
+static int vtab_close(sqlite3_vtab_cursor *cur) {
+	int rv = goCursorClose(cur, ((go_cursor *) cur)->id);
+	sqlite3_free(cur);
+	return rv;
+}
+
+static int vtab_filter(sqlite3_vtab_cursor *cur, int idxNum, const char *idxStr, int argc, sqlite3_value **argv) {
+	return goCursorFilter(cur, ((go_cursor *) cur)->id);
+}
+
+static int vtab_next(sqlite3_vtab_cursor *cur) {
+	return goCursorNext(cur, ((go_cursor *) cur)->id);
+}
+
+static int vtab_eof(sqlite3_vtab_cursor *cur) {
+	return goCursorEOF(((go_cursor *) cur)->id);
+}
+
+static int vtab_column(sqlite3_vtab_cursor *cur, sqlite3_context *ctx, int i) {
+	return goCursorColumn(cur, ((go_cursor *) cur)->id, ctx, i);
+}
+
+static int vtab_rowid(sqlite3_vtab_cursor *cur, sqlite3_int64 *rowid) {
+	return goCursorRowid(cur, ((go_cursor *) cur)->id, rowid);
+}
+
+static void destroy_module(void *id) {
+	goDestroyModule(id);
+}
+
+static sqlite3_module go_module = {
+	1,
+	vtab_connect,
+	vtab_connect,
+	vtab_best_index,
+	vtab_disconnect,
+	vtab_disconnect,
+	vtab_open,
+	vtab_close,
+	vtab_filter,
+	vtab_next,
+	vtab_eof,
+	vtab_column,
+	vtab_rowid,
+};
+
+int my_create_module(sqlite3 *db, const char *name, void *id) {
+	return sqlite3_create_module_v2(db, name, &go_module, id, destroy_module);
+}
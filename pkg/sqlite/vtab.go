@@ -0,0 +1,303 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlite
+
+/*
+#include <stdlib.h>
+#include "sqlite3.h"
+
+// See vtab.c.
+void my_vtab_error(sqlite3_vtab *vtab, char *msg);
+void my_cursor_error(sqlite3_vtab_cursor *cur, char *msg);
+int my_create_module(sqlite3 *db, const char *name, void *id);
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// A virtual table module, which implements tables whose rows come from
+// Go. Modules are registered with Conn.CreateModule; tables using them
+// are created with
+//
+//	CREATE VIRTUAL TABLE name USING module(arguments)
+//
+// or CREATE VIRTUAL TABLE temp.name ... for tables that are gone when
+// the connection is closed. Virtual tables are read-only, and every
+// query scans all of their rows.
+type Module interface {
+	// Create the virtual table of a CREATE VIRTUAL TABLE statement,
+	// or connect to one created before. args holds the module name,
+	// the database name, the table name and the statement's
+	// arguments, as written.
+	Connect(args []string) (VTab, os.Error)
+}
+
+// A virtual table.
+type VTab interface {
+	// Get the CREATE TABLE statement declaring the table's columns.
+	// Its table name is ignored.
+	Schema() string
+
+	// Open a cursor over the table's rows.
+	Open() (VTabCursor, os.Error)
+
+	// Called when the table is no longer used by the connection.
+	Disconnect()
+}
+
+// A cursor over the rows of a virtual table.
+type VTabCursor interface {
+	// Start a scan over all rows, positioning the cursor on the first.
+	// May be called several times on the same cursor.
+	Filter() os.Error
+
+	// Advance to the next row.
+	Next() os.Error
+
+	// Whether the cursor has moved past the last row.
+	EOF() bool
+
+	// Get the value of the i'th column of the current row, of a type
+	// an SQL function may return (see Conn.CreateFunction).
+	Column(i int) (interface{}, os.Error)
+
+	// Get the rowid of the current row.
+	Rowid() (int64, os.Error)
+
+	Close() os.Error
+}
+
+// The modules, tables and cursors known to SQLite, by the id stored with
+// their C counterparts in vtab.c.
+var vtabObjects = struct {
+	mutex  sync.Mutex
+	byId   map[uintptr]interface{}
+	nextId uintptr
+}{byId: make(map[uintptr]interface{})}
+
+func newVTabObject(obj interface{}) unsafe.Pointer {
+	vtabObjects.mutex.Lock()
+	defer vtabObjects.mutex.Unlock()
+	vtabObjects.nextId++
+	vtabObjects.byId[vtabObjects.nextId] = obj
+	return unsafe.Pointer(vtabObjects.nextId)
+}
+
+func vtabObject(id unsafe.Pointer) interface{} {
+	vtabObjects.mutex.Lock()
+	defer vtabObjects.mutex.Unlock()
+	return vtabObjects.byId[uintptr(id)]
+}
+
+func freeVTabObject(id unsafe.Pointer) {
+	vtabObjects.mutex.Lock()
+	vtabObjects.byId[uintptr(id)] = nil, false
+	vtabObjects.mutex.Unlock()
+}
+
+// Register module under name, for use in CREATE VIRTUAL TABLE
+// statements on this connection.
+func (c *Conn) CreateModule(name string, module Module) os.Error {
+	if c == nil || c.db == nil {
+		return os.NewError("nil sqlite database")
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	// On failure, SQLite calls the destructor, which frees the id.
+	return c.error(C.my_create_module(c.db, cname, newVTabObject(module)))
+}
+
+// Report err as the error of a cursor's operation.
+func cursorError(cur *C.sqlite3_vtab_cursor, err os.Error) C.int {
+	if cur != nil {
+		C.my_cursor_error(cur, C.CString(err.String()))
+	}
+	return C.SQLITE_ERROR
+}
+
+// Turn a panic in a cursor method into the error of the cursor's
+// operation, rather than unwinding through SQLite. Must be deferred.
+func recoverCursor(cur *C.sqlite3_vtab_cursor, rv *C.int) {
+	if r := recover(); r != nil {
+		*rv = cursorError(cur, os.NewError(fmt.Sprintf("sqlite: virtual table cursor panicked: %v", r)))
+	}
+}
+
+//export goVTabConnect
+func goVTabConnect(db *C.sqlite3, moduleId unsafe.Pointer, argc C.int, argv **C.char, id *unsafe.Pointer, errmsg **C.char) (rv C.int) {
+	module, ok := vtabObject(moduleId).(Module)
+	if !ok {
+		*errmsg = C.CString("sqlite: module is gone")
+		return C.SQLITE_ERROR
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			*errmsg = C.CString(fmt.Sprintf("sqlite: virtual table module panicked: %v", r))
+			rv = C.SQLITE_ERROR
+		}
+	}()
+
+	args := make([]string, int(argc))
+	if argc > 0 {
+		cargs := (*[1 << 20]*C.char)(unsafe.Pointer(argv))[0:argc]
+		for i, arg := range cargs {
+			args[i] = C.GoString(arg)
+		}
+	}
+	vtab, err := module.Connect(args)
+	if err != nil {
+		*errmsg = C.CString(err.String())
+		return C.SQLITE_ERROR
+	}
+
+	schema := C.CString(vtab.Schema())
+	defer C.free(unsafe.Pointer(schema))
+	if rv := C.sqlite3_declare_vtab(db, schema); rv != 0 {
+		vtab.Disconnect()
+		*errmsg = C.CString(C.GoString(C.sqlite3_errmsg(db)))
+		return rv
+	}
+	*id = newVTabObject(vtab)
+	return C.SQLITE_OK
+}
+
+//export goVTabDisconnect
+func goVTabDisconnect(id unsafe.Pointer) {
+	defer freeVTabObject(id)
+	// A panic can't be reported from a disconnect, so it's dropped.
+	defer func() {
+		recover()
+	}()
+	if vtab, ok := vtabObject(id).(VTab); ok {
+		vtab.Disconnect()
+	}
+}
+
+//export goVTabOpen
+func goVTabOpen(cvtab *C.sqlite3_vtab, id unsafe.Pointer, cursorId *unsafe.Pointer) (rv C.int) {
+	vtab, ok := vtabObject(id).(VTab)
+	if !ok {
+		C.my_vtab_error(cvtab, C.CString("sqlite: virtual table is gone"))
+		return C.SQLITE_ERROR
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			C.my_vtab_error(cvtab, C.CString(fmt.Sprintf("sqlite: virtual table panicked: %v", r)))
+			rv = C.SQLITE_ERROR
+		}
+	}()
+	cursor, err := vtab.Open()
+	if err != nil {
+		C.my_vtab_error(cvtab, C.CString(err.String()))
+		return C.SQLITE_ERROR
+	}
+	*cursorId = newVTabObject(cursor)
+	return C.SQLITE_OK
+}
+
+// Get the cursor with the given id, reporting an error on cur if it's
+// gone.
+func lookupCursor(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer) (VTabCursor, C.int) {
+	cursor, ok := vtabObject(id).(VTabCursor)
+	if !ok {
+		return nil, cursorError(cur, os.NewError("sqlite: cursor is gone"))
+	}
+	return cursor, C.SQLITE_OK
+}
+
+//export goCursorClose
+func goCursorClose(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer) (rv C.int) {
+	cursor, rv := lookupCursor(cur, id)
+	freeVTabObject(id)
+	if cursor == nil {
+		return rv
+	}
+	defer recoverCursor(cur, &rv)
+	if err := cursor.Close(); err != nil {
+		return cursorError(cur, err)
+	}
+	return C.SQLITE_OK
+}
+
+//export goCursorFilter
+func goCursorFilter(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer) (rv C.int) {
+	cursor, rv := lookupCursor(cur, id)
+	if cursor == nil {
+		return rv
+	}
+	defer recoverCursor(cur, &rv)
+	if err := cursor.Filter(); err != nil {
+		return cursorError(cur, err)
+	}
+	return C.SQLITE_OK
+}
+
+//export goCursorNext
+func goCursorNext(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer) (rv C.int) {
+	cursor, rv := lookupCursor(cur, id)
+	if cursor == nil {
+		return rv
+	}
+	defer recoverCursor(cur, &rv)
+	if err := cursor.Next(); err != nil {
+		return cursorError(cur, err)
+	}
+	return C.SQLITE_OK
+}
+
+//export goCursorEOF
+func goCursorEOF(id unsafe.Pointer) (eof C.int) {
+	// A cursor whose EOF panics ends the scan.
+	defer func() {
+		if recover() != nil {
+			eof = 1
+		}
+	}()
+	cursor, ok := vtabObject(id).(VTabCursor)
+	if !ok || cursor.EOF() {
+		return 1
+	}
+	return 0
+}
+
+//export goCursorColumn
+func goCursorColumn(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer, ctx *C.sqlite3_context, i C.int) (rv C.int) {
+	cursor, rv := lookupCursor(cur, id)
+	if cursor == nil {
+		return rv
+	}
+	defer recoverCursor(cur, &rv)
+	value, err := cursor.Column(int(i))
+	if err != nil {
+		return cursorError(cur, err)
+	}
+	setFunctionResult(ctx, value)
+	return C.SQLITE_OK
+}
+
+//export goCursorRowid
+func goCursorRowid(cur *C.sqlite3_vtab_cursor, id unsafe.Pointer, rowid *C.sqlite3_int64) (rv C.int) {
+	cursor, rv := lookupCursor(cur, id)
+	if cursor == nil {
+		return rv
+	}
+	defer recoverCursor(cur, &rv)
+	r, err := cursor.Rowid()
+	if err != nil {
+		return cursorError(cur, err)
+	}
+	*rowid = C.sqlite3_int64(r)
+	return C.SQLITE_OK
+}
+
+//export goDestroyModule
+func goDestroyModule(id unsafe.Pointer) {
+	freeVTabObject(id)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Package sqlitedriver provides generic interfaces to SQL databases,
+// shaped like the driver interfaces of database/sql, and implements them
+// on top of the sqlite package. Code that only needs to run queries can
+// use these interfaces rather than the sqlite package's own API, and
+// still shares its SQLite library.
+package sqlitedriver
+
+import (
+	"os"
+)
+
+// A database driver.
+type Driver interface {
+	// Open a connection to the database name, which is interpreted by
+	// the driver.
+	Open(name string) (Conn, os.Error)
+}
+
+// A connection to a database. Connections are used by one goroutine at
+// a time.
+type Conn interface {
+	// Prepare a statement.
+	Prepare(query string) (Stmt, os.Error)
+
+	// Begin a transaction.
+	Begin() (Tx, os.Error)
+
+	Close() os.Error
+}
+
+// A prepared statement.
+type Stmt interface {
+	// Get the number of arguments Exec and Query expect.
+	NumInput() int
+
+	// Run a statement that doesn't return rows, such as an INSERT.
+	Exec(args []interface{}) (Result, os.Error)
+
+	// Run a query. The statement can't be used again until its rows
+	// are closed.
+	Query(args []interface{}) (Rows, os.Error)
+
+	Close() os.Error
+}
+
+// The result of Stmt.Exec.
+type Result interface {
+	// Get the id of the row inserted by the statement.
+	LastInsertId() (int64, os.Error)
+
+	// Get the number of rows changed by the statement.
+	RowsAffected() (int64, os.Error)
+}
+
+// The rows returned by Stmt.Query.
+type Rows interface {
+	// Get the names of the columns.
+	Columns() []string
+
+	// Read the next row into dest, which has one element per column.
+	// Values are int64, float64, string or []byte, or nil for NULL.
+	// Returns os.EOF when there are no more rows.
+	Next(dest []interface{}) os.Error
+
+	Close() os.Error
+}
+
+// A transaction.
+type Tx interface {
+	Commit() os.Error
+	Rollback() os.Error
+}
+
+// Prepare query on conn, run it once with args, and close the
+// statement again.
+func Exec(conn Conn, query string, args ...interface{}) (Result, os.Error) {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return stmt.Exec(args)
+}
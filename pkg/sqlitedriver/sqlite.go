@@ -0,0 +1,138 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlitedriver
+
+import (
+	"os"
+	"sqlite"
+)
+
+// The driver for SQLite databases. Names are file names, or ":memory:".
+var SQLite Driver = sqliteDriver{}
+
+type sqliteDriver struct{}
+
+func (d sqliteDriver) Open(name string) (Conn, os.Error) {
+	c, err := sqlite.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{c}, nil
+}
+
+type sqliteConn struct {
+	c *sqlite.Conn
+}
+
+func (sc *sqliteConn) Prepare(query string) (Stmt, os.Error) {
+	s, err := sc.c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStmt{sc.c, s}, nil
+}
+
+func (sc *sqliteConn) Begin() (Tx, os.Error) {
+	if err := sc.c.Begin(); err != nil {
+		return nil, err
+	}
+	return sqliteTx{sc.c}, nil
+}
+
+func (sc *sqliteConn) Close() os.Error {
+	return sc.c.Close()
+}
+
+type sqliteStmt struct {
+	c *sqlite.Conn
+	s *sqlite.Stmt
+}
+
+func (ss *sqliteStmt) NumInput() int {
+	return ss.s.ParameterCount()
+}
+
+func (ss *sqliteStmt) Exec(args []interface{}) (Result, os.Error) {
+	if err := ss.s.Exec(args...); err != nil {
+		return nil, err
+	}
+	for ss.s.Next() {
+	}
+	if err := ss.s.Error(); err != nil {
+		return nil, err
+	}
+	return sqliteResult{ss.c.LastInsertRowId(), int64(ss.c.Changes())}, nil
+}
+
+func (ss *sqliteStmt) Query(args []interface{}) (Rows, os.Error) {
+	if err := ss.s.Exec(args...); err != nil {
+		return nil, err
+	}
+	return &sqliteRows{ss.s}, nil
+}
+
+func (ss *sqliteStmt) Close() os.Error {
+	return ss.s.Finalize()
+}
+
+type sqliteResult struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func (r sqliteResult) LastInsertId() (int64, os.Error) {
+	return r.lastInsertId, nil
+}
+
+func (r sqliteResult) RowsAffected() (int64, os.Error) {
+	return r.rowsAffected, nil
+}
+
+type sqliteRows struct {
+	s *sqlite.Stmt
+}
+
+func (sr *sqliteRows) Columns() []string {
+	columns := make([]string, sr.s.ColumnCount())
+	for i := range columns {
+		columns[i] = sr.s.ColumnName(i)
+	}
+	return columns
+}
+
+func (sr *sqliteRows) Next(dest []interface{}) os.Error {
+	if !sr.s.Next() {
+		if err := sr.s.Error(); err != nil {
+			return err
+		}
+		return os.EOF
+	}
+	values, err := sr.s.ScanValues()
+	if err != nil {
+		return err
+	}
+	if len(dest) != len(values) {
+		return os.NewError("sqlitedriver: wrong number of destination values")
+	}
+	copy(dest, values)
+	return nil
+}
+
+// Closing the rows leaves the statement open, so it can be run again.
+func (sr *sqliteRows) Close() os.Error {
+	return sr.s.Reset()
+}
+
+type sqliteTx struct {
+	c *sqlite.Conn
+}
+
+func (tx sqliteTx) Commit() os.Error {
+	return tx.c.Commit()
+}
+
+func (tx sqliteTx) Rollback() os.Error {
+	return tx.c.Rollback()
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package sqlitedriver
+
+import (
+	"os"
+	"testing"
+)
+
+func openTestConn(t *testing.T) Conn {
+	conn, err := SQLite.Open(":memory:")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if _, err := Exec(conn, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatalf(err.String())
+	}
+	return conn
+}
+
+func countRows(t *testing.T, conn Conn) int64 {
+	stmt, err := conn.Prepare("SELECT COUNT(*) FROM t")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(nil)
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer rows.Close()
+	dest := make([]interface{}, 1)
+	if err := rows.Next(dest); err != nil {
+		t.Fatalf(err.String())
+	}
+	n, ok := dest[0].(int64)
+	if !ok {
+		t.Fatalf("count is %T, want int64", dest[0])
+	}
+	return n
+}
+
+func TestExecResult(t *testing.T) {
+	conn := openTestConn(t)
+	defer conn.Close()
+
+	res, err := Exec(conn, "INSERT INTO t (id, name) VALUES (?, ?)", 7, "seven")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if id, err := res.LastInsertId(); err != nil || id != 7 {
+		t.Errorf("last insert id %v (%v), want 7", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		t.Errorf("rows affected %v (%v), want 1", n, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	conn := openTestConn(t)
+	defer conn.Close()
+
+	for _, name := range []string{"one", "two"} {
+		if _, err := Exec(conn, "INSERT INTO t (name) VALUES (?)", name); err != nil {
+			t.Fatalf(err.String())
+		}
+	}
+
+	stmt, err := conn.Prepare("SELECT id, name FROM t WHERE id >= ? ORDER BY id")
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	defer stmt.Close()
+	if n := stmt.NumInput(); n != 1 {
+		t.Errorf("%v inputs, want 1", n)
+	}
+
+	// The statement can be queried again once its rows are closed.
+	for run := 0; run < 2; run++ {
+		rows, err := stmt.Query([]interface{}{1})
+		if err != nil {
+			t.Fatalf(err.String())
+		}
+		if cols := rows.Columns(); len(cols) != 2 || cols[0] != "id" || cols[1] != "name" {
+			t.Errorf("columns %v, want [id name]", cols)
+		}
+		var names []string
+		dest := make([]interface{}, 2)
+		for {
+			err := rows.Next(dest)
+			if err == os.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf(err.String())
+			}
+			name, ok := dest[1].(string)
+			if !ok {
+				t.Fatalf("name is %T, want string", dest[1])
+			}
+			names = append(names, name)
+		}
+		if len(names) != 2 || names[0] != "one" || names[1] != "two" {
+			t.Errorf("run %v: names %v, want [one two]", run, names)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatalf(err.String())
+		}
+	}
+}
+
+func TestTx(t *testing.T) {
+	conn := openTestConn(t)
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if _, err := Exec(conn, "INSERT INTO t (name) VALUES ('gone')"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := countRows(t, conn); n != 0 {
+		t.Errorf("%v rows after rollback, want 0", n)
+	}
+
+	tx, err = conn.Begin()
+	if err != nil {
+		t.Fatalf(err.String())
+	}
+	if _, err := Exec(conn, "INSERT INTO t (name) VALUES ('kept')"); err != nil {
+		t.Fatalf(err.String())
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf(err.String())
+	}
+	if n := countRows(t, conn); n != 1 {
+		t.Errorf("%v rows after commit, want 1", n)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements IP address privacy controls. The IPPrivacy config
+// key selects how client addresses are shown in logs and to users without
+// BanPermission on the root channel:
+//
+//	off   addresses are shown as-is (the default)
+//	mask  the host part of addresses is zeroed (IPv4 /24, IPv6 /48)
+//	omit  addresses are not shown at all
+//
+// Regardless of the privacy mode, addresses that need to be kept around
+// (for example for ban matching) should be stored as hashes, using
+// addressHash. The hashes are salted per server.
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+)
+
+// Get the privacy mode of the server.
+func (server *Server) ipPrivacy() string {
+	mode := server.cfg.StringValue("IPPrivacy")
+	if mode != "mask" && mode != "omit" {
+		return "off"
+	}
+	return mode
+}
+
+// Mask the host part of ip.
+func maskIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPv4(ip4[0], ip4[1], ip4[2], 0)
+	}
+	masked := make(net.IP, len(ip))
+	copy(masked[0:6], ip[0:6])
+	return masked
+}
+
+// Format ip for use in log messages, according to the server's
+// privacy mode.
+func (server *Server) logAddr(ip net.IP) string {
+	switch server.ipPrivacy() {
+	case "mask":
+		return maskIP(ip).String() + " (masked)"
+	case "omit":
+		return "(hidden)"
+	}
+	return ip.String()
+}
+
+// Get ip as it may be shown to client, or nil if it may not be shown
+// at all.
+func (server *Server) visibleAddr(client *Client, ip net.IP) net.IP {
+	if server.HasPermission(client, server.root, BanPermission) {
+		return ip
+	}
+	switch server.ipPrivacy() {
+	case "mask":
+		return maskIP(ip)
+	case "omit":
+		return nil
+	}
+	return ip
+}
+
+// Get a salted hash of ip, suitable for storing in place of the
+// address itself.
+func (server *Server) addressHash(ip net.IP) string {
+	salt := server.cfg.StringValue("IPHashSalt")
+	if len(salt) == 0 {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			panic("Unable to generate address hash salt")
+		}
+		salt = hex.EncodeToString(buf)
+		server.cfg.Set("IPHashSalt", salt)
+	}
+
+	hash := sha1.New()
+	hash.Write([]byte(salt))
+	hash.Write(ip.To16())
+	return hex.EncodeToString(hash.Sum())
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"privdrop"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Look up an entry in a colon-separated database such as /etc/passwd
+// or /etc/group. Name may be either the entry's name or its numeric id.
+// Returns the fields of the matching entry.
+func lookupDbEntry(dbfile string, name string) (fields []string, err os.Error) {
+	f, err := os.Open(dbfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			fields = strings.Split(strings.TrimSpace(line), ":", -1)
+			if len(fields) >= 4 && (fields[0] == name || fields[2] == name) {
+				return fields, nil
+			}
+		}
+		if err == os.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, os.NewError("no such entry in " + dbfile + ": " + name)
+}
+
+// Look up the uid and primary gid of a user.
+func lookupUser(name string) (uid int, gid int, err os.Error) {
+	fields, err := lookupDbEntry("/etc/passwd", name)
+	if err != nil {
+		return -1, -1, err
+	}
+	uid, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err = strconv.Atoi(fields[3])
+	if err != nil {
+		return -1, -1, err
+	}
+	return
+}
+
+// Look up the gid of a group.
+func lookupGroup(name string) (gid int, err os.Error) {
+	fields, err := lookupDbEntry("/etc/group", name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(fields[2])
+}
+
+// Get the path of path relative to root, for use after a chroot into
+// root. Fails if path does not lie within root.
+func chrootPath(root string, path string) (newpath string, err os.Error) {
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	if path == root {
+		return "/", nil
+	}
+	if !strings.HasPrefix(path, root+"/") {
+		return "", os.NewError(path + " is outside of " + root)
+	}
+	return path[len(root):], nil
+}
+
+// Drop root privileges, as configured by the -user, -group and -chroot
+// flags. This must be called once the servers' sockets are bound, but
+// before anything else is set up.
+//
+// Go code can't drop the privileges of a running process, since setuid
+// only applies to the calling thread (see the privdrop package). So
+// Grumble starts itself again, and hands its sockets over as in an
+// upgrade (see upgrade.go). The new process drops privileges before its
+// runtime starts, and sets up everything else itself, such as the
+// control interface. If the new process has been started, restarted is
+// set, and this process should exit.
+//
+// When chrooting, the data directory becomes the new root, and the
+// datadir and blobdir flags are rewritten to be valid inside it. Since
+// the new process starts in the chroot, the certificate and key, and
+// any other files Grumble reads, must be inside the data directory.
+func DropPrivileges() (restarted bool, err os.Error) {
+	if len(*runuser) == 0 && len(*rungroup) == 0 && !*chroot {
+		return false, nil
+	}
+
+	if privdrop.Dropped() {
+		// Upgrades of this process don't drop them again.
+		os.Setenv(privdrop.Env, "")
+		if !*chroot {
+			if err := os.Chdir(*datadir); err != nil {
+				return false, err
+			}
+		}
+		log.Printf("Dropped privileges (uid=%v, gid=%v)", syscall.Getuid(), syscall.Getgid())
+		return false, nil
+	}
+
+	if syscall.Getuid() != 0 {
+		// The process we were upgraded from has dropped them already.
+		// See upgrade.go.
+		if inherited.parent != 0 {
+			return false, nil
+		}
+		return false, os.NewError("must be run as root to drop privileges")
+	}
+
+	uid, gid := -1, -1
+	if len(*runuser) > 0 {
+		uid, gid, err = lookupUser(*runuser)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(*rungroup) > 0 {
+		gid, err = lookupGroup(*rungroup)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	args := os.Args
+	root := ""
+	if *chroot {
+		root, err = filepath.Abs(*datadir)
+		if err != nil {
+			return false, err
+		}
+		absblobdir, err := filepath.Abs(*blobdir)
+		if err != nil {
+			return false, err
+		}
+		newblobdir, err := chrootPath(root, absblobdir)
+		if err != nil {
+			return false, os.NewError("blob directory must be inside the data directory when chrooting: " + err.String())
+		}
+		// Later flags override earlier ones.
+		args = append(append([]string{}, os.Args...), "-datadir=/", "-blobdir="+newblobdir)
+	}
+
+	files, env, err := handoverSockets(privdrop.Env, privdrop.Spec(uid, gid, root))
+	if err != nil {
+		return false, err
+	}
+	defer closeFiles(files)
+	pid, err := startUpgradedProcess(args, files, env)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Started process %v to run without privileges (user %q, group %q, chroot %v)", pid, *runuser, *rungroup, *chroot)
+	return true, nil
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"os"
+)
+
+// Dropping privileges is not supported on Windows. Run Grumble
+// under a restricted service account instead.
+func DropPrivileges() (restarted bool, err os.Error) {
+	if len(*runuser) > 0 || len(*rungroup) > 0 || *chroot {
+		return false, os.NewError("-user, -group and -chroot are not supported on Windows")
+	}
+	return false, nil
+}
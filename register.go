@@ -0,0 +1,217 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements user registration through UserState messages.
+// A client asks for a user to be registered by sending a UserState for
+// the user with user_id set to 0.
+//
+// Registering another user requires the register permission on the
+// root channel. Clients may register themselves if they have the
+// selfregister permission on the root channel, or, when the
+// SelfRegistration config key is set, if they hold a strong
+// certificate. Self-registrations are limited to SelfRegistrationsPerDay
+// per server and day.
+//
+// A certificate is strong if it chains up to one of the certificate
+// authorities in the PEM file given by the CertificateAuthorities
+// config key. There are no strong certificates if the key is unset.
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+// The maximum length of a registered user's name.
+const MaxUserNameLength = 128
+
+// Load the certificate authorities in the PEM file filename.
+func loadCertificateAuthorities(filename string) (cas []*x509.Certificate, err os.Error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(buf) > 0 {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, cert)
+	}
+	return cas, nil
+}
+
+// Check whether the certificate chain presented by a client chains up
+// to one of the server's certificate authorities.
+func (server *Server) isStrongCertificate(chain []*x509.Certificate) bool {
+	filename := server.cfg.StringValue("CertificateAuthorities")
+	if len(chain) == 0 || len(filename) == 0 {
+		return false
+	}
+
+	cas, err := loadCertificateAuthorities(filename)
+	if err != nil {
+		log.Printf("Unable to load certificate authorities: %v", err.String())
+		return false
+	}
+
+	now := time.Seconds()
+	for i, cert := range chain {
+		if now < cert.NotBefore.Seconds() || now > cert.NotAfter.Seconds() {
+			return false
+		}
+		for _, ca := range cas {
+			if cert.CheckSignatureFrom(ca) == nil {
+				return true
+			}
+		}
+		if i+1 < len(chain) && cert.CheckSignatureFrom(chain[i+1]) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// Check whether name may be used for a new registration.
+func (server *Server) validUserName(name string) bool {
+	if len(name) == 0 || len(name) > MaxUserNameLength {
+		return false
+	}
+	if _, exists := server.UserNameMap[name]; exists {
+		return false
+	}
+	matched, err := regexp.MatchString("^("+server.cfg.StringValue("UserNameRegex")+")$", name)
+	return err == nil && matched
+}
+
+// Count a self-registration against the server's daily limit. Returns
+// false if the limit has been reached.
+func (server *Server) countSelfRegistration() bool {
+	limit := server.cfg.IntValue("SelfRegistrationsPerDay")
+	day := time.Seconds() / 86400
+	if day != server.regDay {
+		server.regDay = day
+		server.regCount = 0
+	}
+	if limit > 0 && server.regCount >= limit {
+		return false
+	}
+	server.regCount++
+	return true
+}
+
+// Check the server's ChannelCreation policy, which applies on top of the
+// MakeChannel and MakeTempChannel permissions. Returns the reason the
+// client may not create channels, or an empty string if it may.
+func (server *Server) channelCreationDenied(client *Client) string {
+	if client.UserId() == 0 {
+		return ""
+	}
+
+	switch server.cfg.StringValue("ChannelCreation") {
+	case "registered":
+		if !client.IsRegistered() {
+			return "Only registered users may create channels on this server."
+		}
+	case "strong":
+		if !client.IsRegistered() || !client.StrongCertificate {
+			return "Only registered users with a strong certificate may create channels on this server."
+		}
+	}
+	return ""
+}
+
+// Check whether actor may register target. Sends a PermissionDenied to
+// actor and returns false if not.
+func (server *Server) checkRegistration(actor *Client, target *Client) bool {
+	perm := Permission(RegisterPermission)
+	if actor == target {
+		perm = SelfRegisterPermission
+	}
+
+	allowed := server.HasPermission(actor, server.root, perm)
+	if actor == target && !allowed && server.cfg.BoolValue("SelfRegistration") {
+		allowed = target.StrongCertificate
+	}
+	if target.IsRegistered() || !allowed {
+		actor.sendPermissionDenied(actor, server.root, perm)
+		return false
+	}
+
+	// We can't register a user with an empty hash.
+	if len(target.CertHash) == 0 {
+		actor.sendPermissionDeniedTypeUser("MissingCertificate", target)
+		return false
+	}
+
+	if reason := server.registrationLimitDenied(target); len(reason) > 0 {
+		actor.sendPermissionDeniedText(reason)
+		return false
+	}
+
+	if !server.validUserName(target.Username) {
+		actor.sendPermissionDeniedTypeUser("UserName", target)
+		return false
+	}
+
+	if actor == target && !server.countSelfRegistration() {
+		actor.sendPermissionDeniedText("Too many registrations today. Please try again tomorrow.")
+		return false
+	}
+
+	return true
+}
+
+// Add a new registration with the given name and certificate hash.
+func (server *Server) addRegistration(name string, certhash string) (user *User, err os.Error) {
+	var id uint32
+	for uid, _ := range server.Users {
+		if uid >= id {
+			id = uid + 1
+		}
+	}
+
+	user, err = NewUser(id, name)
+	if err != nil {
+		return nil, err
+	}
+	user.CertHash = certhash
+	user.LastConnect = uint64(time.Seconds())
+	user.LastActive = user.LastConnect
+
+	server.Users[user.Id] = user
+	server.UserNameMap[user.Name] = user
+	if len(user.CertHash) > 0 {
+		server.UserCertMap[user.CertHash] = user
+	}
+	return user, nil
+}
+
+// Register a connected client as a user of the server.
+func (server *Server) RegisterClient(client *Client) (user *User, err os.Error) {
+	user, err = server.addRegistration(client.Username, client.CertHash)
+	if err != nil {
+		return nil, err
+	}
+	client.user = user
+	server.ClearACLCache()
+
+	client.Printf("Registered as user %v (%v)", user.Id, user.Name)
+	return user, nil
+}
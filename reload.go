@@ -0,0 +1,114 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements reloading persistent data while Grumble is
+// running. A reload re-reads the registered users and channel group
+// definitions of a server from its frozen file, and the global ban
+// list from the data directory. Reloads are triggered by SIGHUP (for all
+// servers) or through the control interface.
+//
+// Since running servers are frozen periodically, external tools editing
+// the data directory should trigger a reload as soon as they have
+// written their changes, or those changes will be overwritten.
+
+import (
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"log"
+	"mumbleproto"
+	"os"
+	"path/filepath"
+)
+
+// Get the path of a server's frozen file.
+func frozenServerPath(id int64) string {
+	return filepath.Join(*datadir, fmt.Sprintf("%v", id))
+}
+
+// Replace the server's registered users and channel groups with those
+// in fs. Connected clients whose registration no longer exists are
+// turned into unregistered users.
+func (server *Server) reloadFrozen(fs *frozenServer) (err os.Error) {
+	users := make(map[uint32]*User)
+	names := make(map[string]*User)
+	certs := make(map[string]*User)
+	for _, fu := range fs.Users {
+		u, err := unfreezeUser(&fu)
+		if err != nil {
+			return err
+		}
+		users[u.Id] = u
+		names[u.Name] = u
+		if len(u.CertHash) > 0 {
+			certs[u.CertHash] = u
+		}
+	}
+	if _, ok := users[0]; !ok {
+		return os.NewError("no SuperUser in frozen server")
+	}
+
+	server.Users = users
+	server.UserNameMap = names
+	server.UserCertMap = certs
+
+	for _, fc := range fs.Channels {
+		if channel, ok := server.Channels[fc.Id]; ok {
+			channel.Groups = unfreezeGroups(channel, &fc)
+		}
+	}
+	server.ClearACLCache()
+
+	for _, client := range server.clients {
+		if client.user == nil {
+			continue
+		}
+		if user, ok := users[client.user.Id]; ok {
+			client.user = user
+			continue
+		}
+		client.user = nil
+		err := server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session),
+			UserId:  proto.Uint32(0xffffffff),
+		})
+		if err != nil {
+			log.Printf("Unable to broadcast UserState: %v", err.String())
+		}
+	}
+
+	return nil
+}
+
+// Reload the server's users and groups from its frozen file.
+func (server *Server) Reload() (err os.Error) {
+	fs, err := store.LoadServer(server.Id)
+	if err != nil {
+		return err
+	}
+
+	server.syncCall(func() {
+		err = server.reloadFrozen(fs)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reloaded users and groups of server %v", server.Id)
+	return nil
+}
+
+// Reload the global ban list and all servers.
+func reloadAll() {
+	err := store.LoadBans(globalBans)
+	if err != nil {
+		log.Printf("Unable to reload global ban list: %s", err.String())
+	}
+	for _, s := range allServers() {
+		if err := s.Reload(); err != nil {
+			log.Printf("Unable to reload server %v: %s", s.Id, err.String())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements checking client certificates against a
+// certificate revocation list. The CRL is read from the PEM or DER file
+// given by the CertificateRevocationList config key, and should be
+// issued by the server's certificate authority (see register.go).
+//
+// Parsed CRLs are cached, and only re-read when their file changes, so
+// authenticating a client doesn't mean parsing the CRL again.
+
+import (
+	"crypto/x509"
+	"crypto/x509/crl"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type revocationList struct {
+	mtime   int64
+	expires int64
+
+	// The serial numbers of revoked certificates.
+	revoked map[string]bool
+}
+
+var crlCache = struct {
+	mutex sync.Mutex
+	lists map[string]*revocationList
+}{lists: make(map[string]*revocationList)}
+
+// Read and parse the CRL in filename.
+func readRevocationList(filename string, mtime int64) (rl *revocationList, err os.Error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	certList, err := crl.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	rl = &revocationList{
+		mtime:   mtime,
+		revoked: make(map[string]bool),
+	}
+	if next := certList.TBSCertList.NextUpdate; next != nil {
+		rl.expires = next.Seconds()
+	}
+	for _, revoked := range certList.TBSCertList.RevokedCertificates {
+		rl.revoked[string(revoked.SerialNumber.Bytes)] = true
+	}
+	return rl, nil
+}
+
+// Get the CRL in filename, from the cache if the file hasn't changed.
+func loadRevocationList(filename string) (rl *revocationList, err os.Error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	crlCache.mutex.Lock()
+	defer crlCache.mutex.Unlock()
+
+	rl, ok := crlCache.lists[filename]
+	if ok && rl.mtime == fi.Mtime_ns {
+		return rl, nil
+	}
+
+	rl, err = readRevocationList(filename, fi.Mtime_ns)
+	if err != nil {
+		return nil, err
+	}
+	crlCache.lists[filename] = rl
+	log.Printf("Loaded certificate revocation list %v (%v revoked)", filename, len(rl.revoked))
+	return rl, nil
+}
+
+// Check whether any certificate in a client's certificate chain has been
+// revoked. Returns false if the server has no CRL. If the CRL can't be
+// read, certificates are treated as revoked, so that a broken CRL
+// doesn't let revoked certificates in.
+func (server *Server) isRevokedCertificate(chain []*x509.Certificate) bool {
+	filename := server.cfg.StringValue("CertificateRevocationList")
+	if len(chain) == 0 || len(filename) == 0 {
+		return false
+	}
+
+	rl, err := loadRevocationList(filename)
+	if err != nil {
+		log.Printf("Unable to load certificate revocation list: %v", err.String())
+		return true
+	}
+	if rl.expires > 0 && time.Seconds() > rl.expires {
+		log.Printf("Certificate revocation list %v is out of date", filename)
+	}
+
+	for _, cert := range chain {
+		if rl.revoked[string(cert.SerialNumber)] {
+			return true
+		}
+	}
+	return false
+}
@@ -15,7 +15,7 @@ import (
 	"compress/gzip"
 	"encoding/binary"
 	"encoding/hex"
-	"sync"
+	"sync/atomic"
 	"goprotobuf.googlecode.com/hg/proto"
 	"mumbleproto"
 	"cryptstate"
@@ -24,6 +24,7 @@ import (
 	"io"
 	"rand"
 	"strings"
+	"time"
 )
 
 // The default port a Murmur server listens on
@@ -46,13 +47,19 @@ type Server struct {
 	listener tls.Listener
 	address  string
 	port     int
-	udpconn  *net.UDPConn
+	udpsocks []*udpSocket
+	tlsls    []*tls.Listener
+	tcpsocks []*tcpSocket
 	running  bool
 
+	// The time the server started serving, in seconds since the epoch.
+	startTime int64
+
 	incoming       chan *Message
 	udpsend        chan *Message
 	voicebroadcast chan *VoiceBroadcast
 	freezeRequest  chan *freezeRequest
+	controlRequest chan *controlRequest
 
 	// Signals to the server that a client has been successfully
 	// authenticated.
@@ -61,14 +68,42 @@ type Server struct {
 	// Config-related
 	MaxUsers     int
 	MaxBandwidth uint32
+	cfg          *Config
 
-	// Clients
-	clients map[uint32]*Client
+	// Clients. The clients map is owned by the handler goroutine;
+	// numClients mirrors its size for use by other goroutines.
+	clients    map[uint32]*Client
+	numClients int32
 
 	// Host, host/port -> client mapping
-	hmutex    sync.Mutex
-	hclients  map[string][]*Client
-	hpclients map[string]*Client
+	addrs *addrIndex
+
+	// Bytes received and sent since the last usage sample. See
+	// usagestats.go.
+	bytesIn  int64
+	bytesOut int64
+
+	// Rate limiter for connectionless pings. See udpfilter.go.
+	pings *pingLimiter
+
+	// The day (in days since the Unix epoch) and number of the last
+	// self-registrations. See register.go.
+	regDay   int64
+	regCount int
+
+	// The sessions handed over by an upgrade, by certificate hash and
+	// name, and when they expire. See upgrade.go.
+	upgradeSessions map[string]*upgradeSession
+	upgradeExpiry   int64
+
+	// Channel invites, by token. See invite.go.
+	invites map[string]*Invite
+
+	// The SuperUser's second factor. See totp.go.
+	totp totpState
+
+	// Text bridges, by channel id. See bridge.go.
+	bridges map[int][]Bridge
 
 	// Codec information
 	AlphaCodec       int32
@@ -94,6 +129,13 @@ type freezeRequest struct {
 	readCloser  io.ReadCloser
 }
 
+// A request to run a function in the server's synchronous handler.
+// Used by the control interface to access server state.
+type controlRequest struct {
+	fn   func()
+	done chan bool
+}
+
 // Allocate a new Murmur instance
 func NewServer(id int64, addr string, port int) (s *Server, err os.Error) {
 	s = new(Server)
@@ -108,17 +150,21 @@ func NewServer(id int64, addr string, port int) (s *Server, err os.Error) {
 	s.UserCertMap = make(map[string]*User)
 	s.UserNameMap = make(map[string]*User)
 
-	s.hclients = make(map[string][]*Client)
-	s.hpclients = make(map[string]*Client)
+	s.addrs = newAddrIndex()
+	s.pings = newPingLimiter()
+	s.invites = make(map[string]*Invite)
+	s.bridges = make(map[int][]Bridge)
 
 	s.incoming = make(chan *Message)
 	s.udpsend = make(chan *Message)
 	s.voicebroadcast = make(chan *VoiceBroadcast)
 	s.freezeRequest = make(chan *freezeRequest)
+	s.controlRequest = make(chan *controlRequest)
 	s.clientAuthenticated = make(chan *Client)
 
 	s.MaxBandwidth = 300000
 	s.MaxUsers = 10
+	s.cfg = NewConfig(nil)
 
 	s.Channels = make(map[int]*Channel)
 	s.root = s.NewChannel(0, "Root")
@@ -179,13 +225,31 @@ func (server *Server) NewClient(conn net.Conn) (err os.Error) {
 
 	client.tcpaddr = addr.(*net.TCPAddr)
 	client.server = server
+	client.TraceId = newTraceId()
+
+	if geoip != nil {
+		client.Country = geoip.Lookup(client.tcpaddr.IP)
+		if !server.countryAllowed(client.Country) {
+			client.Printf("Denied connection from %v (country %v)", server.logAddr(client.tcpaddr.IP), client.Country)
+			countryDenied.Add(client.Country, 1)
+			conn.Close()
+			return os.NewError("connection denied by GeoIP policy")
+		}
+		client.Printf("New connection from %v (country %v)", server.logAddr(client.tcpaddr.IP), client.Country)
+		countryConnections.Add(client.Country, 1)
+	}
+
 	client.conn = conn
 	client.reader = bufio.NewReader(client.conn)
 	client.writer = bufio.NewWriter(client.conn)
 	client.state = StateClientConnected
 
 	client.msgchan = make(chan *Message)
+	client.voicechan = make(chan *Message, VoiceQueueSize)
 	client.udprecv = make(chan []byte)
+	client.listening = make(map[int]*Channel)
+	client.invited = make(map[int]bool)
+	client.pluginBucket = NewLeakyBucket(5, 20)
 
 	client.user = nil
 
@@ -201,27 +265,41 @@ func (server *Server) NewClient(conn net.Conn) (err os.Error) {
 // Remove a disconnected client from the server's
 // internal representation.
 func (server *Server) RemoveClient(client *Client, kicked bool) {
-	server.hmutex.Lock()
-	if client.udpaddr != nil {
-		host := client.udpaddr.IP.String()
-		oldclients := server.hclients[host]
-		newclients := []*Client{}
-		for _, hostclient := range oldclients {
-			if hostclient != client {
-				newclients = append(newclients, hostclient)
-			}
-		}
-		server.hclients[host] = newclients
-		server.hpclients[client.udpaddr.String()] = nil, false
+	if len(client.Country) > 0 {
+		countryConnections.Add(client.Country, -1)
+	}
+
+	if _, ok := server.clients[client.Session]; ok {
+		server.addrs.Remove(client)
+		server.clients[client.Session] = nil, false
+		atomic.AddInt32(&server.numClients, -1)
+		sessionCount.Add(-1)
+		voiceDrops.Remove(server.sessionKey(client))
+		server.finishTalkStats(client)
+		server.finishNetQuality(client)
+		server.stopCapture(client)
 	}
-	server.hmutex.Unlock()
 
-	server.clients[client.Session] = nil, false
+	// Record when a registered user was last seen
+	if client.user != nil && client.state >= StateClientReady {
+		now := uint64(time.Seconds())
+		client.user.LastDisconnect = now
+		client.user.LastActive = now
+	}
 
 	// Remove client from channel
 	channel := client.Channel
 	if channel != nil {
 		channel.RemoveClient(client)
+		if client.state == StateClientReady {
+			server.sendChannelMessages(client, channel, nil)
+		}
+	}
+
+	// Stop listening to channels
+	for _, listened := range client.listening {
+		listened.RemoveListener(client)
+		server.broadcastListenerCount(listened)
 	}
 
 	// If the user was not kicked, broadcast a UserRemove message.
@@ -313,7 +391,18 @@ func (server *Server) GenSessionId() (session uint32) {
 // This is the synchronous handler goroutine.
 // Important control channel messages are routed through this Goroutine
 // to keep server state synchronized.
+//
+// Server methods that touch the server's clients, channels or users
+// must only be called from this goroutine. Other goroutines go through
+// syncCall.
 func (server *Server) handler() {
+	prune := time.NewTicker(PruneInterval)
+	defer prune.Stop()
+	keepalive := time.NewTicker(KeepaliveInterval)
+	defer keepalive.Stop()
+
+	server.startBridges()
+
 	for {
 		select {
 		// Control channel messages
@@ -324,16 +413,13 @@ func (server *Server) handler() {
 		case vb := <-server.voicebroadcast:
 			log.Printf("VoiceBroadcast!")
 			if vb.target == 0 {
-				channel := vb.client.Channel
-				for _, client := range channel.clients {
+				for _, client := range vb.client.Channel.recipients {
 					if client != vb.client {
-						client.sendUdp(&Message{
-							buf:    vb.buf,
-							client: client,
-						})
+						vb.sendTo(client)
 					}
 				}
 			}
+			vb.release()
 		// Finish client authentication. Send post-authentication
 		// server info.
 		case client := <-server.clientAuthenticated:
@@ -346,10 +432,40 @@ func (server *Server) handler() {
 				log.Panicf("Unable to freeze the server")
 			}
 			go server.handleFreezeRequest(req, &fs)
+
+		// Control interface requests
+		case req := <-server.controlRequest:
+			req.fn()
+			req.done <- true
+
+		// Prune idle registrations
+		case <-prune.C:
+			server.PruneRegistrations(server.cfg.IntValue("RegistrationMaxIdleDays"))
+			server.removeUnverified()
+			server.removeExpiredInvites()
+
+		// Ping clients, drop dead connections and lift expired mutes
+		case <-keepalive.C:
+			server.checkKeepalive()
+			server.liftExpiredMutes()
 		}
 	}
 }
 
+// Run fn in the server's synchronous handler goroutine and wait
+// for it to finish. If the server isn't running yet, fn is called
+// directly.
+func (server *Server) syncCall(fn func()) {
+	if !server.running {
+		fn()
+		return
+	}
+
+	req := &controlRequest{fn, make(chan bool)}
+	server.controlRequest <- req
+	<-req.done
+}
+
 func (server *Server) handleFreezeRequest(freq *freezeRequest, fs *frozenServer) {
 	pr, pw := io.Pipe()
 
@@ -417,6 +533,25 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 		hash.Write(state.PeerCertificates[0].Raw)
 		sum := hash.Sum()
 		client.CertHash = hex.EncodeToString(sum)
+		client.StrongCertificate = server.isStrongCertificate(state.PeerCertificates)
+	}
+
+	if server.isRevokedCertificate(state.PeerCertificates) {
+		client.Printf("Refused client with a revoked certificate")
+		client.RejectAuth("NoCertificate", "Your certificate has been revoked.")
+		return
+	}
+
+	if reason := server.certificateDenied(client); len(reason) > 0 {
+		client.Printf("Refused client without an accepted certificate")
+		client.RejectAuth("NoCertificate", reason)
+		return
+	}
+
+	if ban, banned := server.globalBanFor(client); banned {
+		client.Printf("Refused globally banned client %v", server.logAddr(client.tcpaddr.IP))
+		client.RejectAuth("None", ban.String())
+		return
 	}
 
 	if client.Username == "SuperUser" {
@@ -424,7 +559,7 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 			client.RejectAuth("WrongUserPW", "")
 			return
 		} else {
-			if server.CheckSuperUserPassword(*auth.Password) {
+			if server.checkSuperUserLogin(*auth.Password) {
 				client.user, ok = server.UserNameMap[client.Username]
 				if !ok {
 					client.RejectAuth("InvalidUsername", "")
@@ -436,9 +571,25 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 			}
 		}
 	} else {
+		// The password may be an invite token. See invite.go.
+		if auth.Password != nil {
+			client.authPassword = *auth.Password
+		}
+
+		// Strong certificates may carry the client's identity. See
+		// certauth.go.
+		if client.StrongCertificate {
+			if name := server.certificateIdentity(state.PeerCertificates[0]); len(name) > 0 && name != "SuperUser" {
+				client.Username = name
+				if user, exists := server.UserNameMap[name]; exists {
+					client.user = user
+				}
+			}
+		}
+
 		// First look up registration by name.
 		user, exists := server.UserNameMap[client.Username]
-		if exists {
+		if exists && client.user == nil {
 			if len(client.CertHash) > 0 && user.CertHash == client.CertHash {
 				client.user = user
 			} else {
@@ -454,6 +605,11 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 				client.user = user
 			}
 		}
+
+		// Registrations waiting for verification aren't used yet.
+		if client.user != nil && client.user.Pending() {
+			client.user = nil
+		}
 	}
 
 	// Setup the cryptstate for the client.
@@ -467,6 +623,10 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 		client.Panic(err.String())
 		return
 	}
+	err = client.crypt.SetWindow(server.cfg.IntValue("CryptLateWindow"), server.cfg.IntValue("CryptLostWindow"))
+	if err != nil {
+		client.Printf("Using default replay window: %v", err.String())
+	}
 
 	// Send CryptState information to the client so it can establish an UDP connection,
 	// if it wishes.
@@ -479,10 +639,12 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 		client.Panic(err.String())
 	}
 
+	client.Tokens = auth.Tokens
+
 	// Add codecs
 	client.codecs = auth.CeltVersions
 	if len(client.codecs) == 0 {
-		log.Printf("Client %i connected without CELT codecs.", client.Session)
+		client.Printf("Client %v connected without CELT codecs.", client.Session)
 	}
 
 	client.state = StateClientAuthenticated
@@ -491,34 +653,40 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 
 // The last part of authentication runs in the server's synchronous handler.
 func (server *Server) finishAuthenticate(client *Client) {
-	// If the client succeeded in proving to the server that it should be granted
-	// the credentials of a registered user, do some sanity checking to make sure
-	// that user isn't already connected.
-	//
-	// If the user is already connected, try to check whether this new client is
-	// connecting from the same IP address. If that's the case, disconnect the
-	// previous client and let the new guy in.
-	if client.user != nil {
-		found := false
-		for _, connectedClient := range server.clients {
-			if connectedClient.UserId() == client.UserId() {
-				found = true
-				break
-			}
-		}
-		// The user is already present on the server.
-		if found {
-			// todo(mkrautz): Do the address checking.
-			client.RejectAuth("UsernameInUse", "A client is already connected using those credentials.")
-			return
-		}
+	// Enforce the per-address and per-certificate connection limits
+	// before anything is changed on the client's behalf. The sessions it
+	// would take over don't count. See limits.go.
+	if reason := server.connectionLimitDenied(client, server.takenOverSessions(client)); len(reason) > 0 {
+		client.Printf("Refused client over the connection limit: %v", reason)
+		client.RejectAuth("None", reason)
+		return
+	}
 
-		// No, that user isn't already connected. Move along.
+	// If the user, or the client's certificate, is already connected, either
+	// refuse the new client or let it take over from the old sessions. See
+	// ghost.go.
+	if !server.takeOverGhosts(client) {
+		return
 	}
 
+	if client.user != nil {
+		// Merge the user's stored access tokens with the ones supplied by
+		// this client, so tokens entered on one client apply to all of them.
+		client.Tokens = mergeTokens(client.user.Tokens, client.Tokens)
+		client.user.Tokens = client.Tokens
+
+		now := uint64(time.Seconds())
+		client.user.LastConnect = now
+		client.user.LastActive = now
+	}
+
+	server.redeemInvites(client, append(client.Tokens, client.authPassword))
+
 	// Add the client to the connected list
 	client.Session = server.GenSessionId()
 	server.clients[client.Session] = client
+	atomic.AddInt32(&server.numClients, 1)
+	sessionCount.Add(1)
 
 	// First, check whether we need to tell the other connected
 	// clients to switch to a codec so the new guy can actually speak.
@@ -527,10 +695,7 @@ func (server *Server) finishAuthenticate(client *Client) {
 	client.sendChannelList()
 
 	// Add the client to the host slice for its host address.
-	host := client.tcpaddr.IP.String()
-	server.hmutex.Lock()
-	server.hclients[host] = append(server.hclients[host], client)
-	server.hmutex.Unlock()
+	server.addrs.AddHost(client.tcpaddr.IP.String(), client)
 
 	userstate := &mumbleproto.UserState{
 		Session:   proto.Uint32(client.Session),
@@ -567,7 +732,18 @@ func (server *Server) finishAuthenticate(client *Client) {
 		}
 	}
 
-	server.userEnterChannel(client, server.root, userstate)
+	// Clients reconnecting after an upgrade go back to their channel.
+	// See upgrade.go.
+	channel := server.root
+	if upgraded := server.upgradeChannel(client); upgraded != nil {
+		channel = upgraded
+		userstate.ChannelId = proto.Uint32(uint32(channel.Id))
+	}
+	server.userEnterChannel(client, channel, userstate)
+	if client.IsRegistered() {
+		server.restoreListeners(client, userstate)
+		server.restoreTimedMute(client, userstate)
+	}
 	if err := server.broadcastProtoMessage(MessageUserState, userstate); err != nil {
 		// Server panic?
 	}
@@ -576,7 +752,10 @@ func (server *Server) finishAuthenticate(client *Client) {
 
 	sync := &mumbleproto.ServerSync{}
 	sync.Session = proto.Uint32(client.Session)
-	sync.MaxBandwidth = proto.Uint32(server.MaxBandwidth)
+	sync.MaxBandwidth = proto.Uint32(uint32(server.effectiveBitrate(client.Channel)))
+	if welcome := server.welcomeTextFor(client); len(welcome) > 0 {
+		sync.WelcomeText = proto.String(welcome)
+	}
 	if client.IsSuperUser() {
 		sync.Permissions = proto.Uint64(uint64(AllPermissions))
 	} else {
@@ -594,17 +773,19 @@ func (server *Server) finishAuthenticate(client *Client) {
 		return
 	}
 
-	err := client.sendProtoMessage(MessageServerConfig, &mumbleproto.ServerConfig{
-		AllowHtml:          proto.Bool(true),
-		MessageLength:      proto.Uint32(1000),
-		ImageMessageLength: proto.Uint32(1000),
-	})
-	if err != nil {
+	if err := server.sendServerConfig(client, false); err != nil {
+		client.Panic(err.String())
+		return
+	}
+	if err := server.sendSuggestConfig(client); err != nil {
 		client.Panic(err.String())
 		return
 	}
 
 	client.state = StateClientReady
+	client.markActive()
+	client.Printf("Authenticated as %v (session %v)", client.ShownName(), client.Session)
+	server.sendChannelMessages(client, nil, client.Channel)
 	client.clientReady <- true
 }
 
@@ -739,6 +920,9 @@ func (server *Server) sendUserList(client *Client) {
 		if len(connectedClient.PluginIdentity) > 0 {
 			userstate.PluginIdentity = proto.String(connectedClient.PluginIdentity)
 		}
+		for cid, _ := range connectedClient.listening {
+			userstate.ListeningChannelAdd = append(userstate.ListeningChannelAdd, uint32(cid))
+		}
 
 		err := client.sendProtoMessage(MessageUserState, userstate)
 		if err != nil {
@@ -794,7 +978,10 @@ func (server *Server) broadcastProtoMessage(kind uint16, msg interface{}) (err o
 
 func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
 	log.Printf("Handle Incoming Message")
+	client.markActive()
 	switch msg.kind {
+	case MessageAuthenticate:
+		server.handleAuthenticateTokens(msg.client, msg)
 	case MessagePing:
 		server.handlePingMessage(msg.client, msg)
 	case MessageChannelRemove:
@@ -820,7 +1007,7 @@ func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
 	case MessageContextAction:
 		log.Printf("MessageContextAction from client")
 	case MessageUserList:
-		log.Printf("MessageUserList from client")
+		server.handleUserListMessage(msg.client, msg)
 	case MessageVoiceTarget:
 		log.Printf("MessageVoiceTarget from client")
 	case MessagePermissionQuery:
@@ -833,120 +1020,198 @@ func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
 		server.handleRequestBlob(msg.client, msg)
 	case MessageServerConfig:
 		log.Printf("MessageServerConfig from client")
+	case MessagePluginDataTransmission:
+		server.handlePluginDataTransmission(msg.client, msg)
 	}
 }
 
-func (s *Server) SetupUDP() (err os.Error) {
-	addr := &net.UDPAddr{
-		Port: s.port,
-	}
-	s.udpconn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
+func (s *Server) SendUDP() {
+	// Scratch buffers for outgoing packets. A batch is sent
+	// synchronously, so one set of buffers suffices.
+	scratch := make([][]byte, UDPBatchSize)
+	for i := range scratch {
+		scratch[i] = make([]byte, PacketBufferSize+4)
 	}
+	msgs := make([]*Message, UDPBatchSize)
 
-	return
-}
+	// The packets of a batch, grouped by the socket they are sent from.
+	pkts := make(map[*udpSocket][]udpPacket)
+	for _, sock := range s.udpsocks {
+		pkts[sock] = make([]udpPacket, 0, UDPBatchSize)
+	}
 
-func (s *Server) SendUDP() {
 	for {
-		msg := <-s.udpsend
-		// Encrypted
-		if msg.client != nil {
-			crypted := make([]byte, len(msg.buf)+4)
-			msg.client.crypt.Encrypt(crypted, msg.buf)
-			s.udpconn.WriteTo(crypted, msg.client.udpaddr)
-			// Non-encrypted
-		} else if msg.address != nil {
-			s.udpconn.WriteTo(msg.buf, msg.address)
-		} else {
-			// Skipping
+		// Wait for a packet, then gather any others that are
+		// already queued, so they can be sent in a single batch.
+		msgs[0] = <-s.udpsend
+		nmsgs := 1
+	gather:
+		for nmsgs < UDPBatchSize {
+			select {
+			case msg := <-s.udpsend:
+				msgs[nmsgs] = msg
+				nmsgs++
+			default:
+				break gather
+			}
+		}
+
+		npkts := 0
+		for _, msg := range msgs[0:nmsgs] {
+			if len(msg.buf) > PacketBufferSize {
+				continue
+			}
+			// Encrypted
+			if msg.client != nil && msg.client.udpsock != nil {
+				sock := msg.client.udpsock
+				crypted := scratch[npkts][0 : len(msg.buf)+4]
+				msg.client.crypt.Encrypt(crypted, msg.buf)
+				pkts[sock] = append(pkts[sock], udpPacket{crypted, msg.client.udpaddr})
+				npkts++
+				// Non-encrypted
+			} else if addr, ok := msg.address.(*net.UDPAddr); ok && msg.sock != nil {
+				plain := scratch[npkts][0:len(msg.buf)]
+				copy(plain, msg.buf)
+				pkts[msg.sock] = append(pkts[msg.sock], udpPacket{plain, addr})
+				npkts++
+			} else {
+				// Skipping
+			}
+		}
+
+		for sock, batch := range pkts {
+			if len(batch) > 0 {
+				sock.batch.WriteBatch(batch)
+				pkts[sock] = batch[0:0]
+			}
+		}
+
+		for i := 0; i < nmsgs; i++ {
+			msgs[i].vbuf.Unref()
+			msgs[i] = nil
 		}
 	}
 }
 
-// Listen for and handle UDP packets.
-func (server *Server) ListenUDP() {
-	buf := make([]byte, UDPPacketSize)
+// Listen for and handle UDP packets on sock.
+func (server *Server) ListenUDP(sock *udpSocket) {
+	bufs := make([][]byte, UDPBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, UDPPacketSize)
+	}
+	pkts := make([]udpPacket, UDPBatchSize)
+
 	for {
-		nread, remote, err := server.udpconn.ReadFrom(buf)
-		if err != nil {
+		for i := range pkts {
+			pkts[i].buf = bufs[i]
+		}
+		n, err := sock.batch.ReadBatch(pkts)
+		if err == ErrNoUDPAddr {
+			log.Printf("No UDPAddr in read packet. Disabling UDP. (Windows?)")
+			return
+		} else if err != nil {
 			// Not much to do here. This is bad, of course. Should we panic this server instance?
 			continue
 		}
 
-		udpaddr, ok := remote.(*net.UDPAddr)
-		if !ok {
-			log.Printf("No UDPAddr in read packet. Disabling UDP. (Windows?)")
+		for _, pkt := range pkts[0:n] {
+			server.handleUDPPacket(pkt.buf, pkt.addr, sock)
+		}
+	}
+}
+
+// Handle a single UDP datagram received on sock.
+func (server *Server) handleUDPPacket(buf []byte, udpaddr *net.UDPAddr, sock *udpSocket) {
+	nread := len(buf)
+	server.countBytesIn(nread)
+
+	// Length 12 is for ping datagrams from the ConnectDialog.
+	if nread == 12 && binary.BigEndian.Uint32(buf) == 0 {
+		if !server.allowUDPPing(udpaddr) {
+			return
+		}
+		readbuf := bytes.NewBuffer(buf)
+		var (
+			tmp32 uint32
+			rand  uint64
+		)
+		_ = binary.Read(readbuf, binary.BigEndian, &tmp32)
+		_ = binary.Read(readbuf, binary.BigEndian, &rand)
+
+		buffer := bytes.NewBuffer(make([]byte, 0, 24))
+		_ = binary.Write(buffer, binary.BigEndian, uint32(ServerVersion))
+		_ = binary.Write(buffer, binary.BigEndian, rand)
+		_ = binary.Write(buffer, binary.BigEndian, uint32(atomic.AddInt32(&server.numClients, 0)))
+		_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxUsers))
+		_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxBandwidth))
+
+		server.udpsend <- &Message{
+			buf:     buffer.Bytes(),
+			address: udpaddr,
+			sock:    sock,
+		}
+	} else if resp := server.protobufPingResponse(buf); resp != nil {
+		// Connectionless ping from a protocol 1.5 client.
+		if !server.allowUDPPing(udpaddr) {
 			return
 		}
+		server.udpsend <- &Message{
+			buf:     resp,
+			address: udpaddr,
+			sock:    sock,
+		}
+	} else if nread > 4 {
+		var match *Client
+
+		// Determine which client sent the the packet.  First, we
+		// check whether the host-port combination is already bound
+		// to a client.
+		//
+		// If we don't find any matches, we try the clients connected
+		// from the same host address. Packets from hosts without any
+		// clients are dropped before attempting to decrypt them.
+		client, hostclients := server.addrs.Lookup(udpaddr)
+		if client == nil && len(hostclients) == 0 {
+			dropUDPPacket("unknown")
+			return
+		}
+		if len(hostclients) > maxUDPCandidates {
+			hostclients = hostclients[0:maxUDPCandidates]
+		}
 
-		// Length 12 is for ping datagrams from the ConnectDialog.
-		if nread == 12 {
-			readbuf := bytes.NewBuffer(buf)
-			var (
-				tmp32 uint32
-				rand  uint64
-			)
-			_ = binary.Read(readbuf, binary.BigEndian, &tmp32)
-			_ = binary.Read(readbuf, binary.BigEndian, &rand)
-
-			buffer := bytes.NewBuffer(make([]byte, 0, 24))
-			_ = binary.Write(buffer, binary.BigEndian, uint32((1<<16)|(2<<8)|2))
-			_ = binary.Write(buffer, binary.BigEndian, rand)
-			_ = binary.Write(buffer, binary.BigEndian, uint32(len(server.clients)))
-			_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxUsers))
-			_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxBandwidth))
-
-			server.udpsend <- &Message{
-				buf:     buffer.Bytes(),
-				address: udpaddr,
+		pbuf := packetPool.Get()
+		plain := pbuf[PacketHeadroom : PacketHeadroom+nread-4]
+		if client != nil {
+			if client.decrypt(plain[0:], buf) == nil {
+				match = client
 			}
 		} else {
-			var match *Client
-			plain := make([]byte, nread-4)
-
-			// Determine which client sent the the packet.  First, we
-			// check the map 'hpclients' in the server struct. It maps
-			// a hort-post combination to a client.
-			//
-			// If we don't find any matches, we look in the 'hclients',
-			// which maps a host address to a slice of clients.
-			server.hmutex.Lock()
-			client, ok := server.hpclients[udpaddr.String()]
-			if ok {
-				err = client.crypt.Decrypt(plain[0:], buf[0:nread])
-				if err != nil {
-					log.Panicf("Unable to decrypt incoming packet for client %v (host-port matched)", client)
-				}
-				match = client
-			} else {
-				host := udpaddr.IP.String()
-				hostclients := server.hclients[host]
-				for _, client := range hostclients {
-					err = client.crypt.Decrypt(plain[0:], buf[0:nread])
-					if err != nil {
-						continue
-					} else {
-						match = client
-					}
-				}
-				if match != nil {
-					match.udpaddr = udpaddr
-					server.hpclients[udpaddr.String()] = match
+			for _, client := range hostclients {
+				if client.decrypt(plain[0:], buf) == nil {
+					match = client
+					break
 				}
 			}
-			server.hmutex.Unlock()
+		}
 
-			// No client found.
-			if match == nil {
-				log.Printf("Sender of UDP packet could not be determined. Packet dropped.")
-				continue
-			}
+		// No client found.
+		if match == nil {
+			dropUDPPacket("decrypt")
+			packetPool.Put(pbuf)
+			return
+		}
 
-			match.udp = true
-			match.udprecv <- plain
+		// Only accept datagrams from the client's bound address. See
+		// udpbind.go.
+		if !server.checkUDPSource(match, udpaddr, plain) {
+			packetPool.Put(pbuf)
+			return
 		}
+		match.capture.voice("in", "udp", plain)
+
+		match.udp = true
+		match.udpsock = sock
+		match.udprecv <- pbuf[0 : PacketHeadroom+nread-4]
 	}
 }
 
@@ -955,6 +1220,49 @@ func (s *Server) ClearACLCache() {
 	s.aclcache = NewACLCache()
 }
 
+// Re-add a registered client as a listener of the channels it was
+// listening to when it last disconnected. Channels that no longer exist,
+// or that the client is no longer permitted to listen to, are skipped.
+func (server *Server) restoreListeners(client *Client, userstate *mumbleproto.UserState) {
+	for _, cid := range client.user.ListeningChannels {
+		channel, exists := server.Channels[cid]
+		if !exists || channel == client.Channel {
+			continue
+		}
+		if !server.HasPermission(client, channel, ListenPermission) {
+			continue
+		}
+		channel.AddListener(client)
+		userstate.ListeningChannelAdd = append(userstate.ListeningChannelAdd, uint32(channel.Id))
+		server.broadcastListenerCount(channel)
+	}
+	server.storeListeners(client)
+}
+
+// Store the channels a registered client is listening to in its
+// user record.
+func (server *Server) storeListeners(client *Client) {
+	if !client.IsRegistered() {
+		return
+	}
+	listening := []int{}
+	for cid, _ := range client.listening {
+		listening = append(listening, cid)
+	}
+	client.user.ListeningChannels = listening
+}
+
+// Tell all connected clients about the number of listeners in channel.
+func (server *Server) broadcastListenerCount(channel *Channel) {
+	chanstate := &mumbleproto.ChannelState{
+		ChannelId:     proto.Uint32(uint32(channel.Id)),
+		ListenerCount: proto.Uint32(uint32(len(channel.listeners))),
+	}
+	if err := server.broadcastProtoMessage(MessageChannelState, chanstate); err != nil {
+		log.Printf("Unable to broadcast listener count: %v", err.String())
+	}
+}
+
 // Helper method for users entering new channels
 func (server *Server) userEnterChannel(client *Client, channel *Channel, userstate *mumbleproto.UserState) {
 	if client.Channel == channel {
@@ -981,6 +1289,12 @@ func (server *Server) userEnterChannel(client *Client, channel *Channel, usersta
 	if channel.parent != nil {
 		server.sendClientPermissions(client, channel.parent)
 	}
+
+	server.updateClientBitrate(client, channel)
+
+	if client.state == StateClientReady {
+		server.sendChannelMessages(client, oldchan, channel)
+	}
 }
 
 // Create a point-in-time snapshot of Server and make it
@@ -1004,25 +1318,51 @@ func (s *Server) FreezeServer() io.ReadCloser {
 }
 
 // The accept loop of the server.
-func (s *Server) ListenAndMurmur() {
+// Bind the server's UDP and TLS sockets. This is done separately from
+// serving clients, so that the sockets can be bound (and the server's
+// certificate read) before Grumble drops its privileges.
+func (s *Server) Listen() (err os.Error) {
+	err = s.SetupUDP()
+	if err != nil {
+		s.closeSockets()
+		return
+	}
+
+	err = s.SetupTLS()
+	if err != nil {
+		s.closeSockets()
+		return
+	}
+
+	return
+}
+
+// Serve clients on the sockets bound by Listen.
+func (s *Server) Serve() {
+	s.startTime = time.Seconds()
+
 	// Launch the event handler goroutine
 	go s.handler()
 
 	s.running = true
 
-	// Setup our UDP listener and spawn our reader and writer goroutines
-	s.SetupUDP()
-	go s.ListenUDP()
+	// Spawn our UDP reader and writer goroutines
+	for _, sock := range s.udpsocks {
+		log.Printf("Listening for UDP on %v", sock.conn.LocalAddr())
+		go s.ListenUDP(sock)
+	}
 	go s.SendUDP()
 
-	// Create a new listening TLS socket.
-	l := NewTLSListener(s.port)
-	if l == nil {
-		log.Printf("Unable to create TLS listener")
-		return
+	for _, l := range s.tlsls[1:] {
+		go s.acceptLoop(l)
 	}
-
 	log.Printf("Created new Murmur instance on port %v", s.port)
+	s.acceptLoop(s.tlsls[0])
+}
+
+// Accept and serve clients connecting to l.
+func (s *Server) acceptLoop(l *tls.Listener) {
+	log.Printf("Listening for TCP on %v", l.Addr())
 
 	// The main accept loop. Basically, we block
 	// until we get a new client connection, and
@@ -0,0 +1,223 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// The default configuration values of a virtual server. Keys that are
+// not present in this map have no default value.
+var defaultCfg = map[string]string{
+	"MaxTextureSize":   "65536",
+	"MaxTextureWidth":  "600",
+	"MaxTextureHeight": "60",
+	"TextureDownscale": "true",
+	"WelcomeText":      "",
+
+	// Registrations of users that haven't been seen for this many
+	// days are removed. Zero disables pruning.
+	"RegistrationMaxIdleDays": "0",
+
+	// Comma-separated lists of addresses to bind for TCP and UDP.
+	// Empty lists bind the server's default address. See bind.go.
+	"TCPAddresses": "",
+	"UDPAddresses": "",
+
+	// Comma-separated lists of country codes to allow or deny
+	// connections from. See geoip.go.
+	"GeoIPAllow": "",
+	"GeoIPDeny":  "",
+
+	// How client addresses are shown in logs and to non-admins:
+	// "off", "mask" or "omit". See privacy.go.
+	"IPPrivacy": "off",
+
+	// Limits announced to clients in ServerConfig, and settings
+	// suggested to them in SuggestConfig. Empty Suggest keys are not
+	// sent. See clientconf.go.
+	"AllowHTML":             "true",
+	"MaxTextMessageLength":  "5000",
+	"MaxImageMessageLength": "131072",
+	"SuggestVersion":        "",
+	"SuggestPositional":     "",
+	"SuggestPushToTalk":     "",
+
+	// Whether the global ban list applies to the server. See
+	// globalban.go.
+	"UseGlobalBans": "true",
+
+	// How much build information to send to clients: "full",
+	// "generic" or "none". See version.go.
+	"VersionDisclosure": "generic",
+
+	// The number of connectionless pings answered per second for
+	// each source address. See udpfilter.go.
+	"UDPPingRate": "5",
+
+	// Clients that send nothing on their control channel for this
+	// many seconds are disconnected. Zero disables the timeout. See
+	// keepalive.go.
+	"ConnectionTimeout": "30",
+
+	// Whether clients with a strong certificate may register
+	// themselves, and how many self-registrations are allowed per
+	// day. CertificateAuthorities is a PEM file of the authorities
+	// that issue strong certificates. See register.go.
+	"SelfRegistration":        "false",
+	"SelfRegistrationsPerDay": "10",
+	"CertificateAuthorities":  "",
+
+	// Whether the server's bandwidth limit is enforced in channels
+	// without a bitrate cap of their own. See bitrate.go.
+	"EnforceMaxBandwidth": "true",
+
+	// Who may create channels, regardless of ACLs: "certificate"
+	// for anyone with a certificate, "registered" for registered
+	// users and "strong" for registered users with a strong
+	// certificate. See register.go.
+	"ChannelCreation": "certificate",
+
+	// Whether users may send each other private messages unless
+	// denied by a channel's ACL. See acl.go.
+	"AllowPrivateMessages": "true",
+
+	// Whether only clients with a strong certificate may connect,
+	// and which certificate attribute, if any, identifies registered
+	// users: "" or "cn". See certauth.go.
+	"RequireStrongCertificate": "false",
+	"CertificateIdentity":      "",
+
+	// A PEM or DER file holding the revocation list of the server's
+	// certificate authority. See revocation.go.
+	"CertificateRevocationList": "",
+
+	// Comma-separated channel=URL mappings of channels to external
+	// chat systems. See bridge.go.
+	"TextBridges": "",
+
+	// The replay window of the crypt state of new sessions, in
+	// packets: how late packets may arrive, and how many may be lost
+	// between two packets. See netquality.go.
+	"CryptLateWindow": "30",
+	"CryptLostWindow": "128",
+
+	// Per-identity limits: the registrations a certificate may have,
+	// and the concurrent connections allowed from one address or with
+	// one certificate. Zero means unlimited. See limits.go.
+	"MaxRegistrationsPerCertificate": "1",
+	"MaxConnectionsPerIP":            "0",
+	"MaxConnectionsPerCertificate":   "0",
+
+	// What to do when a client connects as a user, or with a
+	// certificate, that already has a session: "reject" the new
+	// client, or "kick" the old sessions. See ghost.go.
+	"DuplicateSessions": "reject",
+
+	// The number of sockets, each with their own reader, bound to
+	// each UDP address. Zero means one per GOMAXPROCS. See bind.go.
+	"UDPReaders": "1",
+
+	// Socket tuning: the buffer sizes of UDP voice sockets, in bytes
+	// (zero keeps the system default), and the TCP_NODELAY and
+	// SO_KEEPALIVE options of control connections. See socktune.go.
+	"UDPReceiveBuffer": "0",
+	"UDPSendBuffer":    "0",
+	"TCPNoDelay":       "true",
+	"TCPKeepAlive":     "false",
+
+	// A file of word filter rules for text messages. Disabled if
+	// empty. See wordfilter.go.
+	"WordFilter": "",
+
+	// The names allowed for registered users.
+	"UserNameRegex": `[-=a-zA-Z0-9_\[\]{}()@|.]+`,
+}
+
+// Config holds the configuration of a virtual server as a set of
+// key/value pairs. Keys that have not been explicitly set fall back
+// to their value in defaultCfg.
+//
+// A Config is safe for concurrent use.
+type Config struct {
+	cfgMap map[string]string
+	mutex  sync.RWMutex
+}
+
+// Create a new Config, populated with the key/value pairs in cfgMap.
+// The cfgMap may be nil.
+func NewConfig(cfgMap map[string]string) *Config {
+	cfg := &Config{cfgMap: make(map[string]string)}
+	for key, value := range cfgMap {
+		cfg.cfgMap[key] = value
+	}
+	return cfg
+}
+
+// Get a copy of all explicitly set key/value pairs.
+func (cfg *Config) GetAll() (all map[string]string) {
+	cfg.mutex.RLock()
+	defer cfg.mutex.RUnlock()
+
+	all = make(map[string]string)
+	for key, value := range cfg.cfgMap {
+		all[key] = value
+	}
+	return
+}
+
+// Set a new value for key.
+func (cfg *Config) Set(key, value string) {
+	cfg.mutex.Lock()
+	defer cfg.mutex.Unlock()
+	cfg.cfgMap[key] = value
+}
+
+// Reset key to its default value.
+func (cfg *Config) Reset(key string) {
+	cfg.mutex.Lock()
+	defer cfg.mutex.Unlock()
+	cfg.cfgMap[key] = "", false
+}
+
+// Get the value of key as a string.
+func (cfg *Config) StringValue(key string) (value string) {
+	cfg.mutex.RLock()
+	defer cfg.mutex.RUnlock()
+
+	value, exists := cfg.cfgMap[key]
+	if exists {
+		return value
+	}
+
+	value, exists = defaultCfg[key]
+	if exists {
+		return value
+	}
+
+	return ""
+}
+
+// Get the value of key as an int. Unparsable values yield 0.
+func (cfg *Config) IntValue(key string) (intval int) {
+	str := cfg.StringValue(key)
+	intval, _ = strconv.Atoi(str)
+	return
+}
+
+// Get the value of key as an uint32. Unparsable values yield 0.
+func (cfg *Config) Uint32Value(key string) (uint32val uint32) {
+	str := cfg.StringValue(key)
+	uintval, _ := strconv.Atoui(str)
+	return uint32(uintval)
+}
+
+// Get the value of key as a bool. Unparsable values yield false.
+func (cfg *Config) BoolValue(key string) (boolval bool) {
+	str := cfg.StringValue(key)
+	boolval, _ = strconv.Atob(str)
+	return
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"log"
+)
+
+// Running as a service is only supported on Windows. Elsewhere, use
+// the system's init system to run Grumble.
+func ServiceCommand(args []string) {
+	log.Fatalf("The service command is only supported on Windows")
+}
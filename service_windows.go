@@ -0,0 +1,286 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements running Grumble as a native Windows service.
+//
+// 'grumble service install' registers Grumble with the service control
+// manager, and 'grumble service run' is the entry point used by the
+// service control manager itself. When running as a service, Grumble
+// logs to the Windows event log, and keeps its data under
+// %ProgramData%\Grumble. Its control interface listens on
+// 127.0.0.1:64739 and needs the -ctlpass given at install time.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	serviceName        = "grumble"
+	serviceDisplayName = "Grumble Mumble Server"
+)
+
+// Service control manager constants
+const (
+	_SERVICE_WIN32_OWN_PROCESS = 0x10
+
+	_SERVICE_STOPPED       = 1
+	_SERVICE_START_PENDING = 2
+	_SERVICE_STOP_PENDING  = 3
+	_SERVICE_RUNNING       = 4
+
+	_SERVICE_ACCEPT_STOP     = 0x1
+	_SERVICE_ACCEPT_SHUTDOWN = 0x4
+
+	_SERVICE_CONTROL_STOP        = 1
+	_SERVICE_CONTROL_INTERROGATE = 4
+	_SERVICE_CONTROL_SHUTDOWN    = 5
+
+	_NO_ERROR = 0
+
+	_EVENTLOG_INFORMATION_TYPE = 0x4
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+var (
+	modadvapi32 = loadDll("advapi32.dll")
+
+	procStartServiceCtrlDispatcherW   = getProcAddr(modadvapi32, "StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = getProcAddr(modadvapi32, "RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = getProcAddr(modadvapi32, "SetServiceStatus")
+	procRegisterEventSourceW          = getProcAddr(modadvapi32, "RegisterEventSourceW")
+	procReportEventW                  = getProcAddr(modadvapi32, "ReportEventW")
+)
+
+func loadDll(fname string) uint32 {
+	h, errno := syscall.LoadLibrary(fname)
+	if errno != 0 {
+		panic(fmt.Sprintf("LoadLibrary(%q) failed: %v", fname, syscall.Errstr(errno)))
+	}
+	return h
+}
+
+func getProcAddr(lib uint32, name string) uintptr {
+	addr, errno := syscall.GetProcAddress(lib, name)
+	if errno != 0 {
+		panic(fmt.Sprintf("GetProcAddress(%q) failed: %v", name, syscall.Errstr(errno)))
+	}
+	return uintptr(addr)
+}
+
+// An io.Writer that writes to the Windows event log.
+type eventLogWriter struct {
+	handle uintptr
+}
+
+// Open the event log for the given event source.
+func openEventLog(source string) (elog *eventLogWriter, err os.Error) {
+	h, _, e1 := syscall.Syscall(procRegisterEventSourceW, 2, 0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(source))), 0)
+	if h == 0 {
+		return nil, os.NewSyscallError("RegisterEventSource", int(e1))
+	}
+	return &eventLogWriter{h}, nil
+}
+
+// Write an informational event to the event log. We don't install a
+// message file, so the Event Viewer shows the raw text of each event.
+func (elog *eventLogWriter) Write(p []byte) (n int, err os.Error) {
+	msg := syscall.StringToUTF16Ptr(strings.TrimSpace(string(p)))
+	strs := []*uint16{msg}
+	r1, _, e1 := syscall.Syscall9(procReportEventW, 9, elog.handle, _EVENTLOG_INFORMATION_TYPE, 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	if r1 == 0 {
+		return 0, os.NewSyscallError("ReportEvent", int(e1))
+	}
+	return len(p), nil
+}
+
+var serviceStatusHandle uintptr
+
+// Report the current state of the service to the service control manager.
+func setServiceState(state uint32) {
+	status := &serviceStatus{
+		ServiceType:  _SERVICE_WIN32_OWN_PROCESS,
+		CurrentState: state,
+	}
+	if state == _SERVICE_RUNNING {
+		status.ControlsAccepted = _SERVICE_ACCEPT_STOP | _SERVICE_ACCEPT_SHUTDOWN
+	}
+	if state == _SERVICE_START_PENDING || state == _SERVICE_STOP_PENDING {
+		status.WaitHint = 30000
+	}
+	syscall.Syscall(procSetServiceStatus, 2, serviceStatusHandle, uintptr(unsafe.Pointer(status)), 0)
+}
+
+var currentServiceState uint32 = _SERVICE_STOPPED
+
+// The service control handler. Called by the service control manager
+// to stop the service or query its status.
+func serviceHandler(ctl uintptr, evtype uintptr, evdata uintptr, context uintptr) uintptr {
+	switch ctl {
+	case _SERVICE_CONTROL_STOP, _SERVICE_CONTROL_SHUTDOWN:
+		currentServiceState = _SERVICE_STOP_PENDING
+		setServiceState(currentServiceState)
+		go func() {
+			shutdown <- true
+		}()
+	case _SERVICE_CONTROL_INTERROGATE:
+		setServiceState(currentServiceState)
+	}
+	return _NO_ERROR
+}
+
+// The service's main function. Called by the service control manager
+// once the service has been started.
+func serviceMain(argc uintptr, argv uintptr) uintptr {
+	name := syscall.StringToUTF16Ptr(serviceName)
+	h, _, _ := syscall.Syscall(procRegisterServiceCtrlHandlerExW, 3, uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		log.Printf("Unable to register service control handler")
+		return 0
+	}
+	serviceStatusHandle = h
+
+	currentServiceState = _SERVICE_START_PENDING
+	setServiceState(currentServiceState)
+
+	done := make(chan bool)
+	go func() {
+		RunGrumble()
+		done <- true
+	}()
+
+	currentServiceState = _SERVICE_RUNNING
+	setServiceState(currentServiceState)
+
+	<-done
+
+	currentServiceState = _SERVICE_STOPPED
+	setServiceState(currentServiceState)
+	return 0
+}
+
+// Set up the default directories for running as a service. The
+// service runs without a $HOME, so data is kept under %ProgramData%.
+func setupServiceDefaults() {
+	base := filepath.Join(os.Getenv("ProgramData"), "Grumble")
+	if len(*datadir) == 0 {
+		*datadir = filepath.Join(base, "data")
+	}
+	if len(*blobdir) == 0 {
+		*blobdir = filepath.Join(base, "blob")
+	}
+	// There are no Unix domain sockets on Windows, so the control
+	// interface listens on a loopback TCP port instead. It only starts
+	// if the service was installed with a -ctlpass.
+	if *ctlnet == "unix" {
+		*ctlnet = "tcp"
+		*ctladdr = "127.0.0.1:64739"
+	}
+
+	for _, dir := range []string{base, *datadir, *blobdir} {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Fatalf("Unable to create %v: %v", dir, err.String())
+		}
+	}
+
+	// The service is started in the system directory. Move to
+	// our base directory, which holds the server certificate.
+	err := os.Chdir(base)
+	if err != nil {
+		log.Fatalf("Unable to change directory to %v: %v", base, err.String())
+	}
+}
+
+// Run Grumble under the service control manager.
+func runService() {
+	setupServiceDefaults()
+
+	elog, err := openEventLog(serviceName)
+	if err == nil {
+		log.SetOutput(elog)
+	}
+
+	table := []serviceTableEntry{
+		{syscall.StringToUTF16Ptr(serviceName), syscall.NewCallback(serviceMain)},
+		{nil, 0},
+	}
+	r1, _, e1 := syscall.Syscall(procStartServiceCtrlDispatcherW, 1, uintptr(unsafe.Pointer(&table[0])), 0, 0)
+	if r1 == 0 {
+		log.Fatalf("Unable to start service dispatcher: %v", syscall.Errstr(int(e1)))
+	}
+}
+
+// Run sc.exe to manage the Grumble service.
+func runSc(args ...string) {
+	sc := filepath.Join(os.Getenv("SystemRoot"), "System32", "sc.exe")
+	argv := append([]string{sc}, args...)
+	p, err := os.StartProcess(sc, argv, &os.ProcAttr{Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}})
+	if err != nil {
+		log.Fatalf("Unable to run sc.exe: %v", err.String())
+	}
+	msg, err := p.Wait(0)
+	if err != nil {
+		log.Fatalf("Unable to run sc.exe: %v", err.String())
+	}
+	if msg.ExitStatus() != 0 {
+		os.Exit(msg.ExitStatus())
+	}
+}
+
+// Handle the 'grumble service' command.
+func ServiceCommand(args []string) {
+	if len(args) == 0 {
+		Usage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "install":
+		exe, err := filepath.Abs(os.Args[0])
+		if err != nil {
+			log.Fatalf("Unable to determine executable path: %v", err.String())
+		}
+
+		// Pass the flags given at install time on to the service.
+		binpath := fmt.Sprintf("\"%v\"", exe)
+		flag.Visit(func(f *flag.Flag) {
+			binpath += fmt.Sprintf(" \"-%v=%v\"", f.Name, f.Value.String())
+		})
+		binpath += " service run"
+
+		runSc("create", serviceName, "binPath=", binpath, "start=", "auto", "DisplayName=", serviceDisplayName)
+	case "remove":
+		runSc("delete", serviceName)
+	case "start", "stop":
+		runSc(args[0], serviceName)
+	case "run":
+		runService()
+	default:
+		Usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements socket tuning. The system's default socket buffer
+// sizes are too small for servers with many users or high bitrates, so
+// the UDPReceiveBuffer and UDPSendBuffer config keys set the buffer
+// sizes of the UDP voice sockets, in bytes. TCPNoDelay and TCPKeepAlive
+// set the TCP_NODELAY and SO_KEEPALIVE options of control connections.
+//
+// The options are read when the server's sockets are bound, so changes
+// take effect when the server is restarted.
+
+import (
+	"log"
+	"net"
+	"os"
+)
+
+// The TCP options of a server's control connections.
+type tcpTuning struct {
+	noDelay   bool
+	keepAlive bool
+}
+
+// A net.Listener that applies a tcpTuning to the connections it accepts.
+type tuningListener struct {
+	*net.TCPListener
+	tuning tcpTuning
+}
+
+// Get the TCP options set in the server's config.
+func (server *Server) tcpTuning() tcpTuning {
+	return tcpTuning{
+		noDelay:   server.cfg.BoolValue("TCPNoDelay"),
+		keepAlive: server.cfg.BoolValue("TCPKeepAlive"),
+	}
+}
+
+// Accept a connection and set its TCP options.
+func (l *tuningListener) Accept() (c net.Conn, err os.Error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetNoDelay(l.tuning.noDelay); err != nil {
+		log.Printf("Unable to set TCP_NODELAY for %v: %v", conn.RemoteAddr(), err.String())
+	}
+	if err = conn.SetKeepAlive(l.tuning.keepAlive); err != nil {
+		log.Printf("Unable to set SO_KEEPALIVE for %v: %v", conn.RemoteAddr(), err.String())
+	}
+	return conn, nil
+}
+
+// Set the buffer sizes of a UDP voice socket from the server's config.
+func (server *Server) tuneUDPSocket(conn *net.UDPConn) os.Error {
+	if size := server.cfg.IntValue("UDPReceiveBuffer"); size > 0 {
+		if err := conn.SetReadBuffer(size); err != nil {
+			return err
+		}
+	}
+	if size := server.cfg.IntValue("UDPSendBuffer"); size > 0 {
+		if err := conn.SetWriteBuffer(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file defines the interface between Grumble and the storage
+// backend that persists its virtual servers and the global ban list.
+// The backend is chosen with the -store flag, and configured with the
+// -storedsn flag, whose meaning depends on the backend.
+//
+// The only backend is "file", which keeps each server as a frozen file
+// in the data directory (see freeze.go). -storedsn is unused by it.
+//
+// Servers are saved and loaded whole. There's no finer-grained interface
+// for registrations, channels, ACLs or logs, and no SQL backend.
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var storename *string = flag.String("store", "file", "Storage backend for servers and bans")
+var storedsn *string = flag.String("storedsn", "", "Data source name of the storage backend, if it needs one")
+
+// A Store persists the state of the virtual servers and the global ban
+// list.
+type Store interface {
+	// Get the ids of the stored servers, in ascending order.
+	ServerIds() ([]int64, os.Error)
+
+	// Load the state of the server with the given id.
+	LoadServer(id int64) (*frozenServer, os.Error)
+
+	// Save the state of server.
+	SaveServer(server *Server) os.Error
+
+	// Load the global ban list into bans, or save it.
+	LoadBans(bans *BanList) os.Error
+	SaveBans(bans *BanList) os.Error
+}
+
+// The available storage backends, by name. Each is created from the
+// value of -storedsn.
+var storeBackends = map[string]func(dsn string) (Store, os.Error){
+	"file": newFileStore,
+}
+
+// The store used by this Grumble instance. Set up by RunGrumble.
+var store Store
+
+// Create the store selected by the -store flag.
+func openStore() (Store, os.Error) {
+	backend, ok := storeBackends[*storename]
+	if !ok {
+		return nil, os.NewError("unknown storage backend " + *storename)
+	}
+	return backend(*storedsn)
+}
+
+// A Store that keeps frozen servers in the data directory.
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dsn string) (Store, os.Error) {
+	return &fileStore{*datadir}, nil
+}
+
+func (fst *fileStore) ServerIds() (ids []int64, err os.Error) {
+	f, err := os.Open(fst.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := []int{}
+	for _, name := range names {
+		if matched, _ := regexp.MatchString("^[0-9]+$", name); matched {
+			id, err := strconv.Atoi(name)
+			if err == nil {
+				sorted = append(sorted, id)
+			}
+		}
+	}
+	sort.SortInts(sorted)
+	for _, id := range sorted {
+		ids = append(ids, int64(id))
+	}
+	return ids, nil
+}
+
+func (fst *fileStore) LoadServer(id int64) (*frozenServer, os.Error) {
+	return readFrozenServer(frozenServerPath(id))
+}
+
+func (fst *fileStore) SaveServer(server *Server) os.Error {
+	return server.FreezeToFile(frozenServerPath(server.Id))
+}
+
+func (fst *fileStore) LoadBans(bans *BanList) os.Error {
+	return bans.ReadFile(filepath.Join(fst.dir, globalBanFile))
+}
+
+func (fst *fileStore) SaveBans(bans *BanList) os.Error {
+	return bans.WriteFile(filepath.Join(fst.dir, globalBanFile))
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements talk-time statistics. For each session, Grumble
+// counts the voice packets sent by the client and estimates how long the
+// client has been speaking. When a registered user disconnects, the
+// session's statistics are added to the user's cumulative statistics.
+//
+// Speaking time is measured per talk spurt: consecutive voice packets
+// less than talkSpurtGap apart are considered part of the same spurt,
+// and the time between them is counted as speaking time.
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+const (
+	// Voice packets further apart than this (in nanoseconds) start
+	// a new talk spurt.
+	talkSpurtGap = 500e6
+
+	// The speaking time counted for the first packet of a talk
+	// spurt, in nanoseconds. This is the typical length of the
+	// audio in a voice packet.
+	talkFrameTime = 20e6
+)
+
+// Internal counters, exported via /debug/vars
+var (
+	// Speaking time in milliseconds and voice packet counts, in
+	// total and per session.
+	totalTalkTime       = expvar.NewInt("grumble.talktime.total")
+	totalVoicePackets   = expvar.NewInt("grumble.voicepackets.total")
+	sessionTalkTime     = newSessionCounter("grumble.talktime")
+	sessionVoicePackets = newSessionCounter("grumble.voicepackets")
+)
+
+type talkStats struct {
+	mutex     sync.Mutex
+	packets   uint64
+	talkTime  int64
+	lastVoice int64
+}
+
+// Count a voice packet received at now. Returns the speaking time
+// added by the packet, in nanoseconds.
+func (ts *talkStats) countPacket(now int64) (delta int64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	delta = talkFrameTime
+	if ts.lastVoice > 0 && now-ts.lastVoice < talkSpurtGap {
+		delta = now - ts.lastVoice
+	}
+
+	ts.packets++
+	ts.talkTime += delta
+	ts.lastVoice = now
+	return
+}
+
+// Get the number of voice packets and the speaking time (in
+// nanoseconds) counted so far.
+func (ts *talkStats) get() (packets uint64, talkTime int64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.packets, ts.talkTime
+}
+
+// Count a voice packet sent by client.
+//
+// This method is called from the client's udpreceiver goroutine.
+func (client *Client) countVoicePacket() {
+	delta := client.talk.countPacket(time.Nanoseconds())
+
+	key := client.server.sessionKey(client)
+	totalVoicePackets.Add(1)
+	sessionVoicePackets.Add(key, 1)
+	totalTalkTime.Add(delta / 1e6)
+	sessionTalkTime.Add(key, delta/1e6)
+}
+
+// Get the client's talk statistics for the current session, and
+// cumulatively if the client is a registered user. Speaking times
+// are in milliseconds.
+func (client *Client) talkStatistics() (packets, talkTime, userPackets, userTalkTime uint64) {
+	p, t := client.talk.get()
+	packets = p
+	talkTime = uint64(t / 1e6)
+	userPackets = packets
+	userTalkTime = talkTime
+	if client.user != nil {
+		userPackets += client.user.VoicePackets
+		userTalkTime += client.user.TalkTime
+	}
+	return
+}
+
+// Add the statistics of the client's session to the user's cumulative
+// statistics, and remove its per-session counters.
+func (server *Server) finishTalkStats(client *Client) {
+	if client.user != nil {
+		packets, talkTime, _, _ := client.talkStatistics()
+		client.user.VoicePackets += packets
+		client.user.TalkTime += talkTime
+	}
+
+	key := server.sessionKey(client)
+	sessionTalkTime.Remove(key)
+	sessionVoicePackets.Remove(key)
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements creating virtual servers from templates, or by
+// cloning existing servers. A template is a frozen server saved under a
+// name in the templates directory of the data directory. New servers get
+// the configuration, channel tree, ACLs and groups of their template or
+// source server, and optionally its registered users.
+//
+// Without users, only the SuperUser is kept, and ACL entries and group
+// memberships of other users are dropped. Invites and the config keys
+// naming addresses that can't be shared between servers (TCPAddresses,
+// UDPAddresses and TextBridges) are never copied. Bans are global, so
+// they apply to new servers anyway.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Config keys that aren't copied to new servers.
+var unclonedConfigKeys = []string{"TCPAddresses", "UDPAddresses", "TextBridges"}
+
+var templateNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// Get the directory templates are kept in.
+func templateDir() string {
+	return filepath.Join(*datadir, "templates")
+}
+
+// Get the path of the template with the given name.
+func templatePath(name string) (string, os.Error) {
+	if !templateNameRegexp.MatchString(name) {
+		return "", os.NewError("invalid template name " + name)
+	}
+	return filepath.Join(templateDir(), name), nil
+}
+
+// Get the names of all templates.
+func templateNames() (names []string, err os.Error) {
+	f, err := os.Open(templateDir())
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err = f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	valid := []string{}
+	for _, name := range names {
+		if templateNameRegexp.MatchString(name) {
+			valid = append(valid, name)
+		}
+	}
+	sort.SortStrings(valid)
+	return valid, nil
+}
+
+// Write a frozen server to filename.
+func writeFrozenServer(filename string, fs *frozenServer) (err os.Error) {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+"_")
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = gob.NewEncoder(zw).Encode(fs)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Remove the state of a frozen server that is specific to it, so that
+// it can be used for another server. Unless includeUsers is set, all
+// users but the SuperUser are removed along with their ACL entries and
+// group memberships.
+func (fs *frozenServer) prepareClone(includeUsers bool) {
+	fs.Invites = []Invite{}
+	for _, key := range unclonedConfigKeys {
+		fs.Config[key] = "", false
+	}
+	if includeUsers {
+		return
+	}
+
+	users := []frozenUser{}
+	for _, fu := range fs.Users {
+		if fu.Id == 0 {
+			users = append(users, fu)
+		}
+	}
+	fs.Users = users
+
+	keepIds := func(ids []int) []int {
+		kept := []int{}
+		for _, id := range ids {
+			if id == 0 {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	}
+	for i := range fs.Channels {
+		fc := &fs.Channels[i]
+		acls := []frozenACL{}
+		for _, facl := range fc.ACL {
+			if facl.UserId <= 0 {
+				acls = append(acls, facl)
+			}
+		}
+		fc.ACL = acls
+		for j := range fc.Groups {
+			fc.Groups[j].Add = keepIds(fc.Groups[j].Add)
+			fc.Groups[j].Remove = keepIds(fc.Groups[j].Remove)
+		}
+	}
+}
+
+// Freeze a server for use as a template or clone source.
+func (server *Server) freezeForClone(includeUsers bool) (fs *frozenServer, err os.Error) {
+	// Encode the frozen server right away, so the copy shares no maps
+	// or slices with the running server.
+	buf := new(bytes.Buffer)
+	server.syncCall(func() {
+		var frozen frozenServer
+		frozen, err = server.Freeze()
+		if err == nil {
+			err = gob.NewEncoder(buf).Encode(&frozen)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs = new(frozenServer)
+	err = gob.NewDecoder(buf).Decode(fs)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Config == nil {
+		fs.Config = make(map[string]string)
+	}
+	fs.prepareClone(includeUsers)
+	return fs, nil
+}
+
+// Save a server as a template.
+func (server *Server) SaveTemplate(name string, includeUsers bool) os.Error {
+	filename, err := templatePath(name)
+	if err != nil {
+		return err
+	}
+	fs, err := server.freezeForClone(includeUsers)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(templateDir(), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFrozenServer(filename, fs)
+}
+
+// Read the template with the given name.
+func readTemplate(name string) (fs *frozenServer, err os.Error) {
+	filename, err := templatePath(name)
+	if err != nil {
+		return nil, err
+	}
+	fs, err = readFrozenServer(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Config == nil {
+		fs.Config = make(map[string]string)
+	}
+	return fs, nil
+}
+
+// Serializes startServerFrom, so concurrent calls don't pick the same
+// server id.
+var startServerMutex sync.Mutex
+
+// Create and start a new server from a frozen server, with the next
+// free server id.
+func startServerFrom(fs *frozenServer) (s *Server, err os.Error) {
+	startServerMutex.Lock()
+	defer startServerMutex.Unlock()
+
+	id := int64(1)
+	for _, server := range allServers() {
+		if server.Id >= id {
+			id = server.Id + 1
+		}
+	}
+	fs.Id = int(id)
+
+	s, err = unfreezeServer(fs)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Listen()
+	if err != nil {
+		return nil, err
+	}
+	err = store.SaveServer(s)
+	if err != nil {
+		s.closeSockets()
+		return nil, err
+	}
+	serversMutex.Lock()
+	servers[s.Id] = s
+	serversMutex.Unlock()
+	go s.Serve()
+
+	log.Printf("Started server %v", s.Id)
+	return s, nil
+}
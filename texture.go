@@ -0,0 +1,208 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements validation and conversion of user textures (avatars).
+//
+// Clients send textures in one of two formats. "Old style" textures, as
+// produced by Mumble 1.2.1 and older, are raw 600x60 BGRA bitmaps compressed
+// with Qt's qCompress (a 4-byte big-endian length followed by a zlib stream).
+// "New style" textures are regular image files, such as PNG or JPEG.
+//
+// All textures are converted to new style textures on upload, and are
+// downscaled to fit the server's configured texture limits.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// Width and height of an old style texture
+	OldTextureWidth  = 600
+	OldTextureHeight = 60
+
+	// The maximum size of an uploaded texture that we're willing to
+	// decode, regardless of the server's configured limits.
+	MaxTextureUploadSize = 1024 * 1024
+
+	// The maximum number of pixels of an uploaded texture that we're
+	// willing to decode. A small compressed image can have very large
+	// dimensions, and decoding allocates memory for every pixel.
+	MaxTexturePixels = 2048 * 2048
+)
+
+var (
+	ErrTextureTooLarge  = os.NewError("texture too large")
+	ErrTextureFormat    = os.NewError("unsupported texture format")
+	ErrTextureDimension = os.NewError("texture dimensions exceed limits")
+)
+
+// Check whether buf contains an old style, qCompress'd 600x60 BGRA texture.
+func isOldStyleTexture(buf []byte) bool {
+	if len(buf) <= 4 {
+		return false
+	}
+	return binary.BigEndian.Uint32(buf) == OldTextureWidth*OldTextureHeight*4
+}
+
+// Decode an old style texture into an image.
+func decodeOldStyleTexture(buf []byte) (img image.Image, err os.Error) {
+	zr, err := zlib.NewReader(bytes.NewBuffer(buf[4:]))
+	if err != nil {
+		return nil, ErrTextureFormat
+	}
+	defer zr.Close()
+
+	// Read one byte more than a texture holds, so that streams that
+	// inflate to more are rejected without being inflated entirely.
+	raw, err := ioutil.ReadAll(io.LimitReader(zr, OldTextureWidth*OldTextureHeight*4+1))
+	if err != nil || len(raw) != OldTextureWidth*OldTextureHeight*4 {
+		return nil, ErrTextureFormat
+	}
+
+	// The pixel data is premultiplied BGRA, which maps directly
+	// onto image.RGBAColor once the color channels are swapped.
+	rgba := image.NewRGBA(OldTextureWidth, OldTextureHeight)
+	for y := 0; y < OldTextureHeight; y++ {
+		for x := 0; x < OldTextureWidth; x++ {
+			off := (y*OldTextureWidth + x) * 4
+			rgba.Set(x, y, image.RGBAColor{raw[off+2], raw[off+1], raw[off], raw[off+3]})
+		}
+	}
+
+	return rgba, nil
+}
+
+// Downscale img to fit within maxw x maxh pixels, preserving the
+// aspect ratio. Each destination pixel is the average of the source
+// pixels it covers.
+func downscaleImage(img image.Image, maxw, maxh int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	nw, nh := w, h
+	if nw > maxw {
+		nh = nh * maxw / nw
+		nw = maxw
+	}
+	if nh > maxh {
+		nw = nw * maxh / nh
+		nh = maxh
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	dst := image.NewRGBA(nw, nh)
+	for y := 0; y < nh; y++ {
+		sy0 := b.Min.Y + y*h/nh
+		sy1 := b.Min.Y + (y+1)*h/nh
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < nw; x++ {
+			sx0 := b.Min.X + x*w/nw
+			sx1 := b.Min.X + (x+1)*w/nw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += cr >> 8
+					g += cg >> 8
+					bl += cb >> 8
+					a += ca >> 8
+					n++
+				}
+			}
+			dst.Set(x, y, image.RGBAColor{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// Validate a texture uploaded by a client, and convert it into a new style
+// texture that conforms to the server's texture limits. An empty texture
+// (used by clients to clear their texture) is returned as-is.
+func (server *Server) processTexture(buf []byte) (texture []byte, err os.Error) {
+	if len(buf) == 0 {
+		return buf, nil
+	}
+	if len(buf) > MaxTextureUploadSize {
+		return nil, ErrTextureTooLarge
+	}
+
+	maxsize := server.cfg.IntValue("MaxTextureSize")
+	maxw := server.cfg.IntValue("MaxTextureWidth")
+	maxh := server.cfg.IntValue("MaxTextureHeight")
+
+	var img image.Image
+	reencode := false
+
+	if isOldStyleTexture(buf) {
+		img, err = decodeOldStyleTexture(buf)
+		if err != nil {
+			return nil, err
+		}
+		reencode = true
+	} else {
+		// Check the dimensions before decoding the pixels.
+		config, _, cerr := image.DecodeConfig(bytes.NewBuffer(buf))
+		if cerr != nil {
+			return nil, ErrTextureFormat
+		}
+		if config.Width <= 0 || config.Height <= 0 || config.Width > MaxTexturePixels/config.Height {
+			return nil, ErrTextureDimension
+		}
+
+		var format string
+		img, format, err = image.Decode(bytes.NewBuffer(buf))
+		if err != nil || (format != "png" && format != "jpeg") {
+			return nil, ErrTextureFormat
+		}
+	}
+
+	if maxw > 0 && maxh > 0 {
+		b := img.Bounds()
+		if b.Dx() > maxw || b.Dy() > maxh {
+			if !server.cfg.BoolValue("TextureDownscale") {
+				return nil, ErrTextureDimension
+			}
+			img = downscaleImage(img, maxw, maxh)
+			reencode = true
+		}
+	}
+
+	texture = buf
+	if reencode {
+		out := new(bytes.Buffer)
+		err = png.Encode(out, img)
+		if err != nil {
+			return nil, err
+		}
+		texture = out.Bytes()
+	}
+
+	if maxsize > 0 && len(texture) > maxsize {
+		return nil, ErrTextureTooLarge
+	}
+
+	return texture, nil
+}
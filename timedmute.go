@@ -0,0 +1,154 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements timed mutes and deafens. A mute or deafen set
+// through the control interface may carry a duration, after which it is
+// lifted automatically. The expiry is kept with the session, and for
+// registered users in their registration too, so a user can't get rid
+// of a timed mute by reconnecting.
+//
+// The muted user is told how long the mute lasts, and so are the users
+// allowed to mute them, when the mute is set, when the user reconnects
+// while it lasts, and when it is lifted. Changing the mute or deafen
+// state of a user by any other means makes it permanent again.
+
+import (
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"time"
+)
+
+// Set when the client's mute and deafen expire, in seconds since the
+// epoch. Zero means the mute or deafen, if any, doesn't expire.
+func (client *Client) setMuteExpiry(mute int64, deaf int64) {
+	client.muteExpiry = mute
+	client.deafExpiry = deaf
+	if client.IsRegistered() {
+		client.user.MuteExpiry = mute
+		client.user.DeafExpiry = deaf
+	}
+}
+
+// Make a mute or deafen of a client expire after duration seconds, or
+// never if duration is zero. Must be called before the client's mute
+// and deafen state is changed.
+func (server *Server) setTimedMute(client *Client, deaf bool, duration int64, actor string) {
+	if duration <= 0 {
+		client.setMuteExpiry(0, 0)
+		return
+	}
+
+	expiry := time.Seconds() + duration
+	what := "muted"
+	if deaf {
+		// The mute implied by the deafen lasts as long as the deafen,
+		// unless the client was muted for longer.
+		mute := expiry
+		if client.Mute && client.muteExpiry == 0 {
+			mute = 0
+		} else if client.muteExpiry > expiry {
+			mute = client.muteExpiry
+		}
+		client.setMuteExpiry(mute, expiry)
+		what = "deafened"
+	} else if client.Deaf && client.deafExpiry == 0 {
+		// Deafened clients stay muted until they are undeafened.
+		return
+	} else {
+		client.setMuteExpiry(expiry, client.deafExpiry)
+	}
+
+	server.notifyTimedMute(client,
+		fmt.Sprintf("You have been %v by %v for %v.", what, actor, formatUptime(duration)),
+		fmt.Sprintf("%v has been %v by %v for %v.", client.ShownName(), what, actor, formatUptime(duration)))
+}
+
+// Re-apply the unexpired timed mute or deafen of a registered client
+// that has just connected.
+func (server *Server) restoreTimedMute(client *Client, userstate *mumbleproto.UserState) {
+	now := time.Seconds()
+	mute, deaf := client.user.MuteExpiry, client.user.DeafExpiry
+	if mute <= now {
+		mute = 0
+	}
+	if deaf <= now {
+		deaf = 0
+	}
+	client.setMuteExpiry(mute, deaf)
+
+	if deaf > 0 {
+		client.Deaf = true
+		userstate.Deaf = proto.Bool(true)
+		userstate.Mute = proto.Bool(true)
+		client.Mute = true
+		server.notifyTimedMute(client,
+			fmt.Sprintf("You are deafened for another %v.", formatUptime(deaf-now)),
+			fmt.Sprintf("%v is deafened for another %v.", client.ShownName(), formatUptime(deaf-now)))
+	} else if mute > 0 {
+		client.Mute = true
+		userstate.Mute = proto.Bool(true)
+		server.notifyTimedMute(client,
+			fmt.Sprintf("You are muted for another %v.", formatUptime(mute-now)),
+			fmt.Sprintf("%v is muted for another %v.", client.ShownName(), formatUptime(mute-now)))
+	}
+}
+
+// Lift the timed mutes and deafens that have expired.
+func (server *Server) liftExpiredMutes() {
+	now := time.Seconds()
+	for _, client := range server.clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		userstate := &mumbleproto.UserState{Session: proto.Uint32(client.Session)}
+		what := ""
+		if client.deafExpiry > 0 && client.deafExpiry <= now {
+			client.Deaf = false
+			userstate.Deaf = proto.Bool(false)
+			what = "deafen"
+			client.setMuteExpiry(client.muteExpiry, 0)
+		}
+		if client.muteExpiry > 0 && client.muteExpiry <= now {
+			// Unmuting also undeafens.
+			client.Mute = false
+			client.Deaf = false
+			userstate.Mute = proto.Bool(false)
+			userstate.Deaf = proto.Bool(false)
+			what = "mute"
+			client.setMuteExpiry(0, 0)
+		}
+		if len(what) == 0 {
+			continue
+		}
+
+		client.Printf("Timed %v expired", what)
+		if err := server.broadcastProtoMessage(MessageUserState, userstate); err != nil {
+			client.Printf("Unable to broadcast UserState: %v", err.String())
+		}
+		server.notifyTimedMute(client,
+			fmt.Sprintf("Your %v has expired.", what),
+			fmt.Sprintf("The %v of %v has expired.", what, client.ShownName()))
+	}
+}
+
+// Tell a client about its timed mute, and tell the users allowed to
+// mute it about it as well.
+func (server *Server) notifyTimedMute(target *Client, text string, modtext string) {
+	target.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
+		Message: proto.String(text),
+	})
+
+	txtmsg := &mumbleproto.TextMessage{Message: proto.String(modtext)}
+	for _, client := range server.clients {
+		if client == target || client.state != StateClientReady {
+			continue
+		}
+		if server.HasPermission(client, target.Channel, MuteDeafenPermission) {
+			client.sendProtoMessage(MessageTextMessage, txtmsg)
+		}
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"io/ioutil"
 )
 
-func NewTLSListener(port int) (rl *tls.Listener) {
+func NewTLSListener(l *net.TCPListener, tuning tcpTuning) (rl *tls.Listener) {
 	rl = nil
 
 	// Load the certificate
@@ -74,16 +74,7 @@ func NewTLSListener(port int) (rl *tls.Listener) {
 	config.Certificates[0].PrivateKey = priv
 	config.AuthenticateClient = true
 
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{
-		net.ParseIP("0.0.0.0"),
-		port,
-	})
-	if err != nil {
-		log.Printf("Cannot bind: %s\n", err)
-		return
-	}
-
-	rl = tls.NewListener(l, config)
+	rl = tls.NewListener(&tuningListener{l, tuning}, config)
 
 	return
 }
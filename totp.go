@@ -0,0 +1,110 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements time-based one-time passwords (RFC 6238) as a
+// second factor for the SuperUser. Once a TOTP secret has been set up
+// for a server with 'grumble ctl totp', the SuperUser must append the
+// current six-digit code from an authenticator app to its password.
+//
+// Codes of the previous and next time step are accepted to allow for
+// clock drift, but each time step can only be used once, so an observed
+// code can't be replayed.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// The length of a TOTP time step, in seconds.
+	totpStep = 30
+
+	// The number of digits of a TOTP code.
+	totpDigits = 6
+)
+
+// The TOTP state of a server.
+type totpState struct {
+	mutex sync.Mutex
+
+	// The time step of the last code used to log in.
+	lastStep int64
+}
+
+// Generate a new random TOTP secret, encoded in base32 for entry into
+// authenticator apps.
+func newTOTPSecret() string {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Unable to generate TOTP secret")
+	}
+	return base32.StdEncoding.EncodeToString(buf)
+}
+
+// Get the TOTP code for secret at the given time step.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.NewSHA1(secret)
+	mac.Write(msg)
+	sum := mac.Sum()
+
+	// Dynamic truncation, as described in RFC 4226.
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// Check a TOTP code against the base32-encoded secret. On success, the
+// code's time step is recorded so the code can't be used again.
+func (ts *totpState) check(secret string, code string) bool {
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	now := time.Seconds() / totpStep
+	for step := now - 1; step <= now+1; step++ {
+		if step > ts.lastStep && totpCode(key, step) == code {
+			ts.lastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// Get the provisioning URI of the SuperUser's TOTP secret, for
+// authenticator apps that can scan it as a QR code.
+func (server *Server) totpURI(secret string) string {
+	return fmt.Sprintf("otpauth://totp/SuperUser@grumble-%v?secret=%v", server.Id, secret)
+}
+
+// Check a SuperUser login. If the SuperUser has a TOTP secret, the
+// password must be followed by the current TOTP code.
+func (server *Server) checkSuperUserLogin(password string) bool {
+	superUser, exists := server.Users[0]
+	if !exists || len(superUser.TOTPSecret) == 0 {
+		return server.CheckSuperUserPassword(password)
+	}
+
+	if len(password) < totpDigits {
+		return false
+	}
+	code := password[len(password)-totpDigits:]
+	password = password[:len(password)-totpDigits]
+
+	// Check the password first, so wrong passwords don't use up
+	// time steps.
+	return server.CheckSuperUserPassword(password) && server.totp.check(superUser.TOTPSecret, code)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements session trace IDs. Every connection is assigned
+// a short random trace ID when it is accepted, and log lines about a
+// connection are prefixed with it, so that the log of a single session
+// can be followed on a busy server. Unlike session ids, trace IDs are
+// not reused once a client disconnects.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Generate a new trace ID.
+func newTraceId() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Unable to generate trace id")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Log a message about client, prefixed with its trace ID.
+func (client *Client) Printf(format string, args ...interface{}) {
+	log.Printf("[%v] %v", client.TraceId, fmt.Sprintf(format, args...))
+}
+
+// Log a message about client, prefixed with its trace ID, and panic.
+func (client *Client) Panicf(format string, args ...interface{}) {
+	log.Panicf("[%v] %v", client.TraceId, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements conversion between the two UDP voice framings
+// spoken by Mumble clients. Clients older than 1.5 use the legacy framing,
+// where each packet starts with a type/target byte followed by varint-encoded
+// fields. Clients speaking protocol 1.5 or later use protobuf messages,
+// prefixed by a single byte denoting the message type.
+//
+// Protobuf framing only carries Opus audio, so voice packets can only be
+// converted between the two framings if they contain Opus data.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"os"
+	"packetdatastream"
+	"sync/atomic"
+)
+
+// Message types for protobuf UDP framing
+const (
+	UDPProtobufAudio = iota
+	UDPProtobufPing
+)
+
+// The lowest (v2) protocol version that uses protobuf UDP framing.
+const ProtobufUDPVersion = 1<<48 | 5<<32
+
+// The terminator bit of the legacy Opus frame header
+const opusTerminatorBit = 0x2000
+
+var ErrInvalidVoicePacket = os.NewError("invalid voice packet")
+
+// An Opus voice packet, independent of its UDP framing.
+type opusPacket struct {
+	target     uint32
+	session    uint32
+	frame      uint64
+	terminator bool
+	data       []byte
+	positional []float32
+}
+
+// Convert a legacy (v1) version number into a v2 version number.
+func versionV2FromV1(version uint32) uint64 {
+	major := uint64(version >> 16)
+	minor := uint64((version >> 8) & 0xff)
+	patch := uint64(version & 0xff)
+	return major<<48 | minor<<32 | patch<<16
+}
+
+// Does the client use protobuf UDP framing?
+func (client *Client) usesProtobufUDP() bool {
+	return client.VersionV2 >= ProtobufUDPVersion
+}
+
+// Parse a legacy Opus voice packet sent by a client. Packets sent by
+// clients carry no session id.
+func parseLegacyOpusPacket(buf []byte) (pkt *opusPacket, err os.Error) {
+	if len(buf) < 1 {
+		return nil, ErrInvalidVoicePacket
+	}
+
+	pkt = &opusPacket{target: uint32(buf[0] & 0x1f)}
+	pds := packetdatastream.New(buf[1:])
+	pkt.frame = pds.GetUint64()
+	header := pds.GetUint64()
+	pkt.terminator = (header & opusTerminatorBit) != 0
+	size := int(header &^ opusTerminatorBit)
+	if !pds.IsValid() || size > pds.Left() {
+		return nil, ErrInvalidVoicePacket
+	}
+
+	// Refer to the Opus data in place, rather than copying it.
+	off := 1 + pds.Size()
+	pkt.data = buf[off : off+size]
+	pds.Skip(size)
+
+	if pds.Left() >= 3*4 {
+		pkt.positional = make([]float32, 3)
+		for i := 0; i < 3; i++ {
+			pkt.positional[i] = pds.GetFloat32()
+		}
+	}
+
+	if !pds.IsValid() {
+		return nil, ErrInvalidVoicePacket
+	}
+
+	return pkt, nil
+}
+
+// Parse a protobuf audio packet sent by a client. The buffer must not
+// include the message type byte.
+func parseProtobufAudioPacket(buf []byte) (pkt *opusPacket, err os.Error) {
+	audio := &mumbleproto.UDPAudio{}
+	err = proto.Unmarshal(buf, audio)
+	if err != nil {
+		return nil, err
+	}
+
+	pkt = &opusPacket{
+		data:       audio.OpusData,
+		positional: audio.PositionalData,
+	}
+	if audio.Target != nil {
+		pkt.target = *audio.Target
+	}
+	if audio.FrameNumber != nil {
+		pkt.frame = *audio.FrameNumber
+	}
+	if audio.IsTerminator != nil {
+		pkt.terminator = *audio.IsTerminator
+	}
+	if pkt.target > 0x1f {
+		return nil, ErrInvalidVoicePacket
+	}
+
+	return pkt, nil
+}
+
+// Encode the packet in legacy framing, as sent from the server to a client,
+// into outbuf. Returns the encoded packet, or nil if it doesn't fit.
+func (pkt *opusPacket) encodeLegacy(outbuf []byte) []byte {
+	outbuf[0] = UDPMessageVoiceOpus << 5
+
+	header := uint64(len(pkt.data))
+	if pkt.terminator {
+		header |= opusTerminatorBit
+	}
+
+	pds := packetdatastream.New(outbuf[1:])
+	pds.PutUint32(pkt.session)
+	pds.PutUint64(pkt.frame)
+	pds.PutUint64(header)
+	pds.PutBytes(pkt.data)
+	if len(pkt.positional) == 3 {
+		for _, f := range pkt.positional {
+			pds.PutFloat32(f)
+		}
+	}
+	if !pds.IsValid() {
+		return nil
+	}
+
+	return outbuf[0 : 1+pds.Size()]
+}
+
+// Encode the packet in protobuf framing, as sent from the server to a client.
+func (pkt *opusPacket) protobufBytes() []byte {
+	audio := &mumbleproto.UDPAudio{
+		Context:       proto.Uint32(0),
+		SenderSession: proto.Uint32(pkt.session),
+		FrameNumber:   proto.Uint64(pkt.frame),
+		OpusData:      pkt.data,
+	}
+	if len(pkt.positional) > 0 {
+		audio.PositionalData = pkt.positional
+	}
+	if pkt.terminator {
+		audio.IsTerminator = proto.Bool(true)
+	}
+
+	buf, err := proto.Marshal(audio)
+	if err != nil {
+		return nil
+	}
+
+	return append([]byte{UDPProtobufAudio}, buf...)
+}
+
+// Build the response to a connectionless protobuf ping, or nil if the
+// datagram isn't a request for extended server information.
+func (server *Server) protobufPingResponse(buf []byte) []byte {
+	if len(buf) < 1 || buf[0] != UDPProtobufPing {
+		return nil
+	}
+
+	ping := &mumbleproto.UDPPing{}
+	err := proto.Unmarshal(buf[1:], ping)
+	if err != nil || ping.RequestExtendedInformation == nil || !*ping.RequestExtendedInformation {
+		return nil
+	}
+
+	resp := &mumbleproto.UDPPing{
+		Timestamp:           ping.Timestamp,
+		ServerVersionV2:     proto.Uint64(ServerVersionV2),
+		UserCount:           proto.Uint32(uint32(atomic.AddInt32(&server.numClients, 0))),
+		MaxUserCount:        proto.Uint32(uint32(server.MaxUsers)),
+		MaxBandwidthPerUser: proto.Uint32(uint32(server.MaxBandwidth)),
+	}
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		return nil
+	}
+
+	return append([]byte{UDPProtobufPing}, out...)
+}
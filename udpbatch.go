@@ -0,0 +1,73 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// The maximum number of UDP datagrams sent or received in a single batch.
+const UDPBatchSize = 32
+
+var ErrNoUDPAddr = os.NewError("no UDP address for datagram")
+
+// A UDP datagram, and the address it was received from or should be
+// sent to.
+type udpPacket struct {
+	buf  []byte
+	addr *net.UDPAddr
+}
+
+// A udpBatchConn sends and receives UDP datagrams in batches. On
+// platforms that support it, each batch is transferred with a single
+// system call.
+type udpBatchConn interface {
+	// Send all packets in pkts. Errors for individual
+	// packets are ignored, like they are for WriteTo.
+	WriteBatch(pkts []udpPacket) os.Error
+
+	// Receive at least one, and up to len(pkts), datagrams into
+	// the buffers of pkts. On return, the first n packets hold the
+	// received datagrams and their source addresses.
+	ReadBatch(pkts []udpPacket) (n int, err os.Error)
+
+	// Release what the batch connection holds on to. The UDP socket
+	// itself must be closed separately.
+	Close() os.Error
+}
+
+// The portable udpBatchConn, which transfers one datagram per
+// system call.
+type simpleBatchConn struct {
+	conn *net.UDPConn
+}
+
+func (c *simpleBatchConn) WriteBatch(pkts []udpPacket) os.Error {
+	for _, pkt := range pkts {
+		c.conn.WriteTo(pkt.buf, pkt.addr)
+	}
+	return nil
+}
+
+func (c *simpleBatchConn) ReadBatch(pkts []udpPacket) (n int, err os.Error) {
+	nread, remote, err := c.conn.ReadFrom(pkts[0].buf)
+	if err != nil {
+		return 0, err
+	}
+
+	udpaddr, ok := remote.(*net.UDPAddr)
+	if !ok {
+		return 0, ErrNoUDPAddr
+	}
+
+	pkts[0].buf = pkts[0].buf[0:nread]
+	pkts[0].addr = udpaddr
+	return 1, nil
+}
+
+func (c *simpleBatchConn) Close() os.Error {
+	return nil
+}
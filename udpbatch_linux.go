@@ -0,0 +1,218 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements batched UDP transmission on Linux, using the
+// sendmmsg(2) and recvmmsg(2) system calls. If the running kernel lacks
+// support for either call, we fall back to transferring one datagram
+// at a time.
+
+import (
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _MSG_WAITFORONE = 0x10000
+
+// Scratch space for a single sendmmsg or recvmmsg call.
+type mmsgBatch struct {
+	hdrs  [UDPBatchSize]mmsghdr
+	iovs  [UDPBatchSize]iovec
+	names [UDPBatchSize]syscall.RawSockaddrAny
+}
+
+// Point the i'th header of the batch at buf and the i'th name.
+func (b *mmsgBatch) setup(i int, buf []byte, namelen int) {
+	b.iovs[i].base = uintptr(unsafe.Pointer(&buf[0]))
+	b.iovs[i].setLen(len(buf))
+	b.hdrs[i] = mmsghdr{}
+	b.hdrs[i].name = uintptr(unsafe.Pointer(&b.names[i]))
+	b.hdrs[i].namelen = uint32(namelen)
+	b.hdrs[i].iov = uintptr(unsafe.Pointer(&b.iovs[i]))
+	b.hdrs[i].iovlen = 1
+}
+
+type mmsgConn struct {
+	fallback *simpleBatchConn
+	file     *os.File
+	fd       int
+	ipv6     bool
+
+	// Set once sendmmsg or recvmmsg turn out to be unsupported.
+	nosend bool
+	norecv bool
+
+	// Set by Close. The descriptor may be reused once it's closed.
+	closed bool
+
+	send mmsgBatch
+	recv mmsgBatch
+}
+
+// Create a udpBatchConn for conn. If the socket can't be used for
+// batched transmission, the portable implementation is returned.
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	fallback := &simpleBatchConn{conn}
+
+	file, err := conn.File()
+	if err != nil {
+		log.Printf("Unable to get UDP socket; not batching: %v", err.String())
+		return fallback
+	}
+
+	c := &mmsgConn{fallback: fallback, file: file, fd: file.Fd()}
+	sa, errno := syscall.Getsockname(c.fd)
+	if errno != 0 {
+		log.Printf("Unable to get UDP socket name; not batching: %v", syscall.Errstr(errno))
+		file.Close()
+		return fallback
+	}
+	_, c.ipv6 = sa.(*syscall.SockaddrInet6)
+
+	return c
+}
+
+// Encode addr into the raw socket address rsa, in the address family
+// of our socket. Returns the length of the encoded address, or 0 if addr
+// can't be represented.
+func (c *mmsgConn) encodeAddr(rsa *syscall.RawSockaddrAny, addr *net.UDPAddr) int {
+	if c.ipv6 {
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		ip := addr.IP.To16()
+		if ip == nil {
+			return 0
+		}
+		*sa = syscall.RawSockaddrInet6{}
+		sa.Family = syscall.AF_INET6
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(sa.Addr[0:], ip)
+		return syscall.SizeofSockaddrInet6
+	}
+
+	sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+	ip := addr.IP.To4()
+	if ip == nil {
+		return 0
+	}
+	*sa = syscall.RawSockaddrInet4{}
+	sa.Family = syscall.AF_INET
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(sa.Addr[0:], ip)
+	return syscall.SizeofSockaddrInet4
+}
+
+// Decode a raw socket address into a UDPAddr.
+func decodeAddr(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[0:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	}
+	return nil
+}
+
+func (c *mmsgConn) WriteBatch(pkts []udpPacket) os.Error {
+	if c.closed {
+		return os.EINVAL
+	}
+	if c.nosend {
+		return c.fallback.WriteBatch(pkts)
+	}
+
+	n := 0
+	for _, pkt := range pkts {
+		if len(pkt.buf) == 0 || pkt.addr == nil {
+			continue
+		}
+		namelen := c.encodeAddr(&c.send.names[n], pkt.addr)
+		if namelen == 0 {
+			continue
+		}
+		c.send.setup(n, pkt.buf, namelen)
+		n++
+	}
+
+	sent := 0
+	for sent < n {
+		r1, _, errno := syscall.Syscall6(sysSENDMMSG, uintptr(c.fd), uintptr(unsafe.Pointer(&c.send.hdrs[sent])), uintptr(n-sent), 0, 0, 0)
+		switch {
+		case errno == syscall.ENOSYS:
+			log.Printf("sendmmsg not supported by kernel; not batching UDP sends")
+			c.nosend = true
+			return c.fallback.WriteBatch(pkts)
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			// Skip the datagram that failed, like WriteTo would.
+			sent++
+		default:
+			sent += int(r1)
+		}
+	}
+
+	return nil
+}
+
+func (c *mmsgConn) ReadBatch(pkts []udpPacket) (n int, err os.Error) {
+	if c.closed {
+		return 0, os.EINVAL
+	}
+	if c.norecv {
+		return c.fallback.ReadBatch(pkts)
+	}
+
+	if len(pkts) > UDPBatchSize {
+		pkts = pkts[0:UDPBatchSize]
+	}
+	for i := range pkts {
+		c.recv.setup(i, pkts[i].buf, syscall.SizeofSockaddrAny)
+	}
+
+	r1, _, errno := syscall.Syscall6(sysRECVMMSG, uintptr(c.fd), uintptr(unsafe.Pointer(&c.recv.hdrs[0])), uintptr(len(pkts)), _MSG_WAITFORONE, 0, 0)
+	if errno == syscall.ENOSYS {
+		log.Printf("recvmmsg not supported by kernel; not batching UDP receives")
+		c.norecv = true
+		return c.fallback.ReadBatch(pkts)
+	} else if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", int(errno))
+	}
+
+	n = int(r1)
+	for i := 0; i < n; i++ {
+		addr := decodeAddr(&c.recv.names[i])
+		if addr == nil {
+			// Hand the caller an empty datagram, which is ignored.
+			pkts[i].buf = pkts[i].buf[0:0]
+			addr = &net.UDPAddr{}
+		} else {
+			pkts[i].buf = pkts[i].buf[0:c.recv.hdrs[i].msglen]
+		}
+		pkts[i].addr = addr
+	}
+
+	return n, nil
+}
+
+// Close the duplicate of the socket's descriptor that conn.File made.
+func (c *mmsgConn) Close() os.Error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.file.Close()
+}
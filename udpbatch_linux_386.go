@@ -0,0 +1,32 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+const (
+	sysRECVMMSG = 337
+	sysSENDMMSG = 345
+)
+
+// struct iovec
+type iovec struct {
+	base uintptr
+	len  uint32
+}
+
+func (iov *iovec) setLen(n int) {
+	iov.len = uint32(n)
+}
+
+// struct mmsghdr
+type mmsghdr struct {
+	name       uintptr
+	namelen    uint32
+	iov        uintptr
+	iovlen     uint32
+	control    uintptr
+	controllen uint32
+	flags      int32
+	msglen     uint32
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+const (
+	sysRECVMMSG = 299
+	sysSENDMMSG = 307
+)
+
+// struct iovec
+type iovec struct {
+	base uintptr
+	len  uint64
+}
+
+func (iov *iovec) setLen(n int) {
+	iov.len = uint64(n)
+}
+
+// struct mmsghdr
+type mmsghdr struct {
+	name       uintptr
+	namelen    uint32
+	_          [4]byte
+	iov        uintptr
+	iovlen     uint64
+	control    uintptr
+	controllen uint64
+	flags      int32
+	_          [4]byte
+	msglen     uint32
+	_          [4]byte
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+)
+
+// Batched UDP transmission is only implemented on Linux. Elsewhere,
+// datagrams are sent and received one at a time.
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	return &simpleBatchConn{conn}
+}
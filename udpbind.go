@@ -0,0 +1,100 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements binding a client's UDP traffic to a single source
+// address, so that datagrams with spoofed source addresses can neither
+// inject traffic into a session nor redirect the server's voice traffic
+// towards a victim.
+//
+// A client's UDP traffic is bound to the address of the first encrypted
+// ping that decrypts with its crypt state. Until then, and from any other
+// address afterwards, all other datagrams are dropped.
+//
+// When an encrypted ping arrives from a different address, for example
+// after a NAT rebinding, the client is challenged to prove that it has
+// really moved: voice is sent through the TCP tunnel, and the new address
+// is only bound once it sends a fresh encrypted ping at least
+// udpRebindDelay later, with no traffic arriving from the old address in
+// the meantime. Nothing is sent to the new address before that.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How long the old address must be silent before a client's UDP traffic
+// is moved to a new address, in nanoseconds. Clients ping every few
+// seconds, so this lets a moved client rebind with its next ping.
+const udpRebindDelay = 2e9
+
+// The UDP source address state of a client.
+type udpBinding struct {
+	mutex sync.Mutex
+
+	// The address a challenge is pending for, and when it was issued.
+	pending    *net.UDPAddr
+	challenged int64
+}
+
+// Check whether a decrypted datagram from client is a ping.
+func isUDPPing(client *Client, plain []byte) bool {
+	if len(plain) == 0 {
+		return false
+	}
+	if client.usesProtobufUDP() {
+		return plain[0] == UDPProtobufPing
+	}
+	return (plain[0]>>5)&0x07 == UDPMessagePing
+}
+
+// Check whether a datagram that decrypted with client's crypt state may be
+// accepted from addr, binding or rebinding the client's UDP address as
+// needed. Returns false if the datagram must be dropped.
+func (server *Server) checkUDPSource(client *Client, addr *net.UDPAddr, plain []byte) bool {
+	ub := &client.udpbind
+	ub.mutex.Lock()
+	defer ub.mutex.Unlock()
+
+	// Traffic from the bound address. A pending challenge is void, since
+	// the client is still reachable where it was.
+	if client.udpaddr != nil && client.udpaddr.String() == addr.String() {
+		ub.pending = nil
+		return true
+	}
+
+	if !isUDPPing(client, plain) {
+		dropUDPPacket("unbound")
+		return false
+	}
+
+	if client.udpaddr == nil {
+		client.udpaddr = addr
+		server.addrs.Bind(addr, client)
+		return true
+	}
+
+	now := time.Nanoseconds()
+	if ub.pending == nil || ub.pending.String() != addr.String() {
+		client.Printf("UDP ping from %v, challenging move from %v", addr, client.udpaddr)
+		ub.pending = addr
+		ub.challenged = now
+		client.udp = false
+		dropUDPPacket("rebind")
+		return false
+	}
+	if now-ub.challenged < udpRebindDelay {
+		dropUDPPacket("rebind")
+		return false
+	}
+
+	client.Printf("UDP traffic moved from %v to %v", client.udpaddr, addr)
+	server.addrs.Unbind(client.udpaddr)
+	client.udpaddr = addr
+	server.addrs.Bind(addr, client)
+	ub.pending = nil
+	return true
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the checks applied to incoming UDP datagrams
+// before any decryption is attempted, so that a flood of datagrams from
+// unauthenticated sources can't tie up the goroutines reading from the
+// server's UDP sockets:
+//
+//   - Datagrams from hosts without a connected client are dropped
+//     without attempting to decrypt them.
+//   - Connectionless pings are answered at most UDPPingRate times per
+//     second per host.
+//   - At most maxUDPCandidates decryptions are attempted for a datagram
+//     from a host-port combination not yet bound to a client.
+//   - Datagrams other than pings are only accepted from the address a
+//     client's UDP traffic is bound to (see udpbind.go).
+//
+// Dropped datagrams are counted in grumble.udp.dropped, by reason.
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// The maximum number of clients connected from the same host that
+	// are tried when matching a datagram to its sender.
+	maxUDPCandidates = 8
+
+	// The maximum number of hosts tracked by a pingLimiter in a single
+	// second. Pings from further hosts are dropped.
+	maxPingSources = 65536
+)
+
+// Internal counters, exported via /debug/vars
+var udpDropped = expvar.NewMap("grumble.udp.dropped")
+
+// A pingLimiter limits the number of connectionless pings answered per
+// host and second. It keeps a count per host for the current second
+// only, so its memory use is bounded by the number of hosts seen in a
+// single second.
+type pingLimiter struct {
+	mutex  sync.Mutex
+	second int64
+	counts map[string]int
+}
+
+func newPingLimiter() *pingLimiter {
+	return &pingLimiter{counts: make(map[string]int)}
+}
+
+// Count a ping from ip. Returns true if the ping should be dropped
+// because ip has already sent limit pings this second.
+func (pl *pingLimiter) Ratelimit(ip net.IP, limit int) bool {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	now := time.Seconds()
+	if now != pl.second {
+		pl.second = now
+		pl.counts = make(map[string]int)
+	}
+
+	host := string(ip.To16())
+	count, ok := pl.counts[host]
+	if !ok && len(pl.counts) >= maxPingSources {
+		return true
+	}
+	if count >= limit {
+		return true
+	}
+	pl.counts[host] = count + 1
+	return false
+}
+
+// Check whether a connectionless ping from addr should be answered.
+func (server *Server) allowUDPPing(addr *net.UDPAddr) bool {
+	if server.pings.Ratelimit(addr.IP, server.cfg.IntValue("UDPPingRate")) {
+		dropUDPPacket("ratelimit")
+		return false
+	}
+	return true
+}
+
+// Count a datagram dropped for reason.
+func dropUDPPacket(reason string) {
+	udpDropped.Add(reason, 1)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements binding several UDP sockets to the same address
+// on Linux, using the SO_REUSEPORT socket option. The kernel spreads
+// incoming datagrams over the sockets by hashing their source address,
+// so a client's voice traffic is usually read by the same reader. It
+// isn't always: a client whose NAT mapping changes moves to another
+// reader, and packets from an unknown port are trial-decrypted for all
+// clients on the same host. Decryption is therefore locked per client
+// (see Client.decrypt); the readers only spread the work.
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const _SO_REUSEPORT = 15
+
+// Bind a UDP socket to addr with SO_REUSEPORT set, so that other sockets
+// can be bound to the same address.
+func listenUDPReusePort(addr *net.UDPAddr) (conn *net.UDPConn, err os.Error) {
+	var (
+		family int
+		sa     syscall.Sockaddr
+	)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		family, sa = syscall.AF_INET, sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP)
+		family, sa = syscall.AF_INET6, sa6
+	}
+
+	fd, errno := syscall.Socket(family, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if errno != 0 {
+		return nil, os.NewSyscallError("socket", errno)
+	}
+	syscall.CloseOnExec(fd)
+
+	if errno = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, _SO_REUSEPORT, 1); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", errno)
+	}
+	if family == syscall.AF_INET6 && addr.IP == nil {
+		// Accept IPv4 traffic as well, like net.ListenUDP does.
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	if errno = syscall.Bind(fd, sa); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", errno)
+	}
+
+	f := os.NewFile(fd, "udp:"+addr.String())
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, os.NewError("not a UDP socket")
+	}
+	return conn, nil
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// SO_REUSEPORT is only used on Linux. Elsewhere, each UDP address is
+// bound by a single socket.
+func listenUDPReusePort(addr *net.UDPAddr) (*net.UDPConn, os.Error) {
+	return nil, os.NewError("SO_REUSEPORT isn't supported on this platform")
+}
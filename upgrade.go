@@ -0,0 +1,335 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements in-place upgrades of the Grumble binary. On
+// SIGUSR2, or when asked through the control interface, Grumble freezes
+// its servers, writes the channel each session is in to the data
+// directory, and starts the binary it was started from (which may have
+// been replaced in the meantime) with its listening TCP and UDP sockets.
+// Once the new process has started, the old one exits.
+//
+// Since the new process takes over the sockets themselves, no connection
+// attempt is refused during the upgrade. TLS connections can't be handed
+// over, so connected clients are disconnected, but Mumble clients
+// reconnect on their own, and clients that reconnect within upgradeGrace
+// seconds are put back into the channel they were in.
+//
+// The new process waits for the old one to exit before it binds its
+// other listeners (control interface, console, debug and verification),
+// and doesn't drop privileges again. Upgrades aren't possible when
+// Grumble is chrooted, since the binary isn't reachable from within the
+// chroot, and the user Grumble runs as must be able to read its
+// certificate and key.
+
+import (
+	"fmt"
+	"gob"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The environment variables describing the sockets handed over to
+	// a new process, and the pid of the old process.
+	upgradeSocketsEnv = "GRUMBLE_UPGRADE_SOCKETS"
+	upgradeParentEnv  = "GRUMBLE_UPGRADE_PARENT"
+
+	// How long reconnecting clients are put back into their channel
+	// after an upgrade, in seconds.
+	upgradeGrace = 120
+)
+
+// Asks RunGrumble to upgrade. Used by the control interface.
+var upgradeRequest chan bool = make(chan bool, 1)
+
+// The working directory Grumble was started in.
+var startDir string
+
+// The sockets handed over by the previous process, by server id and bind
+// address, and its pid. See loadInheritedSockets.
+var inherited = struct {
+	tcp    map[string]*net.TCPListener
+	udp    map[string][]*net.UDPConn
+	parent int
+}{tcp: make(map[string]*net.TCPListener), udp: make(map[string][]*net.UDPConn)}
+
+// The session of a client at the time of an upgrade.
+type upgradeSession struct {
+	ServerId  int64
+	CertHash  string
+	Username  string
+	ChannelId int
+}
+
+// Get the path of the file sessions are handed over in.
+func upgradeSessionsPath() string {
+	return filepath.Join(*datadir, "upgrade-sessions")
+}
+
+// Get the key of an inherited socket.
+func inheritedKey(sid int64, addr string) string {
+	return fmt.Sprintf("%v/%v", sid, addr)
+}
+
+// Pick up the sockets handed over by the process that started us, if
+// it was an upgrade. The sockets are described by upgradeSocketsEnv as
+// a comma-separated list of "tcp|udp/serverid/address", one per file
+// descriptor from 3 on. Sockets are also handed over to the process
+// that runs without privileges, see privdrop_unix.go, but without an
+// upgradeParentEnv.
+func loadInheritedSockets() {
+	startDir, _ = os.Getwd()
+
+	desc := os.Getenv(upgradeSocketsEnv)
+	if len(desc) == 0 {
+		return
+	}
+	inherited.parent, _ = strconv.Atoi(os.Getenv(upgradeParentEnv))
+	os.Setenv(upgradeSocketsEnv, "")
+	os.Setenv(upgradeParentEnv, "")
+
+	for i, sock := range strings.Split(desc, ",", -1) {
+		fields := strings.Split(sock, "/", 3)
+		if len(fields) != 3 {
+			log.Printf("Invalid inherited socket %v", sock)
+			continue
+		}
+		sid, err := strconv.Atoi64(fields[1])
+		if err != nil {
+			log.Printf("Invalid inherited socket %v", sock)
+			continue
+		}
+		key := inheritedKey(sid, fields[2])
+
+		f := os.NewFile(3+i, sock)
+		switch fields[0] {
+		case "tcp":
+			l, err := net.FileListener(f)
+			if err == nil {
+				if tcpl, ok := l.(*net.TCPListener); ok {
+					inherited.tcp[key] = tcpl
+				} else {
+					l.Close()
+				}
+			}
+		case "udp":
+			c, err := net.FileConn(f)
+			if err == nil {
+				if udpc, ok := c.(*net.UDPConn); ok {
+					inherited.udp[key] = append(inherited.udp[key], udpc)
+				} else {
+					c.Close()
+				}
+			}
+		}
+		f.Close()
+	}
+	if inherited.parent != 0 {
+		log.Printf("Upgraded from process %v", inherited.parent)
+	}
+}
+
+// Get the TCP listener the previous process bound to addr for the server
+// with the given id, or nil if there is none.
+func inheritedTCPListener(sid int64, addr string) *net.TCPListener {
+	key := inheritedKey(sid, addr)
+	l := inherited.tcp[key]
+	inherited.tcp[key] = nil, false
+	return l
+}
+
+// Get the UDP sockets the previous process bound to addr for the server
+// with the given id.
+func inheritedUDPConns(sid int64, addr string) []*net.UDPConn {
+	key := inheritedKey(sid, addr)
+	conns := inherited.udp[key]
+	inherited.udp[key] = nil, false
+	return conns
+}
+
+// Close the inherited sockets no server has taken over, for instance
+// because its bind addresses changed.
+func closeUnusedInheritedSockets() {
+	for key, l := range inherited.tcp {
+		log.Printf("Closing unused inherited socket tcp/%v", key)
+		l.Close()
+	}
+	for key, conns := range inherited.udp {
+		log.Printf("Closing unused inherited socket udp/%v", key)
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	inherited.tcp = make(map[string]*net.TCPListener)
+	inherited.udp = make(map[string][]*net.UDPConn)
+}
+
+// Freeze all servers and hand their sockets and sessions over to a new
+// Grumble process. If it returns nil, the new process has been started,
+// and this one should exit.
+func upgrade() (err os.Error) {
+	if *chroot {
+		return os.NewError("can't upgrade while chrooted")
+	}
+
+	freezeAll()
+
+	sessions := []upgradeSession{}
+	for _, server := range allServers() {
+		server.syncCall(func() {
+			for _, client := range server.clients {
+				if client.state != StateClientReady || len(client.CertHash) == 0 || client.Channel == nil {
+					continue
+				}
+				sessions = append(sessions, upgradeSession{
+					ServerId:  server.Id,
+					CertHash:  client.CertHash,
+					Username:  client.Username,
+					ChannelId: client.Channel.Id,
+				})
+			}
+		})
+	}
+	f, err := os.OpenFile(upgradeSessionsPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(sessions)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	files, env, err := handoverSockets(upgradeParentEnv, strconv.Itoa(os.Getpid()))
+	if err != nil {
+		os.Remove(upgradeSessionsPath())
+		return err
+	}
+	defer closeFiles(files)
+	pid, err := startUpgradedProcess(os.Args, files, env)
+	if err != nil {
+		os.Remove(upgradeSessionsPath())
+		return err
+	}
+	log.Printf("Started upgraded process %v with %v sockets and %v sessions", pid, len(files), len(sessions))
+	return nil
+}
+
+// Get the listening sockets of all servers as files, and the environment
+// of a new process they're handed over to, which describes them in
+// upgradeSocketsEnv. The environment also sets the variables given as
+// name and value pairs in vars.
+func handoverSockets(vars ...string) (files []*os.File, env []string, err os.Error) {
+	descs := []string{}
+	for _, server := range allServers() {
+		for _, sock := range server.tcpsocks {
+			f, ferr := sock.l.File()
+			if ferr != nil {
+				closeFiles(files)
+				return nil, nil, ferr
+			}
+			files = append(files, f)
+			descs = append(descs, fmt.Sprintf("tcp/%v/%v", server.Id, sock.addr))
+		}
+		for _, sock := range server.udpsocks {
+			f, ferr := sock.conn.File()
+			if ferr != nil {
+				closeFiles(files)
+				return nil, nil, ferr
+			}
+			files = append(files, f)
+			descs = append(descs, fmt.Sprintf("udp/%v/%v", server.Id, sock.addr))
+		}
+	}
+
+	vars = append([]string{upgradeSocketsEnv, strings.Join(descs, ",")}, vars...)
+	for i := 0; i < len(vars); i += 2 {
+		env = append(env, vars[i]+"="+vars[i+1])
+	}
+	for _, kv := range os.Environ() {
+		set := false
+		for i := 0; i < len(vars); i += 2 {
+			if strings.HasPrefix(kv, vars[i]+"=") {
+				set = true
+			}
+		}
+		if !set {
+			env = append(env, kv)
+		}
+	}
+	return files, env, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Read the sessions handed over by the previous process, and give each
+// server its sessions. Does nothing unless this process was started by
+// an upgrade.
+func loadUpgradeSessions() {
+	if inherited.parent == 0 {
+		return
+	}
+	f, err := os.Open(upgradeSessionsPath())
+	if err != nil {
+		log.Printf("Unable to read upgrade sessions: %v", err.String())
+		return
+	}
+	sessions := []upgradeSession{}
+	err = gob.NewDecoder(f).Decode(&sessions)
+	f.Close()
+	os.Remove(upgradeSessionsPath())
+	if err != nil {
+		log.Printf("Unable to read upgrade sessions: %v", err.String())
+		return
+	}
+
+	expiry := time.Seconds() + upgradeGrace
+	for i := range sessions {
+		us := &sessions[i]
+		if server, ok := servers[us.ServerId]; ok {
+			if server.upgradeSessions == nil {
+				server.upgradeSessions = make(map[string]*upgradeSession)
+			}
+			server.upgradeSessions[us.CertHash+"/"+us.Username] = us
+			server.upgradeExpiry = expiry
+		}
+	}
+}
+
+// Get the channel a client that reconnected after an upgrade was in, or
+// nil if it wasn't connected before the upgrade, or may no longer enter
+// the channel.
+func (server *Server) upgradeChannel(client *Client) *Channel {
+	if server.upgradeSessions == nil {
+		return nil
+	}
+	if time.Seconds() > server.upgradeExpiry {
+		server.upgradeSessions = nil
+		return nil
+	}
+
+	key := client.CertHash + "/" + client.Username
+	us, ok := server.upgradeSessions[key]
+	if !ok {
+		return nil
+	}
+	server.upgradeSessions[key] = nil, false
+
+	channel, ok := server.Channels[us.ChannelId]
+	if !ok || !server.HasPermission(client, channel, EnterPermission) {
+		return nil
+	}
+	return channel
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"exec"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Check whether sig asks Grumble to upgrade. See upgrade.go.
+func isUpgradeSignal(sig signal.Signal) bool {
+	return sig == signal.SIGUSR2
+}
+
+// Start the binary Grumble was started from, with the given arguments and
+// the same working directory. The files are passed as file descriptors 3
+// and on.
+func startUpgradedProcess(args []string, files []*os.File, env []string) (pid int, err os.Error) {
+	argv0 := os.Args[0]
+	if strings.Index(argv0, "/") < 0 {
+		argv0, err = exec.LookPath(argv0)
+		if err != nil {
+			return 0, err
+		}
+	} else if !filepath.IsAbs(argv0) {
+		argv0 = filepath.Join(startDir, argv0)
+	}
+
+	attr := &os.ProcAttr{
+		Dir:   startDir,
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	}
+	p, err := os.StartProcess(argv0, args, attr)
+	if err != nil {
+		return 0, err
+	}
+	return p.Pid, nil
+}
+
+// Wait for the process we were upgraded from to exit, for at most 10
+// seconds, so that we can bind the listeners it didn't hand over.
+func waitForUpgradeParent() {
+	if inherited.parent == 0 {
+		return
+	}
+	for i := 0; i < 100 && os.Getppid() == inherited.parent; i++ {
+		time.Sleep(100e6)
+	}
+	if os.Getppid() == inherited.parent {
+		log.Printf("Process %v hasn't exited yet", inherited.parent)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// Upgrades are not supported on Windows, where sockets can't be passed
+// on to a new process. Stop and start the service instead.
+func isUpgradeSignal(sig signal.Signal) bool {
+	return false
+}
+
+func startUpgradedProcess(args []string, files []*os.File, env []string) (pid int, err os.Error) {
+	return 0, os.NewError("upgrades are not supported on Windows")
+}
+
+func waitForUpgradeParent() {
+}
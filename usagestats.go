@@ -0,0 +1,304 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements historical usage statistics, for capacity
+// planning. When enabled with the -usagedb flag, Grumble samples each
+// virtual server every -usageinterval seconds, and records its number of
+// connected users, its channels and how many of them are in use, and the
+// bytes it received and sent since the last sample, in an SQLite
+// database:
+//
+//	CREATE TABLE usage (server INTEGER, time INTEGER, users INTEGER,
+//		channels INTEGER, active_channels INTEGER,
+//		bytes_in INTEGER, bytes_out INTEGER)
+//
+// Daily and weekly peaks can be queried through the control interface,
+// and the peaks of the current day are exported via /debug/vars.
+//
+// With -usagebackups, the database is also backed up every
+// -usagebackupinterval hours, using SQLite's online backup API, into
+// timestamped files next to it. Each backup is checked for corruption
+// before it replaces the oldest one kept.
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sqlite"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var usagedb *string = flag.String("usagedb", "", "SQLite database to record usage statistics in. Disabled if empty")
+var usageinterval *int = flag.Int("usageinterval", 300, "Interval between usage samples, in seconds")
+var usagebackups *int = flag.Int("usagebackups", 0, "Number of backups of the usage database to keep. Disabled if 0")
+var usagebackupinterval *int = flag.Int("usagebackupinterval", 24, "Interval between backups of the usage database, in hours")
+
+// The layout of the timestamps in the names of usage database backups.
+// Names sort in the order the backups were taken.
+const usageBackupLayout = "20060102-150405"
+
+// The peak number of users per server, today.
+var usageDailyPeak = newSessionCounter("grumble.usage.dailypeak")
+
+// The usage database, opened by RecordUsage.
+var usage struct {
+	mutex sync.Mutex
+	db    *sqlite.Conn
+	day   int64
+	peaks map[int64]int
+}
+
+// A sample of a server's usage.
+type UsageSample struct {
+	Time           int64
+	Users          int
+	Channels       int
+	ActiveChannels int
+	BytesIn        int64
+	BytesOut       int64
+}
+
+// The peak usage of a server over a day or a week, starting at Start.
+type UsagePeak struct {
+	Start          int64
+	PeakUsers      int
+	ActiveChannels int
+	BytesIn        int64
+	BytesOut       int64
+}
+
+// Count bytes received by the server.
+func (server *Server) countBytesIn(n int) {
+	atomic.AddInt64(&server.bytesIn, int64(n))
+}
+
+// Count bytes sent by the server.
+func (server *Server) countBytesOut(n int) {
+	atomic.AddInt64(&server.bytesOut, int64(n))
+}
+
+// Take a sample of the server's usage, resetting its byte counters.
+func (server *Server) sampleUsage() (sample UsageSample) {
+	sample.Time = time.Seconds()
+	sample.Users = int(atomic.AddInt32(&server.numClients, 0))
+	sample.BytesIn = atomic.AddInt64(&server.bytesIn, 0)
+	atomic.AddInt64(&server.bytesIn, -sample.BytesIn)
+	sample.BytesOut = atomic.AddInt64(&server.bytesOut, 0)
+	atomic.AddInt64(&server.bytesOut, -sample.BytesOut)
+	server.syncCall(func() {
+		sample.Channels = len(server.Channels)
+		for _, channel := range server.Channels {
+			if len(channel.clients) > 0 {
+				sample.ActiveChannels++
+			}
+		}
+	})
+	return
+}
+
+// Open the usage database at filename, creating its table if needed.
+func openUsageDB(filename string) (db *sqlite.Conn, err os.Error) {
+	db, err = sqlite.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := db.QuickCheck()
+	if err == nil && len(problems) > 0 {
+		err = os.NewError("database is corrupt: " + strings.Join(problems, "; "))
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Samples are written while the servers are running; don't make
+	// each of them wait for a full fsync.
+	if err = db.SetJournalMode("WAL"); err != nil {
+		log.Printf("Unable to use WAL mode for usage database: %v", err.String())
+	} else if err = db.SetSynchronous("NORMAL"); err != nil {
+		log.Printf("Unable to set synchronous mode of usage database: %v", err.String())
+	}
+	err = db.Exec("CREATE TABLE IF NOT EXISTS usage (server INTEGER, time INTEGER, users INTEGER, channels INTEGER, active_channels INTEGER, bytes_in INTEGER, bytes_out INTEGER)")
+	if err == nil {
+		err = db.Exec("CREATE INDEX IF NOT EXISTS usage_server_time ON usage (server, time)")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Record usage statistics of all servers in the usage database. Doesn't
+// return unless the database can't be opened.
+func RecordUsage(filename string, interval int) {
+	db, err := openUsageDB(filename)
+	if err != nil {
+		log.Printf("Unable to open usage database: %v", err.String())
+		return
+	}
+	if interval < 10 {
+		interval = 10
+	}
+	usage.mutex.Lock()
+	usage.db = db
+	usage.peaks = make(map[int64]int)
+	usage.mutex.Unlock()
+	log.Printf("Recording usage statistics in %v every %v seconds", filename, interval)
+
+	lastBackup := time.Seconds()
+	ticker := time.NewTicker(int64(interval) * 1e9)
+	for {
+		<-ticker.C
+		samples := make(map[int64]UsageSample)
+		for _, server := range allServers() {
+			samples[server.Id] = server.sampleUsage()
+		}
+		recordUsageSamples(samples)
+
+		if *usagebackups > 0 && time.Seconds()-lastBackup >= int64(*usagebackupinterval)*3600 {
+			lastBackup = time.Seconds()
+			if err := backupUsageDB(db, filename, *usagebackups); err != nil {
+				log.Printf("Unable to back up usage database: %v", err.String())
+			}
+		}
+	}
+}
+
+// Back up the usage database in filename to a timestamped file next to
+// it, and remove the oldest backups, so that at most keep are left.
+// Backups that fail the integrity check are removed right away.
+func backupUsageDB(db *sqlite.Conn, filename string, keep int) os.Error {
+	prefix := filepath.Base(filename) + ".backup-"
+	path := filename + ".backup-" + time.UTC().Format(usageBackupLayout)
+	err := db.BackupToFile(path, 100, nil)
+	if err == nil {
+		err = checkUsageBackup(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.Printf("Backed up usage database to %v", path)
+
+	dir := filepath.Dir(filename)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by name, so the oldest backups come first.
+	backups := []string{}
+	for _, fi := range entries {
+		if fi.IsRegular() && strings.HasPrefix(fi.Name, prefix) {
+			backups = append(backups, filepath.Join(dir, fi.Name))
+		}
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("Unable to remove old usage database backup: %v", err.String())
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Check a backup of the usage database for corruption.
+func checkUsageBackup(path string) os.Error {
+	db, err := sqlite.OpenWithFlags(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	problems, err := db.QuickCheck()
+	if err == nil && len(problems) > 0 {
+		err = os.NewError("backup is corrupt: " + strings.Join(problems, "; "))
+	}
+	return err
+}
+
+// Write usage samples of servers, by server id, to the database in a
+// single transaction, and update the exported daily peaks.
+func recordUsageSamples(samples map[int64]UsageSample) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	err := usage.db.Transaction(func(db *sqlite.Conn) os.Error {
+		for sid, sample := range samples {
+			err := db.Exec("INSERT INTO usage VALUES (?, ?, ?, ?, ?, ?, ?)",
+				sid, sample.Time, sample.Users, sample.Channels, sample.ActiveChannels, sample.BytesIn, sample.BytesOut)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Unable to record usage: %v", err.String())
+	}
+
+	for sid, sample := range samples {
+		updateDailyPeak(sid, sample)
+	}
+}
+
+// Update the exported daily peak of the server with the given id. The
+// usage mutex must be held.
+func updateDailyPeak(sid int64, sample UsageSample) {
+	day := sample.Time / 86400
+	if day != usage.day {
+		usage.day = day
+		for id, _ := range usage.peaks {
+			usageDailyPeak.Remove(fmt.Sprint(id))
+		}
+		usage.peaks = make(map[int64]int)
+	}
+	if peak, ok := usage.peaks[sid]; !ok || sample.Users > peak {
+		usageDailyPeak.Add(fmt.Sprint(sid), int64(sample.Users-peak))
+		usage.peaks[sid] = sample.Users
+	}
+}
+
+// Get the peak usage of the server with the given id, per period of
+// period seconds, over the last count periods.
+func usagePeaks(sid int64, period int64, count int) (peaks []UsagePeak, err os.Error) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	if usage.db == nil {
+		return nil, os.NewError("usage statistics aren't enabled")
+	}
+
+	now := time.Seconds()
+	since := (now/period - int64(count) + 1) * period
+	stmt, err := usage.db.Prepare("SELECT time / ?1 * ?1, MAX(users), MAX(active_channels), SUM(bytes_in), SUM(bytes_out) FROM usage WHERE server = ?2 AND time >= ?3 GROUP BY time / ?1 ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	err = stmt.Exec(period, sid, since)
+	if err != nil {
+		return nil, err
+	}
+
+	peaks = []UsagePeak{}
+	for stmt.Next() {
+		var peak UsagePeak
+		err = stmt.Scan(&peak.Start, &peak.PeakUsers, &peak.ActiveChannels, &peak.BytesIn, &peak.BytesOut)
+		if err != nil {
+			return nil, err
+		}
+		peaks = append(peaks, peak)
+	}
+	if err = stmt.Error(); err != nil {
+		return nil, err
+	}
+	return peaks, nil
+}
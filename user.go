@@ -6,13 +6,24 @@ package main
 
 import (
 	"encoding/hex"
+	"goprotobuf.googlecode.com/hg/proto"
+	"log"
+	"mumbleproto"
 	"os"
+	"strings"
+	"time"
 )
 
 // This file implements Server's handling of Users.
 //
 // Users are registered clients on the server.
 
+// The maximum number of access tokens stored for a user.
+const MaxUserTokens = 100
+
+// How often registrations are checked for pruning, in nanoseconds.
+const PruneInterval = 3600e9
+
 type User struct {
 	Id            uint32
 	Name          string
@@ -23,6 +34,39 @@ type User struct {
 	CommentBlob   string
 	LastChannelId int
 	LastActive    uint64
+
+	// The last time the user connected to and disconnected from
+	// the server, in seconds since the epoch. Zero if unknown.
+	LastConnect    uint64
+	LastDisconnect uint64
+
+	// Cumulative talk-time statistics. The speaking time is in
+	// milliseconds. See talkstats.go.
+	TalkTime     uint64
+	VoicePackets uint64
+
+	// Channels the user was listening to when last connected
+	ListeningChannels []int
+
+	// Access tokens supplied by the user. The tokens supplied by
+	// each of the user's clients are merged into this list.
+	Tokens []string
+
+	// The token of a registration waiting for email verification.
+	// Empty once the registration is active. See verify.go.
+	VerifyToken string
+
+	// The base32-encoded TOTP secret of the SuperUser, if it must
+	// log in with a second factor. See totp.go.
+	TOTPSecret string
+
+	// When a timed mute or deafen of the user expires, in seconds
+	// since the epoch. Zero if there is none. See timedmute.go.
+	MuteExpiry int64
+	DeafExpiry int64
+
+	// Key/value pairs kept by tools, by namespace. See usermeta.go.
+	Metadata map[string]map[string]string
 }
 
 // Create a new User
@@ -69,3 +113,104 @@ func (user *User) TextureBlobHashBytes() (buf []byte) {
 	}
 	return buf
 }
+
+// Merge the access tokens in b into a. Tokens are compared
+// case-insensitively, and the result holds at most MaxUserTokens
+// tokens.
+func mergeTokens(a []string, b []string) (merged []string) {
+	seen := make(map[string]bool)
+	for _, list := range [][]string{a, b} {
+		for _, token := range list {
+			key := strings.ToLower(token)
+			if len(token) == 0 || seen[key] {
+				continue
+			}
+			if len(merged) >= MaxUserTokens {
+				return
+			}
+			seen[key] = true
+			merged = append(merged, token)
+		}
+	}
+	return
+}
+
+// Remove a user's registration. Any ACLs and group memberships referring
+// to the user are removed as well. If the user is connected, the client
+// stays connected as an unregistered user.
+func (server *Server) RemoveRegistration(user *User) {
+	if user.Id == 0 {
+		return
+	}
+
+	server.Users[user.Id] = nil, false
+	if server.UserNameMap[user.Name] == user {
+		server.UserNameMap[user.Name] = nil, false
+	}
+	if len(user.CertHash) > 0 && server.UserCertMap[user.CertHash] == user {
+		server.UserCertMap[user.CertHash] = nil, false
+	}
+
+	uid := int(user.Id)
+	for _, channel := range server.Channels {
+		acls := []*ChannelACL{}
+		for _, acl := range channel.ACL {
+			if acl.UserId != uid {
+				acls = append(acls, acl)
+			}
+		}
+		channel.ACL = acls
+
+		for _, grp := range channel.Groups {
+			grp.Add[uid] = false, false
+			grp.Remove[uid] = false, false
+		}
+	}
+	server.ClearACLCache()
+
+	for _, client := range server.clients {
+		if client.user != user {
+			continue
+		}
+		client.user = nil
+		err := server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session),
+			UserId:  proto.Uint32(0xffffffff),
+		})
+		if err != nil {
+			log.Printf("Unable to broadcast UserState: %v", err.String())
+		}
+		server.sendClientPermissions(client, client.Channel)
+	}
+}
+
+// Remove the registrations of users that haven't been active on the server
+// for maxIdleDays days. Users that are connected, and users that have never
+// been seen, are not pruned. Returns the removed users.
+func (server *Server) PruneRegistrations(maxIdleDays int) (pruned []*User) {
+	if maxIdleDays <= 0 {
+		return
+	}
+
+	connected := make(map[*User]bool)
+	for _, client := range server.clients {
+		if client.user != nil {
+			connected[client.user] = true
+		}
+	}
+
+	cutoff := uint64(time.Seconds()) - uint64(maxIdleDays)*86400
+	for _, user := range server.Users {
+		if user.Id == 0 || connected[user] || user.LastActive == 0 || user.LastActive >= cutoff {
+			continue
+		}
+		pruned = append(pruned, user)
+	}
+
+	for _, user := range pruned {
+		log.Printf("Pruning idle registration of user %v (%v)", user.Id, user.Name)
+		server.RemoveRegistration(user)
+	}
+
+	return
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements exporting and importing registered users as CSV,
+// for migrating users between servers and for bulk provisioning.
+//
+// Each line holds a user's name, certificate hash, email address and the
+// groups of the root channel the user is a member of, separated by
+// semicolons. The first line is a header, and is skipped on import.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var csvHeader = []string{"name", "certhash", "email", "groups"}
+
+// How conflicts with existing users are resolved on import.
+const (
+	// Leave the existing user untouched.
+	ImportSkip = "skip"
+	// Replace the existing user's certificate hash, email address
+	// and groups.
+	ImportUpdate = "update"
+)
+
+type ExportedUser struct {
+	Name     string
+	CertHash string
+	Email    string
+	Groups   []string
+}
+
+// Quote a CSV field if it needs it.
+func csvQuote(field string) string {
+	if strings.IndexAny(field, ",\"\r\n") < 0 {
+		return field
+	}
+	return "\"" + strings.Replace(field, "\"", "\"\"", -1) + "\""
+}
+
+// Write users to w as CSV.
+func WriteUserCSV(w io.Writer, users []ExportedUser) (err os.Error) {
+	bw := bufio.NewWriter(w)
+	_, err = bw.WriteString(strings.Join(csvHeader, ",") + "\n")
+	if err != nil {
+		return
+	}
+
+	for _, user := range users {
+		fields := []string{user.Name, user.CertHash, user.Email, strings.Join(user.Groups, ";")}
+		for i, field := range fields {
+			fields[i] = csvQuote(field)
+		}
+		_, err = bw.WriteString(strings.Join(fields, ",") + "\n")
+		if err != nil {
+			return
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Split a CSV line into its fields. Quoted fields may not span lines.
+func csvSplit(line string) (fields []string, err os.Error) {
+	field := []byte{}
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '"' && i+1 < len(line) && line[i+1] == '"':
+			field = append(field, '"')
+			i++
+		case c == '"' && (quoted || len(field) == 0):
+			quoted = !quoted
+		case !quoted && c == ',':
+			fields = append(fields, string(field))
+			field = []byte{}
+		default:
+			field = append(field, c)
+		}
+	}
+	if quoted {
+		return nil, os.NewError("unterminated quoted field")
+	}
+	return append(fields, string(field)), nil
+}
+
+// Read users in CSV from r.
+func ReadUserCSV(r io.Reader) (users []ExportedUser, err os.Error) {
+	br := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadString('\n')
+		if err == os.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != os.EOF {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if lineno == 1 || len(line) == 0 {
+			continue
+		}
+
+		fields, err := csvSplit(line)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("line %v: %v", lineno, err.String()))
+		}
+		if len(fields) != len(csvHeader) {
+			return nil, os.NewError(fmt.Sprintf("line %v: expected %v fields", lineno, len(csvHeader)))
+		}
+
+		user := ExportedUser{
+			Name:     fields[0],
+			CertHash: strings.ToLower(fields[1]),
+			Email:    fields[2],
+			Groups:   []string{},
+		}
+		for _, group := range strings.Split(fields[3], ";", -1) {
+			if len(group) > 0 {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Export the registered users of the server, except the SuperUser.
+func (server *Server) exportUsers() []ExportedUser {
+	sorted := userIdSlice{}
+	for _, user := range server.Users {
+		if user.Id != 0 && !user.Pending() {
+			sorted = append(sorted, user)
+		}
+	}
+	sort.Sort(sorted)
+
+	users := []ExportedUser{}
+	for _, user := range sorted {
+		exported := ExportedUser{
+			Name:     user.Name,
+			CertHash: user.CertHash,
+			Email:    user.Email,
+			Groups:   []string{},
+		}
+		for name, group := range server.root.Groups {
+			if group.AddContains(int(user.Id)) {
+				exported.Groups = append(exported.Groups, name)
+			}
+		}
+		sort.SortStrings(exported.Groups)
+		users = append(users, exported)
+	}
+	return users
+}
+
+// Make user a member of exactly the given groups of the root channel.
+func (server *Server) setRootGroups(user *User, groups []string) {
+	member := make(map[string]bool)
+	for _, name := range groups {
+		member[name] = true
+	}
+
+	uid := int(user.Id)
+	for name, group := range server.root.Groups {
+		if !member[name] {
+			group.Add[uid] = false, false
+		}
+	}
+	for name, _ := range member {
+		group, ok := server.root.Groups[name]
+		if !ok {
+			group = NewGroup(server.root, name)
+			server.root.Groups[name] = group
+		}
+		group.Add[uid] = true
+	}
+}
+
+type ImportUsersReply struct {
+	Added   int
+	Updated int
+
+	// Users that were not imported, and why.
+	Skipped []string
+}
+
+// Import users into the server. Users are matched to existing users by
+// name; conflict decides what happens to those. Users whose certificate
+// hash belongs to a different user are always skipped.
+func (server *Server) importUsers(users []ExportedUser, conflict string, reply *ImportUsersReply) {
+	for _, imported := range users {
+		user, exists := server.UserNameMap[imported.Name]
+		if exists && (user.Id == 0 || conflict != ImportUpdate) {
+			reply.Skipped = append(reply.Skipped, imported.Name+": already registered")
+			continue
+		}
+		if !exists && !server.validUserName(imported.Name) {
+			reply.Skipped = append(reply.Skipped, imported.Name+": invalid name")
+			continue
+		}
+		if other, ok := server.UserCertMap[imported.CertHash]; ok && len(imported.CertHash) > 0 && other != user {
+			reply.Skipped = append(reply.Skipped, imported.Name+": certificate registered to "+other.Name)
+			continue
+		}
+
+		if exists {
+			if len(user.CertHash) > 0 {
+				server.UserCertMap[user.CertHash] = nil, false
+			}
+			user.CertHash = imported.CertHash
+			if len(user.CertHash) > 0 {
+				server.UserCertMap[user.CertHash] = user
+			}
+			reply.Updated++
+		} else {
+			var err os.Error
+			user, err = server.addRegistration(imported.Name, imported.CertHash)
+			if err != nil {
+				reply.Skipped = append(reply.Skipped, imported.Name+": "+err.String())
+				continue
+			}
+			reply.Added++
+		}
+		user.Email = imported.Email
+		server.setRootGroups(user, imported.Groups)
+	}
+
+	server.ClearACLCache()
+}
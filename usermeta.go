@@ -0,0 +1,58 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements per-user metadata: small key/value pairs attached
+// to registered users, so that bots and management tools can keep data
+// such as ranks, notes or preferences with the registration. Keys live
+// in namespaces, one per tool, so tools don't step on each other's data.
+//
+// Metadata is only used by tools through the control interface, and is
+// stored with the registration in the frozen server.
+
+import (
+	"os"
+)
+
+// Limits for user metadata
+const (
+	MaxMetadataNameLength  = 64
+	MaxMetadataValueLength = 4096
+	MaxMetadataKeys        = 64
+)
+
+var ErrInvalidMetadata = os.NewError("invalid metadata name or value")
+
+// Set a metadata key of a user. An empty value removes the key.
+func (user *User) SetMetadata(namespace string, key string, value string) os.Error {
+	if len(namespace) == 0 || len(namespace) > MaxMetadataNameLength ||
+		len(key) == 0 || len(key) > MaxMetadataNameLength || len(value) > MaxMetadataValueLength {
+		return ErrInvalidMetadata
+	}
+
+	keys := user.Metadata[namespace]
+	if len(value) == 0 {
+		if keys != nil {
+			keys[key] = "", false
+			if len(keys) == 0 {
+				user.Metadata[namespace] = nil, false
+			}
+		}
+		return nil
+	}
+
+	if keys == nil {
+		if user.Metadata == nil {
+			user.Metadata = make(map[string]map[string]string)
+		}
+		keys = make(map[string]string)
+		user.Metadata[namespace] = keys
+	}
+	if _, exists := keys[key]; !exists && len(keys) >= MaxMetadataKeys {
+		return os.NewError("too many metadata keys")
+	}
+	keys[key] = value
+	return nil
+}
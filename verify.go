@@ -0,0 +1,210 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements email verification of self-registrations. When
+// Grumble is started with -smtpaddr and -verifyurl, a client that
+// registers itself and supplies an email address (in the Grumble
+// extension of UserState) gets a pending registration: the user name is
+// reserved, but the registration isn't used until the link mailed to
+// the user has been opened. Pending registrations that aren't verified
+// within VerificationTimeout are removed.
+//
+// Verification links are served on the address given by -verifyaddr,
+// and must be reachable through the URL given by -verifyurl.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"html"
+	"http"
+	"log"
+	"mumbleproto"
+	"net"
+	"os"
+	"smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a pending registration may remain unverified, in seconds.
+const VerificationTimeout = 48 * 3600
+
+// Is email verification of self-registrations enabled?
+func emailVerification() bool {
+	return len(*smtpaddr) > 0 && len(*verifyurl) > 0
+}
+
+// Is the user's registration waiting for email verification?
+func (user *User) Pending() bool {
+	return len(user.VerifyToken) > 0
+}
+
+// Generate a new verification token.
+func newVerifyToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Unable to generate verification token")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Send a verification mail for user's pending registration on server.
+func sendVerificationMail(server *Server, user *User) (err os.Error) {
+	link := fmt.Sprintf("%v?server=%v&token=%v", *verifyurl, server.Id, user.VerifyToken)
+
+	c, err := smtp.Dial(*smtpaddr)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+
+	if err = c.Mail(*smtpfrom); err != nil {
+		return err
+	}
+	if err = c.Rcpt(user.Email); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "From: %v\r\nTo: %v\r\nSubject: Confirm your registration\r\n\r\n"+
+		"To confirm the registration of the name %v, open the following link:\r\n\r\n%v\r\n\r\n"+
+		"If you did not register, you can ignore this mail.\r\n",
+		*smtpfrom, user.Email, user.Name, link)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Create a pending registration for client, and mail the verification
+// link to email.
+func (server *Server) registerPending(client *Client, email string) (err os.Error) {
+	if strings.IndexAny(email, "\r\n<>") >= 0 || strings.Index(email, "@") <= 0 {
+		return os.NewError("invalid email address")
+	}
+
+	user, err := server.addRegistration(client.Username, client.CertHash)
+	if err != nil {
+		return err
+	}
+	user.Email = email
+	user.VerifyToken = newVerifyToken()
+	client.Printf("Pending registration as user %v (%v), verification sent to %v", user.Id, user.Name, email)
+
+	go func() {
+		err := sendVerificationMail(server, user)
+		if err != nil {
+			log.Printf("Unable to send verification mail for user %v: %v", user.Id, err.String())
+			server.syncCall(func() {
+				server.RemoveRegistration(user)
+			})
+		}
+	}()
+
+	return client.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
+		Session: []uint32{client.Session},
+		Message: proto.String("A confirmation link has been sent to " + html.EscapeString(email) + ". Your registration is complete once you open it."),
+	})
+}
+
+// Activate the pending registration with the given token. Returns false
+// if there is no such registration.
+func (server *Server) verifyRegistration(token string) bool {
+	var user *User
+	for _, u := range server.Users {
+		if u.Pending() && u.VerifyToken == token {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		return false
+	}
+
+	user.VerifyToken = ""
+	user.LastActive = uint64(time.Seconds())
+	log.Printf("Verified registration of user %v (%v) on server %v", user.Id, user.Name, server.Id)
+
+	// Registering clients stay connected as unregistered users until
+	// the registration is verified.
+	for _, client := range server.clients {
+		if client.user != nil || client.CertHash != user.CertHash {
+			continue
+		}
+		client.user = user
+		err := server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session),
+			UserId:  proto.Uint32(user.Id),
+		})
+		if err != nil {
+			log.Printf("Unable to broadcast UserState: %v", err.String())
+		}
+	}
+	server.ClearACLCache()
+
+	return true
+}
+
+// Remove pending registrations that have not been verified in time.
+func (server *Server) removeUnverified() {
+	now := uint64(time.Seconds())
+	for _, user := range server.Users {
+		if user.Pending() && now-user.LastActive > VerificationTimeout {
+			log.Printf("Removing unverified registration of user %v (%v) on server %v", user.Id, user.Name, server.Id)
+			server.RemoveRegistration(user)
+		}
+	}
+}
+
+// Handle a request for a verification link.
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	sid, err := strconv.Atoi64(r.FormValue("server"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid verification link.\n")
+		return
+	}
+	server, err := lookupServer(sid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Invalid verification link.\n")
+		return
+	}
+
+	var ok bool
+	server.syncCall(func() {
+		ok = server.verifyRegistration(r.FormValue("token"))
+	})
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "This verification link is not valid, or has expired.\n")
+		return
+	}
+	fmt.Fprintf(w, "Your registration is now complete.\n")
+}
+
+// Start the listener for verification links on addr.
+func ListenVerify(addr string) (err os.Error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleVerify)
+	log.Printf("Verification listener listening on %v", addr)
+	go http.Serve(l, mux)
+
+	return nil
+}
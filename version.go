@@ -0,0 +1,42 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file builds the Version message sent to connecting clients. The
+// VersionDisclosure config key controls how much build information it
+// includes:
+//
+//	full     the release name, and the OS and Go version Grumble runs on
+//	generic  only the release name (the default)
+//	none     only the protocol version
+//
+// The protocol version is always sent, since clients need it to talk to
+// the server.
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"runtime"
+)
+
+// Build the Version message to send to clients.
+func (server *Server) versionMessage() *mumbleproto.Version {
+	version := &mumbleproto.Version{
+		Version:   proto.Uint32(ServerVersion),
+		VersionV2: proto.Uint64(ServerVersionV2),
+	}
+
+	switch server.cfg.StringValue("VersionDisclosure") {
+	case "none":
+	case "full":
+		version.Release = proto.String("Grumble")
+		version.Os = proto.String(runtime.GOOS)
+		version.OsVersion = proto.String(runtime.GOARCH + ", " + runtime.Version())
+	default:
+		version.Release = proto.String("Grumble")
+	}
+
+	return version
+}
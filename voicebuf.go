@@ -0,0 +1,132 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the packet buffers used on Grumble's voice path.
+//
+// Incoming UDP packets are read into buffers drawn from a global packet
+// pool. Each buffer reserves some headroom in front of the packet, so that
+// the sender's session id can be prepended to the packet in place. The
+// resulting buffer is wrapped in a ref-counted VoiceBuffer and handed to
+// every recipient of the packet; once the last recipient has sent it, the
+// buffer is returned to the pool.
+
+import (
+	"packetdatastream"
+	"sync/atomic"
+)
+
+const (
+	// Headroom reserved at the front of pooled packet buffers, for
+	// prepending headers to received packets in place.
+	PacketHeadroom = 16
+
+	// The size of a pooled packet buffer.
+	PacketBufferSize = PacketHeadroom + UDPPacketSize
+
+	// The maximum number of idle buffers kept in the packet pool.
+	packetPoolSize = 1024
+
+	// The number of voice packets queued per client before the
+	// oldest packets are dropped.
+	VoiceQueueSize = 64
+)
+
+// A pool of fixed-size packet buffers.
+type PacketPool struct {
+	free chan []byte
+}
+
+// Create a new PacketPool that keeps up to count idle buffers.
+func NewPacketPool(count int) *PacketPool {
+	return &PacketPool{free: make(chan []byte, count)}
+}
+
+// Get a buffer from the pool, or allocate a new one if the pool is empty.
+func (pool *PacketPool) Get() []byte {
+	select {
+	case buf := <-pool.free:
+		return buf
+	default:
+	}
+	return make([]byte, PacketBufferSize)
+}
+
+// Return a buffer to the pool. If the pool is full, the buffer is
+// left for the garbage collector.
+func (pool *PacketPool) Put(buf []byte) {
+	if cap(buf) != PacketBufferSize {
+		return
+	}
+	select {
+	case pool.free <- buf[0:PacketBufferSize]:
+	default:
+	}
+}
+
+var packetPool = NewPacketPool(packetPoolSize)
+
+// Copy a packet into a pooled buffer, leaving PacketHeadroom bytes in
+// front of it. Returns nil if the packet doesn't fit.
+func pooledPacket(data []byte) []byte {
+	if len(data) > UDPPacketSize {
+		return nil
+	}
+	buf := packetPool.Get()
+	copy(buf[PacketHeadroom:], data)
+	return buf[0 : PacketHeadroom+len(data)]
+}
+
+// Rewrite the legacy voice packet in buf (as sent by a client, starting at
+// PacketHeadroom) in place, so that it can be sent on to other clients: the
+// header byte is replaced with kind, and the sender's session id is
+// inserted in front of the payload. Returns the rewritten packet.
+func prependSession(buf []byte, kind byte, session uint32) []byte {
+	var hdr [6]byte
+	pds := packetdatastream.New(hdr[1:])
+	pds.PutUint32(session)
+	hdr[0] = kind
+	n := 1 + pds.Size()
+
+	start := PacketHeadroom + 1 - n
+	copy(buf[start:], hdr[0:n])
+	return buf[start:]
+}
+
+// A ref-counted voice packet, shared between all of its recipients.
+type VoiceBuffer struct {
+	// The packet itself
+	data []byte
+	// The pooled buffer backing data, or nil if data isn't pooled.
+	buf  []byte
+	refs int32
+}
+
+// Create a new VoiceBuffer holding a single reference. Data must be a
+// slice of buf; buf is returned to the packet pool once the last
+// reference is dropped. Buf may be nil.
+func NewVoiceBuffer(buf []byte, data []byte) *VoiceBuffer {
+	voiceBuffersInFlight.Add(1)
+	return &VoiceBuffer{data: data, buf: buf, refs: 1}
+}
+
+// Take a new reference to the VoiceBuffer.
+func (vb *VoiceBuffer) Ref() {
+	atomic.AddInt32(&vb.refs, 1)
+}
+
+// Drop a reference to the VoiceBuffer. Calling Unref on a nil
+// VoiceBuffer is a no-op.
+func (vb *VoiceBuffer) Unref() {
+	if vb == nil {
+		return
+	}
+	if atomic.AddInt32(&vb.refs, -1) == 0 {
+		voiceBuffersInFlight.Add(-1)
+		if vb.buf != nil {
+			packetPool.Put(vb.buf)
+		}
+	}
+}
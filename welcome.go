@@ -0,0 +1,64 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements expansion of the variables supported in a
+// server's welcome text. The welcome text is expanded for each client
+// as it is sent in the client's ServerSync message.
+//
+// The following variables are supported:
+//
+//	{username}   the name of the client being welcomed
+//	{usercount}  the number of clients connected to the server
+//	{maxusers}   the maximum number of clients allowed on the server
+//	{uptime}     the time since the server was started
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// Format a duration given in seconds as a short, human readable string,
+// such as "3d 4h 12m".
+func formatUptime(secs int64) string {
+	if secs < 60 {
+		return fmt.Sprintf("%vs", secs)
+	}
+
+	days := secs / 86400
+	hours := (secs % 86400) / 3600
+	minutes := (secs % 3600) / 60
+
+	if days > 0 {
+		return fmt.Sprintf("%vd %vh %vm", days, hours, minutes)
+	} else if hours > 0 {
+		return fmt.Sprintf("%vh %vm", hours, minutes)
+	}
+	return fmt.Sprintf("%vm", minutes)
+}
+
+// Get the server's welcome text, as shown to client. Returns an empty
+// string if the server has no welcome text.
+func (server *Server) welcomeTextFor(client *Client) string {
+	text := server.cfg.StringValue("WelcomeText")
+	if len(text) == 0 {
+		return text
+	}
+
+	// The welcome text is HTML, so escape user-controlled values.
+	vars := map[string]string{
+		"{username}":  html.EscapeString(client.ShownName()),
+		"{usercount}": fmt.Sprintf("%v", len(server.clients)),
+		"{maxusers}":  fmt.Sprintf("%v", server.MaxUsers),
+		"{uptime}":    formatUptime(time.Seconds() - server.startTime),
+	}
+	for name, value := range vars {
+		text = strings.Replace(text, name, value, -1)
+	}
+
+	return text
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2011 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// This file implements the word filter for text messages. The filter's
+// rules are read from the file given by the WordFilter config key, one
+// rule per line:
+//
+//	<action>[:minutes] <word>
+//	<action>[:minutes] /<regexp>/
+//
+// Words match case-insensitively; regular expressions match as written.
+// Empty lines and lines starting with '#' are ignored. The actions are:
+//
+//	censor  the matched text is replaced by asterisks
+//	warn    the message is sent, and the sender is warned
+//	drop    the message isn't sent, and the sender is told so
+//	mute    like drop, and the sender is muted for the given number of
+//	        minutes (5 by default)
+//
+// Every matching rule is applied, and drop and mute win over the others.
+// Like CRLs (see revocation.go), rule files are cached and re-read when
+// they change, so rules can be edited while the server is running.
+
+import (
+	"bufio"
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"log"
+	"mumbleproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// The default length of a mute by the word filter, in minutes.
+	defaultFilterMuteMinutes = 5
+
+	// The most rules a filter file may hold.
+	maxFilterRules = 10000
+)
+
+type filterRule struct {
+	action  string
+	minutes int
+	re      *regexp.Regexp
+}
+
+type wordFilter struct {
+	mtime int64
+	rules []filterRule
+}
+
+var wordFilterCache = struct {
+	mutex   sync.Mutex
+	filters map[string]*wordFilter
+}{filters: make(map[string]*wordFilter)}
+
+// Build a regular expression matching word case-insensitively.
+func foldedWordRegexp(word string) string {
+	pattern := ""
+	for _, r := range word {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			pattern += "[" + strings.ToLower(string(r)) + strings.ToUpper(string(r)) + "]"
+		case strings.IndexRune(`\.+*?()|[]{}^$`, r) >= 0:
+			pattern += `\` + string(r)
+		default:
+			pattern += string(r)
+		}
+	}
+	return pattern
+}
+
+// Parse a rule line of a filter file.
+func parseFilterRule(line string) (rule filterRule, err os.Error) {
+	fields := strings.Split(line, " ", 2)
+	if len(fields) != 2 || len(strings.TrimSpace(fields[1])) == 0 {
+		return rule, os.NewError("expected an action and a word or regexp")
+	}
+
+	action := strings.Split(fields[0], ":", 2)
+	rule.action = action[0]
+	switch rule.action {
+	case "censor", "warn", "drop":
+	case "mute":
+		rule.minutes = defaultFilterMuteMinutes
+		if len(action) > 1 {
+			rule.minutes, err = strconv.Atoi(action[1])
+			if err != nil || rule.minutes <= 0 {
+				return rule, os.NewError("invalid mute duration " + action[1])
+			}
+		}
+	default:
+		return rule, os.NewError("unknown action " + rule.action)
+	}
+
+	pattern := strings.TrimSpace(fields[1])
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		pattern = pattern[1 : len(pattern)-1]
+	} else {
+		pattern = foldedWordRegexp(pattern)
+	}
+	rule.re, err = regexp.Compile(pattern)
+	return rule, err
+}
+
+// Read the filter rules in filename.
+func readWordFilter(filename string, mtime int64) (wf *wordFilter, err os.Error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wf = &wordFilter{mtime: mtime}
+	r := bufio.NewReader(f)
+	for lineno := 1; ; lineno++ {
+		line, rerr := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			if len(wf.rules) >= maxFilterRules {
+				return nil, os.NewError("too many rules")
+			}
+			rule, err := parseFilterRule(line)
+			if err != nil {
+				return nil, os.NewError(fmt.Sprintf("line %v: %v", lineno, err.String()))
+			}
+			wf.rules = append(wf.rules, rule)
+		}
+		if rerr == os.EOF {
+			break
+		} else if rerr != nil {
+			return nil, rerr
+		}
+	}
+	return wf, nil
+}
+
+// Get the word filter in filename, from the cache if the file hasn't
+// changed.
+func loadWordFilter(filename string) (wf *wordFilter, err os.Error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	wordFilterCache.mutex.Lock()
+	defer wordFilterCache.mutex.Unlock()
+
+	wf, ok := wordFilterCache.filters[filename]
+	if ok && wf.mtime == fi.Mtime_ns {
+		return wf, nil
+	}
+
+	wf, err = readWordFilter(filename, fi.Mtime_ns)
+	if err != nil {
+		return nil, err
+	}
+	wordFilterCache.filters[filename] = wf
+	log.Printf("Loaded word filter %v (%v rules)", filename, len(wf.rules))
+	return wf, nil
+}
+
+// Apply the rules of wf to text. Returns the filtered text, the action
+// to take ("drop", "mute", "warn" or "" to just send it), and for mutes,
+// their length in minutes. Rules match the original text, so earlier
+// censor rules don't hide words from later rules.
+func (wf *wordFilter) apply(text string) (filtered string, action string, minutes int) {
+	filtered = text
+	for _, rule := range wf.rules {
+		if !rule.re.MatchString(text) {
+			continue
+		}
+		switch rule.action {
+		case "censor":
+			filtered = rule.re.ReplaceAllStringFunc(filtered, func(s string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(s))
+			})
+		case "warn":
+			if len(action) == 0 {
+				action = "warn"
+			}
+		case "drop":
+			if action != "mute" {
+				action = "drop"
+			}
+		case "mute":
+			action = "mute"
+			if rule.minutes > minutes {
+				minutes = rule.minutes
+			}
+		}
+	}
+	return
+}
+
+// Run a text message of client through the server's word filter. Returns
+// the message to send, or false if it must not be sent.
+func (server *Server) filterTextMessage(client *Client, text string) (string, bool) {
+	filename := server.cfg.StringValue("WordFilter")
+	if len(filename) == 0 {
+		return text, true
+	}
+	wf, err := loadWordFilter(filename)
+	if err != nil {
+		// A broken filter file shouldn't silence the server.
+		log.Printf("Unable to load word filter: %v", err.String())
+		return text, true
+	}
+
+	filtered, action, minutes := wf.apply(text)
+	switch action {
+	case "warn":
+		client.Printf("Word filter: warned")
+		client.sendPermissionDeniedText("Your message contains words that aren't welcome on this server.")
+	case "drop":
+		client.Printf("Word filter: dropped a message")
+		client.sendPermissionDeniedText("Your message was not sent, because it contains words that aren't allowed on this server.")
+		return "", false
+	case "mute":
+		client.Printf("Word filter: dropped a message and muted for %v minutes", minutes)
+		client.sendPermissionDeniedText("Your message was not sent, because it contains words that aren't allowed on this server.")
+		server.setTimedMute(client, false, int64(minutes)*60, "the word filter")
+		client.Mute = true
+		err := server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session),
+			Mute:    proto.Bool(true),
+		})
+		if err != nil {
+			client.Printf("Unable to broadcast UserState: %v", err.String())
+		}
+		return "", false
+	}
+	return filtered, true
+}